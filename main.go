@@ -0,0 +1,13 @@
+// syngo is a rsync like filesystem synchronization tool with the ability to
+// keep a customizeable amount of back history
+package main
+
+import (
+	"os"
+
+	"github.com/haskelladdict/syngo/pkg/syngo"
+)
+
+func main() {
+	syngo.Main(os.Args[1:])
+}
@@ -0,0 +1,259 @@
+// archive contains a backend writing the target tree as a tar archive,
+// optionally gzip or zstd compressed, to a file or stdout. Archives are
+// written in a single pass so syngo can stream backups to tape or object
+// storage; every run writes a complete new archive.
+package syngo
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archivePrefix marks archive targets of the form tar:<file>, where a file
+// of - writes to stdout and files ending in .gz, .tgz, .zst, or .tzst are
+// compressed
+const archivePrefix = "tar:"
+
+// compressions of archives
+const (
+	archiveGzip = "gzip"
+	archiveZstd = "zstd"
+	archiveNone = "none"
+)
+
+var (
+	errArchiveRemove = errors.New("entries can not be removed from archives")
+	errArchiveRead   = errors.New("archives are written in a single pass and can not be read back")
+)
+
+// archiveFS is a backend appending all entries synced to it to a tar
+// archive. Files are written in one piece, so syncers take turns.
+// NOTE: Directory entries are written when directories are created, with
+// their owner permissions added and the current time.
+type archiveFS struct {
+	w  io.Closer      // archive file, nil for stdout
+	zw io.WriteCloser // compressor, nil for uncompressed archives
+	tw *tar.Writer
+
+	wmu     sync.Mutex // held while an entry is written
+	mu      sync.Mutex
+	entries map[string]fileInfo // entries written so far by target path
+}
+
+// archiveCompression returns the compression of the archive file name,
+// unless choice names one
+func archiveCompression(name, choice string) (string, error) {
+	switch choice {
+	case "":
+	case archiveGzip, archiveZstd, archiveNone:
+		return choice, nil
+	default:
+		return "", fmt.Errorf("unknown archive compression %s, use %s, %s, or %s", choice,
+			archiveGzip, archiveZstd, archiveNone)
+	}
+	switch {
+	case strings.HasSuffix(name, ".gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveGzip, nil
+	case strings.HasSuffix(name, ".zst"), strings.HasSuffix(name, ".tzst"):
+		return archiveZstd, nil
+	}
+	return archiveNone, nil
+}
+
+// newArchiveBackend creates the archive described by a target of the form
+// tar:<file>, compressed as chosen or as its name suggests
+func newArchiveBackend(spec, compression string) (backend, error) {
+	name := strings.TrimPrefix(spec, archivePrefix)
+	if name == "" {
+		return nil, fmt.Errorf("missing archive file in %s", spec)
+	}
+	compression, err := archiveCompression(name, compression)
+	if err != nil {
+		return nil, err
+	}
+	a := &archiveFS{entries: make(map[string]fileInfo)}
+	var w io.Writer = os.Stdout
+	if name != "-" {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.w, w = f, f
+	}
+	switch compression {
+	case archiveGzip:
+		a.zw = gzip.NewWriter(w)
+		w = a.zw
+	case archiveZstd:
+		a.zw = newZstdWriter(w)
+		w = a.zw
+	}
+	a.tw = tar.NewWriter(w)
+	return a, nil
+}
+
+// writeHeader writes the header of the entry p described by info and
+// records it. It has to be called with wmu held.
+func (a *archiveFS) writeHeader(p string, info *statInfo, linkPath string) error {
+	hdr, err := tar.FileInfoHeader(info, linkPath)
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(p)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.entries[p] = fileInfo{info: info, path: p, linkPath: linkPath}
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *archiveFS) Lstat(p string) (fileInfo, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fi, ok := a.entries[p]
+	if !ok {
+		return fileInfo{}, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+	}
+	return fi, nil
+}
+
+// List returns the entries of directory p written so far
+func (a *archiveFS) List(p string) ([]fileInfo, error) {
+	if _, err := a.Lstat(p); err != nil && p != "." {
+		return nil, err
+	}
+	a.mu.Lock()
+	var infos []fileInfo
+	for q, fi := range a.entries {
+		if filepath.Dir(q) == p {
+			infos = append(infos, fi)
+		}
+	}
+	a.mu.Unlock()
+	sortInfos(infos)
+	return infos, nil
+}
+
+func (a *archiveFS) Open(p string) (io.ReadCloser, error) {
+	return nil, errArchiveRead
+}
+
+func (a *archiveFS) Mkdir(p string, mode os.FileMode) error {
+	if p == "." || p == "" {
+		return nil
+	}
+	if _, err := a.Lstat(p); err == nil {
+		return nil
+	}
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+	return a.writeHeader(p, &statInfo{FName: path.Base(p), FMode: mode | os.ModeDir,
+		FModTime: time.Now()}, "")
+}
+
+func (a *archiveFS) Create(p string) (io.WriteCloser, error) {
+	return nil, errors.New("archives need the size of files before their data")
+}
+
+// CreateSized writes the header of file p and returns a writer for its data.
+// No other entries are written until the writer is closed.
+func (a *archiveFS) CreateSized(p string, mode os.FileMode, mtime time.Time, size int64) (io.WriteCloser, error) {
+	a.wmu.Lock()
+	err := a.writeHeader(p, &statInfo{FName: path.Base(p), FSize: size, FMode: mode,
+		FModTime: mtime}, "")
+	if err != nil {
+		a.wmu.Unlock()
+		return nil, err
+	}
+	return &archiveFile{a: a, remaining: size}, nil
+}
+
+func (a *archiveFS) Symlink(oldname, newname string) error {
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+	return a.writeHeader(newname, &statInfo{FName: path.Base(newname),
+		FMode: os.ModeSymlink | 0777, FModTime: time.Now()}, oldname)
+}
+
+func (a *archiveFS) Remove(p string) error {
+	return errArchiveRemove
+}
+
+// Chtimes and Chmod do nothing since the attributes of entries are written
+// together with them
+func (a *archiveFS) Chtimes(p string, mtime time.Time) error {
+	_, err := a.Lstat(p)
+	return err
+}
+
+func (a *archiveFS) Chmod(p string, mode os.FileMode) error {
+	_, err := a.Lstat(p)
+	return err
+}
+
+// Close completes the archive
+func (a *archiveFS) Close() error {
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+	err := a.tw.Close()
+	if a.zw != nil {
+		if zerr := a.zw.Close(); err == nil {
+			err = zerr
+		}
+	}
+	if a.w != nil {
+		if cerr := a.w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// archiveFile writes the data of a file to the archive
+type archiveFile struct {
+	a         *archiveFS
+	remaining int64
+}
+
+func (f *archiveFile) Write(p []byte) (int, error) {
+	n, err := f.a.tw.Write(p)
+	f.remaining -= int64(n)
+	return n, err
+}
+
+// Close lets other entries be written. Files which shrank while they were
+// written are padded with zeros to keep the archive intact.
+func (f *archiveFile) Close() error {
+	defer f.a.wmu.Unlock()
+	if f.remaining <= 0 {
+		return nil
+	}
+	if _, err := io.CopyN(f.a.tw, zeroReader{}, f.remaining); err != nil {
+		return err
+	}
+	return errSourceChanged
+}
+
+// zeroReader reads an endless stream of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
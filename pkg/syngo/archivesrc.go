@@ -0,0 +1,354 @@
+// archivesrc reads tar and zip archives synced as source trees, e.g. to
+// restore an archived backup into a live tree
+package syngo
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// archiveSrcSuffixes are the file name suffixes of archives which are synced
+// as source trees
+var archiveSrcSuffixes = []string{".tar", ".tar.gz", ".tgz", ".zip"}
+
+// isArchiveSource reports if the source p is an archive file
+func isArchiveSource(p string) bool {
+	lower := strings.ToLower(p)
+	for _, s := range archiveSrcSuffixes {
+		if strings.HasSuffix(lower, s) {
+			info, err := os.Stat(p)
+			return err == nil && info.Mode().IsRegular()
+		}
+	}
+	return false
+}
+
+// checkArchiveSource verifies that no options requiring a local source tree
+// are used with archive sources
+func checkArchiveSource(srcs []*source, opts *options) error {
+	for _, src := range srcs {
+		if src.archive == nil {
+			continue
+		}
+		if opts.removeSrc || opts.verify || opts.macMeta || opts.follow {
+			return fmt.Errorf("-remove-source-files, -verify, -mac-metadata, and -L are not supported for archive %s",
+				src.root)
+		}
+	}
+	return nil
+}
+
+// srcArchive is an archive synced as a source tree. Its entries are indexed
+// when it is opened and their content is streamed from the archive by the
+// syncers. Uncompressed tar and zip archives are read at the offsets of the
+// entries, compressed tar archives only sequentially (see openStream).
+type srcArchive struct {
+	path     string
+	file     *os.File
+	zip      *zip.Reader
+	gzipped  bool
+	entries  map[string]*archiveEntry // by path relative to the archive root
+	children map[string][]string      // sorted names of the entries of directories
+
+	mu     sync.Mutex // held while an entry of a compressed archive is read
+	stream *tarStream
+}
+
+// archiveEntry is an indexed entry of a srcArchive
+type archiveEntry struct {
+	info   os.FileInfo
+	link   string    // target of symbolic links
+	seq    int       // position of the tar header holding the content
+	offset int64     // offset of the content in the tar stream, -1 if unknown
+	zf     *zip.File // zip member holding the content
+}
+
+// openSrcArchive opens and indexes the archive at path
+func openSrcArchive(path string) (*srcArchive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a := &srcArchive{path: path, file: f, entries: make(map[string]*archiveEntry),
+		children: make(map[string][]string)}
+	a.entries["."] = &archiveEntry{info: &statInfo{FName: ".", FMode: os.ModeDir | 0755,
+		FModTime: info.ModTime()}}
+
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".zip") {
+		err = a.indexZip(info.Size())
+	} else {
+		a.gzipped = !strings.HasSuffix(lower, ".tar")
+		err = a.indexTar()
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read archive %s: %s", path, err)
+	}
+
+	// archives need not contain the parents of their entries
+	for p := range a.entries {
+		for dir := filepath.Dir(p); dir != "." && a.entries[dir] == nil; dir = filepath.Dir(dir) {
+			a.entries[dir] = &archiveEntry{info: &statInfo{FName: filepath.Base(dir),
+				FMode: os.ModeDir | 0755, FModTime: info.ModTime()}}
+		}
+	}
+	for p := range a.entries {
+		if p != "." {
+			dir := filepath.Dir(p)
+			a.children[dir] = append(a.children[dir], filepath.Base(p))
+		}
+	}
+	for _, names := range a.children {
+		sort.Strings(names)
+	}
+	return a, nil
+}
+
+// entryPath returns the path relative to the archive root of the member
+// name, or "" if it is the root or lies outside of the archive
+func entryPath(name string) string {
+	p := path.Clean(strings.TrimPrefix(name, "/"))
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return ""
+	}
+	return filepath.FromSlash(p)
+}
+
+// indexZip indexes the members of a zip archive of the provided size
+func (a *srcArchive) indexZip(size int64) error {
+	zr, err := zip.NewReader(a.file, size)
+	if err != nil {
+		return err
+	}
+	a.zip = zr
+	for _, zf := range zr.File {
+		p := entryPath(zf.Name)
+		if p == "" {
+			continue
+		}
+		e := &archiveEntry{info: zf.FileInfo(), zf: zf}
+		// zip archives store the targets of symbolic links as their content
+		if e.info.Mode()&os.ModeSymlink != 0 {
+			r, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			link, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+			r.Close()
+			if err != nil {
+				return err
+			}
+			e.link = string(link)
+		}
+		a.entries[p] = e
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// indexTar indexes the entries of a tar archive. Later entries replace
+// earlier ones of the same name like they do when extracting the archive.
+func (a *srcArchive) indexTar() error {
+	var r io.Reader = a.file
+	if a.gzipped {
+		zr, err := gzip.NewReader(a.file)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	for seq := 0; ; seq++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p := entryPath(hdr.Name)
+		if p == "" {
+			continue
+		}
+		e := &archiveEntry{info: hdr.FileInfo(), seq: seq, offset: cr.n}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeDir:
+		case tar.TypeSymlink:
+			e.link = hdr.Linkname
+		case tar.TypeLink:
+			// hard links share the content of an earlier entry
+			target := a.entries[entryPath(hdr.Linkname)]
+			if target == nil || !target.info.Mode().IsRegular() {
+				infof(levelDecisions, "%s: hard link to missing entry %s, skipped\n", p, hdr.Linkname)
+				continue
+			}
+			e = &archiveEntry{info: &statInfo{FName: filepath.Base(p), FSize: target.info.Size(),
+				FMode: hdr.FileInfo().Mode(), FModTime: hdr.ModTime}, seq: target.seq,
+				offset: target.offset}
+		default:
+			infof(levelDecisions, "%s: unsupported archive entry, skipped\n", p)
+			continue
+		}
+		// the content of sparse files is not stored contiguously
+		if hdr.Typeflag == tar.TypeGNUSparse || sparseRecords(hdr) {
+			e.offset = -1
+		}
+		a.entries[p] = e
+	}
+}
+
+// sparseRecords reports if hdr describes a sparse file in PAX format
+func sparseRecords(hdr *tar.Header) bool {
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// walk visits the entries of the archive like scanTree visits those of a
+// tree, descending into directories for which visit returns true
+func (a *srcArchive) walk(visit func(relPath string, d os.DirEntry) bool) {
+	var walkDir func(dir string)
+	walkDir = func(dir string) {
+		for _, name := range a.children[dir] {
+			p := filepath.Join(dir, name)
+			e := a.entries[p]
+			if visit(p, fs.FileInfoToDirEntry(e.info)) && e.info.IsDir() {
+				walkDir(p)
+			}
+		}
+	}
+	if visit(".", fs.FileInfoToDirEntry(a.entries["."].info)) {
+		walkDir(".")
+	}
+}
+
+// lstat returns the information about the entry at relPath
+func (a *srcArchive) lstat(relPath string) (*archiveEntry, error) {
+	e := a.entries[filepath.Clean(relPath)]
+	if e == nil {
+		return nil, &os.PathError{Op: "lstat", Path: filepath.Join(a.path, relPath), Err: os.ErrNotExist}
+	}
+	return e, nil
+}
+
+// open opens the content of the regular file at relPath
+func (a *srcArchive) open(relPath string) (io.ReadCloser, error) {
+	e, err := a.lstat(relPath)
+	if err != nil {
+		return nil, err
+	}
+	if !e.info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", relPath)
+	}
+	switch {
+	case e.zf != nil:
+		return e.zf.Open()
+	case !a.gzipped && e.offset >= 0:
+		return ioutil.NopCloser(io.NewSectionReader(a.file, e.offset, e.info.Size())), nil
+	}
+	return a.openStream(e)
+}
+
+// tarStream is a sequential reader of a tar archive positioned after the
+// header at seq
+type tarStream struct {
+	zr  io.Closer
+	tr  *tar.Reader
+	seq int
+}
+
+// openStream reads the content of e from the sequential stream of the
+// archive. The stream is shared by all syncers, so reading holds it until
+// the returned reader is closed, and only restarts from the beginning of the
+// archive if e precedes the current position.
+// NOTE: Entries are scanned in name order rather than archive order, so
+// archives not written in name order may be decompressed several times.
+func (a *srcArchive) openStream(e *archiveEntry) (io.ReadCloser, error) {
+	a.mu.Lock()
+	if a.stream == nil || a.stream.seq >= e.seq {
+		if err := a.restartStream(); err != nil {
+			a.mu.Unlock()
+			return nil, err
+		}
+	}
+	for a.stream.seq < e.seq {
+		if _, err := a.stream.tr.Next(); err != nil {
+			a.stream = nil
+			a.mu.Unlock()
+			if err == io.EOF {
+				err = errors.New("archive changed while syncing")
+			}
+			return nil, err
+		}
+		a.stream.seq++
+	}
+	return &streamReader{r: a.stream.tr, unlock: a.mu.Unlock}, nil
+}
+
+// restartStream positions the stream before the first header of the archive
+func (a *srcArchive) restartStream() error {
+	if a.stream != nil {
+		a.stream.zr.Close()
+		a.stream = nil
+	}
+	zr, err := gzip.NewReader(io.NewSectionReader(a.file, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	a.stream = &tarStream{zr: zr, tr: tar.NewReader(zr), seq: -1}
+	return nil
+}
+
+// streamReader reads an entry from the shared stream of an archive and
+// releases it once closed
+type streamReader struct {
+	r      io.Reader
+	unlock func()
+	once   sync.Once
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *streamReader) Close() error {
+	s.once.Do(s.unlock)
+	return nil
+}
+
+// close releases the archive
+func (a *srcArchive) close() error {
+	return a.file.Close()
+}
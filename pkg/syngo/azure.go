@@ -0,0 +1,385 @@
+// azure contains the object store implementation for Azure Blob Storage
+package syngo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureBlockSize is the block size used for uploading large blobs. Smaller
+// blobs are uploaded with a single request.
+const azureBlockSize = 16 * 1024 * 1024
+
+// azureVersion is the version of the Blob service REST API we speak
+const azureVersion = "2020-10-02"
+
+// azureStore provides access to the blobs of an Azure storage container
+type azureStore struct {
+	client    *http.Client
+	endpoint  *url.URL
+	account   string
+	key       []byte // shared key, nil if a SAS token is used
+	sas       url.Values
+	container string
+}
+
+// newAzureBackend returns a backend for a target of the form
+// az://container/prefix. The storage account and its credentials are taken
+// from AZURE_STORAGE_ACCOUNT and either AZURE_STORAGE_KEY or
+// AZURE_STORAGE_SAS_TOKEN; AZURE_STORAGE_ENDPOINT overrides the service
+// endpoint (e.g. for Azurite).
+func newAzureBackend(spec string, opts *options) (backend, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing container name in %s", spec)
+	}
+
+	a := &azureStore{
+		client:    &http.Client{},
+		account:   os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		container: u.Host,
+	}
+	if a.account == "" {
+		return nil, fmt.Errorf("AZURE_STORAGE_ACCOUNT needs to be set for az targets")
+	}
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		if a.key, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_KEY: %s", err)
+		}
+	} else if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		if a.sas, err = url.ParseQuery(strings.TrimPrefix(sas, "?")); err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_SAS_TOKEN: %s", err)
+		}
+	} else {
+		return nil, fmt.Errorf("AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN need to be set for az targets")
+	}
+
+	endpoint := os.Getenv("AZURE_STORAGE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://" + a.account + ".blob.core.windows.net"
+	}
+	if a.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/")); err != nil {
+		return nil, err
+	}
+	return &objectFS{store: a, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// azureMetaName converts metadata keys to valid Azure metadata names, which
+// have to be C# identifiers
+func azureMetaName(key string) string {
+	return strings.Replace(key, "-", "_", -1)
+}
+
+// metaFromAzure converts Azure metadata names back to our metadata keys
+func metaFromAzure(name string) string {
+	return strings.Replace(strings.ToLower(name), "_", "-", -1)
+}
+
+// do performs an authorized request against the blob with the given name
+// (or the container itself if name is empty). Responses with error status
+// are turned into errors, 404s into errors satisfying os.IsNotExist.
+func (a *azureStore) do(method, name string, query url.Values, header http.Header,
+	body []byte) (*http.Response, error) {
+	u := *a.endpoint
+	u.Path += "/" + a.container
+	if name != "" {
+		u.Path += "/" + name
+	}
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range a.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+	if a.key != nil {
+		a.sign(req, query, len(body))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: strings.ToLower(method), Path: name, Err: os.ErrNotExist}
+		}
+		var azErr struct {
+			Code    string
+			Message string
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		xml.Unmarshal(data, &azErr)
+		return nil, fmt.Errorf("azure %s %s failed: %s %s %s", method, name, resp.Status,
+			azErr.Code, azErr.Message)
+	}
+	return resp, nil
+}
+
+// sign adds a shared key authorization header to req
+func (a *azureStore) sign(req *http.Request, query url.Values, length int) {
+	contentLength := ""
+	if length > 0 {
+		contentLength = strconv.Itoa(length)
+	}
+
+	var msHeaders []string
+	for k := range req.Header {
+		if l := strings.ToLower(k); strings.HasPrefix(l, "x-ms-") {
+			msHeaders = append(msHeaders, l+":"+strings.TrimSpace(req.Header.Get(k)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + a.account + req.URL.EscapedPath()
+	var params []string
+	for k, v := range query {
+		vals := append([]string(nil), v...)
+		sort.Strings(vals)
+		params = append(params, strings.ToLower(k)+":"+strings.Join(vals, ","))
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		resource += "\n" + p
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-Md5"),
+		req.Header.Get("Content-Type"),
+		"", // date, we use x-ms-date instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+
+	h := hmac.New(sha256.New, a.key)
+	h.Write([]byte(toSign))
+	req.Header.Set("Authorization", "SharedKey "+a.account+":"+
+		base64.StdEncoding.EncodeToString(h.Sum(nil)))
+}
+
+// azureMetaHeader returns the request headers storing the provided metadata
+func azureMetaHeader(meta map[string]string) http.Header {
+	h := make(http.Header)
+	for k, v := range meta {
+		h.Set("X-Ms-Meta-"+azureMetaName(k), v)
+	}
+	return h
+}
+
+func (a *azureStore) head(key string) (objectAttrs, error) {
+	resp, err := a.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return objectAttrs{}, err
+	}
+	resp.Body.Close()
+
+	attrs := objectAttrs{size: resp.ContentLength, meta: make(map[string]string)}
+	attrs.modified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "X-Ms-Meta-") {
+			attrs.meta[metaFromAzure(strings.TrimPrefix(k, "X-Ms-Meta-"))] = resp.Header.Get(k)
+		}
+	}
+	return attrs, nil
+}
+
+// azureBlob is a blob entry of a container listing
+type azureBlob struct {
+	Name       string
+	Properties struct {
+		ContentLength int64  `xml:"Content-Length"`
+		LastModified  string `xml:"Last-Modified"`
+	}
+	Metadata struct {
+		Entries []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	}
+}
+
+// list lists all blobs below prefix including their metadata
+func (a *azureStore) list(prefix string) (map[string]objectAttrs, error) {
+	objects := make(map[string]objectAttrs)
+	marker := ""
+	for {
+		q := url.Values{
+			"restype": {"container"},
+			"comp":    {"list"},
+			"include": {"metadata"},
+			"prefix":  {prefix},
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := a.do("GET", "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Blobs struct {
+				Blob []azureBlob
+			}
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid blob listing: %s", err)
+		}
+
+		for _, b := range result.Blobs.Blob {
+			attrs := objectAttrs{size: b.Properties.ContentLength, meta: make(map[string]string)}
+			attrs.modified, _ = http.ParseTime(b.Properties.LastModified)
+			for _, e := range b.Metadata.Entries {
+				attrs.meta[metaFromAzure(e.XMLName.Local)] = e.Value
+			}
+			objects[b.Name] = attrs
+		}
+		if marker = result.NextMarker; marker == "" {
+			return objects, nil
+		}
+	}
+}
+
+func (a *azureStore) download(key string) (io.ReadCloser, error) {
+	resp, err := a.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (a *azureStore) upload(key string, meta map[string]string) (io.WriteCloser, error) {
+	return &azureWriter{store: a, name: key, meta: meta}, nil
+}
+
+func (a *azureStore) setMeta(key string, meta map[string]string) error {
+	resp, err := a.do("PUT", key, url.Values{"comp": {"metadata"}}, azureMetaHeader(meta), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (a *azureStore) remove(key string) error {
+	resp, err := a.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// azureWriter uploads data written to it as a block blob. Small blobs are
+// uploaded with a single request on Close, larger ones as individual blocks
+// which are committed on Close.
+type azureWriter struct {
+	store  *azureStore
+	name   string
+	meta   map[string]string
+	buf    []byte
+	blocks []string
+	err    error
+}
+
+func (w *azureWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= azureBlockSize && w.err == nil {
+		w.err = w.putBlock(w.buf[:azureBlockSize])
+		w.buf = append([]byte(nil), w.buf[azureBlockSize:]...)
+	}
+	return len(p), w.err
+}
+
+// putBlock uploads data as the next uncommitted block of the blob
+func (w *azureWriter) putBlock(data []byte) error {
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(w.blocks))))
+	q := url.Values{"comp": {"block"}, "blockid": {id}}
+	resp, err := w.store.do("PUT", w.name, q, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.blocks = append(w.blocks, id)
+	return nil
+}
+
+func (w *azureWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	h := azureMetaHeader(w.meta)
+	if len(w.blocks) == 0 {
+		h.Set("X-Ms-Blob-Type", "BlockBlob")
+		resp, err := w.store.do("PUT", w.name, nil, h, w.buf)
+		if err != nil {
+			w.err = err
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		if w.err = w.putBlock(w.buf); w.err != nil {
+			return w.err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string
+	}{Latest: w.blocks})
+	if err != nil {
+		return err
+	}
+	resp, err := w.store.do("PUT", w.name, url.Values{"comp": {"blocklist"}}, h, body)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
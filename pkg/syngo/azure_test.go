@@ -0,0 +1,92 @@
+package syngo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// the account and key of the Azurite storage emulator
+const (
+	testAzureAccount = "devstoreaccount1"
+	testAzureKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+func TestAzureSharedKey(t *testing.T) {
+	key, err := base64.StdEncoding.DecodeString(testAzureKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &azureStore{account: testAzureAccount, key: key}
+	const date = "Fri, 24 May 2013 00:00:00 GMT"
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		header map[string]string
+		length int
+		toSign string // string to sign as documented for the Blob service
+	}{
+		{"get blob", "GET", "/container/dir/blob", nil, map[string]string{"Range": "bytes=0-9"}, 0,
+			"GET\n\n\n\n\n\n\n\n\n\n\nbytes=0-9\nx-ms-date:" + date + "\nx-ms-version:2020-10-02\n" +
+				"/devstoreaccount1/container/dir/blob"},
+		{"put blob", "PUT", "/container/a%20b", nil,
+			map[string]string{"Content-Type": "application/octet-stream", "X-Ms-Blob-Type": "BlockBlob",
+				"X-Ms-Meta-Mode": "420"}, 11,
+			"PUT\n\n\n11\n\napplication/octet-stream\n\n\n\n\n\n\n" +
+				"x-ms-blob-type:BlockBlob\nx-ms-date:" + date + "\nx-ms-meta-mode:420\nx-ms-version:2020-10-02\n" +
+				"/devstoreaccount1/container/a%20b"},
+		{"list blobs", "GET", "/container",
+			url.Values{"restype": {"container"}, "comp": {"list"}, "Prefix": {"dir/"}, "include": {"metadata"}},
+			nil, 0,
+			"GET\n\n\n\n\n\n\n\n\n\n\n\nx-ms-date:" + date + "\nx-ms-version:2020-10-02\n" +
+				"/devstoreaccount1/container\ncomp:list\ninclude:metadata\nprefix:dir/\nrestype:container"},
+	} {
+		u := &url.URL{Scheme: "https", Host: "devstoreaccount1.blob.core.windows.net", RawQuery: tt.query.Encode()}
+		u.Path, _ = url.PathUnescape(tt.path)
+		req, err := http.NewRequest(tt.method, u.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		req.Header.Set("X-Ms-Date", date)
+		req.Header.Set("X-Ms-Version", azureVersion)
+		a.sign(req, tt.query, tt.length)
+
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(tt.toSign))
+		want := "SharedKey devstoreaccount1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s: got authorization %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestAzureSASToken(t *testing.T) {
+	var query url.Values
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, auth = r.URL.Query(), r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	endpoint, _ := url.Parse(srv.URL)
+	sas, _ := url.ParseQuery("sv=2020-10-02&sp=rwdl&sig=c2lnbmF0dXJl")
+	a := &azureStore{client: &http.Client{}, endpoint: endpoint, account: testAzureAccount, sas: sas,
+		container: "container"}
+	resp, err := a.do("GET", "blob", url.Values{"comp": {"metadata"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if auth != "" || query.Get("sig") != "c2lnbmF0dXJl" || query.Get("comp") != "metadata" {
+		t.Errorf("request with query %s and authorization %q", query.Encode(), auth)
+	}
+}
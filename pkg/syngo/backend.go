@@ -0,0 +1,365 @@
+// backend contains the storage abstraction used for accessing target trees
+// together with its local file system implementation
+package syngo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backend abstracts the operations syngo performs on a target tree so that
+// targets other than the local file system can be plugged in. All paths are
+// relative to the root of the target tree.
+type backend interface {
+	// Lstat returns information about path without following symbolic links.
+	// For symbolic links the linkPath of the returned fileInfo is set.
+	Lstat(path string) (fileInfo, error)
+
+	// List returns information about the entries of directory path sorted
+	// by name, like Lstat would for each of them
+	List(path string) ([]fileInfo, error)
+
+	// Open opens file path for reading
+	Open(path string) (io.ReadCloser, error)
+
+	// Mkdir creates directory path including any missing parents
+	Mkdir(path string, mode os.FileMode) error
+
+	// Create creates or replaces path with a new empty file. Existing entries
+	// are removed first so we never write through symbolic links. New files
+	// are only accessible by their owner (see newFileMode) until Chmod sets
+	// their final mode.
+	Create(path string) (io.WriteCloser, error)
+
+	Symlink(oldname, newname string) error
+	Remove(path string) error
+	Chtimes(path string, mtime time.Time) error
+	Chmod(path string, mode os.FileMode) error
+
+	// Close releases all resources (connections, helper processes) held by
+	// the backend
+	Close() error
+}
+
+// newFileMode is the mode of files while they are being written. Syncers set
+// the exact mode of the source, including the setuid, setgid, and sticky bits
+// and regardless of the umask, only once a copy is complete so that neither
+// copies in progress nor partial copies left behind by failures are more
+// accessible than the source.
+const newFileMode os.FileMode = 0600
+
+// attrCreator is implemented by backends which need to know the mode and
+// modification time of a file at creation time, e.g. object stores keeping
+// them as immutable object metadata. Syncers prefer CreateWithAttrs over
+// Create followed by Chtimes and Chmod if it is available.
+type attrCreator interface {
+	CreateWithAttrs(path string, mode os.FileMode, mtime time.Time) (io.WriteCloser, error)
+}
+
+// sizedCreator is implemented by backends which need to know the size of a
+// file before its data, e.g. archives writing it into a header. Syncers
+// prefer CreateSized over all other ways of creating files; the mode and
+// modification time are final as well.
+type sizedCreator interface {
+	CreateSized(path string, mode os.FileMode, mtime time.Time, size int64) (io.WriteCloser, error)
+}
+
+// mtimePrecisioner is implemented by backends which store modification times
+// with less than nanosecond precision
+type mtimePrecisioner interface {
+	MtimePrecision() time.Duration
+}
+
+// modeKeeper is implemented by backends which may not store file modes.
+// Differing modes of files are only considered changes if KeepsMode reports
+// that the target stores them.
+type modeKeeper interface {
+	KeepsMode() bool
+}
+
+// keepsMode determines if tgt stores file modes
+func keepsMode(tgt backend) bool {
+	k, ok := tgt.(modeKeeper)
+	return !ok || k.KeepsMode()
+}
+
+// resumer is implemented by backends which can continue writing partially
+// copied files instead of starting over
+type resumer interface {
+	// PrefixSum returns the checksum of the first size bytes of path
+	// computed with algo
+	PrefixSum(path string, size int64, algo hashAlgo) ([]byte, error)
+
+	// Append opens the existing file path for appending
+	Append(path string) (io.WriteCloser, error)
+}
+
+// renamer is implemented by backends which can move files within the target
+// tree
+type renamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+// chowner is implemented by backends which can change the ownership of
+// entries, resolving user and group names on the target's system
+type chowner interface {
+	Lchown(path string, o *owner) error
+}
+
+// sortInfos sorts the entries of a directory listing by name
+func sortInfos(infos []fileInfo) {
+	sort.Slice(infos, func(i, j int) bool { return infos[i].path < infos[j].path })
+}
+
+// prefixSum returns the checksum of the first size bytes read from r
+// computed with algo
+func prefixSum(r io.Reader, size int64, algo hashAlgo) ([]byte, error) {
+	h := algo.new()
+	if _, err := io.CopyN(h, r, size); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sameModTime compares the modification times of a source and a target file
+// at the precision supported by the target backend. Times differing by at
+// most window are considered equal.
+func sameModTime(tgt backend, src, dst time.Time, window time.Duration) bool {
+	if p, ok := tgt.(mtimePrecisioner); ok {
+		src, dst = src.Truncate(p.MtimePrecision()), dst.Truncate(p.MtimePrecision())
+	}
+	d := src.Sub(dst)
+	if d < 0 {
+		d = -d
+	}
+	return d <= window
+}
+
+// isRemote determines if the provided target specification refers to a
+// remote rather than a local target tree
+func isRemote(spec string) bool {
+	_, _, ok := splitRemote(spec)
+	return ok || strings.Contains(spec, "://")
+}
+
+// openTarget returns the backend for the provided target tree specification
+func openTarget(spec string, opts *options) (backend, error) {
+	switch {
+	case strings.HasPrefix(spec, "sftp://"):
+		return newSFTPBackend(spec, opts)
+	case strings.HasPrefix(spec, "s3://"):
+		return newS3Backend(spec, opts)
+	case strings.HasPrefix(spec, "gs://"):
+		return newGCSBackend(spec, opts)
+	case strings.HasPrefix(spec, "az://"):
+		return newAzureBackend(spec, opts)
+	case strings.HasPrefix(spec, "dav://"), strings.HasPrefix(spec, "davs://"):
+		return newWebDAVBackend(spec, opts)
+	case strings.HasPrefix(spec, "ftp://"), strings.HasPrefix(spec, "ftps://"):
+		return newFTPBackend(spec, opts)
+	case strings.HasPrefix(spec, "syngo://"):
+		return newDaemonBackend(spec, opts)
+	case strings.HasPrefix(spec, archivePrefix):
+		// NOTE: This shadows ssh targets on hosts called tar or repo, which
+		// can still be reached as tar.<domain> or user@tar
+		return newArchiveBackend(spec, opts.archiveCompress)
+	case strings.HasPrefix(spec, repoPrefix):
+		return newRepoBackend(spec, opts)
+	}
+	if i := strings.Index(spec, "://"); i > 0 && !strings.ContainsAny(spec[:i], `/\`) {
+		return nil, fmt.Errorf("unsupported target %s; use a local path, [user@]host:path, "+
+			"or a target of the form sftp://, s3://, gs://, az://, dav(s)://, ftp(s)://, "+
+			"syngo://, tar:, or repo:", spec)
+	}
+
+	if host, path, ok := splitRemote(spec); ok {
+		return newSSHBackend(host, path, opts)
+	}
+	l := &localFS{root: spec, fakeSuper: opts.fakeSuper, sums: opts.sums}
+	if opts.nfs {
+		l.nfs = newNFSCache()
+	}
+	return l, nil
+}
+
+// localFS is a backend operating on a tree in the local file system
+type localFS struct {
+	root      string
+	fakeSuper bool      // record privileged attributes instead of applying them
+	sums      *sumCache // optional cache of file checksums
+	nfs       *nfsCache // lookups from directory listings for NFS mounts, nil if unused
+}
+
+func (l *localFS) path(p string) string {
+	return filepath.Join(l.root, p)
+}
+
+func (l *localFS) Lstat(path string) (fileInfo, error) {
+	p := l.path(path)
+	info, err := l.nfs.lstat(l, path)
+	if err != nil {
+		return fileInfo{}, err
+	}
+
+	var linkPath string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if linkPath, err = os.Readlink(p); err != nil {
+			return fileInfo{}, err
+		}
+	} else if l.fakeSuper {
+		st, ok, err := readFakeStat(p)
+		if err != nil {
+			return fileInfo{}, err
+		} else if ok {
+			info = modeInfo{FileInfo: info, mode: fileModeFromUnix(st.mode)}
+		}
+	}
+	return fileInfo{info: info, path: path, linkPath: linkPath}, nil
+}
+
+func (l *localFS) List(path string) ([]fileInfo, error) {
+	entries, err := os.ReadDir(l.path(path))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fileInfo, 0, len(entries))
+	for _, e := range entries {
+		fi, err := l.Lstat(filepath.Join(path, e.Name()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	return infos, nil
+}
+
+func (l *localFS) Open(path string) (io.ReadCloser, error) {
+	return os.Open(l.path(path))
+}
+
+func (l *localFS) Mkdir(path string, mode os.FileMode) error {
+	l.nfs.forget(path)
+	return os.MkdirAll(l.path(path), mode)
+}
+
+func (l *localFS) Create(path string) (io.WriteCloser, error) {
+	p := l.path(path)
+	// on NFS, new files are created with their final permissions right away
+	// instead of looking them up, removing, and changing them one request at
+	// a time
+	if l.nfs != nil {
+		_, err := l.nfs.lstat(l, path)
+		l.nfs.forget(path)
+		if os.IsNotExist(err) {
+			if f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, newFileMode); err == nil {
+				return f, nil
+			}
+		}
+	}
+	// NOTE: For efficiency we simply attempt to remove the file without checking
+	// it it exists
+	os.Remove(p)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, newFileMode)
+	if err != nil {
+		return nil, err
+	}
+	// the mode is only applied to new files, so make sure an entry which
+	// could not be removed does not keep a more permissive one
+	if err := f.Chmod(newFileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l *localFS) Symlink(oldname, newname string) error {
+	l.nfs.forget(newname)
+	return os.Symlink(oldname, l.path(newname))
+}
+
+func (l *localFS) Remove(path string) error {
+	l.nfs.forget(path)
+	return os.Remove(l.path(path))
+}
+
+func (l *localFS) Chtimes(path string, mtime time.Time) error {
+	l.nfs.forget(path)
+	return os.Chtimes(l.path(path), mtime, mtime)
+}
+
+func (l *localFS) Chmod(path string, mode os.FileMode) error {
+	l.nfs.forget(path)
+	if l.fakeSuper {
+		return l.chmodFake(path, mode)
+	}
+	return os.Chmod(l.path(path), mode)
+}
+
+func (l *localFS) Lchown(path string, o *owner) error {
+	uid, gid, err := o.resolve()
+	if err != nil {
+		return err
+	}
+	if l.fakeSuper {
+		return l.lchownFake(path, uid, gid)
+	}
+	l.nfs.forget(path)
+	return os.Lchown(l.path(path), uid, gid)
+}
+
+func (l *localFS) PrefixSum(path string, size int64, algo hashAlgo) ([]byte, error) {
+	f, err := os.Open(l.path(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return l.sums.fileSum(f, size, algo)
+}
+
+// errHardLinked is reported for files which are not appended to since they
+// are hard-linked elsewhere, e.g. into snapshots, whose copies would change
+// as well
+var errHardLinked = errors.New("file has other hard links")
+
+func (l *localFS) Append(path string) (io.WriteCloser, error) {
+	l.nfs.forget(path)
+	f, err := os.OpenFile(l.path(path), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil {
+		f.Close()
+		return nil, err
+	} else if n, ok := linkCount(info); ok && n > 1 {
+		f.Close()
+		return nil, errHardLinked
+	}
+	return f, nil
+}
+
+func (l *localFS) Rename(oldpath, newpath string) error {
+	l.nfs.forget(oldpath)
+	l.nfs.forget(newpath)
+	return os.Rename(l.path(oldpath), l.path(newpath))
+}
+
+// MtimePrecision reports second precision on NFS since servers backed by
+// file systems with coarser timestamps silently truncate them
+func (l *localFS) MtimePrecision() time.Duration {
+	if l.nfs != nil {
+		return time.Second
+	}
+	return 0
+}
+
+func (l *localFS) Close() error {
+	return nil
+}
@@ -0,0 +1,56 @@
+// backup contains the backup of target entries before they are replaced
+package syngo
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// defaultBackupSuffix is appended to backups kept next to the replaced
+// entries, i.e. without a backup dir
+const defaultBackupSuffix = "~"
+
+// inPlaceBackups determines if backups are kept next to the entries they
+// were made of, i.e. by suffix only. Such backups may exist even if the
+// current run makes none.
+func inPlaceBackups(opts *options) bool {
+	return opts.backupDir == "" && opts.backupSuffix != ""
+}
+
+// backupPath returns the path the version of path on the target is moved to
+// before it is replaced
+func backupPath(path string, opts *options) string {
+	return filepath.Join(opts.backupDir, path) + opts.backupSuffix
+}
+
+// backupTarget moves the entry at path on tgt out of the way into its backup
+// location if backups are enabled. Directories are never backed up, they are
+// only replaced by other types of entries if they could be removed, i.e. were
+// empty. Missing entries are ignored.
+func backupTarget(tgt backend, path string, opts *options) error {
+	if !opts.backup {
+		return nil
+	}
+	fi, err := tgt.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.info.IsDir() {
+		return nil
+	}
+
+	dst := backupPath(path, opts)
+	if opts.backupDir != "" {
+		if err := tgt.Mkdir(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+	}
+	if err := tgt.(renamer).Rename(path, dst); err != nil {
+		return err
+	}
+	opts.log.infoEvent(levelDecisions, event{Phase: "sync", Path: path, Action: "backup", Msg: dst},
+		"%s: backed up to %s\n", path, dst)
+	return nil
+}
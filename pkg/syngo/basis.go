@@ -0,0 +1,119 @@
+// basis uses basis directories laid out like the target to avoid copying
+// files from the sources, see -link-dest, -compare-dest, -copy-dest, and
+// snapshots
+package syngo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// ways of using the basis directories for files missing on the target which
+// are unchanged there
+const (
+	basisLink    = iota // hard-link them into the target
+	basisCompare        // skip them
+	basisCopy           // copy them from the basis directory instead of the source
+)
+
+// basisDirs are basis directories, e.g. previous snapshots or backups, whose
+// copies of unchanged files are used as described by mode
+type basisDirs struct {
+	mode  int
+	dirs  []string
+	files int64 // number of files linked
+	bytes int64 // size of the files linked
+}
+
+// find returns the path of the copy of file in the first basis directory
+// holding it unchanged, or "" if there is none
+func (b *basisDirs) find(tgt backend, file fileInfo) string {
+	if b == nil || !file.info.Mode().IsRegular() || file.content != nil {
+		return ""
+	}
+	for _, dir := range b.dirs {
+		base := &localFS{root: dir}
+		fi, err := base.Lstat(file.path)
+		if err == nil && entryChange(tgt, file, fi, 0) == 0 {
+			return base.path(file.path)
+		}
+	}
+	return ""
+}
+
+// link hard-links the unchanged copy of file at path into tgt and reports
+// whether it did. The target does not depend on the basis directory this
+// way, the shared data stays until all links to it are gone.
+func (b *basisDirs) link(tgt backend, path string, file fileInfo) bool {
+	l, ok := tgt.(*localFS)
+	if !ok {
+		return false
+	}
+	// NOTE: Linking fails for file systems without hard links, across file
+	// systems, or once the maximum number of links is reached, the file is
+	// copied then
+	if err := os.Link(path, l.path(file.path)); err != nil {
+		return false
+	}
+	atomic.AddInt64(&b.files, 1)
+	atomic.AddInt64(&b.bytes, file.info.Size())
+	return true
+}
+
+// useBasis uses the basis directories for the source file srcFile missing on
+// tgt and reports if it needs no further syncing. Files to be copied from a
+// basis directory are marked as such.
+func useBasis(tgt backend, srcFile *fileInfo, opts *options) bool {
+	path := opts.basis.find(tgt, *srcFile)
+	if path == "" {
+		return false
+	}
+	switch opts.basis.mode {
+	case basisCompare:
+		opts.log.infoEvent(levelDecisions, event{Phase: "check", Path: srcFile.path, Action: "skip",
+			Msg: "unchanged in basis"}, "%s: unchanged in %s, skipped\n", srcFile.path, path)
+		return true
+	case basisLink:
+		if !opts.dryRun && opts.basis.link(tgt, path, *srcFile) {
+			// the link changed the modification time of its directory
+			opts.dirs.touch(srcFile.path)
+			opts.log.infoEvent(levelDecisions, event{Phase: "check", Path: srcFile.path, Action: "link"},
+				"%s: unchanged, linked\n", srcFile.path)
+			return true
+		}
+	case basisCopy:
+		srcFile.basis = path
+	}
+	return false
+}
+
+// basisFlag is a flag.Value adding a basis directory for each occurrence of
+// -link-dest, -compare-dest, or -copy-dest
+type basisFlag struct {
+	basis **basisDirs
+	mode  int
+}
+
+func (f basisFlag) String() string {
+	return ""
+}
+
+func (f basisFlag) Set(s string) error {
+	dir, err := absPath(s)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s)
+	}
+	if *f.basis == nil {
+		*f.basis = &basisDirs{mode: f.mode}
+	} else if (*f.basis).mode != f.mode {
+		return errors.New("-link-dest, -compare-dest, and -copy-dest cannot be combined")
+	}
+	(*f.basis).dirs = append((*f.basis).dirs, filepath.Clean(dir))
+	return nil
+}
@@ -0,0 +1,462 @@
+// batch records the changes of a sync run in a batch file and applies them
+// to another copy of the target later, e.g. one on an isolated network which
+// is only reachable by carrying the batch over
+package syngo
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// batchVersion is the version of the batch file format
+const batchVersion = 1
+
+// operations recorded in batch files
+const (
+	batchMkdir = iota + 1
+	batchCreate
+	batchWrite
+	batchClose
+	batchSymlink
+	batchRemove
+	batchRemoveAll // extraneous entries deleted including their content
+	batchChtimes
+	batchChmod
+	batchEnd // marks complete batches
+)
+
+// batchHeader starts every batch file
+type batchHeader struct {
+	Version int
+	Created time.Time
+}
+
+// batchOp is a single change recorded in a batch file. Files are recorded as
+// a create followed by writes of their data and a close; the writes of files
+// synced concurrently may be interleaved.
+type batchOp struct {
+	Op    int
+	Path  string
+	Link  string // target of symbolic links
+	Mode  os.FileMode
+	Mtime time.Time
+	Data  []byte
+}
+
+// batchFS is a backend recording all changes made through it in a batch
+// file. Unless only is set, they are applied to the wrapped backend as well,
+// otherwise the wrapped backend is only read to determine the changes.
+type batchFS struct {
+	backend
+	only bool
+
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *gob.Encoder
+	err error // first failure to record a change
+}
+
+// createBatch creates the batch file at path recording the changes made to
+// tgt
+func createBatch(path string, tgt backend, only bool) (*batchFS, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &batchFS{backend: tgt, only: only, f: f, w: bufio.NewWriter(f)}
+	b.enc = gob.NewEncoder(b.w)
+	if err := b.enc.Encode(batchHeader{Version: batchVersion, Created: time.Now()}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// record appends op to the batch. Once recording failed, all further changes
+// fail as well since the batch would be incomplete.
+func (b *batchFS) record(op batchOp) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		if err := b.enc.Encode(&op); err != nil {
+			b.err = fmt.Errorf("failed to record change in batch: %s", err)
+		}
+	}
+	return b.err
+}
+
+// recordOnly reports if changes are recorded without applying them
+func (b *batchFS) recordOnly() bool {
+	return b != nil && b.only
+}
+
+// removed records the deletion of the extraneous entry at path
+func (b *batchFS) removed(path string) error {
+	if b == nil {
+		return nil
+	}
+	return b.record(batchOp{Op: batchRemoveAll, Path: path})
+}
+
+func (b *batchFS) Mkdir(path string, mode os.FileMode) error {
+	if !b.only {
+		if err := b.backend.Mkdir(path, mode); err != nil {
+			return err
+		}
+	}
+	return b.record(batchOp{Op: batchMkdir, Path: path, Mode: mode})
+}
+
+func (b *batchFS) Create(path string) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	if !b.only {
+		var err error
+		if w, err = b.backend.Create(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.record(batchOp{Op: batchCreate, Path: path}); err != nil {
+		if w != nil {
+			w.Close()
+		}
+		return nil, err
+	}
+	return &batchFile{b: b, w: w, path: path}, nil
+}
+
+func (b *batchFS) Symlink(oldname, newname string) error {
+	if !b.only {
+		if err := b.backend.Symlink(oldname, newname); err != nil {
+			return err
+		}
+	}
+	return b.record(batchOp{Op: batchSymlink, Path: newname, Link: oldname})
+}
+
+func (b *batchFS) Remove(path string) error {
+	if !b.only {
+		if err := b.backend.Remove(path); err != nil {
+			return err
+		}
+	}
+	return b.record(batchOp{Op: batchRemove, Path: path})
+}
+
+func (b *batchFS) Chtimes(path string, mtime time.Time) error {
+	if !b.only {
+		if err := b.backend.Chtimes(path, mtime); err != nil {
+			return err
+		}
+	}
+	return b.record(batchOp{Op: batchChtimes, Path: path, Mtime: mtime})
+}
+
+func (b *batchFS) Chmod(path string, mode os.FileMode) error {
+	if !b.only {
+		if err := b.backend.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	return b.record(batchOp{Op: batchChmod, Path: path, Mode: mode})
+}
+
+func (b *batchFS) MtimePrecision() time.Duration {
+	if p, ok := b.backend.(mtimePrecisioner); ok {
+		return p.MtimePrecision()
+	}
+	return 0
+}
+
+func (b *batchFS) KeepsMode() bool {
+	return keepsMode(b.backend)
+}
+
+// Close completes the batch file and closes the wrapped backend
+func (b *batchFS) Close() error {
+	err := b.record(batchOp{Op: batchEnd})
+	if ferr := b.w.Flush(); err == nil && ferr != nil {
+		err = ferr
+	}
+	if cerr := b.f.Close(); err == nil && cerr != nil {
+		err = cerr
+	}
+	if cerr := b.backend.Close(); err == nil && cerr != nil {
+		err = cerr
+	}
+	return err
+}
+
+// batchFile records the data written to a file created on a batchFS
+type batchFile struct {
+	b    *batchFS
+	w    io.WriteCloser // nil if changes are only recorded
+	path string
+}
+
+func (f *batchFile) Write(p []byte) (int, error) {
+	if f.w != nil {
+		if n, err := f.w.Write(p); err != nil {
+			return n, err
+		}
+	}
+	if err := f.b.record(batchOp{Op: batchWrite, Path: f.path, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *batchFile) Close() error {
+	if f.w != nil {
+		if err := f.w.Close(); err != nil {
+			return err
+		}
+	}
+	return f.b.record(batchOp{Op: batchClose, Path: f.path})
+}
+
+// readBatchCmd implements the read-batch command which applies a batch
+// written by -write-batch to a target tree
+func readBatchCmd(args []string) {
+	flags := flag.NewFlagSet("read-batch", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list the changes in the batch without applying them")
+	verbose := flags.Bool("v", false, "list the entries changed by the batch")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo read-batch [options] <batch file> <target tree>")
+		fmt.Println("\noptions:")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+	}
+	if *verbose || *dryRun {
+		defaultLog.verbosity = levelFiles
+	}
+	tgtTree := flags.Arg(1)
+	if !isRemote(tgtTree) {
+		var err error
+		if tgtTree, err = absPath(tgtTree); err != nil {
+			log.Fatal(err)
+		}
+	}
+	os.Exit(readBatch(flags.Arg(0), tgtTree, *dryRun))
+}
+
+// readBatch applies the batch file at path to tgtTree and returns the exit
+// code of the run
+func readBatch(path, tgtTree string, dryRun bool) int {
+	startTime := time.Now()
+	f, err := os.Open(path)
+	if err != nil {
+		log.Print(err)
+		return exitFatal
+	}
+	defer f.Close()
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var hdr batchHeader
+	if err := dec.Decode(&hdr); err != nil {
+		log.Printf("%s is not a batch file: %s\n", path, err)
+		return exitFatal
+	} else if hdr.Version != batchVersion {
+		log.Printf("unsupported version %d of batch file %s\n", hdr.Version, path)
+		return exitFatal
+	}
+
+	tgt, err := openTarget(tgtTree, &options{})
+	if err != nil {
+		log.Print(err)
+		return exitFatal
+	}
+	if _, ok := tgt.(*localFS); ok && !dryRun {
+		lock, err := lockTarget(tgtTree, 0, nil, nil)
+		if err != nil {
+			log.Print(err)
+			return exitFatal
+		}
+		defer lock.unlock()
+	}
+
+	var stats syncStats
+	files := make(map[string]io.WriteCloser)
+	complete := false
+	for !complete {
+		var op batchOp
+		if err := dec.Decode(&op); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = errors.New("batch is incomplete")
+			}
+			logError("sync", path, "read batch", err)
+			stats.numErrors++
+			break
+		}
+		if op.Op == batchEnd {
+			complete = true
+			continue
+		}
+		if filepath.IsAbs(op.Path) || withinDir(filepath.Clean(op.Path), "..") {
+			logError("sync", op.Path, "apply", errors.New("path outside of the target tree"))
+			stats.numErrors++
+			continue
+		}
+		if err := applyBatchOp(tgt, op, files, &stats, dryRun); err != nil {
+			logError("sync", op.Path, "apply "+batchOpName(op.Op), err)
+			stats.numErrors++
+		}
+	}
+	// files left open were not completely recorded
+	for p, w := range files {
+		if w != nil {
+			w.Close()
+			tgt.Remove(p)
+		}
+		logError("sync", p, "apply", errors.New("incomplete file in batch"))
+		stats.numErrors++
+	}
+	if err := tgt.Close(); err != nil {
+		log.Printf("failed to close target %s: %s\n", tgtTree, err)
+		stats.numErrors++
+	}
+
+	infof(levelSummary, "applied batch from %s\n", hdr.Created.Format(time.RFC3339))
+	printStats(stats, startTime, dryRun)
+	if dryRun {
+		infof(levelSummary, "dry run, the target was not changed\n")
+	}
+	defaultLog.printErrors()
+	if stats.numErrors > 0 {
+		return exitPartial
+	}
+	return exitOK
+}
+
+// applyBatchOp applies op to tgt, keeping track of the files being written in
+// files and of the applied changes in stats
+func applyBatchOp(tgt backend, op batchOp, files map[string]io.WriteCloser, stats *syncStats,
+	dryRun bool) error {
+	switch op.Op {
+	case batchMkdir:
+		infof(levelFiles, "%s/\n", op.Path)
+		stats.numDirs++
+		if !dryRun {
+			return tgt.Mkdir(op.Path, op.Mode)
+		}
+	case batchCreate:
+		if w := files[op.Path]; w != nil {
+			w.Close()
+		}
+		files[op.Path] = nil
+		if !dryRun {
+			w, err := tgt.Create(op.Path)
+			if err != nil {
+				delete(files, op.Path)
+				return err
+			}
+			files[op.Path] = w
+		}
+	case batchWrite:
+		w, ok := files[op.Path]
+		if !ok {
+			// the creation of the file failed and was already reported
+			return nil
+		}
+		stats.numBytes += int64(len(op.Data))
+		if w != nil {
+			if _, err := w.Write(op.Data); err != nil {
+				w.Close()
+				delete(files, op.Path)
+				return err
+			}
+		}
+	case batchClose:
+		w, ok := files[op.Path]
+		if !ok {
+			return nil
+		}
+		delete(files, op.Path)
+		infof(levelFiles, "%s\n", op.Path)
+		stats.numFiles++
+		if w != nil {
+			return w.Close()
+		}
+	case batchSymlink:
+		infof(levelFiles, "%s -> %s\n", op.Path, op.Link)
+		stats.numSymlinks++
+		if !dryRun {
+			return tgt.Symlink(op.Link, op.Path)
+		}
+	case batchRemove:
+		if !dryRun {
+			return tgt.Remove(op.Path)
+		}
+	case batchRemoveAll:
+		infof(levelFiles, "deleting %s\n", op.Path)
+		stats.numDeleted++
+		if !dryRun {
+			return removeTree(tgt, op.Path)
+		}
+	case batchChtimes:
+		if !dryRun {
+			return tgt.Chtimes(op.Path, op.Mtime)
+		}
+	case batchChmod:
+		if !dryRun {
+			return tgt.Chmod(op.Path, op.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown operation %d", op.Op)
+	}
+	return nil
+}
+
+// batchOpName describes the batch operation op in error messages
+func batchOpName(op int) string {
+	switch op {
+	case batchMkdir:
+		return "mkdir"
+	case batchCreate, batchWrite, batchClose:
+		return "write"
+	case batchSymlink:
+		return "symlink"
+	case batchRemove, batchRemoveAll:
+		return "remove"
+	case batchChtimes:
+		return "chtimes"
+	case batchChmod:
+		return "chmod"
+	}
+	return "operation"
+}
+
+// removeTree removes the entry at path of tgt including the content of
+// directories. Entries which no longer exist are not an error.
+func removeTree(tgt backend, path string) error {
+	fi, err := tgt.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.info.IsDir() {
+		entries, err := tgt.List(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := removeTree(tgt, e.path); err != nil {
+				return err
+			}
+		}
+	}
+	return tgt.Remove(path)
+}
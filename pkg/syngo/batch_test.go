@@ -0,0 +1,139 @@
+package syngo
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// treeContents returns the data of the files and the targets of the links
+// below root by path, directories map to empty strings
+func treeContents(t *testing.T, root string) map[string]string {
+	contents := make(map[string]string)
+	for _, p := range treePaths(t, root) {
+		full := filepath.Join(root, p)
+		info, err := os.Lstat(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(full)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[p] = "-> " + link
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(full)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[p] = string(data)
+		default:
+			contents[p] = ""
+		}
+	}
+	return contents
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	for _, only := range []bool{false, true} {
+		src, tgt, other := t.TempDir(), t.TempDir(), t.TempDir()
+		if err := os.Mkdir(filepath.Join(src, "dir"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		// large enough to be recorded in several writes
+		files := map[string][]byte{"dir/large": randomData(3, 3*defaultBufferSize+1), "changed": []byte("new")}
+		for p, data := range files {
+			if err := ioutil.WriteFile(filepath.Join(src, p), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mtime := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(filepath.Join(src, "changed"), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("dir/large", filepath.Join(src, "link")); err != nil {
+			t.Fatal(err)
+		}
+		// both copies of the target start out the same
+		for _, root := range []string{tgt, other} {
+			for p, data := range map[string]string{"changed": "old", "extra": "extra"} {
+				if err := ioutil.WriteFile(filepath.Join(root, p), []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		old := treeContents(t, tgt)
+
+		path := filepath.Join(t.TempDir(), "batch")
+		b, err := createBatch(path, &localFS{root: tgt}, only)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs, err := sources([]string{src + "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &options{log: newRunLog(0, ioutil.Discard, nil), batch: b, onlyBatch: only, delete: true}
+		stats := runSync(srcs, b, opts)
+		_, numErrors := deleteExtra(srcs, tgt, opts)
+		if err := b.Close(); err != nil || stats.numErrors+numErrors != 0 {
+			t.Fatalf("only %v: recorded batch with %d errors: %v", only, stats.numErrors+numErrors, err)
+		}
+
+		want := treeContents(t, src)
+		if got := treeContents(t, tgt); only && !reflect.DeepEqual(got, old) || !only && !reflect.DeepEqual(got, want) {
+			t.Errorf("only %v: recording changed the target to hold %v", only, treePaths(t, tgt))
+		}
+		if code := readBatch(path, other, false); code != exitOK {
+			t.Errorf("only %v: applying batch exited with %d", only, code)
+		}
+		if got := treeContents(t, other); !reflect.DeepEqual(got, want) {
+			t.Errorf("only %v: batch changed the target to hold %v", only, treePaths(t, other))
+		}
+	}
+}
+
+func TestReadBatchRejectsInvalidBatches(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		ops  []batchOp
+	}{
+		{"incomplete", []batchOp{{Op: batchMkdir, Path: "dir", Mode: os.ModeDir | 0755}}},
+		{"outside of target", []batchOp{{Op: batchMkdir, Path: "../dir", Mode: os.ModeDir | 0755}, {Op: batchEnd}}},
+		{"absolute", []batchOp{{Op: batchCreate, Path: "/tmp/file", Mode: 0644}, {Op: batchEnd}}},
+		{"unclosed file", []batchOp{{Op: batchCreate, Path: "file", Mode: 0644},
+			{Op: batchWrite, Path: "file", Data: []byte("data")}, {Op: batchEnd}}},
+	} {
+		path := filepath.Join(t.TempDir(), "batch")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := bufio.NewWriter(f)
+		enc := gob.NewEncoder(w)
+		enc.Encode(batchHeader{Version: batchVersion, Created: time.Now()})
+		for i := range tt.ops {
+			enc.Encode(&tt.ops[i])
+		}
+		w.Flush()
+		f.Close()
+
+		tgt := t.TempDir()
+		if code := readBatch(path, tgt, false); code != exitPartial {
+			t.Errorf("%s: applying batch exited with %d", tt.name, code)
+		}
+		if _, err := os.Lstat(filepath.Join(tgt, "file")); !os.IsNotExist(err) {
+			t.Errorf("%s: incomplete file left behind: %v", tt.name, err)
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(tgt), "dir")); !os.IsNotExist(err) {
+			t.Errorf("%s: created entry outside of target: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//go:build darwin
+
+// birthtime_darwin contains the preservation of file creation times on macOS
+package syngo
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// birthTimeSupported reports that -crtimes works on this platform
+const birthTimeSupported = true
+
+// setattrlist(2) constants for setting the creation time of links themselves
+const (
+	attrBitMapCount = 5
+	attrCmnCrtime   = 0x00000200
+	fsoptNoFollow   = 0x00000001
+)
+
+// attrList is struct attrlist selecting the attributes to set
+type attrList struct {
+	bitmapCount uint16
+	reserved    uint16
+	commonAttr  uint32
+	volAttr     uint32
+	dirAttr     uint32
+	fileAttr    uint32
+	forkAttr    uint32
+}
+
+// birthTime returns the creation time of the entry described by info and
+// whether it is known
+func birthTime(info os.FileInfo) (time.Time, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Birthtimespec.Unix()), true
+}
+
+// setBirthTime sets the creation time of the entry at path to t
+func setBirthTime(path string, t time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attrs := attrList{bitmapCount: attrBitMapCount, commonAttr: attrCmnCrtime}
+	ts := syscall.NsecToTimespec(t.UnixNano())
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETATTRLIST, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&attrs)), uintptr(unsafe.Pointer(&ts)), unsafe.Sizeof(ts),
+		fsoptNoFollow, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "setattrlist", Path: path, Err: errno}
+	}
+	return nil
+}
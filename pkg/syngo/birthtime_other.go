@@ -0,0 +1,25 @@
+//go:build !darwin && !windows
+
+// birthtime_other contains the fallback for platforms on which creation
+// times cannot be set. NOTE: Linux reports birth times via statx on some file
+// systems (e.g. btrfs, ext4) but offers no way of changing them.
+package syngo
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// birthTimeSupported reports that -crtimes does not work on this platform
+const birthTimeSupported = false
+
+// birthTime never knows the creation time of an entry on this platform
+func birthTime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// setBirthTime always fails since creation times cannot be set
+func setBirthTime(path string, t time.Time) error {
+	return errors.New("creation times cannot be set on this platform")
+}
@@ -0,0 +1,48 @@
+//go:build windows
+
+// birthtime_windows contains the preservation of file creation times on
+// Windows
+package syngo
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// birthTimeSupported reports that -crtimes works on this platform
+const birthTimeSupported = true
+
+// fileFlagOpenReparsePoint opens links themselves rather than their targets
+const fileFlagOpenReparsePoint = 0x00200000
+
+// birthTime returns the creation time of the entry described by info and
+// whether it is known
+func birthTime(info os.FileInfo) (time.Time, bool) {
+	d, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, d.CreationTime.Nanoseconds()), true
+}
+
+// setBirthTime sets the creation time of the entry at path to t
+func setBirthTime(path string, t time.Time) error {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	// directories can only be opened with backup semantics
+	h, err := syscall.CreateFile(p, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_READ|
+		syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE, nil, syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS|fileFlagOpenReparsePoint, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.CloseHandle(h)
+	ft := syscall.NsecToFiletime(t.UnixNano())
+	if err := syscall.SetFileTime(h, &ft, nil, nil); err != nil {
+		return &os.PathError{Op: "SetFileTime", Path: path, Err: err}
+	}
+	return nil
+}
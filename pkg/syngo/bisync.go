@@ -0,0 +1,348 @@
+// bisync contains the bidirectional synchronization of two local trees. The
+// state of both trees after each run is recorded so later runs can tell which
+// side changed an entry, e.g. whether it was created on one side or deleted
+// on the other.
+package syngo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// bisyncCmd implements syngo bisync which propagates changes made to either
+// of two trees since the last run to the other one
+func bisyncCmd(args []string) {
+	flags := flag.NewFlagSet("bisync", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report the changes which would be propagated")
+	verbose := flags.Bool("v", false, "verbose, list every propagated change")
+	conflict := flags.String("conflict", conflictFail,
+		"resolution of entries changed on both sides: fail (leave both alone), newer, larger, or keep-both")
+	maxDelete := flags.Int("max-delete", defaultMaxDelete, "abort without changing either tree if more than this percentage of the entries synced by the last run would be removed from one of them, e.g. because the other one is an unmounted mount point (100 disables the check)")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo bisync [options] <tree A> <tree B>")
+		fmt.Println("\noptions:")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+	}
+	if *verbose {
+		defaultLog.verbosity = levelFiles
+	}
+	if err := checkConflictStrategy(*conflict); err != nil {
+		log.Fatal(err)
+	}
+	if *maxDelete < 0 || *maxDelete > 100 {
+		log.Fatalf("invalid percentage %d of entries to remove\n", *maxDelete)
+	}
+
+	a, err := absPath(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := absPath(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if a == b {
+		log.Fatal("trees cannot be identical")
+	}
+	for _, t := range []string{a, b} {
+		if info, err := os.Stat(t); err != nil || !info.IsDir() {
+			log.Fatalf("%s is not a directory\n", t)
+		}
+	}
+	os.Exit(bisync(a, b, *conflict, *maxDelete, *dryRun))
+}
+
+// defaultMaxDelete is the default percentage of the synced entries bisync
+// removes from a tree before assuming that the other tree is missing
+const defaultMaxDelete = 50
+
+// bisyncStatePath returns the file in tree a recording the state of trees a
+// and b after their last bidirectional sync
+func bisyncStatePath(a, b string) string {
+	sum := sha256.Sum256([]byte(b))
+	return filepath.Join(a, metaDir, "bisync", hex.EncodeToString(sum[:8])+".json")
+}
+
+// bisyncPlan lists the changes to propagate between two trees
+type bisyncPlan struct {
+	toA, toB         []string // paths to copy
+	removeA, removeB []string // paths to remove
+	conflicts        []string // paths changed differently on both sides
+	resolved         []string // conflicting paths resolved by the strategy
+	keepBoth         []string // conflicting paths whose B version is renamed
+}
+
+// bisync synchronizes trees a and b in both directions, resolving conflicts
+// with strategy, and returns the exit code of the run. Runs which would
+// remove more than maxDelete percent of the previously synced entries from
+// either tree are aborted.
+func bisync(a, b, strategy string, maxDelete int, dryRun bool) int {
+	statePath := bisyncStatePath(a, b)
+	state, err := readManifestEntries(statePath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err)
+		return exitFatal
+	}
+	entriesA, errorsA := scanManifest(a, "", nil)
+	entriesB, errorsB := scanManifest(b, "", nil)
+	if errorsA > 0 || errorsB > 0 {
+		// incomplete scans would look like deletions
+		log.Print("failed to scan trees completely, not syncing")
+		return exitPartial
+	}
+
+	plan := planBisync(entryMap(entriesA), entryMap(entriesB), entryMap(state), strategy)
+	if err := checkMaxDelete(plan, state, maxDelete); err != nil {
+		log.Print(err)
+		return exitFatal
+	}
+	// copies are listed by the sync runs themselves unless this is a dry run
+	copyLevel := levelDecisions
+	if dryRun {
+		copyLevel = levelFiles
+	}
+	for _, p := range plan.toB {
+		infof(copyLevel, "%s -> B\n", p)
+	}
+	for _, p := range plan.toA {
+		infof(copyLevel, "%s -> A\n", p)
+	}
+	for _, p := range plan.removeB {
+		infof(levelFiles, "%s: removed from B\n", p)
+	}
+	for _, p := range plan.removeA {
+		infof(levelFiles, "%s: removed from A\n", p)
+	}
+	for _, p := range plan.resolved {
+		infof(levelSummary, "%s: conflict, resolved with %s\n", p, strategy)
+	}
+	for _, p := range plan.conflicts {
+		infof(levelSummary, "%s: conflict, changed on both sides\n", p)
+	}
+	if dryRun {
+		printBisyncSummary(plan)
+		return exitOK
+	}
+
+	// the B versions of conflicting entries which are kept move aside
+	// before A's versions are copied over
+	var numErrors int64
+	for _, p := range plan.keepBoth {
+		if err := os.Rename(filepath.Join(b, p), filepath.Join(b, conflictPath(p))); err != nil {
+			logError("bisync", p, "keep conflicting", err)
+			numErrors++
+		}
+	}
+	if len(plan.toB) > 0 {
+		stats := runSync(treeSource(a), &localFS{root: b}, &options{paths: plan.toB, skipMeta: true})
+		numErrors += stats.numErrors
+	}
+	if len(plan.toA) > 0 {
+		stats := runSync(treeSource(b), &localFS{root: a}, &options{paths: plan.toA, skipMeta: true})
+		numErrors += stats.numErrors
+	}
+	numErrors += removeEntries(b, plan.removeB) + removeEntries(a, plan.removeA)
+
+	// record the entries both trees agree on as the new state
+	entriesA, _ = scanManifest(a, "", nil)
+	entriesB, _ = scanManifest(b, "", nil)
+	synced := entryMap(entriesB)
+	var newState []manifestEntry
+	for _, e := range entriesA {
+		e := e
+		if !inMetaDir(e.Path) && sameEntry(&e, synced[e.Path]) {
+			newState = append(newState, e)
+		}
+	}
+	if err := writeBisyncState(statePath, newState); err != nil {
+		log.Printf("failed to record state of sync: %s\n", err)
+		numErrors++
+	}
+
+	printBisyncSummary(plan)
+	if numErrors > 0 || len(plan.conflicts) > 0 {
+		return exitPartial
+	}
+	return exitOK
+}
+
+// planBisync determines the changes to propagate between trees with the
+// entries a and b given their entries in the last synchronized state. Entries
+// changed on one side only are propagated to the other side while entries
+// changed on both sides are resolved with strategy.
+func planBisync(a, b, state map[string]*manifestEntry, strategy string) *bisyncPlan {
+	paths := make(map[string]bool)
+	for _, m := range []map[string]*manifestEntry{a, b, state} {
+		for p := range m {
+			if !inMetaDir(p) {
+				paths[p] = true
+			}
+		}
+	}
+
+	plan := &bisyncPlan{}
+	for p := range paths {
+		ea, eb, es := a[p], b[p], state[p]
+		changedA, changedB := !sameEntry(ea, es), !sameEntry(eb, es)
+		switch {
+		case sameEntry(ea, eb):
+			// in sync or changed identically on both sides
+		case changedA && !changedB:
+			if ea == nil {
+				plan.removeB = append(plan.removeB, p)
+			} else {
+				plan.toB = append(plan.toB, p)
+			}
+		case changedB && !changedA:
+			if eb == nil {
+				plan.removeA = append(plan.removeA, p)
+			} else {
+				plan.toA = append(plan.toA, p)
+			}
+		default:
+			switch resolveConflict(strategy, ea, eb) {
+			case resolveFirst:
+				plan.toB = append(plan.toB, p)
+			case resolveSecond:
+				plan.toA = append(plan.toA, p)
+			case resolveBoth:
+				plan.keepBoth = append(plan.keepBoth, p)
+				plan.toB = append(plan.toB, p)
+				plan.toA = append(plan.toA, conflictPath(p))
+			default:
+				plan.conflicts = append(plan.conflicts, p)
+				continue
+			}
+			plan.resolved = append(plan.resolved, p)
+		}
+	}
+	for _, l := range [][]string{plan.toA, plan.toB, plan.removeA, plan.removeB, plan.conflicts,
+		plan.resolved, plan.keepBoth} {
+		sort.Strings(l)
+	}
+	return plan
+}
+
+// checkMaxDelete fails if plan removes more than maxDelete percent of the
+// entries of the synchronized state from either tree. Removals on this
+// scale usually mean that the other tree is missing, e.g. an empty mount
+// point of a disk which is not mounted, rather than that its entries were
+// deleted.
+func checkMaxDelete(plan *bisyncPlan, state []manifestEntry, maxDelete int) error {
+	numSynced := 0
+	for _, e := range state {
+		if !inMetaDir(e.Path) {
+			numSynced++
+		}
+	}
+	for _, side := range []struct {
+		name    string
+		removed []string
+	}{{"A", plan.removeA}, {"B", plan.removeB}} {
+		if len(side.removed)*100 > numSynced*maxDelete {
+			return fmt.Errorf("refusing to remove %d of %d synced entries from %s, more than %d%% "+
+				"(check that both trees are present or raise -max-delete)", len(side.removed),
+				numSynced, side.name, maxDelete)
+		}
+	}
+	return nil
+}
+
+// sameEntry determines if the entries x and y, either of which is nil if
+// absent, have the same content. Directories are only compared by type and
+// symbolic links by their target.
+func sameEntry(x, y *manifestEntry) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+	if x.Mode.Type() != y.Mode.Type() {
+		return false
+	}
+	switch {
+	case x.Mode.IsDir():
+		return true
+	case x.Mode&os.ModeSymlink != 0:
+		return x.Link == y.Link
+	}
+	return x.Mode == y.Mode && x.Size == y.Size && x.Mtime.Equal(y.Mtime)
+}
+
+// entryMap indexes entries by path
+func entryMap(entries []manifestEntry) map[string]*manifestEntry {
+	m := make(map[string]*manifestEntry, len(entries))
+	for i := range entries {
+		m[entries[i].Path] = &entries[i]
+	}
+	return m
+}
+
+// inMetaDir determines if path lies within syngo's metadata directory
+func inMetaDir(path string) bool {
+	return withinDir(path, metaDir)
+}
+
+// removeEntries removes paths from tree root, children before their parents,
+// and returns the number of failures. Directories which are not empty since
+// new entries were added to them are kept.
+func removeEntries(root string, paths []string) int64 {
+	var numErrors int64
+	for i := len(paths) - 1; i >= 0; i-- {
+		p := filepath.Join(root, paths[i])
+		err := os.Remove(p)
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		if nonEmptyDir(p) {
+			infof(levelDecisions, "%s: kept, new entries were added to it\n", paths[i])
+			continue
+		}
+		logError("bisync", paths[i], "remove", err)
+		numErrors++
+	}
+	return numErrors
+}
+
+// nonEmptyDir determines if p is a directory with entries
+func nonEmptyDir(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(1)
+	return err == nil && len(names) > 0
+}
+
+// writeBisyncState records entries as the synchronized state at path
+func writeBisyncState(path string, entries []manifestEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(f, entries); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// printBisyncSummary prints the number of changes of plan
+func printBisyncSummary(plan *bisyncPlan) {
+	infof(levelSummary, "%d copied to A, %d copied to B, %d removed from A, %d removed from B, "+
+		"%d conflicts resolved, %d unresolved\n", len(plan.toA), len(plan.toB), len(plan.removeA),
+		len(plan.removeB), len(plan.resolved), len(plan.conflicts))
+}
@@ -0,0 +1,112 @@
+package syngo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPlanBisync(t *testing.T) {
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	file := func(size int64, mtime time.Time) *manifestEntry {
+		return &manifestEntry{Size: size, Mode: 0644, Mtime: mtime}
+	}
+	orig, newer, larger := file(1, old), file(1, old.Add(time.Hour)), file(2, old)
+	dir := &manifestEntry{Mode: os.ModeDir | 0755}
+
+	for _, tt := range []struct {
+		name     string
+		a, b, s  *manifestEntry // versions in A, B, and the state
+		strategy string
+		want     bisyncPlan
+	}{
+		{"in sync", orig, orig, orig, conflictFail, bisyncPlan{}},
+		{"changed identically", newer, newer, orig, conflictFail, bisyncPlan{}},
+		{"new in A", orig, nil, nil, conflictFail, bisyncPlan{toB: []string{"p"}}},
+		{"changed in B", orig, newer, orig, conflictFail, bisyncPlan{toA: []string{"p"}}},
+		{"removed from A", nil, orig, orig, conflictFail, bisyncPlan{removeB: []string{"p"}}},
+		{"removed from B", orig, nil, orig, conflictFail, bisyncPlan{removeA: []string{"p"}}},
+		{"conflict", newer, larger, orig, conflictFail, bisyncPlan{conflicts: []string{"p"}}},
+		{"newer wins", newer, larger, orig, conflictNewer,
+			bisyncPlan{toB: []string{"p"}, resolved: []string{"p"}}},
+		{"larger wins", newer, larger, orig, conflictLarger,
+			bisyncPlan{toA: []string{"p"}, resolved: []string{"p"}}},
+		{"keep both", newer, larger, orig, conflictKeepBoth, bisyncPlan{toA: []string{"p" + conflictSuffix},
+			toB: []string{"p"}, resolved: []string{"p"}, keepBoth: []string{"p"}}},
+		{"removed never wins", nil, newer, orig, conflictNewer,
+			bisyncPlan{toA: []string{"p"}, resolved: []string{"p"}}},
+		{"changed and removed", newer, nil, orig, conflictNewer,
+			bisyncPlan{toB: []string{"p"}, resolved: []string{"p"}}},
+		{"directory conflict", dir, newer, nil, conflictNewer, bisyncPlan{conflicts: []string{"p"}}},
+	} {
+		entries := func(e *manifestEntry) map[string]*manifestEntry {
+			m := map[string]*manifestEntry{metaDir + "/state": orig}
+			if e != nil {
+				m["p"] = e
+			}
+			return m
+		}
+		got := planBisync(entries(tt.a), entries(tt.b), entries(tt.s), tt.strategy)
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: planned %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestCheckMaxDelete(t *testing.T) {
+	state := []manifestEntry{{Path: metaDir}, {Path: metaDir + "/state"}}
+	for i := 0; i < 10; i++ {
+		state = append(state, manifestEntry{Path: strconv.Itoa(i)})
+	}
+	for _, tt := range []struct {
+		removeA, removeB int
+		maxDelete        int
+		ok               bool
+	}{
+		{0, 0, 0, true},
+		{1, 0, 0, false},
+		{5, 5, 50, true},
+		{6, 0, 50, false},
+		{0, 6, 50, false},
+		{10, 0, 100, true},
+	} {
+		plan := &bisyncPlan{removeA: make([]string, tt.removeA), removeB: make([]string, tt.removeB)}
+		if err := checkMaxDelete(plan, state, tt.maxDelete); (err == nil) != tt.ok {
+			t.Errorf("removing %d and %d of 10 entries with at most %d%%: %v", tt.removeA, tt.removeB,
+				tt.maxDelete, err)
+		}
+	}
+}
+
+func TestBisyncAbortsWithMissingTree(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	for i := 0; i < 4; i++ {
+		if err := ioutil.WriteFile(filepath.Join(a, strconv.Itoa(i)), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code := bisync(a, b, conflictFail, defaultMaxDelete, false); code != exitOK {
+		t.Fatalf("first sync exited with %d", code)
+	}
+	if infos, err := ioutil.ReadDir(b); err != nil || len(infos) != 4 {
+		t.Fatalf("synced %d entries to B: %v", len(infos), err)
+	}
+
+	// B looks like an empty mount point
+	if err := os.RemoveAll(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(b, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if code := bisync(a, b, conflictFail, defaultMaxDelete, false); code != exitFatal {
+		t.Errorf("sync against empty tree exited with %d", code)
+	}
+	if infos, err := ioutil.ReadDir(a); err != nil || len(infos) != 5 {
+		t.Errorf("A holds %d entries: %v", len(infos), err)
+	}
+}
@@ -0,0 +1,64 @@
+// bwlimit contains the token bucket rate limiter used for capping the
+// aggregate throughput of all syncers
+package syngo
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all syncer goroutines. Tokens are
+// bytes which are replenished at rate bytes per second; at most one second
+// worth of tokens can accumulate.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be transferred. Requests exceeding the
+// available tokens put the bucket into debt which later callers have to wait
+// for as well, so large chunks are limited correctly.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// reportReader calls report with the number of bytes of every read from r,
+// e.g. for throttling or progress accounting. Reads fail once report does.
+type reportReader struct {
+	r      io.Reader
+	report func(n int) error
+}
+
+func (r *reportReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if rerr := r.report(n); rerr != nil {
+			return n, rerr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,121 @@
+// chmod contains the rsync-like -chmod rules overriding the permissions of
+// synced files and directories
+package syngo
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// chmodRule changes the permissions of files, directories, or both
+type chmodRule struct {
+	dirs, files bool
+	octal       bool   // set the permissions to perm instead of applying op
+	perm        uint32 // permission bits to set, add, or remove
+	who         uint32 // permission bits affected by op
+	op          byte   // +, -, or =
+	x           bool   // X, execute permission for dirs and executable files
+}
+
+// whoBits maps the users of symbolic rules to the permission bits they affect
+var whoBits = map[byte]uint32{'u': 04700, 'g': 02070, 'o': 01007, 'a': 07777}
+
+// parseChmod parses comma separated rules such as D755,F644 or Dg+s,go-w.
+// Rules may be prefixed by D or F to only apply to directories or files and
+// are either octal modes or symbolic changes like those of chmod(1).
+func parseChmod(s string) ([]chmodRule, error) {
+	var rules []chmodRule
+	for _, item := range strings.Split(s, ",") {
+		r := chmodRule{dirs: true, files: true}
+		switch {
+		case strings.HasPrefix(item, "D"):
+			r.files, item = false, item[1:]
+		case strings.HasPrefix(item, "F"):
+			r.dirs, item = false, item[1:]
+		}
+
+		if m, err := strconv.ParseUint(item, 8, 32); err == nil && m <= 07777 {
+			r.octal, r.perm = true, uint32(m)
+			rules = append(rules, r)
+			continue
+		}
+
+		i := strings.IndexAny(item, "+-=")
+		if i < 0 || i == len(item)-1 && item[i] != '=' {
+			return nil, fmt.Errorf("invalid chmod rule %s", item)
+		}
+		r.op = item[i]
+		for _, c := range []byte(item[:i]) {
+			bits, ok := whoBits[c]
+			if !ok {
+				return nil, fmt.Errorf("invalid chmod rule %s", item)
+			}
+			r.who |= bits
+		}
+		if r.who == 0 {
+			r.who = whoBits['a']
+		}
+		for _, c := range []byte(item[i+1:]) {
+			switch c {
+			case 'r':
+				r.perm |= 0444
+			case 'w':
+				r.perm |= 0222
+			case 'x':
+				r.perm |= 0111
+			case 'X':
+				r.x = true
+			case 's':
+				r.perm |= 06000
+			case 't':
+				r.perm |= 01000
+			default:
+				return nil, fmt.Errorf("invalid chmod rule %s", item)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// applyChmod returns mode changed by rules. Only the permission bits
+// (including setuid, setgid, and sticky) are affected.
+func applyChmod(mode os.FileMode, rules []chmodRule) os.FileMode {
+	m := unixModeFromFile(mode)
+	perm, typ := m&07777, m&^07777
+	for _, r := range rules {
+		if (mode.IsDir() && !r.dirs) || (!mode.IsDir() && !r.files) {
+			continue
+		}
+		if r.octal {
+			perm = r.perm
+			continue
+		}
+		bits := r.perm
+		if r.x && (mode.IsDir() || perm&0111 != 0) {
+			bits |= 0111
+		}
+		bits &= r.who
+		switch r.op {
+		case '+':
+			perm |= bits
+		case '-':
+			perm &^= bits
+		case '=':
+			perm = perm&^r.who | bits
+		}
+	}
+	return fileModeFromUnix(typ | perm)
+}
+
+// modeInfo overrides the mode of a source entry, e.g. as changed by -chmod
+type modeInfo struct {
+	os.FileInfo
+	mode os.FileMode
+}
+
+func (m modeInfo) Mode() os.FileMode {
+	return m.mode
+}
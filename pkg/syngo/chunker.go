@@ -0,0 +1,64 @@
+// chunker contains the content-defined chunking of file contents stored in
+// repositories. Chunk boundaries are placed where a rolling gear hash of the
+// preceding bytes matches a mask (FastCDC), so they move along with the
+// content and data shifted by insertions still splits into the same chunks.
+package syngo
+
+// chunk size limits; boundaries are normalized towards the average size by
+// using a stricter mask before and a looser one after it
+const (
+	minChunkSize = 256 * 1024
+	avgChunkSize = 1024 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+
+	chunkMaskStrict = (1 << 22) - 1 // 2 bits more than log2(avgChunkSize)
+	chunkMaskLoose  = (1 << 18) - 1 // 2 bits less
+)
+
+// gearTable maps bytes to the random values mixed into the rolling hash. It
+// is generated from a fixed seed since boundaries, and thus deduplication
+// across runs, depend on it.
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0x73796e676f636463) // splitmix64 seeded with "syngocdc"
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunkBoundary returns the length of the first chunk of data. Data shorter
+// than the minimum chunk size and data without boundary up to the maximum
+// chunk size are returned in one chunk.
+func chunkBoundary(data []byte) int {
+	n := len(data)
+	if n <= minChunkSize {
+		return n
+	}
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+	avg := avgChunkSize
+	if avg > n {
+		avg = n
+	}
+
+	var h uint64
+	i := minChunkSize
+	for ; i < avg; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&chunkMaskStrict == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&chunkMaskLoose == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
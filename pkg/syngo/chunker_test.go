@@ -0,0 +1,83 @@
+package syngo
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// chunkData splits data into chunks the way repositories store files
+func chunkData(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := chunkBoundary(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// randomData returns size pseudo random bytes generated from seed
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkBoundaryDeterministic(t *testing.T) {
+	data := randomData(1, 16*avgChunkSize)
+	first, second := chunkData(data), chunkData(append([]byte(nil), data...))
+	if len(first) != len(second) {
+		t.Fatalf("%d and %d chunks", len(first), len(second))
+	}
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Fatalf("chunk %d differs", i)
+		}
+	}
+}
+
+func TestChunkBoundarySizes(t *testing.T) {
+	data := randomData(2, 64*avgChunkSize)
+	chunks := chunkData(data)
+	for i, c := range chunks {
+		if len(c) > maxChunkSize || (len(c) < minChunkSize && i < len(chunks)-1) {
+			t.Errorf("chunk %d has %d bytes", i, len(c))
+		}
+	}
+	// normalized chunking keeps the mean close to the average size
+	if mean := len(data) / len(chunks); mean < avgChunkSize/2 || mean > 2*avgChunkSize {
+		t.Errorf("mean chunk size %d, want about %d", mean, avgChunkSize)
+	}
+
+	for _, size := range []int{0, 1, minChunkSize} {
+		if n := chunkBoundary(data[:size]); n != size {
+			t.Errorf("%d bytes split after %d", size, n)
+		}
+	}
+	// data without boundaries is cut at the maximum size
+	if n := chunkBoundary(make([]byte, 2*maxChunkSize)); n != maxChunkSize {
+		t.Errorf("zeros split after %d bytes, want %d", n, maxChunkSize)
+	}
+}
+
+func TestChunkBoundaryStableAfterInsert(t *testing.T) {
+	data := randomData(3, 32*avgChunkSize)
+	chunks := chunkData(data)
+	shifted := chunkData(append(randomData(4, 1000), data...))
+
+	// all but the chunks around the insertion are found again
+	seen := make(map[string]bool)
+	for _, c := range shifted {
+		seen[string(c)] = true
+	}
+	var missing int
+	for _, c := range chunks {
+		if !seen[string(c)] {
+			missing++
+		}
+	}
+	if missing > 2 {
+		t.Errorf("%d of %d chunks changed by inserting a prefix", missing, len(chunks))
+	}
+}
@@ -0,0 +1,196 @@
+// compare contains the compare subcommand which reports the differences
+// between two trees without modifying either of them
+package syngo
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// difference describes an entry which differs between two compared trees
+type difference struct {
+	path string
+	what string // missing, extra, or the differing properties
+}
+
+// treeDiff collects the differences found by concurrent walkers
+type treeDiff struct {
+	mu        sync.Mutex
+	diffs     []difference
+	numErrors int64
+}
+
+func (t *treeDiff) add(path, what string) {
+	t.mu.Lock()
+	t.diffs = append(t.diffs, difference{path: path, what: what})
+	t.mu.Unlock()
+}
+
+// compareCmd implements syngo compare, listing the entries of the source tree
+// missing from or differing in the target tree as well as extra entries in
+// the target tree
+func compareCmd(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	checksum := flags.Bool("checksum", false, "compare the content of files of equal size by checksum instead of their modification times")
+	algo := defaultHash
+	flags.Var(hashAlgoFlag{&algo}, "checksum-choice", checksumChoiceUsage)
+	cacheFile := flags.String("checksum-cache", "", "cache checksums in this file so unchanged files are not reread by later runs")
+	modifyWindow := flags.Duration("modify-window", 0, "consider modification times differing by at most this much equal (e.g. 2s for FAT)")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo compare [options] <source tree> <target tree>")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+	}
+
+	srcTree, err := absPath(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	tgtTree, err := absPath(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, t := range []string{srcTree, tgtTree} {
+		if info, err := os.Stat(t); err != nil || !info.IsDir() {
+			log.Fatalf("%s is not a directory\n", t)
+		}
+	}
+
+	if !*checksum {
+		algo = ""
+	}
+	sums := openSumCache("compare", *cacheFile)
+	src, tgt := &localFS{root: srcTree, sums: sums}, &localFS{root: tgtTree, sums: sums}
+	d := &treeDiff{}
+	numErrors := walkTree(srcTree, numWalkers, nil, func(relPath string, _ os.DirEntry) bool {
+		return compareEntry(src, tgt, relPath, algo, *modifyWindow, d)
+	})
+	numErrors += walkTree(tgtTree, numWalkers, nil, func(relPath string, e os.DirEntry) bool {
+		return findExtra(src, relPath, e, d)
+	})
+	numErrors += d.numErrors
+	if err := sums.save(); err != nil {
+		log.Printf("compare: failed to save checksum cache: %v\n", err)
+	}
+
+	sort.Slice(d.diffs, func(i, j int) bool { return d.diffs[i].path < d.diffs[j].path })
+	var missing, extra int
+	for _, diff := range d.diffs {
+		switch diff.what {
+		case "missing":
+			missing++
+		case "extra":
+			extra++
+		}
+		printf("%s: %s\n", diff.path, diff.what)
+	}
+	printf("%d missing, %d extra, %d differing entries\n", missing, extra,
+		len(d.diffs)-missing-extra)
+
+	switch {
+	case numErrors > 0:
+		log.Printf("%d errors while comparing\n", numErrors)
+		os.Exit(exitPartial)
+	case len(d.diffs) > 0:
+		os.Exit(exitDiffer)
+	}
+}
+
+// compareEntry compares the entry at relPath in the source tree with its
+// counterpart in the target tree and returns whether the walk should
+// descend into it. The contents of files of equal size are compared by their
+// checksum computed with algo unless it is empty.
+func compareEntry(src, tgt *localFS, relPath string, algo hashAlgo, modifyWindow time.Duration,
+	d *treeDiff) bool {
+	srcFile, err := src.Lstat(relPath)
+	if err != nil {
+		logError("compare", relPath, "stat", err)
+		atomic.AddInt64(&d.numErrors, 1)
+		return false
+	}
+	tgtFile, err := tgt.Lstat(relPath)
+	if os.IsNotExist(err) {
+		d.add(relPath, "missing")
+		return false
+	} else if err != nil {
+		logError("compare", relPath, "stat", err)
+		atomic.AddInt64(&d.numErrors, 1)
+		return false
+	}
+
+	srcIsDir, tgtIsDir := srcFile.info.IsDir(), tgtFile.info.IsDir()
+	if srcIsDir || tgtIsDir {
+		if srcIsDir != tgtIsDir {
+			d.add(relPath, "type differs")
+		}
+		return srcIsDir && tgtIsDir
+	}
+
+	change := entryChange(tgt, srcFile, tgtFile, modifyWindow)
+	if change&changeNew != 0 {
+		d.add(relPath, "type differs")
+		return false
+	}
+	if algo != "" && srcFile.info.Mode().IsRegular() && change&changeSize == 0 {
+		change &^= changeTime
+		same, err := sameContent(src, tgt, relPath, srcFile.info.Size(), algo)
+		if err != nil {
+			logError("compare", relPath, "checksum", err)
+			atomic.AddInt64(&d.numErrors, 1)
+			return false
+		}
+		if !same {
+			change |= changeContent
+		}
+	}
+	if change != 0 {
+		d.add(relPath, describeChange(change))
+	}
+	return false
+}
+
+// findExtra records the entry e at relPath in the target tree if it does not
+// exist in the source tree and returns whether the walk should descend into
+// it
+func findExtra(src *localFS, relPath string, e os.DirEntry, d *treeDiff) bool {
+	// syngo's metadata directory, e.g. holding the lock of the target, is
+	// not part of the synced content
+	if relPath == metaDir {
+		return false
+	}
+	srcFile, err := src.Lstat(relPath)
+	if os.IsNotExist(err) {
+		d.add(relPath, "extra")
+		return false
+	} else if err != nil {
+		logError("compare", relPath, "stat", err)
+		atomic.AddInt64(&d.numErrors, 1)
+		return false
+	}
+	return srcFile.info.IsDir() && e.IsDir()
+}
+
+// sameContent compares the algo checksums of the files at relPath of size
+// bytes in the src and tgt trees
+func sameContent(src, tgt *localFS, relPath string, size int64, algo hashAlgo) (bool, error) {
+	srcSum, err := src.PrefixSum(relPath, size, algo)
+	if err != nil {
+		return false, err
+	}
+	tgtSum, err := tgt.PrefixSum(relPath, size, algo)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(srcSum, tgtSum), nil
+}
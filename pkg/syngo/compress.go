@@ -0,0 +1,134 @@
+// compress contains the compression of file data sent to syngo servers over
+// ssh or daemon connections. Clients request an algorithm once per connection,
+// falling back to deflate for servers predating lz4, and then compress each
+// write chunk separately, sending chunks which do not shrink as they are.
+// NOTE: zstd is not offered since the standard library has no encoder for it
+// and syngo does without third-party packages. Object store targets are not
+// compressed either, their services store what is uploaded and do not
+// negotiate a compression of the transfer.
+package syngo
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+// compression algorithms understood by syngo servers
+const (
+	compressLZ4     = "lz4"
+	compressDeflate = "deflate"
+)
+
+// defaultCompressLevel is used by -compress without -compress-level
+const defaultCompressLevel = 6
+
+// parseCompressChoice returns the compression algorithm named s
+func parseCompressChoice(s string) (string, error) {
+	switch a := strings.ToLower(s); a {
+	case compressLZ4, compressDeflate:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown compression %s, use %s or %s", s, compressLZ4, compressDeflate)
+}
+
+// compressor compresses write chunks with an algorithm at a fixed level,
+// reusing its deflate writers across the syncer goroutines sharing a
+// connection
+type compressor struct {
+	algorithm string
+	level     int
+	writers   sync.Pool
+}
+
+func newCompressor(algorithm string, level int) *compressor {
+	return &compressor{algorithm: algorithm, level: level}
+}
+
+// compress returns the compressed chunk p, or nil if compressing does not
+// make it smaller
+func (z *compressor) compress(p []byte) []byte {
+	if z.algorithm == compressLZ4 {
+		return z.compressLZ4(p)
+	}
+	var buf bytes.Buffer
+	w, _ := z.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, z.level); err != nil {
+			return nil
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer z.writers.Put(w)
+
+	if _, err := w.Write(p); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(p) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// compressLZ4 returns the chunk p compressed as its uncompressed size
+// followed by an LZ4 block, or nil if that is not smaller. Higher levels
+// search more positions for matches.
+func (z *compressor) compressLZ4(p []byte) []byte {
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(p)))
+	packed := append(size[:n:n], lz4Compress(p, (9-z.level)/2+1)...)
+	if len(packed) >= len(p) {
+		return nil
+	}
+	return packed
+}
+
+// decompress returns the chunk p compressed by a client with algorithm
+func decompress(algorithm string, p []byte) ([]byte, error) {
+	if algorithm == compressLZ4 {
+		size, n := binary.Uvarint(p)
+		if n <= 0 || size > writeChunkSize {
+			return nil, errLZ4Corrupt
+		}
+		return lz4Decompress(p[n:], int(size))
+	}
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// enableCompression asks the server to accept write chunks compressed with
+// algorithm. Servers not supporting lz4 are asked for deflate instead, those
+// not supporting compression at all keep receiving uncompressed data.
+func (c *remoteFS) enableCompression(algorithm string, level int) {
+	if level == 0 {
+		return
+	}
+	_, err := c.call(&request{Op: opPack, Target: algorithm})
+	if err != nil && algorithm != compressDeflate {
+		log.Printf("remote syngo does not support %s compression, using %s: %s\n", algorithm, compressDeflate, err)
+		algorithm = compressDeflate
+		_, err = c.call(&request{Op: opPack, Target: algorithm})
+	}
+	if err != nil {
+		log.Printf("remote syngo does not support compression, sending uncompressed data: %s\n", err)
+		return
+	}
+	c.compressor = newCompressor(algorithm, level)
+}
+
+// checkCompression returns an error if the compression algorithm requested by
+// a client is not supported
+func checkCompression(algorithm string) error {
+	if algorithm != compressLZ4 && algorithm != compressDeflate {
+		return fmt.Errorf("unsupported compression %s", algorithm)
+	}
+	return nil
+}
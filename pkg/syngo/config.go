@@ -0,0 +1,251 @@
+// config contains the configuration file defining named sync jobs which are
+// performed with syngo run
+package syngo
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// job is a named sync job from the configuration file. Apart from source (one
+// or an array of source trees) and target, its settings are named after the command line options of a sync
+// run; array values repeat the option.
+type job map[string][]string
+
+// defaultConfigPath returns the location of the configuration file,
+// $XDG_CONFIG_HOME/syngo/config.toml or ~/.config/syngo/config.toml
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "syngo", "config.toml")
+}
+
+// readConfig parses the configuration file at path and returns its jobs by
+// name. The file uses a subset of TOML: every [name] table defines a job
+// while settings before the first table apply to all jobs. Values are
+// strings, integers, booleans, or single line arrays of these, e.g.
+//
+//	bwlimit = "10M"
+//
+//	[home]
+//	source = "/home/me"
+//	target = "backup:/srv/home"
+//	snapshot = true
+//	prune-keep = 30
+func readConfig(path string) (map[string]job, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	defaults := make(job)
+	jobs := make(map[string]job)
+	cur := defaults
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: invalid table header %s", path, lineNum, line)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			if name == "" || jobs[name] != nil {
+				return nil, fmt.Errorf("%s:%d: invalid or duplicate job %q", path, lineNum, name)
+			}
+			cur = make(job)
+			jobs[name] = cur
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+		key := strings.TrimSpace(line[:i])
+		value, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNum, err)
+		}
+		cur[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, j := range jobs {
+		for k, v := range defaults {
+			if _, ok := j[k]; !ok {
+				j[k] = v
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// stripComment removes a trailing # comment from line, ignoring # inside
+// strings
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0 && c == quote && !(quote == '"' && escaped(line, i)):
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// escaped determines if the character at position i of s is preceded by an
+// odd number of backslashes
+func escaped(s string, i int) bool {
+	n := 0
+	for i--; i >= 0 && s[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// parseConfigValue parses a configuration value into the list of its
+// elements as they are passed on the command line
+func parseConfigValue(s string) ([]string, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("arrays have to end on the same line")
+		}
+		var values []string
+		for _, elem := range splitArray(s[1 : len(s)-1]) {
+			elem = strings.TrimSpace(elem)
+			if elem == "" {
+				continue
+			}
+			v, err := parseConfigScalar(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	v, err := parseConfigScalar(s)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
+
+// splitArray splits the content of an array at commas outside of strings
+func splitArray(s string) []string {
+	var elems []string
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0 && c == quote && !(quote == '"' && escaped(s, i)):
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			elems = append(elems, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(elems, s[start:])
+}
+
+// parseConfigScalar parses a single string, integer, or boolean value
+func parseConfigScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid value %s", s)
+	}
+	return s, nil
+}
+
+// args returns the command line arguments of a sync run performing j
+func (j job) args() ([]string, error) {
+	if len(j["source"]) == 0 || len(j["target"]) != 1 {
+		return nil, fmt.Errorf("jobs need at least one source and a single target")
+	}
+
+	var keys []string
+	for k := range j {
+		if k != "source" && k != "target" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, k := range keys {
+		for _, v := range j[k] {
+			args = append(args, "-"+k+"="+v)
+		}
+	}
+	args = append(args, j["source"]...)
+	return append(args, j["target"][0]), nil
+}
+
+// runCmd implements syngo run, performing a sync job defined in the
+// configuration file
+func runCmd(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	config := flags.String("config", defaultConfigPath(), "configuration file defining the sync jobs")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo run [options] <job>")
+		fmt.Println("\noptions:")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+	}
+
+	jobs, err := readConfig(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := flags.Arg(0)
+	j, ok := jobs[name]
+	if !ok {
+		log.Fatalf("no job %s in %s\n", name, *config)
+	}
+
+	// NOTE: Unknown settings are reported as undefined flags by syncCmd
+	jobArgs, err := j.args()
+	if err != nil {
+		log.Fatalf("invalid job %s: %s\n", name, err)
+	}
+	syncCmd(jobArgs)
+}
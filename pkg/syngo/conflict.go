@@ -0,0 +1,79 @@
+// conflict contains the strategies for resolving conflicting versions of an
+// entry, i.e. entries changed on both sides of a bidirectional sync or
+// modified on the target more recently than in the source with -update
+package syngo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// conflict resolution strategies selectable with -conflict
+const (
+	conflictFail     = "fail"      // leave both versions alone and report an error
+	conflictNewer    = "newer"     // the more recently modified version wins
+	conflictLarger   = "larger"    // the larger version wins
+	conflictKeepBoth = "keep-both" // keep both, renaming the target's version
+)
+
+// conflictSuffix is appended to the name of the renamed version of entries
+// resolved with keep-both
+const conflictSuffix = ".conflict"
+
+// resolutions of a conflict between two versions of an entry
+const (
+	resolveNone   = iota // leave both versions alone
+	resolveFirst         // the first version replaces the second one
+	resolveSecond        // the second version replaces the first one
+	resolveBoth          // keep both versions, renaming the second one
+)
+
+// checkConflictStrategy verifies that s is a known conflict strategy
+func checkConflictStrategy(s string) error {
+	switch s {
+	case conflictFail, conflictNewer, conflictLarger, conflictKeepBoth:
+		return nil
+	}
+	return fmt.Errorf("invalid conflict strategy %s", s)
+}
+
+// resolveConflict decides between the conflicting versions x and y of an
+// entry with strategy. Either version may be nil if the entry was removed;
+// removed versions never win over existing ones. Conflicts involving
+// directories are only resolved if one version was removed.
+func resolveConflict(strategy string, x, y *manifestEntry) int {
+	switch {
+	case strategy == conflictFail:
+		return resolveNone
+	case x == nil:
+		return resolveSecond
+	case y == nil:
+		return resolveFirst
+	case x.Mode.IsDir() || y.Mode.IsDir():
+		return resolveNone
+	case strategy == conflictKeepBoth:
+		return resolveBoth
+	case strategy == conflictNewer && x.Mtime.After(y.Mtime),
+		strategy == conflictLarger && x.Size > y.Size:
+		return resolveFirst
+	case strategy == conflictNewer && y.Mtime.After(x.Mtime),
+		strategy == conflictLarger && y.Size > x.Size:
+		return resolveSecond
+	}
+	return resolveNone
+}
+
+// conflictPath returns the path the second version of an entry at path is
+// renamed to if both versions are kept
+func conflictPath(path string) string {
+	return path + conflictSuffix
+}
+
+// manifestEntryOf returns the manifest entry describing fi
+func manifestEntryOf(fi fileInfo) *manifestEntry {
+	return &manifestEntry{Path: fi.path, Size: fi.info.Size(), Mode: fi.info.Mode(),
+		Mtime: fi.info.ModTime(), Link: fi.linkPath}
+}
+
+// errTargetNewer is reported for -update conflicts with the fail strategy
+var errTargetNewer = errors.New("target is newer than source")
@@ -0,0 +1,583 @@
+// crypt contains the client-side encryption of target trees. File contents
+// are encrypted with AES-GCM in chunks, so files can be streamed and
+// truncated or reordered chunks are detected. Optionally, entry names and
+// symbolic link targets are encrypted deterministically with AES-CTR using
+// a synthetic IV derived from the name, so names can still be looked up.
+// Encrypted names are longer than their plaintext, which limits names to 143
+// bytes.
+// NOTE: Modes, modification times, the tree structure, and approximate file
+// sizes stay visible to the storage.
+package syngo
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// layout of encrypted files: a header consisting of cryptMagic and a random
+// nonce prefix is followed by the sealed chunks of cryptChunkSize bytes of
+// plaintext each. The last chunk may be shorter (or empty) and is marked as
+// final in its additional data.
+const (
+	cryptMagic      = "syngoenc"
+	cryptNoncePre   = 8 // random nonce bytes per file, followed by the chunk index
+	cryptHeaderSize = len(cryptMagic) + cryptNoncePre
+	cryptChunkSize  = 64 * 1024
+	cryptTagSize    = 16
+)
+
+var errCryptCorrupt = errors.New("encrypted file is corrupt or was encrypted with a different key")
+
+// minSecretSize is the minimum size of key files
+const minSecretSize = 32
+
+// maximum sizes of encrypted names and symbolic link targets, NAME_MAX and
+// PATH_MAX-1 of most file systems. They limit plaintext names to 143 bytes.
+const (
+	maxEncryptedName = 255
+	maxEncryptedLink = 4095
+)
+
+// nameEncoding encodes encrypted names with case insensitive characters only
+var nameEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// cryptKeys holds the keys derived from the user's key file
+type cryptKeys struct {
+	content cipher.AEAD
+	names   cipher.Block // nil if names are not encrypted
+	nameIV  []byte       // HMAC key deriving the IVs of names
+}
+
+// loadCryptKeys derives the encryption keys from the content of the key file
+// at path, which should contain at least 32 random bytes
+func loadCryptKeys(path string, encryptNames bool) (*cryptKeys, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < minSecretSize {
+		return nil, fmt.Errorf("key file %s is too short, it needs at least %d random bytes", path,
+			minSecretSize)
+	}
+	block, err := aes.NewCipher(deriveKey(secret, "content"))
+	if err != nil {
+		return nil, err
+	}
+	k := &cryptKeys{}
+	if k.content, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	if encryptNames {
+		if k.names, err = aes.NewCipher(deriveKey(secret, "names")); err != nil {
+			return nil, err
+		}
+		k.nameIV = deriveKey(secret, "name-iv")
+	}
+	return k, nil
+}
+
+// deriveKey derives the 256 bit key used for purpose from secret
+func deriveKey(secret []byte, purpose string) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte("syngo " + purpose))
+	return m.Sum(nil)
+}
+
+// plainSize returns the size of the plaintext of an encrypted file of size
+// bytes
+func plainSize(size int64) int64 {
+	size -= int64(cryptHeaderSize)
+	if size <= 0 {
+		return 0
+	}
+	chunks := (size + cryptChunkSize + cryptTagSize - 1) / (cryptChunkSize + cryptTagSize)
+	if size -= chunks * cryptTagSize; size < 0 {
+		return 0
+	}
+	return size
+}
+
+// chunkAD returns the additional data authenticating chunk i
+func chunkAD(i uint32, final bool) []byte {
+	ad := make([]byte, 5)
+	binary.BigEndian.PutUint32(ad, i)
+	if final {
+		ad[4] = 1
+	}
+	return ad
+}
+
+// cryptWriter encrypts the data written to it. A full chunk is only sealed
+// once more data follows since the last chunk has to be marked as final.
+type cryptWriter struct {
+	w     io.WriteCloser
+	aead  cipher.AEAD
+	nonce []byte
+	index uint32
+	buf   []byte
+}
+
+// encryptWriter returns a writer encrypting all data written to it into w
+func (k *cryptKeys) encryptWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	nonce := make([]byte, k.content.NonceSize())
+	if _, err := rand.Read(nonce[:cryptNoncePre]); err != nil {
+		return nil, err
+	}
+	header := append([]byte(cryptMagic), nonce[:cryptNoncePre]...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &cryptWriter{w: w, aead: k.content, nonce: nonce,
+		buf: make([]byte, 0, cryptChunkSize)}, nil
+}
+
+// seal encrypts and writes the buffered chunk
+func (c *cryptWriter) seal(final bool) error {
+	binary.BigEndian.PutUint32(c.nonce[cryptNoncePre:], c.index)
+	out := c.aead.Seal(nil, c.nonce, c.buf, chunkAD(c.index, final))
+	c.index++
+	c.buf = c.buf[:0]
+	_, err := c.w.Write(out)
+	return err
+}
+
+func (c *cryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(c.buf) == cryptChunkSize {
+			if err := c.seal(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(c.buf[len(c.buf):cryptChunkSize], p)
+		c.buf = c.buf[:len(c.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (c *cryptWriter) Close() error {
+	if err := c.seal(true); err != nil {
+		c.w.Close()
+		return err
+	}
+	return c.w.Close()
+}
+
+// decryptFile writes the plaintext of the encrypted file read from r to w
+func (k *cryptKeys) decryptFile(w io.Writer, r io.Reader) error {
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(cryptMagic)]) != cryptMagic {
+		return errCryptCorrupt
+	}
+	nonce := make([]byte, k.content.NonceSize())
+	copy(nonce, header[len(cryptMagic):])
+
+	// a chunk is final if it is short or nothing follows it
+	br := bufio.NewReader(r)
+	chunk := make([]byte, cryptChunkSize+cryptTagSize)
+	for i := uint32(0); ; i++ {
+		n, err := io.ReadFull(br, chunk)
+		if err == io.EOF {
+			return errCryptCorrupt
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err == io.ErrUnexpectedEOF
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+		binary.BigEndian.PutUint32(nonce[cryptNoncePre:], i)
+		plain, err := k.content.Open(nil, nonce, chunk[:n], chunkAD(i, final))
+		if err != nil {
+			return errCryptCorrupt
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// encryptName encrypts a single name deterministically. Names whose
+// encryption is longer than maxSize bytes are rejected.
+func (k *cryptKeys) encryptName(name string, maxSize int) (string, error) {
+	if nameEncoding.EncodedLen(aes.BlockSize+len(name)) > maxSize {
+		return "", &os.PathError{Op: "encrypt", Path: name, Err: syscall.ENAMETOOLONG}
+	}
+	m := hmac.New(sha256.New, k.nameIV)
+	m.Write([]byte(name))
+	iv := m.Sum(nil)[:aes.BlockSize]
+	out := make([]byte, aes.BlockSize+len(name))
+	copy(out, iv)
+	cipher.NewCTR(k.names, iv).XORKeyStream(out[aes.BlockSize:], []byte(name))
+	return strings.ToLower(nameEncoding.EncodeToString(out)), nil
+}
+
+// decryptName decrypts a name encrypted by encryptName
+func (k *cryptKeys) decryptName(name string) (string, error) {
+	data, err := nameEncoding.DecodeString(strings.ToUpper(name))
+	if err != nil || len(data) < aes.BlockSize {
+		return "", fmt.Errorf("invalid encrypted name %s", name)
+	}
+	iv := data[:aes.BlockSize]
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCTR(k.names, iv).XORKeyStream(plain, data[aes.BlockSize:])
+	m := hmac.New(sha256.New, k.nameIV)
+	m.Write(plain)
+	if !hmac.Equal(m.Sum(nil)[:aes.BlockSize], iv) {
+		return "", fmt.Errorf("invalid encrypted name %s", name)
+	}
+	return string(plain), nil
+}
+
+// encryptPath encrypts every element of the relative path p
+func (k *cryptKeys) encryptPath(p string) (string, error) {
+	if k.names == nil {
+		return p, nil
+	}
+	elems := strings.Split(filepath.ToSlash(p), "/")
+	for i, e := range elems {
+		if e != "" && e != "." && e != ".." {
+			var err error
+			if elems[i], err = k.encryptName(e, maxEncryptedName); err != nil {
+				return "", err
+			}
+		}
+	}
+	return filepath.FromSlash(strings.Join(elems, "/")), nil
+}
+
+// cryptFS is a backend encrypting all data written to the wrapped backend
+type cryptFS struct {
+	backend
+	keys *cryptKeys
+}
+
+// cryptInfo reports the plaintext size of an encrypted file
+type cryptInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (c cryptInfo) Size() int64 {
+	return c.size
+}
+
+func (c *cryptFS) Lstat(p string) (fileInfo, error) {
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	fi, err := c.backend.Lstat(ep)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	return c.plainInfo(fi, p)
+}
+
+// plainInfo turns the information fi about the encrypted entry of p into
+// the one about its plaintext
+func (c *cryptFS) plainInfo(fi fileInfo, p string) (fileInfo, error) {
+	var err error
+	fi.path = p
+	if fi.info.Mode().IsRegular() {
+		fi.info = cryptInfo{FileInfo: fi.info, size: plainSize(fi.info.Size())}
+	} else if fi.linkPath != "" && c.keys.names != nil {
+		if fi.linkPath, err = c.keys.decryptName(fi.linkPath); err != nil {
+			return fileInfo{}, err
+		}
+	}
+	return fi, nil
+}
+
+// List decrypts the names of the entries of directory p. With encrypted
+// names, the listing is sorted by the encrypted names.
+func (c *cryptFS) List(p string) ([]fileInfo, error) {
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := c.backend.List(ep)
+	if err != nil {
+		return nil, err
+	}
+	for i, fi := range infos {
+		name := filepath.Base(fi.path)
+		if c.keys.names != nil {
+			if name, err = c.keys.decryptName(name); err != nil {
+				return nil, err
+			}
+		}
+		if infos[i], err = c.plainInfo(fi, filepath.Join(p, name)); err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// Open returns a reader for the plaintext of file p
+func (c *cryptFS) Open(p string) (io.ReadCloser, error) {
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.backend.Open(ep)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(c.keys.decryptFile(pw, f))
+		f.Close()
+	}()
+	return pr, nil
+}
+
+func (c *cryptFS) Mkdir(p string, mode os.FileMode) error {
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return err
+	}
+	return c.backend.Mkdir(ep, mode)
+}
+
+func (c *cryptFS) Create(p string) (io.WriteCloser, error) {
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return nil, err
+	}
+	w, err := c.backend.Create(ep)
+	if err != nil {
+		return nil, err
+	}
+	return c.keys.encryptWriter(w)
+}
+
+// Symlink stores link targets as a single encrypted name if names are
+// encrypted
+func (c *cryptFS) Symlink(oldname, newname string) error {
+	var err error
+	if c.keys.names != nil {
+		if oldname, err = c.keys.encryptName(oldname, maxEncryptedLink); err != nil {
+			return err
+		}
+	}
+	ep, err := c.keys.encryptPath(newname)
+	if err != nil {
+		return err
+	}
+	return c.backend.Symlink(oldname, ep)
+}
+
+func (c *cryptFS) Remove(p string) error {
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return err
+	}
+	return c.backend.Remove(ep)
+}
+
+func (c *cryptFS) Chtimes(p string, mtime time.Time) error {
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return err
+	}
+	return c.backend.Chtimes(ep, mtime)
+}
+
+func (c *cryptFS) Chmod(p string, mode os.FileMode) error {
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return err
+	}
+	return c.backend.Chmod(ep, mode)
+}
+
+func (c *cryptFS) Rename(oldpath, newpath string) error {
+	r, ok := c.backend.(renamer)
+	if !ok {
+		return errors.New("renaming is not supported by the target")
+	}
+	oldEp, err := c.keys.encryptPath(oldpath)
+	if err != nil {
+		return err
+	}
+	newEp, err := c.keys.encryptPath(newpath)
+	if err != nil {
+		return err
+	}
+	return r.Rename(oldEp, newEp)
+}
+
+func (c *cryptFS) Lchown(p string, o *owner) error {
+	ch, ok := c.backend.(chowner)
+	if !ok {
+		return errors.New("changing ownership is not supported by the target")
+	}
+	ep, err := c.keys.encryptPath(p)
+	if err != nil {
+		return err
+	}
+	return ch.Lchown(ep, o)
+}
+
+func (c *cryptFS) MtimePrecision() time.Duration {
+	if p, ok := c.backend.(mtimePrecisioner); ok {
+		return p.MtimePrecision()
+	}
+	return 0
+}
+
+func (c *cryptFS) KeepsMode() bool {
+	return keepsMode(c.backend)
+}
+
+// decryptCmd implements the decrypt command which restores the plaintext of
+// an encrypted local target tree
+func decryptCmd(args []string) {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := flags.String("key", "", "file containing the key the tree was encrypted with")
+	names := flags.Bool("names", false, "the tree was synced with -encrypt-names")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo decrypt [options] <encrypted tree> <destination>")
+		fmt.Println("\noptions:")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 || *keyFile == "" {
+		flags.Usage()
+	}
+	keys, err := loadCryptKeys(*keyFile, *names)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if decryptTree(keys, flags.Arg(0), flags.Arg(1)) > 0 {
+		os.Exit(exitPartial)
+	}
+}
+
+// decryptTree restores the plaintext of the encrypted local tree src at dst
+// and returns the number of errors encountered. The meta directory, e.g. the
+// lock of the tree, is not encrypted and skipped.
+func decryptTree(keys *cryptKeys, src, dst string) int {
+	// directory metadata is set once their content is complete, deepest
+	// directories first
+	var dirs []string
+	infos := make(map[string]os.FileInfo)
+	numErrors := 0
+	filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Println(err)
+			numErrors++
+			return nil
+		}
+		rel, _ := filepath.Rel(src, p)
+		if rel == metaDir && info.IsDir() {
+			return filepath.SkipDir
+		}
+		out := filepath.Join(dst, decryptPath(keys, rel))
+		if info.IsDir() {
+			dirs = append(dirs, out)
+			infos[out] = info
+		}
+		if err := decryptEntry(keys, p, out, info); err != nil {
+			log.Printf("failed to decrypt %s: %s\n", rel, err)
+			numErrors++
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info := infos[dirs[i]]
+		if err := os.Chmod(dirs[i], info.Mode()); err != nil {
+			log.Println(err)
+			numErrors++
+		}
+		if err := os.Chtimes(dirs[i], info.ModTime(), info.ModTime()); err != nil {
+			log.Println(err)
+			numErrors++
+		}
+	}
+	return numErrors
+}
+
+// decryptPath decrypts the relative path p, keeping elements which are not
+// encrypted such as those of the top level directory
+func decryptPath(k *cryptKeys, p string) string {
+	if k.names == nil {
+		return p
+	}
+	elems := strings.Split(filepath.ToSlash(p), "/")
+	for i, e := range elems {
+		if name, err := k.decryptName(e); err == nil {
+			elems[i] = name
+		}
+	}
+	return filepath.FromSlash(strings.Join(elems, "/"))
+}
+
+// decryptEntry restores the entry at src described by info at dst. The
+// metadata of directories is left to the caller.
+func decryptEntry(k *cryptKeys, src, dst string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		return os.MkdirAll(dst, 0700)
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if k.names != nil {
+			if link, err = k.decryptName(link); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(link, dst)
+	case info.Mode().IsRegular():
+		r, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, newFileMode)
+		if err != nil {
+			return err
+		}
+		if err := k.decryptFile(w, r); err != nil {
+			w.Close()
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
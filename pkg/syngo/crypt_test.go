@@ -0,0 +1,243 @@
+package syngo
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// testKeys returns the keys derived from a key file containing secret
+func testKeys(t *testing.T, secret string, encryptNames bool) *cryptKeys {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(path, []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := loadCryptKeys(path, encryptNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+const (
+	testSecret  = "0123456789abcdef0123456789abcdef"
+	otherSecret = "fedcba9876543210fedcba9876543210"
+)
+
+// nopCloser turns a bytes.Buffer into an io.WriteCloser
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// encrypt returns the encryption of plain by k
+func encrypt(t *testing.T, k *cryptKeys, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := k.encryptWriter(nopCloser{&buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// odd write sizes exercise the buffering of chunks
+	for p := plain; len(p) > 0; {
+		n := 1 + rand.Intn(100000)
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLoadCryptKeysRejectsShortKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(path, []byte(testSecret[:minSecretSize-1]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCryptKeys(path, false); err == nil {
+		t.Fatalf("key of %d bytes accepted", minSecretSize-1)
+	}
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	k := testKeys(t, testSecret, false)
+	for _, size := range []int{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1,
+		3*cryptChunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		enc := encrypt(t, k, plain)
+		if got := plainSize(int64(len(enc))); got != int64(size) {
+			t.Errorf("plain size of %d encrypted bytes is %d, want %d", len(enc), got, size)
+		}
+		var out bytes.Buffer
+		if err := k.decryptFile(&out, bytes.NewReader(enc)); err != nil {
+			t.Fatalf("decrypting %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Errorf("decryption of %d bytes differs", size)
+		}
+	}
+}
+
+func TestCryptDetectsTampering(t *testing.T) {
+	k := testKeys(t, testSecret, false)
+	plain := make([]byte, 2*cryptChunkSize)
+	rand.Read(plain)
+	enc := encrypt(t, k, plain)
+	sealed := cryptChunkSize + cryptTagSize
+	chunk := func(i int) []byte {
+		return enc[cryptHeaderSize+i*sealed : cryptHeaderSize+(i+1)*sealed]
+	}
+
+	flipped := append([]byte(nil), enc...)
+	flipped[cryptHeaderSize+100] ^= 1
+	// the second chunk is the final one
+	reordered := append(append(append([]byte(nil), enc[:cryptHeaderSize]...), chunk(1)...), chunk(0)...)
+	for name, data := range map[string][]byte{
+		"flipped bit":       flipped,
+		"reordered chunks":  reordered,
+		"missing last":      enc[:cryptHeaderSize+sealed],
+		"truncated chunk":   enc[:len(enc)-1],
+		"missing all":       enc[:cryptHeaderSize],
+		"missing header":    enc[cryptHeaderSize:],
+		"appended garbage":  append(append([]byte(nil), enc...), 0),
+		"dropped first one": append(append([]byte(nil), enc[:cryptHeaderSize]...), enc[cryptHeaderSize+sealed:]...),
+	} {
+		if err := k.decryptFile(ioutil.Discard, bytes.NewReader(data)); err != errCryptCorrupt {
+			t.Errorf("%s: got %v, want %v", name, err, errCryptCorrupt)
+		}
+	}
+}
+
+func TestCryptWrongKey(t *testing.T) {
+	enc := encrypt(t, testKeys(t, testSecret, true), []byte("secret data"))
+	other := testKeys(t, otherSecret, true)
+	if err := other.decryptFile(ioutil.Discard, bytes.NewReader(enc)); err != errCryptCorrupt {
+		t.Errorf("decrypting with the wrong key: got %v, want %v", err, errCryptCorrupt)
+	}
+
+	name, err := testKeys(t, testSecret, true).encryptName("name", maxEncryptedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.decryptName(name); err == nil {
+		t.Error("name decrypted with the wrong key")
+	}
+}
+
+func TestCryptNames(t *testing.T) {
+	k := testKeys(t, testSecret, true)
+	longest := strings.Repeat("x", 143)
+	for _, name := range []string{"a", "name.txt", "ÄÖÜ 日本", longest} {
+		enc, err := k.encryptName(name, maxEncryptedName)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(enc) > maxEncryptedName || strings.ContainsAny(enc, `/\`) {
+			t.Errorf("%s: invalid encrypted name %s", name, enc)
+		}
+		// names are encrypted deterministically so they can be looked up
+		if again, _ := k.encryptName(name, maxEncryptedName); again != enc {
+			t.Errorf("%s: encrypted to %s and %s", name, enc, again)
+		}
+		// case insensitive file systems may change the case of names
+		for _, e := range []string{enc, strings.ToUpper(enc)} {
+			if dec, err := k.decryptName(e); err != nil || dec != name {
+				t.Errorf("%s: decrypted %s to %q, %v", name, e, dec, err)
+			}
+		}
+	}
+
+	enc, _ := k.encryptName("name", maxEncryptedName)
+	tampered := []byte(enc)
+	tampered[len(tampered)-1] ^= 'a' ^ 'b'
+	if _, err := k.decryptName(string(tampered)); err == nil {
+		t.Error("tampered name decrypted")
+	}
+
+	if _, err := k.encryptName(longest+"x", maxEncryptedName); !errors.Is(err, syscall.ENAMETOOLONG) {
+		t.Errorf("encrypting a name of %d bytes: got %v, want %v", len(longest)+1, err, syscall.ENAMETOOLONG)
+	}
+}
+
+func TestCryptFSRejectsLongNames(t *testing.T) {
+	tgt := t.TempDir()
+	c := &cryptFS{backend: &localFS{root: tgt}, keys: testKeys(t, testSecret, true)}
+	long := strings.Repeat("x", 144)
+	if _, err := c.Create(long); !errors.Is(err, syscall.ENAMETOOLONG) {
+		t.Errorf("creating %d byte name: got %v, want %v", len(long), err, syscall.ENAMETOOLONG)
+	}
+	if err := c.Symlink(strings.Repeat("x/", 2100), "link"); !errors.Is(err, syscall.ENAMETOOLONG) {
+		t.Errorf("creating link to long target: got %v, want %v", err, syscall.ENAMETOOLONG)
+	}
+	if err := c.Symlink(long+"/"+long, "link"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := c.Lstat("link")
+	if err != nil || fi.linkPath != long+"/"+long {
+		t.Errorf("link target %q, %v", fi.linkPath, err)
+	}
+	if _, err := os.Lstat(filepath.Join(tgt, "link")); !os.IsNotExist(err) {
+		t.Error("link name is not encrypted")
+	}
+}
+
+func TestDecryptLockedTarget(t *testing.T) {
+	for _, names := range []bool{false, true} {
+		src, tgt, dst := t.TempDir(), t.TempDir(), t.TempDir()
+		if err := os.Mkdir(filepath.Join(src, "dir"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := randomData(6, 100000)
+		if err := ioutil.WriteFile(filepath.Join(src, "dir", "file"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		k := testKeys(t, testSecret, names)
+
+		// sync the way the command line does, the lock stays on the target
+		lock, err := lockTarget(tgt, 0, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs, err := sources([]string{src + "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := &options{log: newRunLog(0, ioutil.Discard, nil)}
+		stats := runSync(srcs, &cryptFS{backend: &localFS{root: tgt}, keys: k}, opts)
+		lock.unlock()
+		if stats.numErrors != 0 || stats.numFiles != 1 {
+			t.Fatalf("synced %d files with %d errors", stats.numFiles, stats.numErrors)
+		}
+		if _, err := os.Stat(filepath.Join(tgt, metaDir)); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := decryptTree(k, tgt, dst); n != 0 {
+			t.Errorf("names encrypted %v: %d errors decrypting", names, n)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dst, "dir", "file"))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("names encrypted %v: decrypted %d of %d bytes: %v", names, len(got), len(data), err)
+		}
+		if _, err := os.Lstat(filepath.Join(dst, metaDir)); !os.IsNotExist(err) {
+			t.Errorf("names encrypted %v: meta directory decrypted", names)
+		}
+	}
+}
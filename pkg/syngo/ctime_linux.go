@@ -0,0 +1,23 @@
+//go:build linux
+
+// ctime_linux contains the lookup of inode change times on Linux
+package syngo
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// ctimeSupported reports that -ctime works on this platform
+const ctimeSupported = true
+
+// inodeChangeTime returns the time the inode of the entry described by info
+// last changed and whether it is known
+func inodeChangeTime(info os.FileInfo) (time.Time, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Ctim.Unix()), true
+}
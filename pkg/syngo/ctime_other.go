@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+// ctime_other contains the fallback for platforms without inode change times
+package syngo
+
+import (
+	"os"
+	"time"
+)
+
+// ctimeSupported reports that -ctime does not work on this platform
+const ctimeSupported = false
+
+// inodeChangeTime never knows the inode change time of an entry on this
+// platform
+func inodeChangeTime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
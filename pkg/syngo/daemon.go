@@ -0,0 +1,231 @@
+// daemon contains syngo's daemon mode which serves a directory tree to
+// clients connecting via TCP or unix sockets, as well as the client side for
+// syngo:// targets. Daemon connections speak the same protocol as the ssh
+// helper, preceded by an open request selecting the tree below the daemon
+// root. Daemons started with a secret challenge clients to prove they know it
+// before serving any tree.
+package syngo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultDaemonAddr is the address daemons listen on unless configured
+// otherwise. syngo:// targets without port connect to the same port.
+const defaultDaemonAddr = "localhost:8730"
+
+// daemonSecretEnv names the environment variable holding the secret clients
+// use to authenticate to daemons started with -secret-file
+const daemonSecretEnv = "SYNGO_DAEMON_SECRET"
+
+// daemonCmd implements --serve, serving the subtrees of root to syngo://
+// clients. NOTE: Connections are not encrypted and only authenticated if a
+// secret is configured; expose daemons only on trusted networks or behind an
+// ssh tunnel.
+func daemonCmd(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", defaultDaemonAddr,
+		"address to listen on, either host:port or unix:<socket path>")
+	metricsListen := flags.String("metrics-listen", "", "export Prometheus metrics at /metrics on this address (e.g. :9730)")
+	secretFile := flags.String("secret-file", "",
+		"only serve clients knowing the secret in this file, passed to clients in $"+daemonSecretEnv)
+	flags.Usage = func() {
+		fmt.Println("usage: syngo --serve [options] <root>")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+	}
+
+	root, err := absPath(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		log.Fatalf("daemon root %s is not a directory\n", root)
+	}
+	var secret []byte
+	if *secretFile != "" {
+		if secret, err = readDaemonSecret(*secretFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	network, addr := "tcp", *listen
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+		// remove stale sockets left behind by previous daemons
+		os.Remove(addr)
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving %s on %s\n", root, *listen)
+	if *metricsListen != "" {
+		serveMetrics(*metricsListen)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("failed to accept connection: %s\n", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			start := time.Now()
+			numErrors := int64(1)
+			defer func() {
+				// a misbehaving client must not take down the daemon
+				if r := recover(); r != nil {
+					log.Printf("connection from %s failed: %v\n", conn.RemoteAddr(), r)
+				}
+				procMetrics.recordRun(start, 0, 0, numErrors)
+			}()
+			if err := serveDaemonConn(root, secret, conn); err != nil {
+				log.Printf("connection from %s failed: %s\n", conn.RemoteAddr(), err)
+			} else {
+				numErrors = 0
+			}
+		}()
+	}
+}
+
+// readDaemonSecret reads the secret shared by a daemon and its clients from
+// path, ignoring surrounding white space
+func readDaemonSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// authResponse returns the answer to the daemon challenge nonce proving the
+// knowledge of secret without sending it
+func authResponse(secret, nonce []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(nonce)
+	return m.Sum(nil)
+}
+
+// serveDaemonConn handles a single client connection. The first request has
+// to be an open request naming the tree below root the client wants to sync.
+// If secret is set, the response to it carries a nonce and the client has to
+// answer with an auth request before any other request is served.
+func serveDaemonConn(root string, secret []byte, conn net.Conn) error {
+	c := newServerConn(conn, conn)
+	var req request
+	if err := c.dec.Decode(&req); err != nil {
+		return err
+	}
+
+	var resp response
+	var err error
+	if req.Op != opOpen {
+		err = fmt.Errorf("expected open request, got %s", req.Op)
+	} else {
+		err = checkPath(root, req.Path, true)
+	}
+	if err == nil && secret != nil {
+		resp.Nonce = make([]byte, 32)
+		_, err = rand.Read(resp.Nonce)
+	}
+	if rerr := c.reply(&resp, err); rerr != nil {
+		return rerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if secret != nil {
+		var auth request
+		if err := c.dec.Decode(&auth); err != nil {
+			return err
+		}
+		if auth.Op != opAuth || !hmac.Equal(auth.Data, authResponse(secret, resp.Nonce)) {
+			err = fmt.Errorf("authentication failed")
+		}
+		if rerr := c.reply(&response{}, err); rerr != nil {
+			return rerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.serve(filepath.Join(root, req.Path))
+}
+
+// newDaemonBackend connects to the syngo daemon serving a target of the form
+// syngo://host[:port]/path, or syngo:///path?socket=<unix socket> for daemons
+// listening on a unix socket
+func newDaemonBackend(spec string, opts *options) (backend, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	network, addr := "tcp", u.Host
+	if socket := u.Query().Get("socket"); socket != "" {
+		network, addr = "unix", socket
+	} else if addr == "" {
+		return nil, fmt.Errorf("missing host in %s", spec)
+	} else if _, _, err := net.SplitHostPort(addr); err != nil {
+		_, port, _ := net.SplitHostPort(defaultDaemonAddr)
+		addr = net.JoinHostPort(addr, port)
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newRemoteFS(conn, conn, conn.Close)
+	tree := strings.Trim(u.Path, "/")
+	if tree == "" {
+		tree = "."
+	}
+	if err := openDaemonTree(c, tree, os.Getenv(daemonSecretEnv)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.enableCompression(opts.packing, opts.compress)
+	return c, nil
+}
+
+// openDaemonTree selects the tree served by the daemon connected to c,
+// answering its challenge with secret if it requires one
+func openDaemonTree(c *remoteFS, tree, secret string) error {
+	resp, err := c.call(&request{Op: opOpen, Path: tree})
+	if err != nil {
+		return err
+	}
+	if resp.Nonce == nil {
+		return nil
+	}
+	if secret == "" {
+		return fmt.Errorf("daemon requires a secret, set $%s", daemonSecretEnv)
+	}
+	data := authResponse(bytes.TrimSpace([]byte(secret)), resp.Nonce)
+	_, err = c.call(&request{Op: opAuth, Data: data})
+	return err
+}
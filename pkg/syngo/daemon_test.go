@@ -0,0 +1,228 @@
+package syngo
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dialDaemon connects a client to a daemon serving root over an in-memory
+// connection and opens tree with clientSecret
+func dialDaemon(t *testing.T, root string, secret []byte, tree, clientSecret string) (*remoteFS, error) {
+	client, server := net.Pipe()
+	go func() {
+		serveDaemonConn(root, secret, server)
+		server.Close()
+	}()
+	c := newRemoteFS(client, client, client.Close)
+	if err := openDaemonTree(c, tree, clientSecret); err != nil {
+		c.Close()
+		return nil, err
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, nil
+}
+
+func TestDaemonRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "tree"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c, err := dialDaemon(t, root, nil, "tree", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// larger than a chunk so reads and writes take several requests
+	data := randomData(5, 2*writeChunkSize+10)
+	if err := c.Mkdir("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Create("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := c.Chtimes("dir/file", mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Chmod("dir/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := c.Lstat("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.info.Size() != int64(len(data)) || fi.info.Mode() != 0600 || !fi.info.ModTime().Equal(mtime) {
+		t.Errorf("file has size %d, mode %s and mtime %s", fi.info.Size(), fi.info.Mode(), fi.info.ModTime())
+	}
+	r, err := c.Open("dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d of %d bytes: %v", len(got), len(data), err)
+	}
+	sum, err := c.PrefixSum("dir/file", 100, hashSHA256)
+	if err != nil || !bytes.Equal(sum, hashSHA256.sum(data[:100])) {
+		t.Errorf("prefix checksum %x: %v", sum, err)
+	}
+
+	if err := c.Rename("dir/file", "dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Symlink("moved", "dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := c.List("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := make(map[string]string)
+	for _, fi := range infos {
+		links[fi.info.Name()] = fi.linkPath
+	}
+	if len(links) != 2 || links["link"] != "moved" {
+		t.Errorf("directory lists %v", links)
+	}
+	if err := c.Remove("dir/link"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Lstat("dir/link"); !os.IsNotExist(err) {
+		t.Errorf("removed link: %v", err)
+	}
+
+	got, err = ioutil.ReadFile(filepath.Join(root, "tree", "dir", "moved"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("daemon stored %d of %d bytes: %v", len(got), len(data), err)
+	}
+}
+
+func TestDaemonStaysInTree(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "file")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := dialDaemon(t, root, nil, ".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		op   func() error
+	}{
+		{"lstat parent", func() error { _, err := c.Lstat("../x"); return err }},
+		{"lstat absolute", func() error { _, err := c.Lstat("/etc/passwd"); return err }},
+		{"lstat through link", func() error { _, err := c.Lstat("dir/secret"); return err }},
+		{"list link", func() error { _, err := c.List("dir"); return err }},
+		{"create through link", func() error { _, err := c.Create("dir/x"); return err }},
+		{"append through link", func() error { _, err := c.Append("dir/secret"); return err }},
+		{"append link", func() error { _, err := c.Append("file"); return err }},
+		{"mkdir through link", func() error { return c.Mkdir("dir/sub", 0755) }},
+		{"symlink through link", func() error { return c.Symlink("x", "dir/y") }},
+		{"chmod link", func() error { return c.Chmod("file", 0666) }},
+		{"chtimes link", func() error { return c.Chtimes("file", time.Now()) }},
+		{"sum link", func() error { _, err := c.PrefixSum("file", 6, hashSHA256); return err }},
+		{"read link", func() error {
+			r, err := c.Open("file")
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(ioutil.Discard, r)
+			return err
+		}},
+		// last since they would move the files the others try to reach
+		{"rename into link", func() error { return c.Rename("file", "dir/file") }},
+		{"remove through link", func() error { return c.Remove("dir/secret") }},
+	} {
+		if err := tt.op(); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	infos, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Mode() != 0600 {
+		t.Errorf("daemon changed the directory outside of its tree")
+	}
+	if _, err := dialDaemon(t, root, nil, "dir", ""); err == nil {
+		t.Errorf("opened tree through link")
+	}
+}
+
+func TestDaemonSecret(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		secret       string
+		clientSecret string
+		ok           bool
+	}{
+		{"no secret", "", "", true},
+		{"unused client secret", "", "secret", true},
+		{"matching secret", "secret", "secret\n", true},
+		{"missing client secret", "secret", "", false},
+		{"wrong secret", "secret", "guess", false},
+	} {
+		var secret []byte
+		if tt.secret != "" {
+			secret = []byte(tt.secret)
+		}
+		c, err := dialDaemon(t, t.TempDir(), secret, ".", tt.clientSecret)
+		if err == nil {
+			_, err = c.Lstat(".")
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestDaemonRejectsInvalidReads(t *testing.T) {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := dialDaemon(t, root, nil, ".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		offset, size int64
+	}{
+		{0, -1},
+		{0, 0},
+		{-1, 4},
+		{0, -1 << 62},
+	} {
+		if _, err := c.call(&request{Op: opRead, Path: "file", Offset: tt.offset, Size: tt.size}); err == nil {
+			t.Errorf("read of %d bytes at %d: no error", tt.size, tt.offset)
+		}
+	}
+	// the connection is still served
+	if resp, err := c.call(&request{Op: opRead, Path: "file", Size: 4}); err != nil || string(resp.Data) != "data" {
+		t.Errorf("read after invalid reads: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+// delete contains the removal of target entries which no longer exist in the
+// source trees, either for good or by moving them into the target's trash,
+// and the empty-trash command
+package syngo
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trashDir returns the directory of target tree tgt which entries deleted by
+// sync runs are moved to, one subdirectory per run named by its start time
+func trashDir(tgt string) string {
+	return filepath.Join(tgt, metaDir, "trash")
+}
+
+// deleteExtra removes the entries of local target tree tgtTree which do not
+// exist in any of srcs, backing them up if requested, or moves them into the
+// trash, and returns the number of deleted entries and errors. syngo's
+// metadata directory, the partial and backup dirs, backups and conflict
+// copies kept next to other entries (see keptCopy), files renamed by
+// transforms, and entries excluded by filters are never deleted.
+func deleteExtra(srcs []*source, tgtTree string, opts *options) (int64, int64) {
+	var mu sync.Mutex
+	var extra []string
+	var numErrors int64
+	for _, src := range srcs {
+		root := filepath.Join(tgtTree, src.prefix)
+		if _, err := os.Lstat(root); os.IsNotExist(err) {
+			continue
+		}
+		numErrors += walkTree(root, numWalkers, opts.log, func(relPath string, e os.DirEntry) bool {
+			path := src.tgtPath(relPath)
+			if keepEntry(srcs, src, path, opts) {
+				return false
+			}
+			// excluded entries are protected from deletion
+			if relPath != "." && excluded(filepath.ToSlash(relPath), opts.filters) {
+				return false
+			}
+			// files renamed by transforms and the directories leading to
+			// them may have no counterparts in the sources
+			file, dir := opts.renamed.lookup(path)
+			if file {
+				return false
+			}
+			srcInfo, err := src.lstat(relPath)
+			if os.IsNotExist(err) && dir {
+				return e.IsDir()
+			} else if os.IsNotExist(err) {
+				inSource := func(name string) bool {
+					_, err := src.lstat(filepath.Join(filepath.Dir(relPath), name))
+					return err == nil
+				}
+				if keptCopy(tgtTree, path, inSource, opts) {
+					return false
+				}
+				mu.Lock()
+				extra = append(extra, path)
+				mu.Unlock()
+				return false
+			} else if err != nil {
+				opts.log.logError("delete", path, "stat source of", err)
+				atomic.AddInt64(&numErrors, 1)
+				return false
+			}
+			return srcInfo.IsDir() && e.IsDir()
+		})
+	}
+	sort.Strings(extra)
+	if opts.dryRun {
+		reportDeletions(tgtTree, extra, opts)
+		return int64(len(extra)), numErrors
+	}
+
+	trash := filepath.Join(trashDir(tgtTree), time.Now().Format(snapshotTimeFormat))
+	var numDeleted int64
+	for _, path := range extra {
+		var err error
+		switch {
+		case opts.batch.recordOnly():
+		case opts.trash:
+			dst := filepath.Join(trash, path)
+			if err = os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+				err = os.Rename(filepath.Join(tgtTree, path), dst)
+			}
+		default:
+			err = removeExtra(&localFS{root: tgtTree, fakeSuper: opts.fakeSuper}, path, opts)
+		}
+		if err == nil {
+			err = opts.batch.removed(path)
+		}
+		if err != nil {
+			opts.log.logError("delete", path, "delete", err)
+			numErrors++
+			continue
+		}
+		numDeleted++
+		opts.dirs.touch(path)
+		if opts.itemize {
+			opts.log.printf("*deleting %s\n", path)
+		} else {
+			opts.log.infoEvent(levelFiles, event{Phase: "delete", Path: path, Action: "delete"},
+				"deleting %s\n", path)
+		}
+	}
+	if numDeleted > 0 {
+		// the directories changed by deletions are recorded in batches too
+		var dirTgt backend = &localFS{root: tgtTree, fakeSuper: opts.fakeSuper}
+		if opts.batch != nil {
+			dirTgt = opts.batch
+		}
+		numErrors += opts.dirs.finalize(dirTgt, opts.log)
+	}
+	return numDeleted, numErrors
+}
+
+// removeExtra removes the extraneous entry at path on the local target tgt.
+// With backups, the files and links at or below path are backed up like
+// replaced ones instead. Directories which may hold backups kept next to
+// their entries are emptied one entry at a time, sparing the kept copies,
+// and only removed once they are empty.
+func removeExtra(tgt *localFS, path string, opts *options) error {
+	info, err := os.Lstat(tgt.path(path))
+	if err != nil {
+		return err
+	}
+	switch {
+	case !info.IsDir() && opts.backup:
+		return backupTarget(tgt, path, opts)
+	case !info.IsDir():
+		return tgt.Remove(path)
+	case !opts.backup && !inPlaceBackups(opts):
+		return os.RemoveAll(tgt.path(path))
+	}
+	entries, err := os.ReadDir(tgt.path(path))
+	if err != nil {
+		return err
+	}
+	// kept copies are determined before removing the entries they belong to
+	var remove []string
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name())
+		if !keptCopy(tgt.root, p, func(string) bool { return false }, opts) {
+			remove = append(remove, p)
+		}
+	}
+	for _, p := range remove {
+		if err := removeExtra(tgt, p, opts); err != nil {
+			return err
+		}
+	}
+	if entries, err := os.ReadDir(tgt.path(path)); err == nil && len(entries) > 0 {
+		return nil
+	}
+	return tgt.Remove(path)
+}
+
+// keptCopy determines if the entry at path in target tree tgtTree, which
+// does not exist in the sources, is a copy of another entry kept next to it,
+// i.e. its name is that of the other entry plus a suffix: either the
+// target's version of a source entry kept by -conflict keep-both, or the
+// backup of an entry which still exists in the sources, no longer exists on
+// the target, or is backed up by this run. inSource reports if the sibling of
+// path with the provided name exists in the sources.
+// NOTE: Entries named like this by their owners are kept as well.
+func keptCopy(tgtTree, path string, inSource func(name string) bool, opts *options) bool {
+	name := filepath.Base(path)
+	if orig := strings.TrimSuffix(name, conflictSuffix); orig != name && orig != "" && inSource(orig) {
+		return true
+	}
+	if !inPlaceBackups(opts) {
+		return false
+	}
+	orig := strings.TrimSuffix(name, opts.backupSuffix)
+	if orig == name || orig == "" {
+		return false
+	}
+	if opts.backup || inSource(orig) {
+		return true
+	}
+	_, err := os.Lstat(filepath.Join(tgtTree, filepath.Dir(path), orig))
+	return os.IsNotExist(err)
+}
+
+// reportDeletions prints the entries at paths in tgtTree which a run would
+// delete, grouped by their directory and with the space they take up
+func reportDeletions(tgtTree string, paths []string, opts *options) {
+	type group struct {
+		paths []string
+		size  int64
+	}
+	groups := make(map[string]*group)
+	var dirs []string
+	var total int64
+	for _, path := range paths {
+		size := treeSize(filepath.Join(tgtTree, path))
+		dir := filepath.Dir(path)
+		g, ok := groups[dir]
+		if !ok {
+			g = &group{}
+			groups[dir] = g
+			dirs = append(dirs, dir)
+		}
+		g.paths = append(g.paths, path)
+		g.size += size
+		total += size
+	}
+	sort.Strings(dirs)
+
+	action := "delete"
+	if opts.trash {
+		action = "move into the trash"
+	}
+	opts.log.printf("would %s %d entries, reclaiming %.5g MB:\n", action, len(paths),
+		float64(total)/1024/1024)
+	for _, dir := range dirs {
+		g := groups[dir]
+		opts.log.printf("%s/ (%d entries, %.5g MB)\n", dir, len(g.paths), float64(g.size)/1024/1024)
+		for _, path := range g.paths {
+			name := filepath.Base(path)
+			if info, err := os.Lstat(filepath.Join(tgtTree, path)); err == nil && info.IsDir() {
+				name += "/"
+			}
+			opts.log.printf("    %s\n", name)
+		}
+	}
+}
+
+// treeSize returns the total size of the regular files at or below path
+func treeSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// keepEntry determines if the entry at path in the target tree is exempt from
+// deletion while checking it against src, i.e. it is part of syngo's
+// bookkeeping or belongs to another of srcs
+func keepEntry(srcs []*source, src *source, path string, opts *options) bool {
+	if path == "." {
+		return false
+	}
+	for _, dir := range []string{metaDir, opts.partialDir, opts.backupDir} {
+		if dir != "" && withinDir(path, dir) {
+			return true
+		}
+	}
+	if src.prefix != "." {
+		return false
+	}
+	for _, s := range srcs {
+		if s.prefix == path {
+			return true
+		}
+	}
+	return false
+}
+
+// emptyTrash implements the empty-trash command which permanently removes
+// the entries deleted by sync runs into the trash of a target tree
+func emptyTrash(args []string) {
+	flags := flag.NewFlagSet("empty-trash", flag.ExitOnError)
+	olderThan := flags.String("older-than", "", "only remove entries deleted longer ago than the given age (e.g. 36h, 30d, 2w)")
+	dryRun := flags.Bool("dry-run", false, "only report which runs' deletions would be removed")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo empty-trash [options] <target tree>")
+		fmt.Println("\noptions:")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+	}
+
+	tgtTree, err := absPath(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var cutoff time.Time
+	if *olderThan != "" {
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cutoff = time.Now().Add(-age)
+	}
+
+	entries, err := ioutil.ReadDir(trashDir(tgtTree))
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	failed := false
+	for _, e := range entries {
+		t, err := time.ParseInLocation(snapshotTimeFormat, e.Name(), time.Local)
+		if err != nil || (!cutoff.IsZero() && !t.Before(cutoff)) {
+			continue
+		}
+		fmt.Printf("removing entries deleted at %s\n", t.Format("2006-01-02 15:04:05"))
+		if *dryRun {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(trashDir(tgtTree), e.Name())); err != nil {
+			log.Printf("failed to empty trash %s: %s\n", e.Name(), err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(exitPartial)
+	}
+}
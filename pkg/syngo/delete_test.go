@@ -0,0 +1,109 @@
+package syngo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+// treePaths returns the paths of all entries below root except those in
+// syngo's metadata directory
+func treePaths(t *testing.T, root string) []string {
+	var paths []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		if rel == metaDir {
+			return filepath.SkipDir
+		}
+		if rel != "." {
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestDeleteExtra(t *testing.T) {
+	synced := []string{"dir", "dir/keep", "keep", "keep" + conflictSuffix}
+	extra := []string{"dir/extra", "extra", "gone", "gone/file"}
+	for _, tt := range []struct {
+		name      string
+		opts      options
+		deleted   int64
+		remaining []string
+		trashed   []string
+	}{
+		{"delete", options{}, 3, synced, nil},
+		{"trash", options{trash: true}, 3, synced, append([]string{"dir"}, extra...)},
+		{"dry run", options{dryRun: true}, 3, append(append([]string{}, synced...), extra...), nil},
+		{"excluded", options{filters: []filterRule{{re: regexp.MustCompile("^gone$")}}}, 2,
+			append(append([]string{}, synced...), "gone", "gone/file"), nil},
+	} {
+		src, tgt := t.TempDir(), t.TempDir()
+		for _, root := range []string{src, tgt} {
+			if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{"keep", "dir/keep"} {
+				if err := ioutil.WriteFile(filepath.Join(root, p), []byte(p), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := os.MkdirAll(filepath.Join(tgt, "gone"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{"keep" + conflictSuffix, "dir/extra", "extra", "gone/file", metaDir + "/state"} {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(tgt, p)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(tgt, p), []byte(p), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		srcs, err := sources([]string{src + "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := tt.opts
+		opts.log = newRunLog(0, ioutil.Discard, nil)
+		opts.dirs = newDirTracker()
+		deleted, numErrors := deleteExtra(srcs, tgt, &opts)
+		if deleted != tt.deleted || numErrors != 0 {
+			t.Errorf("%s: deleted %d entries with %d errors", tt.name, deleted, numErrors)
+		}
+		sort.Strings(tt.remaining)
+		if got := treePaths(t, tgt); !reflect.DeepEqual(got, tt.remaining) {
+			t.Errorf("%s: target holds %v", tt.name, got)
+		}
+		if _, err := os.Stat(filepath.Join(tgt, metaDir, "state")); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		runs, _ := ioutil.ReadDir(trashDir(tgt))
+		if len(tt.trashed) == 0 {
+			if len(runs) != 0 {
+				t.Errorf("%s: %d runs in the trash", tt.name, len(runs))
+			}
+			continue
+		}
+		if len(runs) != 1 {
+			t.Fatalf("%s: %d runs in the trash", tt.name, len(runs))
+		}
+		if got := treePaths(t, filepath.Join(trashDir(tgt), runs[0].Name())); !reflect.DeepEqual(got, tt.trashed) {
+			t.Errorf("%s: trash holds %v", tt.name, got)
+		}
+	}
+}
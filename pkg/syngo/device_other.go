@@ -0,0 +1,23 @@
+//go:build !unix
+
+// device_other contains the fallback for platforms without device IDs
+package syngo
+
+import "os"
+
+// deviceID never knows the device of an entry on this platform so file
+// system boundaries are not detected
+func deviceID(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// inodeNumber never knows the inode number of an entry on this platform
+func inodeNumber(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// linkCount never knows the number of hard links to an entry on this
+// platform
+func linkCount(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
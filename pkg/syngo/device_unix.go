@@ -0,0 +1,40 @@
+//go:build unix
+
+// device_unix contains the lookup of the device of file system entries on
+// unix platforms
+package syngo
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceID returns the ID of the device containing the entry described by
+// info and whether it is known
+func deviceID(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Dev), true
+}
+
+// inodeNumber returns the inode number of the entry described by info and
+// whether it is known
+func inodeNumber(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
+
+// linkCount returns the number of hard links to the entry described by info
+// and whether it is known
+func linkCount(info os.FileInfo) (uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Nlink), true
+}
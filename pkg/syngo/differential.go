@@ -0,0 +1,130 @@
+// differential writes differential backups, i.e. dated trees or archives
+// holding only the files changed since the last full backup together with a
+// manifest of the complete source state
+package syngo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// differentialTarget prepares a differential backup run below the local
+// directory tgtTree and returns the target of the run, a new directory or
+// archive named after the current time. The source is checked against the
+// state recorded at opts.differential; if there is none yet, the run is a
+// full backup recording it.
+func differentialTarget(tgtTree string, opts *options) (string, error) {
+	base, err := readManifest(opts.differential)
+	if os.IsNotExist(err) {
+		opts.tgtManifest = nil
+	} else if err != nil {
+		return "", err
+	} else {
+		opts.tgtManifest = base
+	}
+
+	if err := os.MkdirAll(tgtTree, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Join(tgtTree, time.Now().Format(snapshotTimeFormat))
+	if opts.differentialTar {
+		name += differentialArchiveExt(opts)
+	}
+	if _, err := os.Lstat(name); err == nil {
+		return "", fmt.Errorf("backup %s already exists", name)
+	}
+	if opts.differentialTar {
+		return archivePrefix + name, nil
+	}
+	return name, nil
+}
+
+// differentialArchiveExt returns the extension of differential backups
+// written as archives, which are gzip compressed unless chosen otherwise
+func differentialArchiveExt(opts *options) string {
+	switch opts.archiveCompress {
+	case archiveZstd:
+		return ".tar.zst"
+	case archiveNone:
+		return ".tar"
+	}
+	return ".tar.gz"
+}
+
+// writeDifferentialManifest records the state of srcs next to the backup
+// written to tgtTree by the run, and as the state later differential backups
+// are based on if full is set
+func writeDifferentialManifest(srcs []*source, tgtTree string, full bool, opts *options) error {
+	entries, numErrors := sourceManifest(srcs, opts)
+	if numErrors > 0 {
+		return fmt.Errorf("failed to record %d entries of the sources", numErrors)
+	}
+	paths := []string{strings.TrimSuffix(strings.TrimPrefix(tgtTree, archivePrefix),
+		differentialArchiveExt(opts)) + ".manifest"}
+	if full {
+		paths = append(paths, opts.differential)
+	}
+	for _, p := range paths {
+		f, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		err = writeManifest(f, entries)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write manifest %s: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// sourceManifest returns the manifest entries of the entries of srcs which
+// are synced, by their path in the target, together with the number of
+// entries which could not be recorded
+func sourceManifest(srcs []*source, opts *options) ([]manifestEntry, int64) {
+	var mu sync.Mutex
+	var entries []manifestEntry
+	var numErrors int64
+	for _, src := range srcs {
+		numErrors += src.scan(opts, true, func(relPath string, d os.DirEntry) bool {
+			if relPath == "." && src.prefix == "." {
+				return true
+			}
+			if relPath != "." && skipPath(relPath, isDir(d), opts) {
+				return false
+			}
+			info, err := d.Info()
+			if err != nil {
+				opts.log.logError("manifest", src.tgtPath(relPath), "stat", err)
+				mu.Lock()
+				numErrors++
+				mu.Unlock()
+				return false
+			}
+			e := manifestEntry{Path: filepath.ToSlash(src.tgtPath(relPath)), Size: info.Size(),
+				Mode: info.Mode(), Mtime: info.ModTime()}
+			if info.Mode()&os.ModeSymlink != 0 {
+				if e.Link, err = src.readlink(relPath); err != nil {
+					opts.log.logError("manifest", e.Path, "read symbolic link", err)
+					mu.Lock()
+					numErrors++
+					mu.Unlock()
+					return false
+				}
+			}
+			mu.Lock()
+			entries = append(entries, e)
+			mu.Unlock()
+			return isDir(d)
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, numErrors
+}
@@ -0,0 +1,75 @@
+// dirmeta contains the finalization of directory metadata. Directories are
+// created writable for their owner so their content can be synced, and their
+// modification times change whenever entries are added or removed, so their
+// modes and times are only set once their content is complete.
+package syngo
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// dirTracker records the source directories of a sync run and which of their
+// target counterparts need their metadata set
+type dirTracker struct {
+	mu    sync.Mutex
+	dirs  map[string]fileInfo // source directories by target path
+	dirty map[string]bool     // directories whose metadata needs to be set
+}
+
+func newDirTracker() *dirTracker {
+	return &dirTracker{dirs: make(map[string]fileInfo), dirty: make(map[string]bool)}
+}
+
+// add records the source directory dir, marking it dirty if its target
+// counterpart was created or its metadata differs
+func (d *dirTracker) add(dir fileInfo, dirty bool) {
+	d.mu.Lock()
+	d.dirs[dir.path] = dir
+	if dirty {
+		d.dirty[dir.path] = true
+	}
+	d.mu.Unlock()
+}
+
+// touch marks the directory containing path dirty after an entry was
+// created, replaced, or removed in it
+func (d *dirTracker) touch(path string) {
+	d.mu.Lock()
+	d.dirty[filepath.Dir(path)] = true
+	d.mu.Unlock()
+}
+
+// finalize sets the mode and modification time of all dirty directories on
+// tgt to those of their sources, logging failures to logs, and returns their
+// number.
+// Directories which are not part of the synced source trees are left alone.
+// Children are finalized before their parents so that parents without write
+// or search permission do not lock us out of them.
+func (d *dirTracker) finalize(tgt backend, logs *runLog) int64 {
+	d.mu.Lock()
+	var paths []string
+	for p := range d.dirty {
+		if _, ok := d.dirs[p]; ok {
+			paths = append(paths, p)
+		}
+	}
+	d.dirty = make(map[string]bool)
+	d.mu.Unlock()
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	var numErrors int64
+	for _, p := range paths {
+		dir := d.dirs[p]
+		if err := tgt.Chmod(p, dir.info.Mode()); err != nil {
+			logs.logError("dirs", p, "change mode of", err)
+			numErrors++
+		}
+		if err := tgt.Chtimes(p, dir.info.ModTime()); err != nil {
+			logs.logError("dirs", p, "change modification time of", err)
+			numErrors++
+		}
+	}
+	return numErrors
+}
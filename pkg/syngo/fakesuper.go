@@ -0,0 +1,120 @@
+// fakesuper contains syngo's fake-super mode which lets unprivileged syncs
+// to local targets record the ownership, device numbers, and special mode
+// bits of entries in an extended attribute instead of applying them. The
+// attribute uses rsync's format so trees can be restored by a privileged
+// rsync run reading them with --fake-super.
+// XXX: syngo itself does not read the attribute of source entries yet, nor
+// can it create device files on privileged targets.
+package syngo
+
+import (
+	"fmt"
+	"os"
+)
+
+// fakeSuperAttr is the extended attribute holding the recorded state
+const fakeSuperAttr = "user.rsync.%stat"
+
+// fakeStat is the state of an entry recorded in fake-super mode
+type fakeStat struct {
+	mode         uint32 // unix st_mode including the file type
+	major, minor uint32 // device numbers of device files
+	uid, gid     int
+}
+
+func (st fakeStat) String() string {
+	return fmt.Sprintf("%o %d,%d %d:%d", st.mode, st.major, st.minor, st.uid, st.gid)
+}
+
+// readFakeStat returns the state recorded for the entry at p and whether
+// there is one
+func readFakeStat(p string) (fakeStat, bool, error) {
+	var st fakeStat
+	value, ok, err := getFakeSuperAttr(p)
+	if err != nil || !ok {
+		return st, false, err
+	}
+	if _, err := fmt.Sscanf(string(value), "%o %d,%d %d:%d", &st.mode, &st.major, &st.minor,
+		&st.uid, &st.gid); err != nil {
+		return st, false, fmt.Errorf("invalid %s attribute: %s", fakeSuperAttr, err)
+	}
+	return st, true, nil
+}
+
+// recordFakeStat applies update to the state recorded for the entry at p.
+// Entries without recorded state start out with their actual one.
+func recordFakeStat(p string, update func(st *fakeStat)) error {
+	st, ok, err := readFakeStat(p)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		st.mode = unixModeFromFile(info.Mode())
+		st.uid, st.gid, _ = ownerIDs(info)
+	}
+	update(&st)
+	return setFakeSuperAttr(p, []byte(st.String()))
+}
+
+// fakePerm returns the permissions actually applied for mode in fake-super
+// mode. Special bits are only recorded and the owner keeps access so the
+// recorded state can be updated and restored.
+func fakePerm(mode os.FileMode) os.FileMode {
+	if mode.IsDir() {
+		return mode.Perm() | 0700
+	}
+	return mode.Perm() | 0600
+}
+
+// chmodFake records mode for path and applies its permissions as far as
+// fake-super mode allows
+func (l *localFS) chmodFake(path string, mode os.FileMode) error {
+	p := l.path(path)
+	if err := recordFakeStat(p, func(st *fakeStat) {
+		st.mode = unixModeFromFile(mode)
+	}); err != nil {
+		return err
+	}
+	return os.Chmod(p, fakePerm(mode))
+}
+
+// lchownFake records the ownership of path. NOTE: Extended attributes in the
+// user namespace can not be set on symbolic links, so the ownership of links
+// is not recorded.
+func (l *localFS) lchownFake(path string, uid, gid int) error {
+	p := l.path(path)
+	info, err := os.Lstat(p)
+	if err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return recordFakeStat(p, func(st *fakeStat) {
+		if uid >= 0 {
+			st.uid = uid
+		}
+		if gid >= 0 {
+			st.gid = gid
+		}
+	})
+}
+
+// createFakeSpecial creates an empty file standing in for the device, named
+// pipe, or socket path of the given mode and device numbers
+func (l *localFS) createFakeSpecial(path string, mode os.FileMode, major, minor uint32) error {
+	p := l.path(path)
+	os.Remove(p)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, newFileMode)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return recordFakeStat(p, func(st *fakeStat) {
+		st.mode = unixModeFromFile(mode)
+		st.major, st.minor = major, minor
+	})
+}
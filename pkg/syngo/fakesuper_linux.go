@@ -0,0 +1,52 @@
+//go:build linux
+
+// fakesuper_linux contains the extended attribute access of fake-super mode
+// on linux
+package syngo
+
+import (
+	"os"
+	"syscall"
+)
+
+// fakeSuperSupported reports that -fake-super works on this platform
+const fakeSuperSupported = true
+
+// getFakeSuperAttr returns the value of the fake-super attribute of p and
+// whether it is set
+func getFakeSuperAttr(p string) ([]byte, bool, error) {
+	buf := make([]byte, 64)
+	for {
+		n, err := syscall.Getxattr(p, fakeSuperAttr, buf)
+		if err == syscall.ERANGE {
+			buf = make([]byte, 2*len(buf))
+			continue
+		} else if err == syscall.ENODATA {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, &os.PathError{Op: "getxattr", Path: p, Err: err}
+		}
+		return buf[:n], true, nil
+	}
+}
+
+// setFakeSuperAttr sets the fake-super attribute of p to value
+func setFakeSuperAttr(p string, value []byte) error {
+	if err := syscall.Setxattr(p, fakeSuperAttr, value, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: p, Err: err}
+	}
+	return nil
+}
+
+// deviceNumbers returns the major and minor device numbers of the device
+// file described by info
+func deviceNumbers(info os.FileInfo) (uint32, uint32) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	dev := uint64(st.Rdev)
+	major := uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+	minor := uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+	return major, minor
+}
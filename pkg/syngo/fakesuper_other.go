@@ -0,0 +1,27 @@
+//go:build !linux
+
+// fakesuper_other contains the fallback for platforms without fake-super
+// mode
+package syngo
+
+import (
+	"errors"
+	"os"
+)
+
+// fakeSuperSupported reports that -fake-super does not work on this platform
+const fakeSuperSupported = false
+
+var errNoFakeSuper = errors.New("fake-super mode is not supported on this platform")
+
+func getFakeSuperAttr(p string) ([]byte, bool, error) {
+	return nil, false, errNoFakeSuper
+}
+
+func setFakeSuperAttr(p string, value []byte) error {
+	return errNoFakeSuper
+}
+
+func deviceNumbers(info os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
@@ -0,0 +1,50 @@
+// filter contains the regular expression based filter rules selecting the
+// source entries to sync
+package syngo
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// filterRule includes or excludes the entries whose path relative to the
+// source root matches re
+type filterRule struct {
+	include bool
+	re      *regexp.Regexp
+}
+
+// filterFlag is a flag.Value adding a rule for each occurrence of
+// -include-regexp or -exclude-regexp. Both flags share the same list of rules
+// so their order on the command line is retained.
+type filterFlag struct {
+	rules   *[]filterRule
+	include bool
+}
+
+func (f filterFlag) String() string {
+	return ""
+}
+
+// Set compiles the regular expression s once so walkers only need to match
+func (f filterFlag) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return fmt.Errorf("invalid filter %s: %s", s, err)
+	}
+	*f.rules = append(*f.rules, filterRule{include: f.include, re: re})
+	return nil
+}
+
+// excluded determines if the entry at relPath (relative to the source root,
+// with forward slashes on all platforms) is excluded by rules. The first matching rule decides; entries matching no
+// rule are included. Excluded directories are skipped including their
+// content.
+func excluded(relPath string, rules []filterRule) bool {
+	for _, r := range rules {
+		if r.re.MatchString(relPath) {
+			return !r.include
+		}
+	}
+	return false
+}
@@ -0,0 +1,728 @@
+// ftp contains a backend for syncing to FTP servers, e.g. of legacy web
+// hosting, with optional explicit TLS (FTPS). Directory listings use MLSD if
+// the server supports it and modification times are preserved via MFMT.
+// XXX: Active mode and implicit FTPS (port 990) are not supported.
+package syngo
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ftpMaxConns is the maximum number of connections to an FTP server. Every
+// transfer needs a control connection of its own and servers often limit
+// the number of connections per client.
+const ftpMaxConns = 4
+
+// ftpDialTimeout limits how long connecting to an FTP server may take
+const ftpDialTimeout = 30 * time.Second
+
+// ftpTimeFormat is the format of modification times in MLSD, MDTM, and MFMT
+const ftpTimeFormat = "20060102150405"
+
+// ftpFS is a backend storing the target tree on an FTP server. Lookups are
+// answered from per directory listings like for WebDAV.
+type ftpFS struct {
+	addr      string      // host:port of the server
+	tlsConfig *tls.Config // nil for plain FTP
+	user      string
+	password  string
+	root      string
+
+	idle  chan *ftpConn     // connections not in use
+	slots chan struct{}     // one per open connection
+	feat  map[string]string // features announced by the server with their parameters
+
+	noChmod int32 // set once the server rejected SITE CHMOD
+
+	mu      sync.Mutex
+	dirs    map[string]map[string]fileInfo // listings of directories
+	changed map[string]bool                // paths modified since listing
+}
+
+// ftpConn is a control connection to an FTP server
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// newFTPBackend returns a backend for a target of the form
+// ftp[s]://[user[:password]@]host[:port]/path. Like curl, the path is
+// relative to the login directory unless it starts with a double slash. If
+// no password is part of the URL it is taken from SYNGO_FTP_PASSWORD.
+func newFTPBackend(spec string, opts *options) (backend, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	f := &ftpFS{
+		addr:     u.Host,
+		user:     "anonymous",
+		password: "anonymous@",
+		root:     strings.TrimPrefix(u.Path, "/"),
+		idle:     make(chan *ftpConn, ftpMaxConns),
+		slots:    make(chan struct{}, ftpMaxConns),
+		dirs:     make(map[string]map[string]fileInfo),
+		changed:  make(map[string]bool),
+	}
+	if u.Port() == "" {
+		f.addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	if u.User != nil {
+		f.user = u.User.Username()
+		f.password, _ = u.User.Password()
+		if f.password == "" {
+			f.password = os.Getenv("SYNGO_FTP_PASSWORD")
+		}
+	}
+	if u.Scheme == "ftps" {
+		f.tlsConfig = &tls.Config{ServerName: u.Hostname(),
+			ClientSessionCache: tls.NewLRUClientSessionCache(ftpMaxConns)}
+	}
+	if f.root == "" {
+		f.root = "."
+	}
+
+	// the first connection determines the features of the server
+	c, err := f.get()
+	if err != nil {
+		return nil, err
+	}
+	f.put(c, nil)
+	if !f.supports("MFMT") {
+		log.Printf("%s does not support MFMT, modification times are not preserved (consider -size-only)\n",
+			u.Hostname())
+	}
+	return f, nil
+}
+
+// dial opens and logs in a new control connection
+func (f *ftpFS) dial() (*ftpConn, error) {
+	conn, err := net.DialTimeout("tcp", f.addr, ftpDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	if err := c.login(f); err != nil {
+		c.text.Close()
+		return nil, fmt.Errorf("failed to log in to %s: %s", f.addr, err)
+	}
+	return c, nil
+}
+
+// login authenticates c, enabling TLS first for FTPS, and determines the
+// features of the server if not done yet
+func (c *ftpConn) login(f *ftpFS) error {
+	if _, _, err := c.text.ReadResponse(2); err != nil {
+		return err
+	}
+	if f.tlsConfig != nil {
+		if _, _, err := c.cmd(2, "AUTH TLS"); err != nil {
+			return err
+		}
+		c.conn = tls.Client(c.conn, f.tlsConfig)
+		c.text = textproto.NewConn(c.conn)
+	}
+	code, _, err := c.cmd(0, "USER %s", f.user)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, _, err := c.cmd(2, "PASS %s", f.password); err != nil {
+			return err
+		}
+	} else if code/100 != 2 {
+		return fmt.Errorf("unexpected reply %d to USER", code)
+	}
+	if f.tlsConfig != nil {
+		if _, _, err := c.cmd(2, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, _, err := c.cmd(2, "PROT P"); err != nil {
+			return err
+		}
+	}
+	if _, _, err := c.cmd(2, "TYPE I"); err != nil {
+		return err
+	}
+
+	if f.feat == nil {
+		f.feat = make(map[string]string)
+		if _, msg, err := c.cmd(2, "FEAT"); err == nil {
+			// the first and last lines are the text of the reply itself
+			for _, line := range strings.Split(msg, "\n") {
+				if fields := strings.SplitN(strings.TrimSpace(line), " ", 2); strings.HasPrefix(line, " ") {
+					f.feat[strings.ToUpper(fields[0])] = strings.Join(fields[1:], " ")
+				}
+			}
+		}
+	}
+	if f.supports("UTF8") {
+		c.cmd(2, "OPTS UTF8 ON")
+	}
+	return nil
+}
+
+// supports determines if the server announced feature name
+func (f *ftpFS) supports(name string) bool {
+	_, ok := f.feat[name]
+	return ok
+}
+
+// cmd sends a command and reads the reply, which has to start with the
+// digit expect unless it is 0
+func (c *ftpConn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	for _, a := range args {
+		if s, ok := a.(string); ok && strings.ContainsAny(s, "\r\n") {
+			return 0, "", fmt.Errorf("FTP commands can not contain line breaks: %q", s)
+		}
+	}
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.text.ReadResponse(expect)
+}
+
+// get returns an idle connection or opens a new one unless all are in use
+func (f *ftpFS) get() (*ftpConn, error) {
+	select {
+	case c := <-f.idle:
+		return c, nil
+	default:
+	}
+	select {
+	case c := <-f.idle:
+		return c, nil
+	case f.slots <- struct{}{}:
+		c, err := f.dial()
+		if err != nil {
+			<-f.slots
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+// put returns c to the idle connections unless err shows that it broke.
+// Errors replied by the server leave the connection usable.
+func (f *ftpFS) put(c *ftpConn, err error) {
+	if _, ok := err.(*textproto.Error); err != nil && !ok {
+		c.text.Close()
+		<-f.slots
+		return
+	}
+	f.idle <- c
+}
+
+// do runs fn on a connection
+func (f *ftpFS) do(fn func(c *ftpConn) error) error {
+	c, err := f.get()
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	f.put(c, err)
+	return err
+}
+
+// ftpError turns the reply err of the server to op on p into a path error,
+// which satisfies os.IsNotExist for unavailable files if notExist is set
+func ftpError(err error, op, p string, notExist bool) error {
+	te, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+	if notExist && (te.Code == 550 || te.Code == 450) {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	return &os.PathError{Op: op, Path: p, Err: fmt.Errorf("%d %s", te.Code, te.Msg)}
+}
+
+// dataConn opens a passive mode data connection, preferring EPSV. The
+// address announced by PASV is ignored in favor of the one of the server
+// since it is often wrong behind NAT.
+func (c *ftpConn) dataConn(f *ftpFS) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	var port int
+	if _, msg, err := c.cmd(2, "EPSV"); err == nil {
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid EPSV reply %s", msg)
+		}
+		if port, err = strconv.Atoi(msg[start+4 : end]); err != nil {
+			return nil, fmt.Errorf("invalid EPSV reply %s", msg)
+		}
+	} else if _, ok := err.(*textproto.Error); !ok {
+		return nil, err
+	} else {
+		_, msg, err := c.cmd(2, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("invalid PASV reply %s", msg)
+		}
+		fields := strings.Split(msg[start+1:end], ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("invalid PASV reply %s", msg)
+		}
+		p1, err1 := strconv.Atoi(fields[4])
+		p2, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid PASV reply %s", msg)
+		}
+		port = p1*256 + p2
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), ftpDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if f.tlsConfig != nil {
+		conn = tls.Client(conn, f.tlsConfig)
+	}
+	return conn, nil
+}
+
+// transfer opens a data connection and starts the transfer command on it.
+// The caller has to close the data connection and read the final reply.
+func (c *ftpConn) transfer(f *ftpFS, format string, args ...interface{}) (net.Conn, error) {
+	data, err := c.dataConn(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		data.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// readAll runs a transfer command and returns all data received
+func (f *ftpFS) readAll(format string, args ...interface{}) ([]byte, error) {
+	var buf []byte
+	err := f.do(func(c *ftpConn) error {
+		data, err := c.transfer(f, format, args...)
+		if err != nil {
+			return err
+		}
+		buf, err = ioutil.ReadAll(data)
+		data.Close()
+		if _, _, rerr := c.text.ReadResponse(2); err == nil {
+			err = rerr
+		}
+		return err
+	})
+	return buf, err
+}
+
+func (f *ftpFS) path(p string) string {
+	return path.Join(f.root, filepath.ToSlash(p))
+}
+
+// parseFacts parses an MLSD or MLST entry into the name and information of
+// the entry; ok is false for the entries of the directory itself and its
+// parent
+func parseFacts(line string) (string, fileInfo, bool) {
+	i := strings.Index(line, " ")
+	if i < 0 {
+		return "", fileInfo{}, false
+	}
+	name := line[i+1:]
+	info := &statInfo{FName: path.Base(name)}
+	var linkPath string
+	var typ, perm os.FileMode = 0, 0644
+	permKnown := false
+	for _, fact := range strings.Split(line[:i], ";") {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, val := strings.ToLower(kv[0]), kv[1]
+		switch key {
+		case "type":
+			switch t := strings.ToLower(val); {
+			case t == "cdir" || t == "pdir":
+				return "", fileInfo{}, false
+			case t == "dir":
+				typ = os.ModeDir
+			case strings.HasPrefix(t, "os.unix=slink"), strings.HasPrefix(t, "os.unix=symlink"):
+				typ = os.ModeSymlink
+				if j := strings.Index(val, ":"); j >= 0 {
+					linkPath = val[j+1:]
+				}
+			}
+		case "size":
+			info.FSize, _ = strconv.ParseInt(val, 10, 64)
+		case "modify":
+			info.FModTime = parseFTPTime(val)
+		case "unix.mode":
+			if v, err := strconv.ParseUint(val, 8, 32); err == nil {
+				perm, permKnown = fileModeFromUnix(uint32(v))&^os.ModeType, true
+			}
+		}
+	}
+	switch {
+	case typ == os.ModeSymlink:
+		perm = 0777
+	case typ == os.ModeDir && !permKnown:
+		perm = 0755
+	}
+	info.FMode = typ | perm
+	return name, fileInfo{info: info, linkPath: linkPath}, true
+}
+
+// parseFTPTime parses a time in the UTC based format of MLSD and MDTM with
+// optional fractional seconds
+func parseFTPTime(s string) time.Time {
+	frac := ""
+	if i := strings.Index(s, "."); i >= 0 {
+		s, frac = s[:i], s[i:]
+	}
+	t, err := time.Parse(ftpTimeFormat, s)
+	if err != nil {
+		return time.Time{}
+	}
+	if d, err := time.ParseDuration("0" + frac + "s"); err == nil && frac != "" {
+		t = t.Add(d)
+	}
+	return t
+}
+
+// list returns the information about the entries of directory p keyed by
+// their paths relative to the tree root
+func (f *ftpFS) list(p string) (map[string]fileInfo, error) {
+	infos := make(map[string]fileInfo)
+	if !f.supports("MLST") {
+		// without MLSD, only the names are listed and looked up one by one
+		data, err := f.readAll("NLST %s", f.path(p))
+		if err != nil {
+			return nil, ftpError(err, "list", p, true)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			name := path.Base(strings.TrimRight(line, "\r"))
+			if name == "" || name == "." || name == ".." {
+				continue
+			}
+			q := filepath.Join(p, name)
+			fi, err := f.stat(q)
+			if err != nil {
+				return nil, err
+			}
+			infos[q] = fi
+		}
+		return infos, nil
+	}
+
+	data, err := f.readAll("MLSD %s", f.path(p))
+	if err != nil {
+		return nil, ftpError(err, "list", p, true)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, fi, ok := parseFacts(strings.TrimRight(line, "\r"))
+		if !ok {
+			continue
+		}
+		fi.path = filepath.Join(p, path.Base(name))
+		infos[fi.path] = fi
+	}
+	return infos, nil
+}
+
+// stat looks up p on the server, via MLST if supported or else via SIZE
+// and MDTM for files and CWD for directories
+func (f *ftpFS) stat(p string) (fileInfo, error) {
+	var fi fileInfo
+	err := f.do(func(c *ftpConn) error {
+		if f.supports("MLST") {
+			_, msg, err := c.cmd(2, "MLST %s", f.path(p))
+			if err != nil {
+				return err
+			}
+			for _, line := range strings.Split(msg, "\n") {
+				if strings.HasPrefix(line, " ") {
+					if _, info, ok := parseFacts(strings.TrimSpace(line)); ok {
+						fi = info
+						return nil
+					}
+					// the root may be reported as cdir
+					fi = fileInfo{info: &statInfo{FName: path.Base(p), FMode: os.ModeDir | 0755}}
+					return nil
+				}
+			}
+			return fmt.Errorf("invalid MLST reply for %s", p)
+		}
+
+		if _, msg, err := c.cmd(2, "SIZE %s", f.path(p)); err == nil {
+			info := &statInfo{FName: path.Base(p), FMode: 0644}
+			info.FSize, _ = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+			if _, msg, err := c.cmd(2, "MDTM %s", f.path(p)); err == nil {
+				info.FModTime = parseFTPTime(strings.TrimSpace(msg))
+			}
+			fi = fileInfo{info: info}
+			return nil
+		} else if _, ok := err.(*textproto.Error); !ok {
+			return err
+		}
+		_, home, err := c.cmd(2, "PWD")
+		if err != nil {
+			return err
+		}
+		if _, _, err := c.cmd(2, "CWD %s", f.path(p)); err != nil {
+			return err
+		}
+		fi = fileInfo{info: &statInfo{FName: path.Base(p), FMode: os.ModeDir | 0755}}
+		if i, j := strings.Index(home, `"`), strings.LastIndex(home, `"`); i < j {
+			home = strings.Replace(home[i+1:j], `""`, `"`, -1)
+		}
+		_, _, err = c.cmd(2, "CWD %s", home)
+		return err
+	})
+	if err != nil {
+		return fileInfo{}, ftpError(err, "lstat", p, true)
+	}
+	fi.path = p
+	return fi, nil
+}
+
+func (f *ftpFS) Lstat(p string) (fileInfo, error) {
+	p = filepath.Clean(p)
+	dir := filepath.Dir(p)
+
+	f.mu.Lock()
+	listing, listed := f.dirs[dir]
+	changed := f.changed[p]
+	f.mu.Unlock()
+
+	if changed || p == "." {
+		return f.stat(p)
+	}
+	if !listed {
+		infos, err := f.list(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return fileInfo{}, err
+		}
+		listing = infos
+		f.mu.Lock()
+		f.dirs[dir] = listing
+		f.mu.Unlock()
+	}
+	if fi, ok := listing[p]; ok {
+		return fi, nil
+	}
+	return fileInfo{}, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+}
+
+func (f *ftpFS) List(p string) ([]fileInfo, error) {
+	listing, err := f.list(filepath.Clean(p))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fileInfo, 0, len(listing))
+	for _, fi := range listing {
+		infos = append(infos, fi)
+	}
+	sortInfos(infos)
+	return infos, nil
+}
+
+// forget marks p as modified so it is no longer looked up in the listing
+func (f *ftpFS) forget(p string) {
+	f.mu.Lock()
+	f.changed[filepath.Clean(p)] = true
+	f.mu.Unlock()
+}
+
+func (f *ftpFS) Open(p string) (io.ReadCloser, error) {
+	c, err := f.get()
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.transfer(f, "RETR %s", f.path(p))
+	if err != nil {
+		f.put(c, err)
+		return nil, ftpError(err, "open", p, true)
+	}
+	return &ftpFile{fs: f, c: c, data: data, path: p}, nil
+}
+
+func (f *ftpFS) Create(p string) (io.WriteCloser, error) {
+	f.forget(p)
+	c, err := f.get()
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.transfer(f, "STOR %s", f.path(p))
+	if err != nil {
+		f.put(c, err)
+		return nil, ftpError(err, "create", p, false)
+	}
+	return &ftpFile{fs: f, c: c, data: data, path: p, write: true}, nil
+}
+
+func (f *ftpFS) Mkdir(p string, mode os.FileMode) error {
+	p = filepath.Clean(p)
+	if fi, err := f.Lstat(p); err == nil && fi.info.IsDir() {
+		return nil
+	}
+	if parent := filepath.Dir(p); parent != p {
+		if err := f.Mkdir(parent, mode); err != nil {
+			return err
+		}
+	}
+	f.forget(p)
+	err := f.do(func(c *ftpConn) error {
+		_, _, err := c.cmd(2, "MKD %s", f.path(p))
+		return err
+	})
+	if err != nil {
+		// another worker may have created the directory in the meantime
+		if fi, serr := f.stat(p); serr == nil && fi.info.IsDir() {
+			return nil
+		}
+		return ftpError(err, "mkdir", p, false)
+	}
+	return nil
+}
+
+func (f *ftpFS) Symlink(oldname, newname string) error {
+	return errors.New("symbolic links are not supported by FTP targets")
+}
+
+func (f *ftpFS) Remove(p string) error {
+	f.forget(p)
+	err := f.do(func(c *ftpConn) error {
+		_, _, err := c.cmd(2, "DELE %s", f.path(p))
+		if _, ok := err.(*textproto.Error); ok {
+			if _, _, rerr := c.cmd(2, "RMD %s", f.path(p)); rerr == nil {
+				return nil
+			}
+		}
+		return err
+	})
+	return ftpError(err, "remove", p, true)
+}
+
+func (f *ftpFS) Rename(oldpath, newpath string) error {
+	f.forget(oldpath)
+	f.forget(newpath)
+	err := f.do(func(c *ftpConn) error {
+		if _, _, err := c.cmd(3, "RNFR %s", f.path(oldpath)); err != nil {
+			return err
+		}
+		_, _, err := c.cmd(2, "RNTO %s", f.path(newpath))
+		return err
+	})
+	return ftpError(err, "rename", oldpath, true)
+}
+
+// Chtimes sets the modification time with MFMT and does nothing on servers
+// not supporting it
+func (f *ftpFS) Chtimes(p string, mtime time.Time) error {
+	if !f.supports("MFMT") {
+		return nil
+	}
+	f.forget(p)
+	err := f.do(func(c *ftpConn) error {
+		_, _, err := c.cmd(2, "MFMT %s %s", mtime.UTC().Format(ftpTimeFormat), f.path(p))
+		return err
+	})
+	return ftpError(err, "chtimes", p, true)
+}
+
+// Chmod changes permissions with SITE CHMOD and stops trying once the server
+// does not understand it
+func (f *ftpFS) Chmod(p string, mode os.FileMode) error {
+	if atomic.LoadInt32(&f.noChmod) != 0 {
+		return nil
+	}
+	f.forget(p)
+	err := f.do(func(c *ftpConn) error {
+		_, _, err := c.cmd(2, "SITE CHMOD %o %s", unixModeFromFile(mode)&07777, f.path(p))
+		return err
+	})
+	if te, ok := err.(*textproto.Error); ok && (te.Code == 500 || te.Code == 502 || te.Code == 504) {
+		atomic.StoreInt32(&f.noChmod, 1)
+		return nil
+	}
+	return ftpError(err, "chmod", p, true)
+}
+
+// MtimePrecision reports that MFMT only sets whole seconds
+func (f *ftpFS) MtimePrecision() time.Duration {
+	return time.Second
+}
+
+// KeepsMode reports if the server lists permissions, which only some do via
+// the unix.mode fact of MLSD
+func (f *ftpFS) KeepsMode() bool {
+	return strings.Contains(strings.ToLower(f.feat["MLST"]), "unix.mode")
+}
+
+func (f *ftpFS) Close() error {
+	for {
+		select {
+		case c := <-f.idle:
+			c.cmd(2, "QUIT")
+			c.text.Close()
+			<-f.slots
+		default:
+			return nil
+		}
+	}
+}
+
+// ftpFile is a file opened for reading or writing over a data connection.
+// Closing it completes the transfer and releases the control connection.
+type ftpFile struct {
+	fs    *ftpFS
+	c     *ftpConn
+	data  net.Conn
+	path  string
+	write bool
+}
+
+func (f *ftpFile) Read(p []byte) (int, error) {
+	return f.data.Read(p)
+}
+
+func (f *ftpFile) Write(p []byte) (int, error) {
+	return f.data.Write(p)
+}
+
+// Close waits for the server to confirm the transfer. Readers closed early
+// abort the transfer, which is not an error.
+func (f *ftpFile) Close() error {
+	err := f.data.Close()
+	_, _, rerr := f.c.text.ReadResponse(2)
+	f.fs.put(f.c, rerr)
+	if !f.write {
+		if _, ok := rerr.(*textproto.Error); ok {
+			rerr = nil
+		}
+	} else {
+		f.fs.forget(f.path)
+	}
+	if err != nil {
+		return err
+	}
+	return ftpError(rerr, "close", f.path, false)
+}
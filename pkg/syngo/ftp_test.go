@@ -0,0 +1,156 @@
+package syngo
+
+import (
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFTPLogin answers the login of FTP clients on l, accepting the user
+// "user" with password "secret" and anonymous users without password. The
+// commands received are sent to cmds.
+func serveFTPLogin(l net.Listener, cmds chan<- string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			text := textproto.NewConn(conn)
+			defer text.Close()
+			text.PrintfLine("220 ready")
+			var user string
+			for {
+				line, err := text.ReadLine()
+				if err != nil {
+					return
+				}
+				cmds <- line
+				fields := strings.SplitN(line, " ", 2)
+				arg := ""
+				if len(fields) == 2 {
+					arg = fields[1]
+				}
+				switch strings.ToUpper(fields[0]) {
+				case "USER":
+					user = arg
+					if user == "anonymous" {
+						text.PrintfLine("230 logged in")
+					} else {
+						text.PrintfLine("331 password required")
+					}
+				case "PASS":
+					if user == "user" && arg == "secret" {
+						text.PrintfLine("230 logged in")
+					} else {
+						text.PrintfLine("530 login incorrect")
+					}
+				case "TYPE", "OPTS":
+					text.PrintfLine("200 ok")
+				case "FEAT":
+					text.PrintfLine("211-Features:\r\n MLST type*;size*;modify*;unix.mode*;\r\n MFMT\r\n UTF8\r\n211 End")
+				case "QUIT":
+					text.PrintfLine("221 bye")
+					return
+				default:
+					text.PrintfLine("502 not implemented")
+				}
+			}
+		}()
+	}
+}
+
+func TestFTPLogin(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cmds := make(chan string, 100)
+	go serveFTPLogin(l, cmds)
+
+	for _, tt := range []struct {
+		name     string
+		userinfo string
+		env      string // password in SYNGO_FTP_PASSWORD
+		ok       bool
+		want     []string // commands of the login
+	}{
+		{"anonymous", "", "", true, []string{"USER anonymous", "TYPE I", "FEAT", "OPTS UTF8 ON"}},
+		{"password in URL", "user:secret@", "", true,
+			[]string{"USER user", "PASS secret", "TYPE I", "FEAT", "OPTS UTF8 ON"}},
+		{"password in environment", "user@", "secret", true,
+			[]string{"USER user", "PASS secret", "TYPE I", "FEAT", "OPTS UTF8 ON"}},
+		{"wrong password", "user:guess@", "", false, []string{"USER user", "PASS guess"}},
+		{"line break in user", "a%0D%0ADELE%20x@", "", false, nil},
+	} {
+		t.Setenv("SYNGO_FTP_PASSWORD", tt.env)
+		b, err := newFTPBackend("ftp://"+tt.userinfo+l.Addr().String()+"/tree", &options{})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if err == nil {
+			f := b.(*ftpFS)
+			if !f.supports("MFMT") || !f.KeepsMode() || f.root != "tree" {
+				t.Errorf("%s: features %v and root %s", tt.name, f.feat, f.root)
+			}
+			b.Close()
+			tt.want = append(tt.want, "QUIT")
+		}
+
+		for _, want := range tt.want {
+			select {
+			case got := <-cmds:
+				if got != want {
+					t.Errorf("%s: got command %q, want %q", tt.name, got, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: missing command %q", tt.name, want)
+			}
+		}
+		// commands of failed logins may still arrive after the error
+		time.Sleep(10 * time.Millisecond)
+		for len(cmds) > 0 {
+			if got := <-cmds; tt.ok || strings.Contains(got, "DELE") {
+				t.Errorf("%s: unexpected command %q", tt.name, got)
+			}
+		}
+	}
+}
+
+func TestParseFacts(t *testing.T) {
+	for _, tt := range []struct {
+		line     string
+		ok       bool
+		name     string
+		mode     os.FileMode
+		size     int64
+		linkPath string
+	}{
+		{"type=file;size=42;modify=20200102030405;unix.mode=0640; a file", true, "a file", 0640, 42, ""},
+		{"type=dir;modify=20200102030405; sub", true, "sub", os.ModeDir | 0755, 0, ""},
+		{"type=OS.unix=slink:../target;modify=20200102030405; link", true, "link", os.ModeSymlink | 0777, 0,
+			"../target"},
+		{"type=cdir; .", false, "", 0, 0, ""},
+		{"type=pdir; ..", false, "", 0, 0, ""},
+		{"garbage", false, "", 0, 0, ""},
+	} {
+		name, fi, ok := parseFacts(tt.line)
+		if ok != tt.ok {
+			t.Errorf("%q: ok %v", tt.line, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if name != tt.name || fi.info.Mode() != tt.mode || fi.info.Size() != tt.size || fi.linkPath != tt.linkPath {
+			t.Errorf("%q: got %q, %s, %d, %q", tt.line, name, fi.info.Mode(), fi.info.Size(), fi.linkPath)
+		}
+	}
+	if got := parseFTPTime("20200102030405.5"); !got.Equal(time.Date(2020, 1, 2, 3, 4, 5, 5e8, time.UTC)) {
+		t.Errorf("fractional time parsed as %s", got)
+	}
+}
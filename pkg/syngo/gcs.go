@@ -0,0 +1,422 @@
+// gcs contains the object store implementation for Google Cloud Storage based
+// on its JSON API
+package syngo
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsChunkSize is the chunk size of resumable uploads; it has to be a
+// multiple of 256 kB. Smaller files are uploaded with a single request.
+const gcsChunkSize = 8 * 1024 * 1024
+
+// gcsScope is the OAuth2 scope needed for syncing to a bucket
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gcsStore provides access to the objects of a Google Cloud Storage bucket
+type gcsStore struct {
+	client   *http.Client
+	endpoint string
+	bucket   string
+	token    *oauthToken // nil if no authentication is required
+}
+
+// newGCSBackend returns a backend for a target of the form gs://bucket/prefix.
+// Credentials are taken from GOOGLE_OAUTH_ACCESS_TOKEN, the service account
+// key file in GOOGLE_APPLICATION_CREDENTIALS, or the GCE metadata server. If
+// STORAGE_EMULATOR_HOST is set the emulator is used without authentication.
+func newGCSBackend(spec string, opts *options) (backend, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket name in %s", spec)
+	}
+
+	g := &gcsStore{
+		client: &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		endpoint: "https://storage.googleapis.com",
+		bucket:   u.Host,
+	}
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		g.endpoint = strings.TrimSuffix(host, "/")
+	} else if g.token, err = newGCSToken(); err != nil {
+		return nil, err
+	}
+	return &objectFS{store: g, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// objectURL returns the JSON API URL for the object with the given key
+func (g *gcsStore) objectURL(key string) string {
+	return g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(key)
+}
+
+// uploadURL returns the upload URL for the given upload type
+func (g *gcsStore) uploadURL(uploadType string) string {
+	return g.endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) +
+		"/o?uploadType=" + uploadType
+}
+
+// do performs an authorized request. Responses with error status are turned
+// into errors, 404s into errors satisfying os.IsNotExist. Status 308 is
+// used by resumable uploads and is not considered an error.
+func (g *gcsStore) do(method, u string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if g.token != nil {
+		tok, err := g.token.get()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusPermanentRedirect {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: strings.ToLower(method), Path: u, Err: os.ErrNotExist}
+		}
+		var gErr struct {
+			Error struct {
+				Message string
+			}
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(data, &gErr)
+		return nil, fmt.Errorf("gcs %s %s failed: %s %s", method, u, resp.Status, gErr.Error.Message)
+	}
+	return resp, nil
+}
+
+// gcsObject is the JSON representation of an object's metadata
+type gcsObject struct {
+	Name     string            `json:"name,omitempty"`
+	Size     string            `json:"size,omitempty"`
+	Updated  time.Time         `json:"updated,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (g *gcsStore) head(key string) (objectAttrs, error) {
+	resp, err := g.do("GET", g.objectURL(key), nil, nil)
+	if err != nil {
+		return objectAttrs{}, err
+	}
+	defer resp.Body.Close()
+
+	var obj gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return objectAttrs{}, fmt.Errorf("invalid metadata for object %s: %s", key, err)
+	}
+	size, _ := strconv.ParseInt(obj.Size, 10, 64)
+	return objectAttrs{size: size, modified: obj.Updated, meta: obj.Metadata}, nil
+}
+
+func (g *gcsStore) download(key string) (io.ReadCloser, error) {
+	resp, err := g.do("GET", g.objectURL(key)+"?alt=media", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (g *gcsStore) upload(key string, meta map[string]string) (io.WriteCloser, error) {
+	return &gcsWriter{store: g, obj: gcsObject{Name: key, Metadata: meta}}, nil
+}
+
+func (g *gcsStore) setMeta(key string, meta map[string]string) error {
+	body, err := json.Marshal(gcsObject{Metadata: meta})
+	if err != nil {
+		return err
+	}
+	h := http.Header{"Content-Type": {"application/json"}}
+	resp, err := g.do("PATCH", g.objectURL(key), h, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (g *gcsStore) remove(key string) error {
+	resp, err := g.do("DELETE", g.objectURL(key), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// gcsWriter uploads data written to it as an object. Small objects are
+// uploaded with a single multipart request on Close, larger ones via a
+// resumable upload session in chunks of gcsChunkSize.
+type gcsWriter struct {
+	store   *gcsStore
+	obj     gcsObject
+	buf     []byte
+	session string // resumable upload session URI
+	offset  int64  // number of bytes uploaded to the session
+	err     error
+}
+
+func (w *gcsWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	// keep at least one byte buffered so the final chunk is never empty
+	for len(w.buf) > gcsChunkSize && w.err == nil {
+		w.err = w.uploadChunk(w.buf[:gcsChunkSize], false)
+		w.buf = append([]byte(nil), w.buf[gcsChunkSize:]...)
+	}
+	return len(p), w.err
+}
+
+// uploadChunk uploads data to the resumable upload session which is started
+// if necessary
+func (w *gcsWriter) uploadChunk(data []byte, final bool) error {
+	if w.session == "" {
+		body, err := json.Marshal(w.obj)
+		if err != nil {
+			return err
+		}
+		h := http.Header{"Content-Type": {"application/json; charset=UTF-8"}}
+		resp, err := w.store.do("POST", w.store.uploadURL("resumable"), h, body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if w.session = resp.Header.Get("Location"); w.session == "" {
+			return fmt.Errorf("failed to start resumable upload of %s", w.obj.Name)
+		}
+	}
+
+	total := "*"
+	if final {
+		total = strconv.FormatInt(w.offset+int64(len(data)), 10)
+	}
+	h := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%s", w.offset,
+		w.offset+int64(len(data))-1, total)}}
+	resp, err := w.store.do("PUT", w.session, h, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if !final && resp.StatusCode != http.StatusPermanentRedirect {
+		return fmt.Errorf("unexpected response %s during upload of %s", resp.Status, w.obj.Name)
+	}
+	w.offset += int64(len(data))
+	return nil
+}
+
+func (w *gcsWriter) Close() error {
+	if w.err != nil {
+		if w.session != "" {
+			if resp, err := w.store.do("DELETE", w.session, nil, nil); err == nil {
+				resp.Body.Close()
+			}
+		}
+		return w.err
+	}
+	if w.session != "" {
+		w.err = w.uploadChunk(w.buf, true)
+		return w.err
+	}
+
+	// small objects are uploaded in one go as metadata and data parts
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	meta, err := json.Marshal(w.obj)
+	if err != nil {
+		return err
+	}
+	for _, part := range []struct {
+		contentType string
+		data        []byte
+	}{{"application/json; charset=UTF-8", meta}, {"application/octet-stream", w.buf}} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return err
+		}
+		pw.Write(part.data)
+	}
+	mw.Close()
+
+	h := http.Header{"Content-Type": {"multipart/related; boundary=" + mw.Boundary()}}
+	resp, err := w.store.do("POST", w.store.uploadURL("multipart"), h, body.Bytes())
+	if err != nil {
+		w.err = err
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// oauthToken caches an OAuth2 access token and refreshes it before it expires
+type oauthToken struct {
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+	fetch  func() (string, time.Duration, error)
+}
+
+// get returns a valid access token
+func (t *oauthToken) get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Before(t.expiry) {
+		return t.token, nil
+	}
+	tok, lifetime, err := t.fetch()
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain access token: %s", err)
+	}
+	t.token = tok
+	t.expiry = time.Now().Add(lifetime - time.Minute)
+	return tok, nil
+}
+
+// tokenResponse is the response of an OAuth2 token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// readTokenResponse decodes an OAuth2 token endpoint response
+func readTokenResponse(resp *http.Response) (string, time.Duration, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return "", 0, fmt.Errorf("%s: %s", resp.Status, data)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", 0, err
+	}
+	return tr.AccessToken, time.Duration(tr.ExpiresIn) * time.Second, nil
+}
+
+// newGCSToken determines where to obtain access tokens for Google Cloud
+// Storage from
+func newGCSToken() (*oauthToken, error) {
+	if tok := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); tok != "" {
+		return &oauthToken{token: tok, expiry: time.Now().Add(100 * 365 * 24 * time.Hour)}, nil
+	}
+
+	if keyFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); keyFile != "" {
+		return serviceAccountToken(keyFile)
+	}
+
+	// fall back to the metadata server available on Google Compute Engine
+	return &oauthToken{fetch: func() (string, time.Duration, error) {
+		req, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", 0, err
+		}
+		return readTokenResponse(resp)
+	}}, nil
+}
+
+// serviceAccountToken returns a token source based on the service account
+// key stored in keyFile using the OAuth2 JWT bearer flow
+func serviceAccountToken(keyFile string) (*oauthToken, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	var sa struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return nil, fmt.Errorf("invalid service account key file %s: %s", keyFile, err)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", keyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s is not an RSA key", keyFile)
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	return &oauthToken{fetch: func() (string, time.Duration, error) {
+		enc := base64.RawURLEncoding
+		now := time.Now().Unix()
+		header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+		claims, err := json.Marshal(map[string]interface{}{
+			"iss":   sa.ClientEmail,
+			"scope": gcsScope,
+			"aud":   sa.TokenURI,
+			"iat":   now,
+			"exp":   now + 3600,
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		unsigned := header + "." + enc.EncodeToString(claims)
+		sum := sha256.Sum256([]byte(unsigned))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			return "", 0, err
+		}
+
+		resp, err := http.PostForm(sa.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		return readTokenResponse(resp)
+	}}, nil
+}
@@ -0,0 +1,117 @@
+package syngo
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGCSServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var numTokens int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			numTokens++
+			if err := checkJWT(&key.PublicKey, r.FormValue("assertion"), srv.URL+"/token"); err != "" {
+				http.Error(w, err, http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(tokenResponse{AccessToken: "token", ExpiresIn: 3600})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.EscapedPath() != "/storage/v1/b/bucket/o/dir%2Ffile" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	data, _ := json.Marshal(map[string]string{
+		"client_email": "syngo@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    srv.URL + "/token",
+	})
+	if err := ioutil.WriteFile(keyFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := serviceAccountToken(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &gcsStore{client: &http.Client{}, endpoint: srv.URL, bucket: "bucket", token: tok}
+	// the token is fetched once and reused
+	for i := 0; i < 2; i++ {
+		resp, err := g.do("GET", g.objectURL("dir/file"), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if numTokens != 1 {
+		t.Errorf("fetched %d tokens", numTokens)
+	}
+}
+
+// checkJWT verifies the signature and claims of the JWT bearer assertion jwt
+// and returns a description of the first problem found
+func checkJWT(pub *rsa.PublicKey, jwt, aud string) string {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return "malformed assertion"
+	}
+	enc := base64.RawURLEncoding
+	var header, claims map[string]interface{}
+	for i, v := range []*map[string]interface{}{&header, &claims} {
+		data, err := enc.DecodeString(parts[i])
+		if err != nil || json.Unmarshal(data, v) != nil {
+			return "malformed assertion"
+		}
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return "malformed signature"
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return "invalid signature"
+	}
+	exp, _ := claims["exp"].(float64)
+	iat, _ := claims["iat"].(float64)
+	switch {
+	case header["alg"] != "RS256":
+		return "unexpected algorithm"
+	case claims["iss"] != "syngo@example.iam.gserviceaccount.com":
+		return "unexpected issuer"
+	case claims["scope"] != gcsScope:
+		return "unexpected scope"
+	case claims["aud"] != aud:
+		return "unexpected audience"
+	case exp-iat != 3600:
+		return "unexpected lifetime"
+	}
+	return ""
+}
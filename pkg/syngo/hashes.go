@@ -0,0 +1,404 @@
+// hashes contains the checksum algorithms available for comparing, verifying,
+// and recording file contents. Fast non-cryptographic checksums detect
+// accidental changes, cryptographic ones also those made on purpose.
+package syngo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/bits"
+	"strings"
+)
+
+// hashAlgo names a checksum algorithm
+type hashAlgo string
+
+const (
+	hashXXH64  hashAlgo = "xxh64"
+	hashBLAKE3 hashAlgo = "blake3"
+	hashSHA256 hashAlgo = "sha256"
+)
+
+// defaultHash is used unless another algorithm is chosen
+const defaultHash = hashXXH64
+
+// hashAlgos lists the supported algorithms together with their constructors
+// and whether they are cryptographic
+var hashAlgos = []struct {
+	algo   hashAlgo
+	new    func() hash.Hash
+	crypto bool
+}{
+	{hashXXH64, func() hash.Hash { return newXXH64() }, false},
+	{hashBLAKE3, func() hash.Hash { return newBLAKE3() }, true},
+	{hashSHA256, sha256.New, true},
+}
+
+// parseHashAlgo returns the algorithm named s, the default if s is empty
+func parseHashAlgo(s string) (hashAlgo, error) {
+	if s == "" {
+		return defaultHash, nil
+	}
+	var names []string
+	for _, h := range hashAlgos {
+		if string(h.algo) == strings.ToLower(s) {
+			return h.algo, nil
+		}
+		names = append(names, string(h.algo))
+	}
+	return "", fmt.Errorf("unknown checksum algorithm %s, use one of %s", s, strings.Join(names, ", "))
+}
+
+// hashAlgoFlag is a flag.Value holding a checksum algorithm
+type hashAlgoFlag struct {
+	algo *hashAlgo
+}
+
+func (f hashAlgoFlag) String() string {
+	if f.algo == nil {
+		return ""
+	}
+	return string(*f.algo)
+}
+
+func (f hashAlgoFlag) Set(s string) error {
+	a, err := parseHashAlgo(s)
+	if err != nil {
+		return err
+	}
+	*f.algo = a
+	return nil
+}
+
+// checksumChoiceUsage documents the flags selecting a checksum algorithm
+const checksumChoiceUsage = "checksum algorithm: xxh64 (fast), blake3, or sha256 (cryptographic)"
+
+// new returns a hash computing checksums with a. Checksums recorded without
+// naming their algorithm, e.g. by older versions of syngo, are SHA-256.
+func (a hashAlgo) new() hash.Hash {
+	for _, h := range hashAlgos {
+		if h.algo == a {
+			return h.new()
+		}
+	}
+	return sha256.New()
+}
+
+// sum returns the checksum of data computed with a
+func (a hashAlgo) sum(data []byte) []byte {
+	h := a.new()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// cryptographic reports if changes can not be hidden from checksums of a
+func (a hashAlgo) cryptographic() bool {
+	for _, h := range hashAlgos {
+		if h.algo == a {
+			return h.crypto
+		}
+	}
+	return a == ""
+}
+
+// xxh64 computes 64 bit xxHash checksums (seed 0)
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int // number of bytes in buf
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func newXXH64() *xxh64 {
+	x := &xxh64{}
+	x.Reset()
+	return x
+}
+
+func (x *xxh64) Reset() {
+	p1, p2 := xxPrime1, xxPrime2
+	x.v = [4]uint64{p1 + p2, p2, 0, -p1}
+	x.total = 0
+	x.n = 0
+}
+
+func (x *xxh64) Size() int      { return 8 }
+func (x *xxh64) BlockSize() int { return 32 }
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// stripes consumes the 32 byte stripes at the start of p
+func (x *xxh64) stripes(p []byte) []byte {
+	for ; len(p) >= 32; p = p[32:] {
+		for i := range x.v {
+			x.v[i] = xxRound(x.v[i], binary.LittleEndian.Uint64(p[8*i:]))
+		}
+	}
+	return p
+}
+
+func (x *xxh64) Write(p []byte) (int, error) {
+	n := len(p)
+	x.total += uint64(n)
+	if x.n > 0 {
+		c := copy(x.buf[x.n:], p)
+		x.n += c
+		p = p[c:]
+		if x.n < len(x.buf) {
+			return n, nil
+		}
+		x.stripes(x.buf[:])
+		x.n = 0
+	}
+	p = x.stripes(p)
+	x.n = copy(x.buf[:], p)
+	return n, nil
+}
+
+func (x *xxh64) Sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v[0], 1) + bits.RotateLeft64(x.v[1], 7) +
+			bits.RotateLeft64(x.v[2], 12) + bits.RotateLeft64(x.v[3], 18)
+		for _, v := range x.v {
+			h = xxMerge(h, v)
+		}
+	} else {
+		h = x.v[2] + xxPrime5
+	}
+	h += x.total
+
+	p := x.buf[:x.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func (x *xxh64) Sum(b []byte) []byte {
+	var s [8]byte
+	binary.BigEndian.PutUint64(s[:], x.Sum64())
+	return append(b, s[:]...)
+}
+
+// blake3 computes unkeyed 256 bit BLAKE3 checksums, following the structure
+// of the reference implementation: the input is split into 1 KiB chunks
+// whose chaining values are merged into a binary tree.
+// NOTE: Chunks are compressed one at a time without SIMD, so this is slower
+// than optimized implementations but still faster than SHA-256 on machines
+// without SHA extensions.
+type blake3 struct {
+	chunk blake3Chunk
+	stack [][8]uint32 // chaining values of complete subtrees
+}
+
+const (
+	blake3ChunkStart = 1 << iota
+	blake3ChunkEnd
+	blake3Parent
+	blake3Root
+)
+
+const blake3ChunkLen = 1024
+
+var blake3IV = [8]uint32{0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c,
+	0x1f83d9ab, 0x5be0cd19}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func newBLAKE3() *blake3 {
+	b := &blake3{}
+	b.Reset()
+	return b
+}
+
+func (b *blake3) Reset() {
+	b.chunk = blake3Chunk{cv: blake3IV}
+	b.stack = b.stack[:0]
+}
+
+func (b *blake3) Size() int      { return 32 }
+func (b *blake3) BlockSize() int { return 64 }
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+// blake3Compress compresses a block of 64 bytes into the chaining value cv
+// and returns the full output state
+func blake3Compress(cv [8]uint32, m [16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags}
+	for r := 0; r < 7; r++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var p [16]uint32
+		for i, j := range blake3Permutation {
+			p[i] = m[j]
+		}
+		m = p
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+// blake3Output is a node of the tree which is compressed once it is known
+// whether it is the root
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *blake3Output) chainingValue() (cv [8]uint32) {
+	s := blake3Compress(o.cv, o.block, o.counter, o.blockLen, o.flags)
+	copy(cv[:], s[:8])
+	return cv
+}
+
+func blake3ParentOutput(left, right [8]uint32) blake3Output {
+	o := blake3Output{cv: blake3IV, blockLen: 64, flags: blake3Parent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// blake3Chunk is the state of the chunk currently being hashed
+type blake3Chunk struct {
+	cv         [8]uint32
+	counter    uint64 // index of the chunk
+	block      [64]byte
+	blockLen   int
+	compressed int // number of blocks compressed so far
+}
+
+func (c *blake3Chunk) len() int {
+	return 64*c.compressed + c.blockLen
+}
+
+func (c *blake3Chunk) startFlag() uint32 {
+	if c.compressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+func blake3Words(block *[64]byte) (m [16]uint32) {
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return m
+}
+
+func (c *blake3Chunk) write(p []byte) {
+	for len(p) > 0 {
+		if c.blockLen == len(c.block) {
+			s := blake3Compress(c.cv, blake3Words(&c.block), c.counter, 64, c.startFlag())
+			copy(c.cv[:], s[:8])
+			c.compressed++
+			c.block = [64]byte{}
+			c.blockLen = 0
+		}
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *blake3Chunk) output() blake3Output {
+	return blake3Output{cv: c.cv, block: blake3Words(&c.block), counter: c.counter,
+		blockLen: uint32(c.blockLen), flags: c.startFlag() | blake3ChunkEnd}
+}
+
+func (b *blake3) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if b.chunk.len() == blake3ChunkLen {
+			o := b.chunk.output()
+			cv := o.chainingValue()
+			total := b.chunk.counter + 1
+			// merge the subtrees completed by the chunk, one per trailing
+			// zero bit of the number of chunks
+			for ; total&1 == 0; total >>= 1 {
+				o := blake3ParentOutput(b.stack[len(b.stack)-1], cv)
+				cv = o.chainingValue()
+				b.stack = b.stack[:len(b.stack)-1]
+			}
+			b.stack = append(b.stack, cv)
+			b.chunk = blake3Chunk{cv: blake3IV, counter: b.chunk.counter + 1}
+		}
+		k := blake3ChunkLen - b.chunk.len()
+		if k > len(p) {
+			k = len(p)
+		}
+		b.chunk.write(p[:k])
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (b *blake3) Sum(in []byte) []byte {
+	o := b.chunk.output()
+	for i := len(b.stack) - 1; i >= 0; i-- {
+		o = blake3ParentOutput(b.stack[i], o.chainingValue())
+	}
+	s := blake3Compress(o.cv, o.block, o.counter, o.blockLen, o.flags|blake3Root)
+	var out [32]byte
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(out[4*i:], s[i])
+	}
+	return append(in, out[:]...)
+}
@@ -0,0 +1,107 @@
+package syngo
+
+import (
+	"encoding/hex"
+	"hash"
+	"testing"
+)
+
+// vectorInput returns the input of the BLAKE3 test vectors, the bytes i%251
+func vectorInput(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+// checkVector compares the checksum of data computed by h, both in one write
+// and in writes of odd sizes crossing the internal block boundaries, to want
+func checkVector(t *testing.T, name string, h hash.Hash, data []byte, want string) {
+	t.Helper()
+	h.Reset()
+	h.Write(data)
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		t.Errorf("%s of %d bytes: got %s, want %s", name, len(data), got, want)
+	}
+	h.Reset()
+	for p := data; len(p) > 0; {
+		n := 7
+		if n > len(p) {
+			n = len(p)
+		}
+		h.Write(p[:n])
+		p = p[n:]
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		t.Errorf("%s of %d bytes written in pieces: got %s, want %s", name, len(data), got, want)
+	}
+}
+
+func TestXXH64Vectors(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		want  string
+	}{
+		// reference values published for xxHash implementations
+		{"", "ef46db3751d8e999"},
+		{"a", "d24ec4f1a98c6e5b"},
+		{"abc", "44bc2cf5ad770999"},
+		{"Call me Ishmael. Some years ago--never mind how long precisely-", "02a2e85470d6fd96"},
+	} {
+		checkVector(t, "xxh64", newXXH64(), []byte(tt.input), tt.want)
+	}
+
+	// the inputs of the BLAKE3 vectors cover the 32 byte stripes, the values
+	// were computed with github.com/cespare/xxhash
+	for _, tt := range []struct {
+		n    int
+		want string
+	}{
+		{0, "ef46db3751d8e999"},
+		{1, "e934a84adb052768"},
+		{63, "e26aa9e2a95f8e4f"},
+		{64, "f7c67301db6713f0"},
+		{65, "c31eb63b2ae4465b"},
+		{1023, "d66738f081c25cf4"},
+		{1024, "138e26c65048ce29"},
+		{1025, "cfd73aedd2d6a39d"},
+		{2048, "a69e05a7eff57800"},
+		{31744, "5fd04299cacedf8a"},
+	} {
+		checkVector(t, "xxh64", newXXH64(), vectorInput(tt.n), tt.want)
+	}
+}
+
+func TestBLAKE3Vectors(t *testing.T) {
+	// the first 32 bytes of the unkeyed hashes of the official test vectors
+	for _, tt := range []struct {
+		n    int
+		want string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{63, "e9bc37a594daad83be9470df7f7b3798297c3d834ce80ba85d6e207627b7db7b"},
+		{64, "4eed7141ea4a5cd4b788606bd23f46e212af9cacebacdc7d1f4c6dc7f2511b98"},
+		{65, "de1e5fa0be70df6d2be8fffd0e99ceaa8eb6e8c93a63f2d8d1c30ecb6b263dee"},
+		{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{31744, "62b6960e1a44bcc1eb1a611a8d6235b6b4b78f32e7abc4fb4c6cdcce94895c47"},
+	} {
+		checkVector(t, "blake3", newBLAKE3(), vectorInput(tt.n), tt.want)
+	}
+}
+
+func TestHashAlgoSum(t *testing.T) {
+	for _, h := range hashAlgos {
+		a := h.algo.sum([]byte("data"))
+		if len(a) != h.algo.new().Size() {
+			t.Errorf("%s checksum has %d bytes, want %d", h.algo, len(a), h.algo.new().Size())
+		}
+		if b := h.algo.sum([]byte("date")); string(a) == string(b) {
+			t.Errorf("%s checksums of different data are equal", h.algo)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// hooks contains the -pre-cmd and -post-cmd shell commands run around every
+// sync run
+package syngo
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// runOutcome records the results of a run passed on to -post-cmd
+type runOutcome struct {
+	stats    syncStats
+	snapshot string
+}
+
+// env returns the environment variables describing the outcome of a run
+// which exited with exitCode after duration
+func (o *runOutcome) env(exitCode int, duration time.Duration) []string {
+	return []string{
+		fmt.Sprintf("SYNGO_EXIT_CODE=%d", exitCode),
+		fmt.Sprintf("SYNGO_FILES=%d", o.stats.numFiles),
+		fmt.Sprintf("SYNGO_BYTES=%d", o.stats.numBytes),
+		fmt.Sprintf("SYNGO_ERRORS=%d", o.stats.numErrors),
+		fmt.Sprintf("SYNGO_DELETED=%d", o.stats.numDeleted),
+		fmt.Sprintf("SYNGO_DURATION=%d", int64(duration.Seconds())),
+		"SYNGO_SNAPSHOT=" + o.snapshot,
+	}
+}
+
+// hookEnv returns the environment variables describing the sources and
+// target of a run
+func hookEnv(srcs []*source, tgtTree string) []string {
+	var roots []string
+	for _, src := range srcs {
+		roots = append(roots, src.root)
+	}
+	return []string{
+		"SYNGO_SOURCES=" + strings.Join(roots, string(filepath.ListSeparator)),
+		"SYNGO_TARGET=" + tgtTree,
+	}
+}
+
+// runHook runs command with the shell of the platform and env added to the
+// environment of syngo. Its output is passed through to stderr so it does not
+// mix with the -json-stats output.
+func runHook(command string, env []string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,488 @@
+// httpsrc mirrors read-only HTTP(S) sources, i.e. directory listings served
+// by web servers and published syngo manifests, to a target tree
+package syngo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpETagFile is the file in the meta directory of local targets recording
+// the entity tags of mirrored files for conditional requests
+const httpETagFile = "http-etags.json"
+
+// hrefRegex matches the links of HTML directory listings
+var hrefRegex = regexp.MustCompile(`(?i)href\s*=\s*["']([^"']+)["']`)
+
+// isHTTPSource reports if the source tree p is served over HTTP(S)
+func isHTTPSource(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// checkHTTPSource verifies that HTTP sources are mirrored on their own and
+// without options requiring a local source tree
+func checkHTTPSource(srcs []*source, opts *options) error {
+	for _, src := range srcs {
+		if !isHTTPSource(src.root) {
+			continue
+		}
+		switch {
+		case len(srcs) > 1:
+			return errors.New("HTTP sources can not be combined with other sources")
+		case opts.delete:
+			return errors.New("HTTP sources can not be combined with -delete")
+		case opts.index != nil:
+			return errors.New("HTTP sources can not be combined with -index")
+		case len(opts.transforms) > 0:
+			return errors.New("HTTP sources do not support transforms")
+		}
+	}
+	return nil
+}
+
+// syncSources synchronizes srcs to tgt, mirroring HTTP sources with
+// conditional requests instead of comparing them to the target
+func syncSources(srcs []*source, tgt backend, tgtTree string, opts *options) syncStats {
+	if len(srcs) == 1 && isHTTPSource(srcs[0].root) {
+		return mirrorHTTP(srcs[0].root, tgt, tgtTree, opts)
+	}
+	return runSync(srcs, tgt, opts)
+}
+
+// httpEntry is a file, directory, or symbolic link published by an HTTP
+// source. Only manifests provide modes, modification times, and links.
+type httpEntry struct {
+	url   *url.URL
+	path  string // path relative to the target tree
+	dir   bool
+	mode  os.FileMode
+	mtime time.Time
+	link  string
+}
+
+// httpMirror keeps the state of mirroring an HTTP source to a target
+type httpMirror struct {
+	client *http.Client
+	tgt    backend
+	opts   *options
+
+	mu       sync.Mutex
+	etags    map[string]string // entity tags of the target files
+	etagPath string            // empty if entity tags are not kept
+	stats    syncStats
+}
+
+// mirrorHTTP mirrors the HTTP source root to tgt and returns the statistics
+// of the run. URLs ending in a slash are crawled as directory listings, all
+// others are fetched as manifests. Files are only transferred if the server
+// reports them as changed since the target copy was fetched.
+func mirrorHTTP(root string, tgt backend, tgtTree string, opts *options) syncStats {
+	m := &httpMirror{client: &http.Client{}, tgt: tgt, opts: opts,
+		etags: make(map[string]string)}
+	if _, ok := tgt.(*localFS); ok {
+		m.etagPath = filepath.Join(tgtTree, metaDir, httpETagFile)
+		if data, err := ioutil.ReadFile(m.etagPath); err == nil {
+			if err := json.Unmarshal(data, &m.etags); err != nil {
+				log.Printf("ignoring invalid entity tags in %s: %s\n", m.etagPath, err)
+				m.etags = make(map[string]string)
+			}
+		}
+	}
+
+	base, err := url.Parse(root)
+	if err != nil {
+		m.opts.log.logError("scan", root, "parse", err)
+		return syncStats{numErrors: 1}
+	}
+	var entries []httpEntry
+	if strings.HasSuffix(base.Path, "/") {
+		entries = m.crawl(base, ".")
+	} else {
+		entries = m.readManifest(base)
+	}
+
+	// entries below symbolic links would be written wherever the links point
+	links := make(map[string]bool)
+	for _, e := range entries {
+		if e.link != "" {
+			links[e.path] = true
+		}
+	}
+	tgtLinks := make(map[string]bool)
+
+	// directories are created up front so files can be fetched in parallel,
+	// links only at the end so no file is written through them
+	var files, symlinks []httpEntry
+	for _, e := range entries {
+		switch {
+		case m.belowLink(e.path, links, tgtLinks):
+			m.fail(e.path, "sync", errors.New("path below a symbolic link"))
+		case e.dir:
+			m.mkdir(e)
+		case e.link != "":
+			symlinks = append(symlinks, e)
+		default:
+			files = append(files, e)
+		}
+	}
+	_, numSyncers := workerCounts(tgt, opts)
+	bufferSize := opts.bufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+	queue := make(chan httpEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < numSyncers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bufferSize)
+			for e := range queue {
+				m.fetch(e, buf)
+			}
+		}()
+	}
+	for _, e := range files {
+		if opts.interrupted() {
+			break
+		}
+		queue <- e
+	}
+	close(queue)
+	wg.Wait()
+	for _, e := range symlinks {
+		if opts.interrupted() {
+			break
+		}
+		m.symlink(e)
+	}
+
+	if m.etagPath != "" && !opts.dryRun {
+		if err := m.saveETags(); err != nil {
+			m.opts.log.logError("sync", m.etagPath, "save entity tags to", err)
+			m.stats.numErrors++
+		}
+	}
+	return m.stats
+}
+
+// belowLink determines if a parent directory of the relative path p is a
+// symbolic link, either one of the links published by the source or one
+// already present on the target. The latter are remembered in tgtLinks.
+func (m *httpMirror) belowLink(p string, links, tgtLinks map[string]bool) bool {
+	for dir := filepath.Dir(p); dir != "."; dir = filepath.Dir(dir) {
+		if links[dir] {
+			return true
+		}
+		linked, ok := tgtLinks[dir]
+		if !ok {
+			fi, err := m.tgt.Lstat(dir)
+			linked = err == nil && fi.info.Mode()&os.ModeSymlink != 0
+			tgtLinks[dir] = linked
+		}
+		if linked {
+			return true
+		}
+	}
+	return false
+}
+
+// get issues a GET request for u with the provided extra headers
+func (m *httpMirror) get(u *url.URL, header http.Header) (*http.Response, error) {
+	ctx := m.opts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return m.client.Do(req)
+}
+
+// fail records the failure of action on path
+func (m *httpMirror) fail(path, action string, err error) {
+	m.opts.log.logError("sync", path, action, err)
+	m.mu.Lock()
+	m.stats.numErrors++
+	m.mu.Unlock()
+}
+
+// crawl returns the entries below the directory listing at dir, which is
+// synced to relPath in the target
+func (m *httpMirror) crawl(dir *url.URL, relPath string) []httpEntry {
+	resp, err := m.get(dir, nil)
+	if err != nil {
+		m.fail(dir.String(), "list", err)
+		return nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = errors.New(resp.Status)
+	}
+	if err != nil {
+		m.fail(dir.String(), "list", err)
+		return nil
+	}
+
+	var entries []httpEntry
+	seen := make(map[string]bool)
+	for _, match := range hrefRegex.FindAllSubmatch(body, -1) {
+		name, u, isDir, ok := listingChild(dir, string(match[1]))
+		if !ok || seen[name] {
+			continue
+		}
+		seen[name] = true
+		e := httpEntry{url: u, path: filepath.Join(relPath, name), dir: isDir}
+		if skipPath(e.path, e.dir, m.opts) {
+			m.stats.numFiltered++
+			continue
+		}
+		entries = append(entries, e)
+		if isDir {
+			entries = append(entries, m.crawl(u, e.path)...)
+		}
+	}
+	return entries
+}
+
+// listingChild resolves the link href of the directory listing at dir and
+// returns the name and URL of the entry it refers to if it is a direct child
+// of dir. Parent directories, sort links, and external links are ignored.
+func listingChild(dir *url.URL, href string) (string, *url.URL, bool, bool) {
+	u, err := dir.Parse(href)
+	if err != nil || u.RawQuery != "" || u.Scheme != dir.Scheme || u.Host != dir.Host {
+		return "", nil, false, false
+	}
+	u.Fragment = ""
+	rest := strings.TrimPrefix(u.Path, dir.Path)
+	if rest == u.Path || rest == "" {
+		return "", nil, false, false
+	}
+	isDir := strings.HasSuffix(rest, "/")
+	name := strings.TrimSuffix(rest, "/")
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", nil, false, false
+	}
+	return name, u, isDir, true
+}
+
+// readManifest returns the entries of the manifest published at u. Their
+// content is fetched relative to the directory of the manifest.
+func (m *httpMirror) readManifest(u *url.URL) []httpEntry {
+	resp, err := m.get(u, nil)
+	if err != nil {
+		m.fail(u.String(), "fetch manifest", err)
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		m.fail(u.String(), "fetch manifest", errors.New(resp.Status))
+		return nil
+	}
+	manifest, err := decodeManifest(resp.Body, u.String())
+	if err != nil {
+		m.fail(u.String(), "read manifest", err)
+		return nil
+	}
+
+	var entries []httpEntry
+	for _, me := range manifest {
+		p := filepath.Clean(filepath.FromSlash(me.Path))
+		if p == "." {
+			continue
+		}
+		if filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+			m.fail(me.Path, "sync", errors.New("path outside of the manifest tree"))
+			continue
+		}
+		e := httpEntry{url: u.ResolveReference(&url.URL{Path: filepath.ToSlash(p)}), path: p,
+			dir: me.Mode.IsDir(), mode: me.Mode, mtime: me.Mtime, link: me.Link}
+		if !e.dir && e.link == "" && !me.Mode.IsRegular() {
+			m.stats.numSkipped++
+			continue
+		}
+		if skipPath(e.path, e.dir, m.opts) {
+			m.stats.numFiltered++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// mkdir creates the directory e on the target unless it exists
+func (m *httpMirror) mkdir(e httpEntry) {
+	if fi, err := m.tgt.Lstat(e.path); err == nil && fi.info.IsDir() {
+		return
+	}
+	if !m.opts.dryRun {
+		mode := e.mode.Perm()
+		if mode == 0 {
+			mode = 0755
+		}
+		if err := m.tgt.Mkdir(e.path, mode); err != nil {
+			m.fail(e.path, "create directory", err)
+			return
+		}
+	}
+	m.stats.numDirs++
+	m.opts.log.infoEvent(levelFiles, event{Phase: "dirs", Path: e.path, Action: "mkdir"}, "%s/\n", e.path)
+}
+
+// symlink creates the symbolic link e on the target unless it is up to date
+func (m *httpMirror) symlink(e httpEntry) {
+	m.mu.Lock()
+	m.stats.numExamined++
+	m.mu.Unlock()
+	if fi, err := m.tgt.Lstat(e.path); err == nil && fi.linkPath == e.link {
+		m.mu.Lock()
+		m.stats.numUnchanged++
+		m.mu.Unlock()
+		return
+	}
+	if !m.opts.dryRun {
+		if err := m.tgt.Remove(e.path); err != nil && !os.IsNotExist(err) {
+			m.fail(e.path, "remove", err)
+			return
+		}
+		if err := m.tgt.Symlink(e.link, e.path); err != nil {
+			m.fail(e.path, "create symbolic link", err)
+			return
+		}
+	}
+	m.mu.Lock()
+	m.stats.numSymlinks++
+	m.mu.Unlock()
+	m.opts.log.infoEvent(levelFiles, event{Phase: "sync", Path: e.path, Action: "symlink"}, "%s -> %s\n",
+		e.path, e.link)
+}
+
+// fetch transfers file e to the target unless the server reports that the
+// target copy is still current, either via the recorded entity tag or the
+// modification time of the copy
+func (m *httpMirror) fetch(e httpEntry, buf []byte) {
+	m.mu.Lock()
+	m.stats.numExamined++
+	etag := m.etags[filepath.ToSlash(e.path)]
+	m.mu.Unlock()
+
+	header := make(http.Header)
+	if fi, err := m.tgt.Lstat(e.path); err == nil && fi.info.Mode().IsRegular() {
+		header.Set("If-Modified-Since", fi.info.ModTime().UTC().Format(http.TimeFormat))
+		if etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+	}
+	resp, err := m.get(e.url, header)
+	if err != nil {
+		m.fail(e.path, "fetch", err)
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		m.mu.Lock()
+		m.stats.numUnchanged++
+		m.mu.Unlock()
+		return
+	case http.StatusOK:
+	default:
+		m.fail(e.path, "fetch", errors.New(resp.Status))
+		return
+	}
+
+	mtime := e.mtime
+	if mtime.IsZero() {
+		mtime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	}
+	var n int64
+	if m.opts.dryRun {
+		n = resp.ContentLength
+	} else if n, err = m.write(e, resp.Body, mtime, buf); err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.stats.numFiles++
+	if n > 0 {
+		m.stats.numBytes += n
+	}
+	if tag := resp.Header.Get("ETag"); tag != "" {
+		m.etags[filepath.ToSlash(e.path)] = tag
+	} else {
+		delete(m.etags, filepath.ToSlash(e.path))
+	}
+	m.mu.Unlock()
+	m.opts.log.infoEvent(levelFiles, event{Phase: "sync", Path: e.path, Action: "sync", Bytes: n}, "%s\n",
+		e.path)
+}
+
+// write stores the content of file e read from r on the target. Incomplete
+// copies are removed again since their modification time would make them
+// look current to later conditional requests.
+func (m *httpMirror) write(e httpEntry, r io.Reader, mtime time.Time, buf []byte) (int64, error) {
+	w, err := m.tgt.Create(e.path)
+	if err != nil {
+		m.fail(e.path, "create", err)
+		return 0, err
+	}
+	n, err := io.CopyBuffer(w, r, buf)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		m.tgt.Remove(e.path)
+		m.fail(e.path, "fetch", err)
+		return 0, err
+	}
+
+	mode := e.mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := m.tgt.Chmod(e.path, mode); err != nil {
+		m.fail(e.path, "set mode of", err)
+	}
+	// without a modification time, the server decides based on the entity
+	// tag and the time of the fetch
+	if !mtime.IsZero() {
+		if err := m.tgt.Chtimes(e.path, mtime); err != nil {
+			m.fail(e.path, "set modification time of", err)
+		}
+	}
+	return n, nil
+}
+
+// saveETags records the entity tags of the target files for the next run
+func (m *httpMirror) saveETags() error {
+	data, err := json.Marshal(m.etags)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.etagPath), 0755); err != nil {
+		return err
+	}
+	tmp := m.etagPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("%s: %s", tmp, err)
+	}
+	return os.Rename(tmp, m.etagPath)
+}
@@ -0,0 +1,69 @@
+package syngo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirrorHTTPStaysBelowLinks(t *testing.T) {
+	tgt, outside := t.TempDir(), t.TempDir()
+	// a link left on the target, e.g. by the manifest of a previous run
+	if err := os.Symlink(outside, filepath.Join(tgt, "old")); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{"/a/pwn": "pwned", "/old/pwn": "pwned", "/ok": "ok", "/d/f": "f"}
+	manifest := []manifestEntry{
+		{Path: "a", Mode: os.ModeSymlink | 0777, Link: outside},
+		{Path: "a/pwn", Mode: 0644},
+		{Path: "old/pwn", Mode: 0644},
+		{Path: "ok", Mode: 0644},
+		{Path: "d", Mode: os.ModeDir | 0755},
+		{Path: "d/f", Mode: 0644},
+		// listed before its parent link
+		{Path: "l/pwn", Mode: 0644},
+		{Path: "l", Mode: os.ModeSymlink | 0777, Link: outside},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest" {
+			enc := json.NewEncoder(w)
+			for _, e := range manifest {
+				enc.Encode(e)
+			}
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(data))
+	}))
+	defer srv.Close()
+
+	res, err := Sync([]string{srv.URL + "/manifest"}, tgt, Options{})
+	if err != ErrPartial {
+		t.Errorf("sync: %v", err)
+	}
+	// a/pwn, l/pwn, and old/pwn
+	if res.Errors != 3 || res.Files != 2 || res.Symlinks != 2 {
+		t.Errorf("%d errors, %d files, and %d links", res.Errors, res.Files, res.Symlinks)
+	}
+
+	if infos, err := ioutil.ReadDir(outside); err != nil || len(infos) != 0 {
+		t.Errorf("mirror wrote %d entries through links: %v", len(infos), err)
+	}
+	for _, p := range []string{"ok", "d/f"} {
+		if _, err := os.Stat(filepath.Join(tgt, p)); err != nil {
+			t.Error(err)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(tgt, "a")); err != nil || link != outside {
+		t.Errorf("link a -> %s: %v", link, err)
+	}
+}
@@ -0,0 +1,121 @@
+// index contains the file index persisted between sync runs which lets
+// repeated syncs of mostly unchanged trees skip looking up entries on the
+// target
+package syngo
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fileIndex records the source entries which were in sync with the target
+// at the end of a run. Entries whose source metadata still matches the one
+// recorded by the previous run are assumed to be up to date on the target.
+// NOTE: This only holds as long as the target is not changed by anything
+// but syngo; remove the index file to check the target itself again.
+type fileIndex struct {
+	path    string
+	prev    map[string]manifestEntry // entries recorded by the previous run
+	ctime   bool                     // entries whose inode changed since the previous run are changed
+	since   time.Time                // start of the previous run, kept as the index file's mtime
+	started time.Time                // start of the current run
+
+	mu   sync.Mutex
+	next []manifestEntry // entries recorded by the current run
+}
+
+// loadFileIndex loads the index kept at path, starting out empty if it does
+// not exist yet. With ctime, entries whose inode changed since the previous
+// run are not considered unchanged.
+func loadFileIndex(path string, ctime bool) (*fileIndex, error) {
+	x := &fileIndex{path: path, ctime: ctime, started: time.Now()}
+	entries, err := readManifestEntries(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		x.since = info.ModTime()
+	}
+	x.prev = make(map[string]manifestEntry, len(entries))
+	for _, e := range entries {
+		x.prev[e.Path] = e
+	}
+	return x, nil
+}
+
+// unchanged determines if the source entry file is recorded in the index
+// with the same size, modification time, mode, and link target. A nil index
+// never contains any entries.
+func (x *fileIndex) unchanged(file fileInfo) bool {
+	if x == nil {
+		return false
+	}
+	e, ok := x.prev[filepath.ToSlash(file.path)]
+	if !ok || e.Size != file.info.Size() || !e.Mtime.Equal(file.info.ModTime()) ||
+		e.Mode != file.info.Mode() || e.Link != file.linkPath {
+		return false
+	}
+	if x.ctime {
+		t, ok := inodeChangeTime(file.info)
+		return ok && t.Before(x.since)
+	}
+	return true
+}
+
+// record adds the source entry file, which is in sync with the target, to
+// the index of the current run
+func (x *fileIndex) record(file fileInfo) {
+	if x == nil {
+		return
+	}
+	e := manifestEntryOf(file)
+	e.Path = filepath.ToSlash(e.Path)
+	x.mu.Lock()
+	x.next = append(x.next, *e)
+	x.mu.Unlock()
+}
+
+// save replaces the index file with the entries recorded by the current run,
+// which become the starting point of the next run. The modification time of
+// the index is set to the start of the run.
+func (x *fileIndex) save() error {
+	if x == nil {
+		return nil
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	sort.Slice(x.next, func(i, j int) bool { return x.next[i].Path < x.next[j].Path })
+	tmp := x.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(f, x.next); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp, x.started, x.started); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, x.path); err != nil {
+		return err
+	}
+	// NOTE: The next run starts later, so entries changed in between are
+	// never missed
+	x.since, x.started = x.started, time.Now()
+	x.prev = make(map[string]manifestEntry, len(x.next))
+	for _, e := range x.next {
+		x.prev[e.Path] = e
+	}
+	x.next = nil
+	return nil
+}
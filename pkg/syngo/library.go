@@ -0,0 +1,255 @@
+// library contains the API for embedding syngo into other Go programs
+package syngo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Options configures a sync run started by Sync. The zero value syncs with
+// the same defaults as the syngo command.
+type Options struct {
+	Checkers   int   // number of concurrent target checkers, 0 for the default
+	Syncers    int   // number of concurrent file syncers, 0 for the default
+	BufferSize int   // size of the syncers' copy buffers, 0 for the default
+	Bwlimit    int64 // limit of the aggregate transfer rate in bytes/s, 0 if unlimited
+	Retries    int   // number of times failed entries are retried at the end of the run
+
+	CopyStreams    int   // goroutines copying ranges of large local files, disabled if at most 1
+	CopyStreamsMin int64 // files smaller than this are copied as a single stream, 0 for the default
+
+	Rsh         string // remote shell command used to reach remote targets, ssh if empty
+	RemoteSyngo string // path of the syngo binary on remote hosts, syngo if empty
+	S3Endpoint  string // endpoint URL of an S3 compatible object store
+
+	// Include and Exclude are regular expressions matched against the paths
+	// of source entries relative to their source root. Include rules are
+	// checked first; entries matching no rule are synced.
+	Include []string
+	Exclude []string
+	MinSize int64 // files smaller than this are skipped, ignored if 0
+	MaxSize int64 // files larger than this are skipped, ignored if 0
+	OneFS   bool  // do not descend into directories on other file systems
+	Follow  bool  // sync the referents of symbolic links instead of the links
+
+	SizeOnly     bool          // files of equal size are up to date
+	ModifyWindow time.Duration // modification times differing at most this much are equal
+	Update       bool          // skip files which are newer on the target
+	Verify       bool          // compare checksums of source and target after copying
+	Checksum     string        // checksum algorithm ("xxh64", "blake3", or "sha256"), xxh64 if empty
+	CompareSums  bool          // compare files of equal size by checksum instead of modification time
+	SumCache     string        // cache checksums of local files in this file, unused if empty
+	Partial      bool          // keep partial copies of files which failed to sync
+	Delete       bool          // remove extraneous entries from local targets
+	DryRun       bool          // only determine the changes without making them
+	NFS          bool          // tune local targets for NFS mounts (see the -nfs flag)
+	WaitForLock  time.Duration // how long to wait for other runs syncing to the same local target
+
+	// LinkDest, CompareDest, and CopyDest are basis directories laid out like
+	// the target, only one kind of them can be used. Files missing on the
+	// target which are unchanged in one of them are hard-linked from there
+	// (local targets only), skipped, or copied from there instead of the
+	// source, respectively.
+	LinkDest    []string
+	CompareDest []string
+	CopyDest    []string
+
+	// Transforms are called for every regular source file in order and may
+	// veto syncing it, rename it, or transform its content (see Transform)
+	Transforms []Transform
+
+	// Output receives the messages of the run up to Verbosity: -1 for none,
+	// 0 for its start and summary, 1 for every synced entry, and 2 for the
+	// decisions about every entry. Messages are printed to standard output
+	// if it is nil. Errors about individual entries are logged to ErrorLog,
+	// the standard logger if it is nil.
+	Verbosity int
+	Output    io.Writer
+	ErrorLog  *log.Logger
+}
+
+// Result summarizes a sync run
+type Result struct {
+	Files     int64    // number of synced files and symbolic links
+	Bytes     int64    // number of synced bytes
+	Errors    int64    // number of failures while scanning, checking, or syncing
+	Skipped   int64    // number of entries of unsupported types (devices, sockets, ...)
+	Conflicts int64    // number of entries which were newer on the target with Update
+	Deleted   int64    // number of extraneous target entries deleted
+	Examined  int64    // number of source files and symbolic links checked against the target
+	Unchanged int64    // number of examined entries which were up to date
+	Filtered  int64    // number of source entries skipped by filters and size limits
+	Dirs      int64    // number of directories created on the target
+	Symlinks  int64    // number of symbolic links created on the target
+	Failed    []string // target paths of the entries which failed to sync
+}
+
+// ErrPartial is returned by Sync if some entries could not be synced. The
+// result describes the run nevertheless.
+var ErrPartial = errors.New("some entries could not be synced")
+
+// Sync synchronizes the source trees srcs to the target tgtTree like the
+// syngo command. Sources are synced into a directory named like them on the
+// target unless they end in a slash, and targets may be given in any of the
+// forms supported by the command. Errors about individual entries are logged
+// and reported as ErrPartial, other errors abort the run.
+func Sync(srcs []string, tgtTree string, o Options) (Result, error) {
+	return SyncContext(context.Background(), srcs, tgtTree, o)
+}
+
+// SyncContext is like Sync but stops once ctx is canceled, aborting the
+// copies in flight. The result of the interrupted run is returned together
+// with the error of ctx.
+func SyncContext(ctx context.Context, srcs []string, tgtTree string, o Options) (Result, error) {
+	opts := &options{
+		ctx:          ctx,
+		checkers:     o.Checkers,
+		syncers:      o.Syncers,
+		bufferSize:   o.BufferSize,
+		retries:      o.Retries,
+		rsh:          o.Rsh,
+		remoteSyngo:  o.RemoteSyngo,
+		s3Endpoint:   o.S3Endpoint,
+		minSize:      o.MinSize,
+		maxSize:      o.MaxSize,
+		oneFS:        o.OneFS,
+		follow:       o.Follow,
+		sizeOnly:     o.SizeOnly,
+		modifyWindow: o.ModifyWindow,
+		update:       o.Update,
+		conflict:     conflictNewer,
+		verify:       o.Verify,
+		checksum:     o.CompareSums,
+		partial:      o.Partial,
+		delete:       o.Delete,
+		dryRun:       o.DryRun,
+		nfs:          o.NFS,
+		backupSuffix: defaultBackupSuffix,
+		waitForLock:  o.WaitForLock,
+		transforms:   o.Transforms,
+		log:          newRunLog(o.Verbosity, o.Output, o.ErrorLog),
+	}
+	if opts.rsh == "" {
+		opts.rsh = "ssh"
+	}
+	if opts.remoteSyngo == "" {
+		opts.remoteSyngo = "syngo"
+	}
+	opts.copyStreams, opts.copyStreamsMin = o.CopyStreams, o.CopyStreamsMin
+	algo, err := parseHashAlgo(o.Checksum)
+	if err != nil {
+		return Result{}, err
+	}
+	opts.checksumChoice = algo
+	if o.SumCache != "" {
+		if opts.sums, err = loadSumCache(o.SumCache); err != nil {
+			return Result{}, fmt.Errorf("failed to load checksum cache %s: %s", o.SumCache, err)
+		}
+	}
+	if o.Bwlimit > 0 {
+		opts.limiter = newRateLimiter(o.Bwlimit)
+	}
+	for mode, dirs := range [][]string{basisLink: o.LinkDest, basisCompare: o.CompareDest,
+		basisCopy: o.CopyDest} {
+		for _, dir := range dirs {
+			if err := (basisFlag{basis: &opts.basis, mode: mode}).Set(dir); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+	for _, rules := range []struct {
+		patterns []string
+		include  bool
+	}{{o.Include, true}, {o.Exclude, false}} {
+		for _, p := range rules.patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return Result{}, fmt.Errorf("invalid filter %s: %s", p, err)
+			}
+			opts.filters = append(opts.filters, filterRule{include: rules.include, re: re})
+		}
+	}
+
+	sources, err := sources(srcs)
+	if err != nil {
+		return Result{}, err
+	}
+	if !isRemote(tgtTree) {
+		if tgtTree, err = absPath(tgtTree); err != nil {
+			return Result{}, err
+		}
+	} else if opts.delete {
+		return Result{}, errors.New("Delete is only supported for local target trees")
+	}
+	defer closeSources(sources)
+	if err := checkHTTPSource(sources, opts); err != nil {
+		return Result{}, err
+	}
+	if err := checkArchiveSource(sources, opts); err != nil {
+		return Result{}, err
+	}
+	for _, src := range sources {
+		if isHTTPSource(src.root) || src.archive != nil {
+			continue
+		}
+		if err := checkInput(src.root, filepath.Join(tgtTree, src.prefix)); err != nil {
+			return Result{}, err
+		}
+	}
+
+	tgt, err := openTarget(tgtTree, opts)
+	if err != nil {
+		return Result{}, err
+	}
+	if _, ok := tgt.(*localFS); ok && !opts.dryRun {
+		lock, err := lockTarget(tgtTree, opts.waitForLock, opts.done(), opts.log)
+		if err != nil {
+			tgt.Close()
+			return Result{}, err
+		}
+		defer lock.unlock()
+	}
+	if err := checkTarget(tgt, tgtTree, opts, false); err != nil {
+		tgt.Close()
+		return Result{}, err
+	}
+	stats := syncSources(sources, tgt, tgtTree, opts)
+	if opts.delete && !opts.interrupted() {
+		numDeleted, numErrors := deleteExtra(sources, tgtTree, opts)
+		stats.numDeleted += numDeleted
+		stats.numErrors += numErrors
+	}
+	if err := tgt.Close(); err != nil {
+		return resultOf(stats), fmt.Errorf("failed to close target %s: %s", tgtTree, err)
+	}
+	if err := opts.sums.save(); err != nil {
+		return resultOf(stats), fmt.Errorf("failed to save checksum cache %s: %s", o.SumCache, err)
+	}
+
+	res := resultOf(stats)
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	if res.Errors > 0 {
+		return res, ErrPartial
+	}
+	return res, nil
+}
+
+// resultOf converts the statistics of a run into its result
+func resultOf(stats syncStats) Result {
+	res := Result{Files: stats.numFiles, Bytes: stats.numBytes, Errors: stats.numErrors,
+		Skipped: stats.numSkipped, Conflicts: stats.numConflicts, Deleted: stats.numDeleted,
+		Examined: stats.numExamined, Unchanged: stats.numUnchanged, Filtered: stats.numFiltered,
+		Dirs: stats.numDirs, Symlinks: stats.numSymlinks}
+	for _, f := range stats.failed {
+		res.Failed = append(res.Failed, f.path)
+	}
+	return res
+}
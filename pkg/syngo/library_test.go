@@ -0,0 +1,37 @@
+package syngo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSyncLogsPerRun(t *testing.T) {
+	names := []string{"a.txt", "b.txt"}
+	outputs := make([]bytes.Buffer, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		src, tgt := t.TempDir(), t.TempDir()
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(out *bytes.Buffer) {
+			defer wg.Done()
+			if _, err := Sync([]string{src + "/"}, tgt, Options{Verbosity: levelFiles, Output: out}); err != nil {
+				t.Error(err)
+			}
+		}(&outputs[i])
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		out := outputs[i].String()
+		if !strings.Contains(out, name) || strings.Contains(out, names[1-i]) {
+			t.Errorf("output of the run syncing %s: %q", name, out)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+// link_other contains the fallback for platforms without junctions
+package syngo
+
+import "os"
+
+// linkInfo returns info unchanged since symbolic links are reported as such
+// on this platform
+func linkInfo(path string, info os.FileInfo) os.FileInfo {
+	return info
+}
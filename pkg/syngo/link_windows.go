@@ -0,0 +1,35 @@
+//go:build windows
+
+// link_windows contains the handling of directory junctions on Windows
+package syngo
+
+import "os"
+
+// junctionInfo reports a directory junction as symbolic link so it is
+// recreated as a directory symbolic link on the target. NOTE: Creating
+// symbolic links requires the corresponding privilege or developer mode;
+// without it, syncing them fails with an error.
+type junctionInfo struct {
+	os.FileInfo
+}
+
+func (j junctionInfo) Mode() os.FileMode {
+	return os.ModeSymlink | j.FileInfo.Mode().Perm()
+}
+
+func (j junctionInfo) IsDir() bool {
+	return false
+}
+
+// linkInfo returns info of the entry at path, reporting junctions and other
+// name surrogate reparse points which os.Readlink can resolve as symbolic
+// links
+func linkInfo(path string, info os.FileInfo) os.FileInfo {
+	if info.Mode()&os.ModeIrregular == 0 {
+		return info
+	}
+	if _, err := os.Readlink(path); err != nil {
+		return info
+	}
+	return junctionInfo{info}
+}
@@ -0,0 +1,49 @@
+// lock contains the locking of local target trees which keeps concurrent
+// syngo runs from syncing to the same target
+package syngo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockRetryDelay is the delay between attempts to lock a target locked by
+// another run
+const lockRetryDelay = time.Second
+
+// errLocked is reported by tryLock if the lock is held by another process
+var errLocked = errors.New("locked")
+
+// lockTarget locks the local target tree tgt, waiting up to wait for other
+// runs holding the lock to finish or until done is closed, which is logged
+// to logs. The lock file is
+// kept in syngo's metadata directory of the target.
+func lockTarget(tgt string, wait time.Duration, done <-chan struct{}, logs *runLog) (*targetLock, error) {
+	path := filepath.Join(tgt, metaDir, "lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	waiting := false
+	for {
+		l, err := tryLock(path)
+		if err != errLocked {
+			return l, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%s is in use by another syngo run (lock file %s)", tgt, path)
+		}
+		if !waiting {
+			logs.infof(levelSummary, "waiting for another syngo run syncing to %s\n", tgt)
+			waiting = true
+		}
+		select {
+		case <-time.After(lockRetryDelay):
+		case <-done:
+			return nil, fmt.Errorf("interrupted while waiting for the lock of %s", tgt)
+		}
+	}
+}
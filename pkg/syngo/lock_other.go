@@ -0,0 +1,36 @@
+//go:build !unix
+
+// lock_other contains the locking of target trees via exclusively created
+// lock files on platforms without flock(2)
+package syngo
+
+import (
+	"fmt"
+	"os"
+)
+
+// targetLock is a lock file which exists while the lock is held.
+// NOTE: The lock file stays behind if syngo dies and has to be removed by
+// hand.
+type targetLock struct {
+	path string
+}
+
+// tryLock acquires the lock file at path without waiting and records the
+// process ID of the holder in it for reference
+func tryLock(path string) (*targetLock, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, errLocked
+	} else if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+	return &targetLock{path: path}, nil
+}
+
+// unlock releases the lock
+func (l *targetLock) unlock() {
+	os.Remove(l.path)
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+// lock_unix contains the advisory locking of target trees via flock(2) on
+// unix platforms
+package syngo
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// targetLock is a lock file held via flock(2). The lock is released by the
+// kernel if syngo dies, so stale lock files are harmless.
+type targetLock struct {
+	f *os.File
+}
+
+// tryLock acquires the lock file at path without waiting and records the
+// process ID of the holder in it for reference
+func tryLock(path string) (*targetLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return &targetLock{f: f}, nil
+}
+
+// unlock releases the lock
+func (l *targetLock) unlock() {
+	l.f.Close()
+}
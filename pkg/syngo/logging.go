@@ -0,0 +1,305 @@
+// logging contains syngo's leveled console output. Errors are always logged
+// via the log package; all other messages go through infof and are shown
+// depending on the selected verbosity. With -log-format json, messages and
+// errors are instead written as structured events, one JSON object per line.
+package syngo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// verbosity levels selectable on the command line
+const (
+	levelQuiet     = -1 // -q: errors only
+	levelSummary   = 0  // start and summary of a run (default)
+	levelFiles     = 1  // -v: every synced entry
+	levelDecisions = 2  // -vv: per file decisions of the checkers
+)
+
+// runLog holds the logging state of a run: the verbosity and destinations
+// of its messages and the errors logged for its error summary. A nil runLog
+// stands for defaultLog.
+type runLog struct {
+	verbosity int
+	json      bool        // log structured JSON events instead of text
+	stdout    io.Writer   // receives messages, see printf
+	errors    *log.Logger // receives errors in text mode
+
+	// file selected with -log-file and the logger recording messages in it,
+	// nil if no log file is used
+	file    *os.File
+	fileLog *log.Logger
+
+	summary errorSummary // errors logged via logError
+}
+
+// defaultLog is the log of the syngo command, configured by its flags. Its
+// stdout is switched to stderr if stdout carries data such as an archive.
+var defaultLog = &runLog{verbosity: levelSummary, stdout: os.Stdout, errors: log.Default()}
+
+// newRunLog returns a log of messages up to verbosity written to stdout and
+// of errors written to errors, which default to standard output and the
+// standard logger if nil
+func newRunLog(verbosity int, stdout io.Writer, errors *log.Logger) *runLog {
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if errors == nil {
+		errors = log.Default()
+	}
+	return &runLog{verbosity: verbosity, stdout: stdout, errors: errors}
+}
+
+// orDefault returns l, or defaultLog if l is nil
+func (l *runLog) orDefault() *runLog {
+	if l == nil {
+		return defaultLog
+	}
+	return l
+}
+
+// event is a structured log event
+type event struct {
+	Time   time.Time `json:"time"`
+	Level  string    `json:"level"`           // info or error
+	Phase  string    `json:"phase,omitempty"` // scan, dirs, check, or sync
+	Path   string    `json:"path,omitempty"`
+	Action string    `json:"action,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Bytes  int64     `json:"bytes,omitempty"`
+	Msg    string    `json:"msg,omitempty"`
+}
+
+// emit writes ev to stderr if the verbosity is at least level and to the log
+// file following the same rules as infof
+func (l *runLog) emit(level int, ev event) {
+	l = l.orDefault()
+	ev.Time = time.Now()
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	if l.verbosity >= level {
+		os.Stderr.Write(data)
+	}
+	if l.file != nil && (l.verbosity >= level || level <= levelFiles) {
+		l.file.Write(data)
+	}
+}
+
+// maxSummaryPaths is the number of affected paths listed per error type in
+// the error summary
+const maxSummaryPaths = 10
+
+// errorSummary collects the paths affected by errors during a run grouped by
+// the failed action and the cause of the error
+type errorSummary struct {
+	mu    sync.Mutex
+	paths map[string][]string
+}
+
+// errorCause returns a short description of the cause of err such as
+// "permission denied", stripping the paths included in most errors
+func errorCause(err error) string {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno.Error()
+	}
+	return "other errors"
+}
+
+func (s *errorSummary) add(path, action string, err error) {
+	key := action + ": " + errorCause(err)
+	s.mu.Lock()
+	if s.paths == nil {
+		s.paths = make(map[string][]string)
+	}
+	s.paths[key] = append(s.paths[key], path)
+	s.mu.Unlock()
+}
+
+// reset drops all recorded errors
+func (s *errorSummary) reset() {
+	s.mu.Lock()
+	s.paths = nil
+	s.mu.Unlock()
+}
+
+// forget drops all errors recorded for path
+func (s *errorSummary) forget(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, paths := range s.paths {
+		kept := paths[:0]
+		for _, p := range paths {
+			if p != path {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.paths, k)
+		} else {
+			s.paths[k] = kept
+		}
+	}
+}
+
+// print lists the number of errors per type and the affected paths on stderr
+func (s *errorSummary) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.paths) == 0 {
+		return
+	}
+
+	var keys []string
+	for k := range s.paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(os.Stderr, "\nerror summary:")
+	for _, k := range keys {
+		paths := s.paths[k]
+		sort.Strings(paths)
+		fmt.Fprintf(os.Stderr, "  %s (%d)\n", k, len(paths))
+		for i, p := range paths {
+			if i == maxSummaryPaths {
+				fmt.Fprintf(os.Stderr, "    ... and %d more\n", len(paths)-i)
+				break
+			}
+			fmt.Fprintf(os.Stderr, "    %s\n", p)
+		}
+	}
+}
+
+// resetErrors drops all errors recorded for the error summary
+func (l *runLog) resetErrors() {
+	l.orDefault().summary.reset()
+}
+
+// forgetErrors drops all errors recorded for path, e.g. before it is
+// retried
+func (l *runLog) forgetErrors(path string) {
+	l.orDefault().summary.forget(path)
+}
+
+// printErrors prints the error summary on stderr
+func (l *runLog) printErrors() {
+	l.orDefault().summary.print()
+}
+
+// logError logs the failure of action on path during phase
+func (l *runLog) logError(phase, path, action string, err error) {
+	l = l.orDefault()
+	l.summary.add(path, action, err)
+	if l.json {
+		l.emit(levelQuiet, event{Level: "error", Phase: phase, Path: path, Action: action,
+			Error: err.Error()})
+		return
+	}
+	l.errors.Printf("failed to %s %s: %s\n", action, path, err)
+}
+
+// infoEvent logs ev at the provided level, as the message described by
+// format and args in text mode
+func (l *runLog) infoEvent(level int, ev event, format string, args ...interface{}) {
+	l = l.orDefault()
+	if !l.json {
+		l.infof(level, format, args...)
+		return
+	}
+	ev.Level = "info"
+	l.emit(level, ev)
+}
+
+// openLogFile appends all errors and messages of the syngo command up to at
+// least levelFiles to the file at path, independent of the console
+// verbosity
+func openLogFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defaultLog.file = f
+	defaultLog.fileLog = log.New(f, "", log.LstdFlags)
+	log.SetOutput(io.MultiWriter(os.Stderr, f))
+	return nil
+}
+
+// printf prints a message to stdout and records it in the log file
+func (l *runLog) printf(format string, args ...interface{}) {
+	l = l.orDefault()
+	fmt.Fprintf(l.stdout, format, args...)
+	if l.fileLog != nil {
+		l.fileLog.Printf(format, args...)
+	}
+}
+
+// infof prints a message to stdout if the verbosity is at least level
+func (l *runLog) infof(level int, format string, args ...interface{}) {
+	l = l.orDefault()
+	if l.json {
+		l.emit(level, event{Level: "info", Msg: strings.TrimSpace(fmt.Sprintf(format, args...))})
+		return
+	}
+	if l.verbosity >= level {
+		l.printf(format, args...)
+	} else if l.fileLog != nil && level <= levelFiles {
+		l.fileLog.Printf(format, args...)
+	}
+}
+
+// The following functions log to defaultLog, for commands other than sync
+// whose output is not configured per run.
+
+func logError(phase, path, action string, err error) {
+	defaultLog.logError(phase, path, action, err)
+}
+
+func infoEvent(level int, ev event, format string, args ...interface{}) {
+	defaultLog.infoEvent(level, ev, format, args...)
+}
+
+func printf(format string, args ...interface{}) {
+	defaultLog.printf(format, args...)
+}
+
+func infof(level int, format string, args ...interface{}) {
+	defaultLog.infof(level, format, args...)
+}
+
+// describeChange describes the reasons for syncing an entry in words
+func describeChange(change int) string {
+	if change&changeNew != 0 {
+		return "new"
+	}
+	var reasons []string
+	for i, c := range []int{changeSize, changeTime, changeMode, changeLink, changeContent, changeCtime} {
+		if change&c != 0 {
+			reasons = append(reasons, []string{"size", "time", "permissions", "link target",
+				"content", "change time"}[i])
+		}
+	}
+	if len(reasons) == 1 {
+		return reasons[0] + " differs"
+	}
+	return strings.Join(reasons, ", ") + " differ"
+}
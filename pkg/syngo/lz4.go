@@ -0,0 +1,162 @@
+// lz4 contains a compressor and decompressor of the LZ4 block format used for
+// compressing file data sent to syngo servers. Only single blocks without the
+// LZ4 frame format are supported since write chunks are compressed one at a
+// time and carry their uncompressed size themselves.
+package syngo
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// LZ4 block format limits
+const (
+	lz4MinMatch     = 4     // shortest match encoded
+	lz4LastLiterals = 5     // bytes at the end of a block which are always literals
+	lz4MatchLimit   = 12    // matches start at least this many bytes before the end
+	lz4MaxOffset    = 65535 // longest distance of a match
+	lz4HashLog      = 14    // log2 of the number of entries in the match table
+)
+
+var errLZ4Corrupt = errors.New("corrupt lz4 block")
+
+// lz4Hash returns the match table index of the 4 bytes v
+func lz4Hash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lz4HashLog)
+}
+
+// lz4Compress returns the LZ4 block encoding of src. Matches are searched at
+// every position until no match was found for a while, larger accelerations
+// skip more positions, trading compression for speed.
+func lz4Compress(src []byte, accel int) []byte {
+	if accel < 1 {
+		accel = 1
+	}
+	dst := make([]byte, 0, len(src)+len(src)/255+16)
+	var table [1 << lz4HashLog]int32 // positions + 1 of recently seen 4 byte sequences
+	anchor := 0                      // start of the pending literals
+	for i, limit := 0, len(src)-lz4MatchLimit; i < limit; {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := lz4Hash(v)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > lz4MaxOffset || binary.LittleEndian.Uint32(src[cand:]) != v {
+			i += accel + (i-anchor)>>6
+			continue
+		}
+
+		for i > anchor && cand > 0 && src[i-1] == src[cand-1] {
+			i--
+			cand--
+		}
+		end := i + lz4MinMatch
+		for end < len(src)-lz4LastLiterals && src[end] == src[end-i+cand] {
+			end++
+		}
+		dst = lz4Sequence(dst, src[anchor:i], i-cand, end-i)
+		anchor, i = end, end
+	}
+	return lz4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4Sequence appends the sequence of the literals lit followed by a match of
+// matchLen bytes at offset to dst. The last sequence of a block has no match.
+func lz4Sequence(dst, lit []byte, offset, matchLen int) []byte {
+	ml := matchLen - lz4MinMatch
+	token := byte(15 << 4)
+	if len(lit) < 15 {
+		token = byte(len(lit) << 4)
+	}
+	if matchLen > 0 {
+		if ml < 15 {
+			token |= byte(ml)
+		} else {
+			token |= 15
+		}
+	}
+	dst = append(dst, token)
+	dst = lz4AppendLength(dst, len(lit))
+	dst = append(dst, lit...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset>>8))
+	return lz4AppendLength(dst, ml)
+}
+
+// lz4AppendLength appends the bytes extending the length n beyond the 4 bits
+// of a token
+func lz4AppendLength(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4ReadLength returns the length n of a token extended by the bytes at
+// src[i:] and the index following them
+func lz4ReadLength(src []byte, i, n int) (int, int, error) {
+	if n < 15 {
+		return n, i, nil
+	}
+	for {
+		if i >= len(src) {
+			return 0, i, errLZ4Corrupt
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, nil
+		}
+	}
+}
+
+// lz4Decompress returns the size bytes encoded by the LZ4 block src
+func lz4Decompress(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	for i := 0; ; {
+		if i >= len(src) {
+			return nil, errLZ4Corrupt
+		}
+		token := src[i]
+		var n int
+		var err error
+		n, i, err = lz4ReadLength(src, i+1, int(token>>4))
+		if err != nil || n > len(src)-i || n > size-len(dst) {
+			return nil, errLZ4Corrupt
+		}
+		dst = append(dst, src[i:i+n]...)
+		i += n
+		if i == len(src) {
+			break
+		}
+
+		if len(src)-i < 2 {
+			return nil, errLZ4Corrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		if offset == 0 || offset > len(dst) {
+			return nil, errLZ4Corrupt
+		}
+		if n, i, err = lz4ReadLength(src, i+2, int(token&15)); err != nil {
+			return nil, err
+		}
+		n += lz4MinMatch
+		if n > size-len(dst) {
+			return nil, errLZ4Corrupt
+		}
+		// matches may overlap the bytes they produce
+		for start := len(dst) - offset; n > 0; n-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+	if len(dst) != size {
+		return nil, errLZ4Corrupt
+	}
+	return dst, nil
+}
@@ -0,0 +1,65 @@
+package syngo
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestLZ4RoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("syngo synchronizes file trees. "), 5000)
+	for name, data := range map[string][]byte{
+		"empty":      nil,
+		"short":      []byte("abc"),
+		"zeros":      make([]byte, writeChunkSize),
+		"text":       text,
+		"random":     randomData(5, 100000),
+		"long match": append(randomData(6, 70000), randomData(6, 70000)...),
+	} {
+		for _, accel := range []int{1, 5} {
+			packed := lz4Compress(data, accel)
+			got, err := lz4Decompress(packed, len(data))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s at acceleration %d: %v", name, accel, err)
+			}
+		}
+	}
+	if packed := lz4Compress(text, 1); len(packed) > len(text)/20 {
+		t.Errorf("repeated text compressed to %d of %d bytes", len(packed), len(text))
+	}
+}
+
+func TestLZ4RejectsCorruptBlocks(t *testing.T) {
+	data := randomData(7, 1000)
+	data = append(data, data...)
+	packed := lz4Compress(data, 1)
+	for i := 0; i < 200; i++ {
+		corrupt := append([]byte(nil), packed[:rand.Intn(len(packed))]...)
+		if i%2 == 0 {
+			corrupt = append([]byte(nil), packed...)
+			corrupt[rand.Intn(len(corrupt))] ^= byte(1 + rand.Intn(255))
+		}
+		// corrupt blocks must not panic, though some changes to literals
+		// decode to different data of the same size
+		lz4Decompress(corrupt, len(data))
+	}
+	if _, err := lz4Decompress(packed, len(data)-1); err == nil {
+		t.Error("block decompressed to the wrong size")
+	}
+}
+
+func TestCompressorRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible data "), 10000)
+	for _, algorithm := range []string{compressLZ4, compressDeflate} {
+		packed := newCompressor(algorithm, defaultCompressLevel).compress(data)
+		if packed == nil {
+			t.Fatalf("%s did not compress", algorithm)
+		}
+		if got, err := decompress(algorithm, packed); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s round trip: %v", algorithm, err)
+		}
+	}
+	if packed := newCompressor(compressLZ4, 1).compress(randomData(8, 1000)); packed != nil {
+		t.Errorf("random data compressed to %d bytes", len(packed))
+	}
+}
@@ -0,0 +1,120 @@
+//go:build darwin
+
+// macmeta_darwin contains the copying of macOS specific metadata such as
+// Finder info and resource forks, which macOS keeps in com.apple.* extended
+// attributes
+package syngo
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// macMetadataSupported reports that -mac-metadata works on this platform
+const macMetadataSupported = true
+
+// xattrNoFollow makes the xattr calls act on symbolic links themselves
+const xattrNoFollow = 0x0001
+
+// copyMacMetadata copies the com.apple.* extended attributes of the entry
+// at src to the entry at dst
+func copyMacMetadata(src, dst string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "com.apple.") {
+			continue
+		}
+		value, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := setXattr(dst, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listXattrs returns the names of the extended attributes of path
+func listXattrs(path string) ([]string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_LISTXATTR, uintptr(unsafe.Pointer(p)), 0, 0,
+		xattrNoFollow, 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, _, errno = syscall.Syscall6(syscall.SYS_LISTXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(&buf[0])), size, xattrNoFollow, 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	var names []string
+	for _, n := range bytes.Split(buf[:size], []byte{0}) {
+		if len(n) > 0 {
+			names = append(names, string(n))
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of the extended attribute name of path
+func getXattr(path, name string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	size, _, errno := syscall.Syscall6(syscall.SYS_GETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(n)), 0, 0, 0, xattrNoFollow)
+	if errno != 0 {
+		return nil, errno
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	size, _, errno = syscall.Syscall6(syscall.SYS_GETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(&buf[0])), size, 0, xattrNoFollow)
+	if errno != 0 {
+		return nil, errno
+	}
+	return buf[:size], nil
+}
+
+// setXattr sets the extended attribute name of path to value
+func setXattr(path, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(n)), uintptr(v), uintptr(len(value)), 0, xattrNoFollow)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
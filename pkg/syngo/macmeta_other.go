@@ -0,0 +1,15 @@
+//go:build !darwin
+
+// macmeta_other contains the fallback for platforms without macOS metadata
+package syngo
+
+import "errors"
+
+// macMetadataSupported reports that -mac-metadata does not work on this
+// platform
+const macMetadataSupported = false
+
+// copyMacMetadata always fails since there is no macOS metadata to copy
+func copyMacMetadata(src, dst string) error {
+	return errors.New("macOS metadata is not supported on this platform")
+}
@@ -0,0 +1,200 @@
+// manifest contains the manifest subcommand which records the state of a
+// tree in a file for later verification or offline comparison
+package syngo
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// manifestEntry describes a single entry of a tree. Manifests consist of one
+// JSON encoded entry per line sorted by path.
+type manifestEntry struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	Mtime  time.Time   `json:"mtime"`
+	Link   string      `json:"link,omitempty"`   // target of symbolic links
+	SHA256 string      `json:"sha256,omitempty"` // checksum of regular files, see -checksum-choice
+	XXH64  string      `json:"xxh64,omitempty"`
+	BLAKE3 string      `json:"blake3,omitempty"`
+	Chunks []string    `json:"chunks,omitempty"` // content chunks of files in repositories
+}
+
+// manifestCmd implements syngo manifest, writing the manifest of a tree to
+// stdout or a file
+func manifestCmd(args []string) {
+	flags := flag.NewFlagSet("manifest", flag.ExitOnError)
+	out := flags.String("o", "", "write the manifest to this file instead of stdout")
+	hash := flags.Bool("hash", true, "record the checksum of every regular file")
+	algo := defaultHash
+	flags.Var(hashAlgoFlag{&algo}, "checksum-choice", checksumChoiceUsage)
+	cacheFile := flags.String("checksum-cache", "", "cache checksums in this file so unchanged files are not reread by later runs")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo manifest [options] <tree>")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+	}
+
+	tree, err := absPath(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if info, err := os.Stat(tree); err != nil || !info.IsDir() {
+		log.Fatalf("%s is not a directory\n", tree)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if !*hash {
+		algo = ""
+	}
+	sums := openSumCache("manifest", *cacheFile)
+	entries, numErrors := scanManifest(tree, algo, sums)
+	if err := sums.save(); err != nil {
+		log.Printf("manifest: failed to save checksum cache: %v\n", err)
+	}
+	if err := writeManifest(w, entries); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if numErrors > 0 {
+		log.Printf("%d entries could not be recorded\n", numErrors)
+		os.Exit(exitPartial)
+	}
+}
+
+// scanManifest returns the manifest entries of the tree rooted at root
+// sorted by path together with the number of entries which could not be
+// recorded. The checksums of regular files are computed with algo unless it
+// is empty, and looked up in and added to sums if it is not nil.
+func scanManifest(root string, algo hashAlgo, sums *sumCache) ([]manifestEntry, int64) {
+	fs := &localFS{root: root, sums: sums}
+	var mu sync.Mutex
+	var entries []manifestEntry
+	var numErrors int64
+	numErrors += walkTree(root, numWalkers, nil, func(relPath string, d os.DirEntry) bool {
+		if relPath == "." {
+			return true
+		}
+		fi, err := fs.Lstat(relPath)
+		if err != nil {
+			logError("manifest", relPath, "stat", err)
+			atomic.AddInt64(&numErrors, 1)
+			return false
+		}
+		e := manifestEntry{Path: filepath.ToSlash(relPath), Size: fi.info.Size(), Mode: fi.info.Mode(),
+			Mtime: fi.info.ModTime(), Link: fi.linkPath}
+		if algo != "" && fi.info.Mode().IsRegular() {
+			sum, err := fs.PrefixSum(relPath, e.Size, algo)
+			if err != nil {
+				logError("manifest", relPath, "checksum", err)
+				atomic.AddInt64(&numErrors, 1)
+				return false
+			}
+			e.setSum(algo, sum)
+		}
+		mu.Lock()
+		entries = append(entries, e)
+		mu.Unlock()
+		return d.IsDir()
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, numErrors
+}
+
+// setSum records the algo checksum sum of e
+func (e *manifestEntry) setSum(algo hashAlgo, sum []byte) {
+	s := hex.EncodeToString(sum)
+	switch algo {
+	case hashXXH64:
+		e.XXH64 = s
+	case hashBLAKE3:
+		e.BLAKE3 = s
+	default:
+		e.SHA256 = s
+	}
+}
+
+// writeManifest writes entries to w, one per line
+func writeManifest(w io.Writer, entries []manifestEntry) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for i := range entries {
+		if err := enc.Encode(&entries[i]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// readManifestEntries loads the entries of the manifest at path
+func readManifestEntries(path string) ([]manifestEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeManifest(f, path)
+}
+
+// decodeManifest reads the entries of the manifest named name from r
+func decodeManifest(r io.Reader, name string) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e manifestEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %s", name, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readManifest loads the manifest at path as a map from paths to the
+// recorded entries. The root of the tree is included as ".".
+func readManifest(path string) (map[string]fileInfo, error) {
+	manifest, err := readManifestEntries(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]fileInfo{
+		".": {info: &statInfo{FName: ".", FMode: os.ModeDir | 0755}, path: "."},
+	}
+	for _, e := range manifest {
+		p := filepath.FromSlash(e.Path)
+		entries[p] = fileInfo{
+			info: &statInfo{FName: filepath.Base(p), FSize: e.Size, FMode: e.Mode,
+				FModTime: e.Mtime},
+			path:     p,
+			linkPath: e.Link,
+		}
+	}
+	return entries, nil
+}
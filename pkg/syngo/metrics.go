@@ -0,0 +1,101 @@
+// metrics contains the Prometheus metrics endpoint of long running syngo
+// processes, i.e. syncs with -watch or -every and daemons
+package syngo
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// metrics accumulates the counters exported by the metrics endpoint. Runs
+// are sync runs, or client connections for daemons.
+type metrics struct {
+	mu          sync.Mutex
+	bytes       int64     // bytes transferred by syncs or received by daemons
+	files       int64     // files synced or written
+	errors      int64     // failed entries or connections
+	runs        int64     // completed runs
+	lastSuccess time.Time // end of the last run without errors
+	lastRun     time.Duration
+	runsTime    time.Duration // total duration of all runs
+}
+
+// procMetrics are the metrics of this process, nil unless they are exported
+var procMetrics *metrics
+
+// serveMetrics starts exporting the process' metrics at /metrics on addr
+func serveMetrics(addr string) {
+	procMetrics = &metrics{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", procMetrics.serveHTTP)
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+}
+
+// recordRun adds a run which started at start and transferred n bytes of
+// files with numErrors failures. A nil metrics is allowed.
+func (m *metrics) recordRun(start time.Time, n, files, numErrors int64) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start)
+	m.mu.Lock()
+	m.bytes += n
+	m.files += files
+	m.errors += numErrors
+	m.runs++
+	m.lastRun = d
+	m.runsTime += d
+	if numErrors == 0 {
+		m.lastSuccess = time.Now()
+	}
+	m.mu.Unlock()
+}
+
+// addTransfer records n bytes and files of a run which is still going on,
+// e.g. a daemon connection. A nil metrics is allowed.
+func (m *metrics) addTransfer(n, files int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.bytes += n
+	m.files += files
+	m.mu.Unlock()
+}
+
+// serveHTTP writes the metrics in the Prometheus text exposition format
+func (m *metrics) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	lastSuccess := math.NaN()
+	if !m.lastSuccess.IsZero() {
+		lastSuccess = float64(m.lastSuccess.UnixNano()) / 1e9
+	}
+	values := []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"syngo_bytes_total", "counter", "Bytes transferred by sync runs or received by the daemon.", float64(m.bytes)},
+		{"syngo_files_total", "counter", "Files synced by sync runs or written by the daemon.", float64(m.files)},
+		{"syngo_errors_total", "counter", "Entries which failed to sync or failed daemon connections.", float64(m.errors)},
+		{"syngo_last_success_timestamp_seconds", "gauge", "End of the last run without errors.", lastSuccess},
+		{"syngo_last_run_duration_seconds", "gauge", "Duration of the last run.", m.lastRun.Seconds()},
+	}
+	runs, runsTime := m.runs, m.runsTime
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, v := range values {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", v.name, v.help, v.name, v.kind,
+			v.name, v.value)
+	}
+	fmt.Fprintf(w, "# HELP syngo_run_duration_seconds Duration of runs or daemon connections.\n")
+	fmt.Fprintf(w, "# TYPE syngo_run_duration_seconds summary\n")
+	fmt.Fprintf(w, "syngo_run_duration_seconds_sum %g\n", runsTime.Seconds())
+	fmt.Fprintf(w, "syngo_run_duration_seconds_count %d\n", runs)
+}
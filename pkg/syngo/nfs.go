@@ -0,0 +1,74 @@
+// nfs contains the adjustments of local targets for trees on NFS mounts,
+// where every lookup is a round trip to the server and the server may
+// truncate modification times
+package syngo
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// nfsCache answers lookups in a local target tree from listings of whole
+// directories. Listing a directory is a single READDIRPLUS request on NFS
+// which also fills the client's attribute cache, whereas looking up entries
+// one at a time costs a request each, especially for missing ones.
+type nfsCache struct {
+	mu      sync.Mutex
+	dirs    map[string]map[string]os.FileInfo // listings of directories by name
+	changed map[string]bool                   // paths modified since listing
+}
+
+func newNFSCache() *nfsCache {
+	return &nfsCache{dirs: make(map[string]map[string]os.FileInfo),
+		changed: make(map[string]bool)}
+}
+
+// lstat returns information about path in l, from the listing of its parent
+// directory if possible. Without a cache the entry is looked up directly.
+func (c *nfsCache) lstat(l *localFS, path string) (os.FileInfo, error) {
+	if c == nil {
+		return os.Lstat(l.path(path))
+	}
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+
+	c.mu.Lock()
+	listing, listed := c.dirs[dir]
+	changed := c.changed[path]
+	c.mu.Unlock()
+	if changed || path == "." {
+		return os.Lstat(l.path(path))
+	}
+
+	if !listed {
+		entries, err := os.ReadDir(l.path(dir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		listing = make(map[string]os.FileInfo, len(entries))
+		for _, e := range entries {
+			// entries removed since listing are skipped
+			if info, err := e.Info(); err == nil {
+				listing[e.Name()] = info
+			}
+		}
+		c.mu.Lock()
+		c.dirs[dir] = listing
+		c.mu.Unlock()
+	}
+	if info, ok := listing[filepath.Base(path)]; ok {
+		return info, nil
+	}
+	return nil, &os.PathError{Op: "lstat", Path: l.path(path), Err: os.ErrNotExist}
+}
+
+// forget marks path as modified so it is no longer looked up in the listing
+func (c *nfsCache) forget(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.changed[filepath.Clean(path)] = true
+	c.mu.Unlock()
+}
@@ -0,0 +1,284 @@
+// objects contains a generic backend for cloud object stores. Files map to
+// objects below a key prefix, file modes, modification times, and symbolic
+// link targets are kept in object metadata.
+package syngo
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// object metadata keys used for storing file attributes
+const (
+	metaMtime   = "syngo-mtime"
+	metaMode    = "syngo-mode"
+	metaSymlink = "syngo-symlink"
+)
+
+// objectAttrs describes a stored object
+type objectAttrs struct {
+	size     int64
+	modified time.Time
+	meta     map[string]string
+}
+
+// objectStore is implemented by the individual object store services. Keys
+// are full object keys, metadata keys are lower case.
+type objectStore interface {
+	// head returns the attributes of the object stored under key
+	head(key string) (objectAttrs, error)
+
+	// upload returns a writer storing all data written to it as object key
+	// with the provided metadata once it is closed
+	upload(key string, meta map[string]string) (io.WriteCloser, error)
+
+	// download returns a reader for the data of object key
+	download(key string) (io.ReadCloser, error)
+
+	// setMeta replaces the metadata of object key
+	setMeta(key string, meta map[string]string) error
+
+	remove(key string) error
+}
+
+// objectLister is implemented by object stores which can list all objects
+// below a key prefix including their metadata with a few requests
+type objectLister interface {
+	list(prefix string) (map[string]objectAttrs, error)
+}
+
+// objectFS is a backend storing the target tree in an object store. If the
+// store supports listing, the objects below the prefix are listed once and
+// lookups are answered from the listing instead of one request per file.
+type objectFS struct {
+	store  objectStore
+	prefix string
+
+	once    sync.Once
+	mu      sync.Mutex
+	listing map[string]objectAttrs // nil if listing is not available
+	changed map[string]bool        // keys modified since the listing
+}
+
+// loadListing lists the objects below the prefix once if the store supports
+// it
+func (o *objectFS) loadListing() {
+	o.once.Do(func() {
+		lister, ok := o.store.(objectLister)
+		if !ok {
+			return
+		}
+		prefix := o.prefix
+		if prefix != "" {
+			prefix += "/"
+		}
+		listing, err := lister.list(prefix)
+		if err != nil {
+			log.Printf("failed to list objects, falling back to individual lookups: %s\n", err)
+			return
+		}
+		o.listing = listing
+		o.changed = make(map[string]bool)
+	})
+}
+
+// lookup returns the attributes of object key, from the listing if possible
+func (o *objectFS) lookup(key string) (objectAttrs, error) {
+	o.loadListing()
+	o.mu.Lock()
+	if o.listing != nil && !o.changed[key] {
+		attrs, ok := o.listing[key]
+		o.mu.Unlock()
+		if !ok {
+			return attrs, &os.PathError{Op: "lstat", Path: key, Err: os.ErrNotExist}
+		}
+		return attrs, nil
+	}
+	o.mu.Unlock()
+	return o.store.head(key)
+}
+
+// forget marks object key as modified so it is no longer looked up in the
+// listing
+func (o *objectFS) forget(key string) {
+	o.mu.Lock()
+	if o.changed != nil {
+		o.changed[key] = true
+	}
+	o.mu.Unlock()
+}
+
+// key returns the object key for path p
+func (o *objectFS) key(p string) string {
+	return strings.TrimPrefix(path.Join(o.prefix, p), "/")
+}
+
+// attrMeta returns the metadata describing a file with the provided mode and
+// modification time
+func attrMeta(mode os.FileMode, mtime time.Time) map[string]string {
+	return map[string]string{
+		metaMtime: strconv.FormatInt(mtime.UnixNano(), 10),
+		metaMode:  strconv.FormatUint(uint64(mode), 8),
+	}
+}
+
+// objectInfo reconstructs file information from the attributes of the object
+// representing path p
+func objectInfo(p string, attrs objectAttrs) (*statInfo, string) {
+	info := &statInfo{
+		FName:    path.Base(p),
+		FSize:    attrs.size,
+		FMode:    0644,
+		FModTime: attrs.modified,
+	}
+	if v, err := strconv.ParseInt(attrs.meta[metaMtime], 10, 64); err == nil {
+		info.FModTime = time.Unix(0, v)
+	}
+	if v, err := strconv.ParseUint(attrs.meta[metaMode], 8, 32); err == nil {
+		info.FMode = os.FileMode(v)
+	}
+
+	var linkPath string
+	if v, ok := attrs.meta[metaSymlink]; ok {
+		linkPath, _ = url.QueryUnescape(v)
+		info.FMode |= os.ModeSymlink
+	}
+	return info, linkPath
+}
+
+func (o *objectFS) Lstat(p string) (fileInfo, error) {
+	attrs, err := o.lookup(o.key(p))
+	if err != nil {
+		return fileInfo{}, err
+	}
+	info, linkPath := objectInfo(p, attrs)
+	return fileInfo{info: info, path: p, linkPath: linkPath}, nil
+}
+
+// List derives the entries of directory p from the listing of all objects,
+// with directories for common key prefixes. Objects modified since the
+// listing are looked up again.
+// NOTE: Empty directories do not exist in object stores and are never listed.
+func (o *objectFS) List(p string) ([]fileInfo, error) {
+	o.loadListing()
+	if o.listing == nil {
+		return nil, errors.New("listing is not supported by the object store")
+	}
+	prefix := o.key(p)
+	if prefix == "." {
+		prefix = ""
+	} else if prefix != "" {
+		prefix += "/"
+	}
+	o.mu.Lock()
+	var keys []string
+	dirs := make(map[string]bool)
+	for key := range o.listing {
+		rest := strings.TrimPrefix(key, prefix)
+		if rest == key && prefix != "" {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			dirs[rest[:i]] = true
+		} else if rest != "" {
+			keys = append(keys, rest)
+		}
+	}
+	o.mu.Unlock()
+
+	var infos []fileInfo
+	for name := range dirs {
+		infos = append(infos, fileInfo{info: &statInfo{FName: name, FMode: os.ModeDir | 0755},
+			path: path.Join(p, name)})
+	}
+	for _, name := range keys {
+		if dirs[name] {
+			continue
+		}
+		fi, err := o.Lstat(path.Join(p, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	if len(infos) == 0 && p != "." {
+		return nil, &os.PathError{Op: "list", Path: p, Err: os.ErrNotExist}
+	}
+	sortInfos(infos)
+	return infos, nil
+}
+
+func (o *objectFS) Open(p string) (io.ReadCloser, error) {
+	return o.store.download(o.key(p))
+}
+
+// Mkdir is a no-op since object stores have no notion of directories
+func (o *objectFS) Mkdir(p string, mode os.FileMode) error {
+	return nil
+}
+
+func (o *objectFS) Create(p string) (io.WriteCloser, error) {
+	return o.CreateWithAttrs(p, 0644, time.Now())
+}
+
+func (o *objectFS) CreateWithAttrs(p string, mode os.FileMode, mtime time.Time) (io.WriteCloser, error) {
+	o.forget(o.key(p))
+	return o.store.upload(o.key(p), attrMeta(mode, mtime))
+}
+
+// Symlink stores symbolic links as empty objects with the link target kept
+// in their metadata
+func (o *objectFS) Symlink(oldname, newname string) error {
+	meta := attrMeta(os.ModeSymlink|0777, time.Now())
+	meta[metaSymlink] = url.QueryEscape(oldname)
+	o.forget(o.key(newname))
+	w, err := o.store.upload(o.key(newname), meta)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (o *objectFS) Remove(p string) error {
+	o.forget(o.key(p))
+	return o.store.remove(o.key(p))
+}
+
+// setAttrs updates the attribute metadata of the object representing p
+func (o *objectFS) setAttrs(p string, update func(info *statInfo)) error {
+	fi, err := o.Lstat(p)
+	if err != nil {
+		return err
+	}
+	info := fi.info.(*statInfo)
+	update(info)
+
+	meta := attrMeta(info.FMode, info.FModTime)
+	if fi.linkPath != "" {
+		meta[metaSymlink] = url.QueryEscape(fi.linkPath)
+	}
+	o.forget(o.key(p))
+	return o.store.setMeta(o.key(p), meta)
+}
+
+func (o *objectFS) Chtimes(p string, mtime time.Time) error {
+	return o.setAttrs(p, func(info *statInfo) { info.FModTime = mtime })
+}
+
+func (o *objectFS) Chmod(p string, mode os.FileMode) error {
+	return o.setAttrs(p, func(info *statInfo) { info.FMode = mode })
+}
+
+func (o *objectFS) Close() error {
+	return nil
+}
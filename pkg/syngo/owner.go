@@ -0,0 +1,222 @@
+// owner contains the handling of the ownership of target entries
+package syngo
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// owner describes the ownership of a target entry. Names are resolved on the
+// target's system and take precedence over the numeric IDs which are used if
+// a name is unknown there; IDs of -1 leave the respective ID unchanged.
+type owner struct {
+	Uid, Gid    int
+	User, Group string
+}
+
+// parseChown parses an ownership specification of the form user[:group] or
+// :group where user and group are either names or numeric IDs
+func parseChown(spec string) (*owner, error) {
+	o := &owner{Uid: -1, Gid: -1}
+	u, g := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		u, g = spec[:i], spec[i+1:]
+	}
+	if u == "" && g == "" {
+		return nil, fmt.Errorf("invalid owner %s", spec)
+	}
+	if id, err := strconv.Atoi(u); err == nil {
+		o.Uid = id
+	} else {
+		o.User = u
+	}
+	if id, err := strconv.Atoi(g); err == nil {
+		o.Gid = id
+	} else {
+		o.Group = g
+	}
+	return o, nil
+}
+
+// idMapping translates the user (or group) ID or name from of source entries
+// to the ID or name to on the target; a from of "*" matches all entries
+type idMapping struct {
+	from, to string
+}
+
+// parseIDMap parses a comma separated list of from:to mappings
+func parseIDMap(spec string) ([]idMapping, error) {
+	var m []idMapping
+	for _, s := range strings.Split(spec, ",") {
+		i := strings.Index(s, ":")
+		if i <= 0 || i == len(s)-1 {
+			return nil, fmt.Errorf("invalid id mapping %s", s)
+		}
+		m = append(m, idMapping{from: s[:i], to: s[i+1:]})
+	}
+	return m, nil
+}
+
+// mapID translates the source ID and name (possibly "") according to the
+// first matching mapping. Mapping to a name clears the ID so entries fail
+// rather than falling back to the source ID if the name is unknown.
+func mapID(m []idMapping, id int, name string) (int, string) {
+	for _, e := range m {
+		if e.from != "*" && e.from != strconv.Itoa(id) && (name == "" || e.from != name) {
+			continue
+		}
+		if to, err := strconv.Atoi(e.to); err == nil {
+			return to, ""
+		}
+		return -1, e.to
+	}
+	return id, name
+}
+
+// idCache caches the IDs of user and group names looked up on this system
+// and the names of IDs
+type idCache struct {
+	mu         sync.Mutex
+	users      map[string]int
+	groups     map[string]int
+	userNames  map[int]string
+	groupNames map[int]string
+}
+
+var localIDs = &idCache{
+	users:      make(map[string]int),
+	groups:     make(map[string]int),
+	userNames:  make(map[int]string),
+	groupNames: make(map[int]string),
+}
+
+// lookup returns the ID of the user (or group) name, or -1 if it is unknown
+func (c *idCache) lookup(name string, group bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := c.users
+	if group {
+		ids = c.groups
+	}
+	if id, ok := ids[name]; ok {
+		return id
+	}
+
+	id := -1
+	if group {
+		if g, err := user.LookupGroup(name); err == nil {
+			id, _ = strconv.Atoi(g.Gid)
+		}
+	} else if u, err := user.Lookup(name); err == nil {
+		id, _ = strconv.Atoi(u.Uid)
+	}
+	ids[name] = id
+	return id
+}
+
+// name returns the name of the user (or group) ID, or "" if it is unknown
+func (c *idCache) name(id int, group bool) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := c.userNames
+	if group {
+		names = c.groupNames
+	}
+	if name, ok := names[id]; ok {
+		return name
+	}
+
+	name := ""
+	if group {
+		if g, err := user.LookupGroupId(strconv.Itoa(id)); err == nil {
+			name = g.Name
+		}
+	} else if u, err := user.LookupId(strconv.Itoa(id)); err == nil {
+		name = u.Username
+	}
+	names[id] = name
+	return name
+}
+
+// resolve returns the numeric user and group IDs of o on this system
+func (o *owner) resolve() (int, int, error) {
+	uid, gid := o.Uid, o.Gid
+	if o.User != "" {
+		if id := localIDs.lookup(o.User, false); id >= 0 {
+			uid = id
+		} else if uid < 0 {
+			return 0, 0, fmt.Errorf("unknown user %s", o.User)
+		}
+	}
+	if o.Group != "" {
+		if id := localIDs.lookup(o.Group, true); id >= 0 {
+			gid = id
+		} else if gid < 0 {
+			return 0, 0, fmt.Errorf("unknown group %s", o.Group)
+		}
+	}
+	return uid, gid, nil
+}
+
+// entryOwner returns the ownership the copy of file should get, or nil to
+// leave it alone. With -owner and -group the owner and group of the source
+// entry are preserved by name unless -numeric-ids is given, falling back to
+// the numeric IDs for names unknown on either system. -usermap and -groupmap
+// translate source owners and groups; -chown takes precedence.
+func entryOwner(file fileInfo, opts *options) *owner {
+	if !opts.owner && !opts.group {
+		return opts.chown
+	}
+
+	o := &owner{Uid: -1, Gid: -1}
+	if uid, gid, ok := ownerIDs(file.info); ok {
+		// names are looked up for matching mappings even with -numeric-ids
+		// but only passed on if a mapping yields them
+		if opts.owner {
+			o.Uid = uid
+			if !opts.numericIDs || opts.usermap != nil {
+				o.User = localIDs.name(uid, false)
+			}
+			o.Uid, o.User = mapID(opts.usermap, o.Uid, o.User)
+			if opts.numericIDs && o.Uid == uid {
+				o.User = ""
+			}
+		}
+		if opts.group {
+			o.Gid = gid
+			if !opts.numericIDs || opts.groupmap != nil {
+				o.Group = localIDs.name(gid, true)
+			}
+			o.Gid, o.Group = mapID(opts.groupmap, o.Gid, o.Group)
+			if opts.numericIDs && o.Gid == gid {
+				o.Group = ""
+			}
+		}
+	}
+	if c := opts.chown; c != nil {
+		if c.Uid >= 0 || c.User != "" {
+			o.Uid, o.User = c.Uid, c.User
+		}
+		if c.Gid >= 0 || c.Group != "" {
+			o.Gid, o.Group = c.Gid, c.Group
+		}
+	}
+	if o.Uid < 0 && o.Gid < 0 && o.User == "" && o.Group == "" {
+		return nil
+	}
+	return o
+}
+
+// setOwner changes the ownership of the copy of file on tgt as configured.
+// NOTE: Ownership is applied whenever entries are written; it is not
+// compared to decide whether entries need syncing.
+func setOwner(tgt backend, file fileInfo, opts *options) error {
+	o := entryOwner(file, opts)
+	if o == nil {
+		return nil
+	}
+	return tgt.(chowner).Lchown(file.path, o)
+}
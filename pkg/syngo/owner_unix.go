@@ -0,0 +1,20 @@
+//go:build unix
+
+// owner_unix contains the lookup of the ownership of file system entries on
+// unix platforms
+package syngo
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownerIDs returns the numeric user and group IDs owning the entry described
+// by info and whether they are known
+func ownerIDs(info os.FileInfo) (int, int, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
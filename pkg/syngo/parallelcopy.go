@@ -0,0 +1,105 @@
+// parallelcopy copies single large files between local files with several
+// goroutines, each reading and writing disjoint ranges at their offsets. This
+// keeps more requests in flight than a single stream on high-latency or
+// parallel storage such as network file systems and RAID arrays.
+package syngo
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultCopyStreamsMin is the size from which files are copied by several
+// streams unless configured otherwise
+const defaultCopyStreamsMin = 256 * 1024 * 1024
+
+// copyRangeSize is the size of the ranges handed out to the streams. Streams
+// pick up the next range once they are done with theirs, so slow ranges do
+// not hold up the others.
+const copyRangeSize = 16 * 1024 * 1024
+
+// useCopyStreams determines if the regular file of size bytes is copied by
+// several streams
+func useCopyStreams(size int64, opts *options) bool {
+	min := opts.copyStreamsMin
+	if min <= 0 {
+		min = defaultCopyStreamsMin
+	}
+	return opts.copyStreams > 1 && size >= min && size > copyRangeSize
+}
+
+// parallelCopy copies the first size bytes of src to dst, which is extended
+// to size up front, using streams goroutines with copy buffers of bufSize
+// bytes. report is called after every chunk written and aborts the copy if
+// it fails. It returns the number of bytes written.
+func parallelCopy(dst, src *os.File, size int64, streams, bufSize int, report func(n int) error) (int64, error) {
+	if err := preallocate(dst, size); err != nil {
+		return 0, err
+	}
+
+	// report updates progress and the bandwidth limit, which are not meant
+	// to be used by several goroutines of one file
+	var reportMu sync.Mutex
+	var next, written int64
+	var failed int32
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err })
+		atomic.StoreInt32(&failed, 1)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, bufSize)
+			for atomic.LoadInt32(&failed) == 0 {
+				off := atomic.AddInt64(&next, copyRangeSize) - copyRangeSize
+				if off >= size {
+					return
+				}
+				end := off + copyRangeSize
+				if end > size {
+					end = size
+				}
+				for off < end && atomic.LoadInt32(&failed) == 0 {
+					chunk := buf
+					if int64(len(chunk)) > end-off {
+						chunk = chunk[:end-off]
+					}
+					n, err := src.ReadAt(chunk, off)
+					// the preallocated copy would look complete if the
+					// source shrank
+					if err == io.EOF && n < len(chunk) {
+						err = errSourceChanged
+					}
+					if n > 0 {
+						if _, werr := dst.WriteAt(chunk[:n], off); werr != nil {
+							fail(werr)
+							return
+						}
+						off += int64(n)
+						atomic.AddInt64(&written, int64(n))
+						reportMu.Lock()
+						rerr := report(n)
+						reportMu.Unlock()
+						if rerr != nil {
+							fail(rerr)
+							return
+						}
+					}
+					if err != nil && err != io.EOF {
+						fail(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return written, firstErr
+}
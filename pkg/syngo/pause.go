@@ -0,0 +1,52 @@
+// pause contains the pausing and resuming of running syncs, e.g. so a backup
+// can temporarily yield disk and network bandwidth
+package syngo
+
+import "sync"
+
+// pauser blocks syncers while a run is paused
+type pauser struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed once the run is resumed, nil while running
+}
+
+// pause pauses the run and reports whether it was running before
+func (p *pauser) pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// resume resumes the run and reports whether it was paused before
+func (p *pauser) resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		return false
+	}
+	close(p.resumed)
+	p.resumed = nil
+	return true
+}
+
+// wait blocks while the run is paused or until done is closed. A nil pauser
+// never blocks.
+func (p *pauser) wait(done <-chan struct{}) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-done:
+	}
+}
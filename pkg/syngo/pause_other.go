@@ -0,0 +1,9 @@
+//go:build !unix
+
+// pause_other contains the fallback for platforms without SIGUSR1 and SIGUSR2
+package syngo
+
+// handlePauseSignals does nothing since runs can not be paused on this
+// platform
+func handlePauseSignals(p *pauser) {
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+// pause_unix contains the signals pausing and resuming syncs on unix
+// platforms
+package syngo
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handlePauseSignals pauses the syncers of the run controlled by p on
+// SIGUSR1 and resumes them on SIGUSR2
+func handlePauseSignals(p *pauser) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range c {
+			if sig == syscall.SIGUSR1 && p.pause() {
+				infof(levelSummary, "paused, send SIGUSR2 to resume\n")
+			} else if sig == syscall.SIGUSR2 && p.resume() {
+				infof(levelSummary, "resumed\n")
+			}
+		}
+	}()
+}
@@ -0,0 +1,25 @@
+//go:build linux
+
+// preallocate_linux reserves the space of files copied in parallel on Linux
+package syngo
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate extends f to size bytes, reserving their blocks up front where
+// the file system supports it so ranges written in parallel do not fragment
+// the file
+func preallocate(f *os.File, size int64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return f.Truncate(size)
+		}
+		return nil
+	}
+}
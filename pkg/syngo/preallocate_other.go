@@ -0,0 +1,11 @@
+//go:build !linux
+
+// preallocate_other contains the fallback for platforms without fallocate
+package syngo
+
+import "os"
+
+// preallocate extends f to size bytes
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
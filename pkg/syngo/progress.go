@@ -0,0 +1,224 @@
+// progress contains the progress display of a sync run
+package syngo
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// largeFileSize is the size above which files in transfer are listed
+// individually in the progress display
+const largeFileSize = 16 * 1024 * 1024
+
+// progress intervals on terminals and for periodic log lines otherwise
+const (
+	progressTTYInterval = 500 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+)
+
+// progress keeps track of how much of a sync run is done. Since the source
+// tree is scanned while syncing, totals keep growing until all files have
+// been checked.
+type progress struct {
+	queuedFiles int64 // files found to need syncing
+	queuedBytes int64
+	doneFiles   int64 // files synced so far
+	doneBytes   int64
+	checked     int32 // set once all files have been checked
+
+	mu    sync.Mutex
+	large []*fileProgress // large files currently in transfer
+
+	display bool            // show the progress on stderr
+	events  *progressStream // receives progress events, nil if unused
+	tty     bool
+	start   time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newProgress returns the progress of a new run which is displayed if
+// display is set and reported as events to events unless it is nil
+func newProgress(display bool, events *progressStream) *progress {
+	p := &progress{display: display, events: events, stop: make(chan struct{}),
+		done: make(chan struct{})}
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		p.tty = true
+	}
+	return p
+}
+
+// queue records a file which needs to be synced
+func (p *progress) queue(size int64) {
+	atomic.AddInt64(&p.queuedFiles, 1)
+	atomic.AddInt64(&p.queuedBytes, size)
+}
+
+// fileProgress tracks the transfer of a single file
+type fileProgress struct {
+	p       *progress
+	path    string
+	size    int64
+	copied  int64
+	start   time.Time
+	emitted time.Time // time of the last bytes event
+}
+
+// startFile records the start of the transfer of path. Large files are
+// listed in the progress display until endFile is called.
+func (p *progress) startFile(path string, size int64) *fileProgress {
+	f := &fileProgress{p: p, path: path, size: size, start: time.Now()}
+	if p.events != nil {
+		f.emitted = f.start
+		p.events.emit(progressEvent{Event: "start", Path: path, Size: size})
+	}
+	if size >= largeFileSize {
+		p.mu.Lock()
+		p.large = append(p.large, f)
+		p.mu.Unlock()
+	}
+	return f
+}
+
+// endFile records the end of the transfer of f
+func (p *progress) endFile(f *fileProgress) {
+	p.mu.Lock()
+	for i, l := range p.large {
+		if l == f {
+			p.large = append(p.large[:i], p.large[i+1:]...)
+			break
+		}
+	}
+	p.mu.Unlock()
+}
+
+// add records n bytes of f copied. Events are emitted at most as often as
+// the display on terminals is updated.
+func (f *fileProgress) add(n int64) {
+	copied := atomic.AddInt64(&f.copied, n)
+	atomic.AddInt64(&f.p.doneBytes, n)
+	if f.p.events != nil && time.Since(f.emitted) >= progressTTYInterval {
+		f.emitted = time.Now()
+		f.p.events.emit(progressEvent{Event: "bytes", Path: f.path, Size: f.size, Bytes: copied})
+	}
+}
+
+// String describes the state of the transfer of f
+func (f *fileProgress) String() string {
+	copied := atomic.LoadInt64(&f.copied)
+	rate := float64(copied) / time.Since(f.start).Seconds()
+	return fmt.Sprintf("%s %.1f/%.1f MB (%.0f%%) %.2f MB/s", filepath.Base(f.path),
+		float64(copied)/1024/1024, float64(f.size)/1024/1024,
+		100*float64(copied)/float64(f.size), rate/1024/1024)
+}
+
+// fileDone records the entry at path which has been synced
+func (p *progress) fileDone(path string) {
+	atomic.AddInt64(&p.doneFiles, 1)
+	if p.events != nil {
+		p.events.emit(progressEvent{Event: "done", Path: path})
+	}
+}
+
+// phase reports the start of the named phase of the run. A nil progress is
+// allowed.
+func (p *progress) phase(name string) {
+	if p != nil && p.events != nil {
+		p.events.emit(progressEvent{Event: "phase", Phase: name})
+	}
+}
+
+// checkDone records that all files have been checked so totals are final
+func (p *progress) checkDone() {
+	atomic.StoreInt32(&p.checked, 1)
+}
+
+// run starts displaying progress until finish is called
+func (p *progress) run() {
+	p.start = time.Now()
+	interval := progressLogInterval
+	if p.tty || !p.display {
+		interval = progressTTYInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print()
+			case <-p.stop:
+				p.print()
+				if p.tty && p.display {
+					fmt.Fprintln(os.Stderr)
+				}
+				close(p.done)
+				return
+			}
+		}
+	}()
+}
+
+// finish stops the progress display after printing the final state
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.done
+}
+
+// print displays the current progress, in place on terminals, and reports
+// it as a totals event
+func (p *progress) print() {
+	doneFiles := atomic.LoadInt64(&p.doneFiles)
+	doneBytes := atomic.LoadInt64(&p.doneBytes)
+	queuedFiles := atomic.LoadInt64(&p.queuedFiles)
+	queuedBytes := atomic.LoadInt64(&p.queuedBytes)
+	checked := atomic.LoadInt32(&p.checked) == 1
+	if p.events != nil {
+		p.events.emit(progressEvent{Event: "totals", Bytes: doneBytes, DoneFiles: doneFiles,
+			QueuedFiles: queuedFiles, QueuedBytes: queuedBytes, Checked: checked})
+	}
+	if !p.display {
+		return
+	}
+
+	more, eta := "+", "?"
+	elapsed := time.Since(p.start).Seconds()
+	rate := float64(doneBytes) / elapsed
+	if checked {
+		more = ""
+		if rate > 0 {
+			remaining := float64(queuedBytes-doneBytes) / rate
+			eta = (time.Duration(remaining) * time.Second).String()
+		}
+	}
+	percent := 100.0
+	if queuedBytes > 0 {
+		percent = 100 * float64(doneBytes) / float64(queuedBytes)
+	}
+
+	line := fmt.Sprintf("synced %d/%d%s files, %.1f/%.1f%s MB (%.0f%%), %.2f MB/s, ETA %s",
+		doneFiles, queuedFiles, more, float64(doneBytes)/1024/1024,
+		float64(queuedBytes)/1024/1024, more, percent, rate/1024/1024, eta)
+	p.mu.Lock()
+	large := append([]*fileProgress(nil), p.large...)
+	p.mu.Unlock()
+
+	if p.tty {
+		// show the longest running large transfer and pad to overwrite
+		// leftovers of longer previous lines
+		if len(large) > 0 {
+			line += " | " + large[0].String()
+		}
+		fmt.Fprintf(os.Stderr, "\r%-120s", line)
+	} else {
+		log.Println(line)
+		for _, f := range large {
+			log.Printf("copying %s\n", f)
+		}
+	}
+}
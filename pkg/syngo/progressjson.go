@@ -0,0 +1,48 @@
+// progressjson contains the stream of machine readable progress events
+// written for -progress-json
+package syngo
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressEvent is a single line of the progress stream. Events are
+// phase (a new phase of the run started), start (a file transfer started),
+// bytes (periodic update of a transfer), done (a file was synced), and
+// totals (periodic update of the whole run).
+type progressEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Phase string    `json:"phase,omitempty"` // dirs, files, retry, delete, or done
+	Path  string    `json:"path,omitempty"`
+	Size  int64     `json:"size,omitempty"`  // size of the file in transfer
+	Bytes int64     `json:"bytes,omitempty"` // bytes copied of the file or run
+
+	// progress of the whole run, totals grow until all files are checked
+	DoneFiles   int64 `json:"done_files,omitempty"`
+	QueuedFiles int64 `json:"queued_files,omitempty"`
+	QueuedBytes int64 `json:"queued_bytes,omitempty"`
+	Checked     bool  `json:"checked,omitempty"`
+}
+
+// progressStream writes progress events as newline delimited JSON
+type progressStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newProgressStream(w io.Writer) *progressStream {
+	return &progressStream{enc: json.NewEncoder(w)}
+}
+
+// emit writes ev to the stream. Write errors are ignored so a reader going
+// away does not affect the run.
+func (s *progressStream) emit(ev progressEvent) {
+	ev.Time = time.Now()
+	s.mu.Lock()
+	s.enc.Encode(&ev)
+	s.mu.Unlock()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+// reflink_other contains the fallback for platforms without reflink support
+package syngo
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile always fails since reflinks are not supported on this platform
+func cloneFile(dst, src *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,628 @@
+// remote contains the syngo protocol used for syncing to remote targets. A
+// remote syngo helper is started via ssh and serves requests for the target
+// tree on its stdin and stdout.
+package syngo
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// protocol operations understood by the syngo server
+const (
+	opLstat   = "lstat"
+	opMkdir   = "mkdir"
+	opCreate  = "create"
+	opWrite   = "write"
+	opClose   = "close"
+	opSymlink = "symlink"
+	opRemove  = "remove"
+	opChtimes = "chtimes"
+	opChmod   = "chmod"
+	opOpen    = "open" // selects the served tree, only used by daemons
+	opAppend  = "append"
+	opSum     = "sum" // checksum of the start of a file for resuming
+	opRename  = "rename"
+	opChown   = "chown"
+	opPack    = "pack" // enables compressed write requests, see compress.go
+	opList    = "list"
+	opRead    = "read" // reads up to Size bytes of a file starting at Offset
+	opAuth    = "auth" // answers the challenge of a daemon requiring a secret
+)
+
+// request is a single protocol request sent from client to server
+type request struct {
+	Op     string
+	Path   string
+	Target string // link target for symlink requests, new path for rename requests
+	Mode   os.FileMode
+	Time   time.Time
+	Handle int64
+	Size   int64 // number of bytes to checksum for sum requests or to read for read requests
+	Offset int64 // start of the data returned by read requests
+	Data   []byte
+	Owner  *owner   // ownership for chown requests, names are resolved by the server
+	Packed bool     // Data is compressed with the algorithm enabled by a compress request
+	Hash   hashAlgo // checksum algorithm of sum requests, SHA-256 if empty
+}
+
+// response is the server's answer to a request. Write requests are not
+// answered; their errors are reported when the file is closed.
+type response struct {
+	Err      string
+	NotExist bool
+	Info     *statInfo
+	LinkPath string
+	Handle   int64
+	Sum      []byte
+	Hash     hashAlgo    // algorithm of Sum, empty if sent by servers only supporting SHA-256
+	Entries  []listEntry // directory entries for list requests
+	Data     []byte      // file data for read requests, empty at the end of the file
+	Nonce    []byte      // challenge sent in response to open requests by daemons requiring a secret
+}
+
+// listEntry describes a directory entry in the response to a list request
+type listEntry struct {
+	Info     *statInfo
+	LinkPath string
+}
+
+// err turns the error recorded in a response back into an error value
+func (r *response) err(op, path string) error {
+	if r.Err == "" {
+		return nil
+	}
+	if r.NotExist {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+	return errors.New(r.Err)
+}
+
+// statInfo is a serializable implementation of os.FileInfo used for
+// transferring file information between client and server
+type statInfo struct {
+	FName    string
+	FSize    int64
+	FMode    os.FileMode
+	FModTime time.Time
+}
+
+func newStatInfo(info os.FileInfo) *statInfo {
+	return &statInfo{
+		FName:    info.Name(),
+		FSize:    info.Size(),
+		FMode:    info.Mode(),
+		FModTime: info.ModTime(),
+	}
+}
+
+func (s *statInfo) Name() string       { return s.FName }
+func (s *statInfo) Size() int64        { return s.FSize }
+func (s *statInfo) Mode() os.FileMode  { return s.FMode }
+func (s *statInfo) ModTime() time.Time { return s.FModTime }
+func (s *statInfo) IsDir() bool        { return s.FMode.IsDir() }
+func (s *statInfo) Sys() interface{}   { return nil }
+
+// splitRemote splits a target specification of the form [user@]host:path
+// into its host and path parts. Like rsync, a colon is only considered if no
+// slash precedes it so local paths containing colons keep working. URL style
+// specifications (scheme://...) and paths starting with a drive letter on
+// Windows (C:\...) are not considered.
+func splitRemote(spec string) (string, string, bool) {
+	i := strings.Index(spec, ":")
+	if i <= 0 || strings.ContainsAny(spec[:i], `/\`) || strings.HasPrefix(spec[i:], "://") ||
+		filepath.VolumeName(spec) != "" {
+		return "", "", false
+	}
+	path := spec[i+1:]
+	if path == "" {
+		path = "."
+	}
+	return spec[:i], path, true
+}
+
+// newSSHBackend starts a syngo helper serving path on host via the remote
+// shell command configured in opts and returns a backend talking to it
+func newSSHBackend(host, path string, opts *options) (backend, error) {
+	rsh := strings.Fields(opts.rsh)
+	if len(rsh) == 0 {
+		return nil, fmt.Errorf("no remote shell command provided")
+	}
+	args := append(rsh[1:], host, opts.remoteSyngo, "--server", shellQuote(path))
+	cmd := exec.Command(rsh[0], args...)
+	cmd.Stderr = os.Stderr
+
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start remote shell %s: %s", rsh[0], err)
+	}
+
+	closer := func() error {
+		w.Close()
+		return cmd.Wait()
+	}
+	c := newRemoteFS(r, w, closer)
+	c.enableCompression(opts.packing, opts.compress)
+	return c, nil
+}
+
+// shellQuote quotes s for safe use in a remote shell command line
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// remoteFS is a backend which forwards all operations to a syngo server
+// reachable via the provided stream. Requests from concurrent goroutines are
+// serialized on the stream.
+type remoteFS struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	enc    *gob.Encoder
+	dec    *gob.Decoder
+	closer func() error
+
+	compressor *compressor // compresses write requests, nil if disabled
+}
+
+func newRemoteFS(r io.Reader, w io.Writer, closer func() error) *remoteFS {
+	bw := bufio.NewWriter(w)
+	return &remoteFS{
+		w:      bw,
+		enc:    gob.NewEncoder(bw),
+		dec:    gob.NewDecoder(bufio.NewReader(r)),
+		closer: closer,
+	}
+}
+
+// send sends a request without waiting for a response
+func (c *remoteFS) send(req *request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.enc.Encode(req)
+}
+
+// call sends a request and waits for the server's response
+func (c *remoteFS) call(req *request) (*response, error) {
+	// paths travel with forward slashes so clients and servers on different
+	// platforms agree, link targets are passed on verbatim
+	req.Path = filepath.ToSlash(req.Path)
+	if req.Op == opRename {
+		req.Target = filepath.ToSlash(req.Target)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.enc.Encode(req); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	var resp response
+	if err := c.dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("lost connection to remote syngo: %s", err)
+	}
+	return &resp, resp.err(req.Op, req.Path)
+}
+
+func (c *remoteFS) Lstat(path string) (fileInfo, error) {
+	resp, err := c.call(&request{Op: opLstat, Path: path})
+	if err != nil {
+		return fileInfo{}, err
+	}
+	return fileInfo{info: resp.Info, path: path, linkPath: resp.LinkPath}, nil
+}
+
+func (c *remoteFS) List(path string) ([]fileInfo, error) {
+	resp, err := c.call(&request{Op: opList, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fileInfo, 0, len(resp.Entries))
+	for _, e := range resp.Entries {
+		infos = append(infos, fileInfo{info: e.Info, path: filepath.Join(path, e.Info.FName),
+			linkPath: e.LinkPath})
+	}
+	return infos, nil
+}
+
+// Open returns a reader fetching the file in chunks with read requests
+func (c *remoteFS) Open(path string) (io.ReadCloser, error) {
+	if _, err := c.Lstat(path); err != nil {
+		return nil, err
+	}
+	return &remoteReader{fs: c, path: path}, nil
+}
+
+func (c *remoteFS) Mkdir(path string, mode os.FileMode) error {
+	_, err := c.call(&request{Op: opMkdir, Path: path, Mode: mode})
+	return err
+}
+
+func (c *remoteFS) Create(path string) (io.WriteCloser, error) {
+	resp, err := c.call(&request{Op: opCreate, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return &remoteFile{fs: c, path: path, handle: resp.Handle}, nil
+}
+
+func (c *remoteFS) PrefixSum(path string, size int64, algo hashAlgo) ([]byte, error) {
+	resp, err := c.call(&request{Op: opSum, Path: path, Size: size, Hash: algo})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Hash != algo && (resp.Hash != "" || algo != hashSHA256) {
+		return nil, fmt.Errorf("remote syngo does not support %s checksums", algo)
+	}
+	return resp.Sum, nil
+}
+
+func (c *remoteFS) Append(path string) (io.WriteCloser, error) {
+	resp, err := c.call(&request{Op: opAppend, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return &remoteFile{fs: c, path: path, handle: resp.Handle}, nil
+}
+
+func (c *remoteFS) Rename(oldpath, newpath string) error {
+	_, err := c.call(&request{Op: opRename, Path: oldpath, Target: newpath})
+	return err
+}
+
+func (c *remoteFS) Symlink(oldname, newname string) error {
+	_, err := c.call(&request{Op: opSymlink, Path: newname, Target: oldname})
+	return err
+}
+
+func (c *remoteFS) Remove(path string) error {
+	_, err := c.call(&request{Op: opRemove, Path: path})
+	return err
+}
+
+func (c *remoteFS) Chtimes(path string, mtime time.Time) error {
+	_, err := c.call(&request{Op: opChtimes, Path: path, Time: mtime})
+	return err
+}
+
+func (c *remoteFS) Chmod(path string, mode os.FileMode) error {
+	_, err := c.call(&request{Op: opChmod, Path: path, Mode: mode})
+	return err
+}
+
+func (c *remoteFS) Lchown(path string, o *owner) error {
+	_, err := c.call(&request{Op: opChown, Path: path, Owner: o})
+	return err
+}
+
+func (c *remoteFS) Close() error {
+	c.mu.Lock()
+	c.w.Flush()
+	c.mu.Unlock()
+	return c.closer()
+}
+
+// remoteFile is a file opened for writing on a syngo server
+type remoteFile struct {
+	fs     *remoteFS
+	path   string
+	handle int64
+}
+
+// writeChunkSize is the maximum amount of file data sent per write request
+const writeChunkSize = 256 * 1024
+
+func (f *remoteFile) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); n += writeChunkSize {
+		end := n + writeChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		req := &request{Op: opWrite, Handle: f.handle, Data: p[n:end]}
+		if f.fs.compressor != nil {
+			if packed := f.fs.compressor.compress(req.Data); packed != nil {
+				req.Data, req.Packed = packed, true
+			}
+		}
+		if err := f.fs.send(req); err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *remoteFile) Close() error {
+	_, err := f.fs.call(&request{Op: opClose, Path: f.path, Handle: f.handle})
+	return err
+}
+
+// remoteReader reads a file on a syngo server
+type remoteReader struct {
+	fs     *remoteFS
+	path   string
+	offset int64
+	data   []byte // data received but not read yet
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		resp, err := r.fs.call(&request{Op: opRead, Path: r.path, Offset: r.offset, Size: writeChunkSize})
+		if err != nil {
+			return 0, err
+		}
+		if len(resp.Data) == 0 {
+			return 0, io.EOF
+		}
+		r.data = resp.Data
+		r.offset += int64(len(resp.Data))
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *remoteReader) Close() error {
+	return nil
+}
+
+// readChunk returns up to size bytes of the file at path in fs starting at
+// offset, nothing at the end of the file
+func readChunk(fs *localFS, path string, offset, size int64) ([]byte, error) {
+	if size <= 0 || offset < 0 {
+		return nil, fmt.Errorf("invalid read of %d bytes at offset %d", size, offset)
+	}
+	if size > writeChunkSize {
+		size = writeChunkSize
+	}
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, size)
+	n, err := f.(*os.File).ReadAt(data, offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return data[:n], err
+}
+
+// openFile tracks a file opened for writing by a client
+type openFile struct {
+	w   io.WriteCloser
+	err error // first error encountered while writing
+}
+
+// serverConn is the server side of a protocol stream
+type serverConn struct {
+	bw  *bufio.Writer
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+func newServerConn(r io.Reader, w io.Writer) *serverConn {
+	bw := bufio.NewWriter(w)
+	return &serverConn{
+		bw:  bw,
+		enc: gob.NewEncoder(bw),
+		dec: gob.NewDecoder(bufio.NewReader(r)),
+	}
+}
+
+// reply sends resp to the client, recording err in it
+func (c *serverConn) reply(resp *response, err error) error {
+	if err != nil {
+		resp.Err = err.Error()
+		resp.NotExist = os.IsNotExist(err)
+	}
+	if err := c.enc.Encode(resp); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+// outsideTree determines if the relative path p leaves the served tree
+func outsideTree(p string) bool {
+	p = filepath.Clean(p)
+	return filepath.IsAbs(p) || filepath.VolumeName(p) != "" || withinDir(p, "..")
+}
+
+// linkedPath determines if the relative path p resolves through a symbolic
+// link below root. Parents are always checked since any operation would follow
+// them, the final component only if follow is set because the operation
+// follows it, too (e.g. opening or changing the mode of a file).
+func linkedPath(root, p string, follow bool) bool {
+	p = filepath.FromSlash(p)
+	if linkedParent(root, p) {
+		return true
+	}
+	if !follow || filepath.Clean(p) == "." {
+		return false
+	}
+	info, err := os.Lstat(filepath.Join(root, p))
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// followsLink lists the operations following a symbolic link at their path
+var followsLink = map[string]bool{
+	opList:    true,
+	opRead:    true,
+	opMkdir:   true,
+	opAppend:  true,
+	opSum:     true,
+	opChtimes: true,
+	opChmod:   true,
+}
+
+// checkPath returns an error if the relative path p leaves the tree rooted at
+// root, either lexically or through a symbolic link. NOTE: A link created
+// between the check and the operation, e.g. by a second connection to the
+// same tree, is still followed.
+func checkPath(root, p string, follow bool) error {
+	if outsideTree(p) || linkedPath(root, p, follow) {
+		return fmt.Errorf("path %s is outside of the served tree", p)
+	}
+	return nil
+}
+
+// serve answers protocol requests read from r by applying them to the local
+// tree rooted at root and writing the responses to w
+func serve(root string, r io.Reader, w io.Writer) error {
+	return newServerConn(r, w).serve(root)
+}
+
+// serve answers protocol requests by applying them to the local tree rooted
+// at root until the client closes the stream. Panics caused by a request end
+// the connection with an error instead of the whole server.
+func (c *serverConn) serve(root string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to serve request: %v", r)
+		}
+	}()
+	fs := &localFS{root: root}
+	dec := c.dec
+
+	files := make(map[int64]*openFile)
+	var nextHandle int64
+	var packing string // compression of write requests enabled by the client
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if req.Op == opWrite {
+			if f, ok := files[req.Handle]; ok && f.err == nil {
+				data := req.Data
+				if req.Packed {
+					data, f.err = decompress(packing, data)
+				}
+				if f.err == nil {
+					_, f.err = f.w.Write(data)
+					procMetrics.addTransfer(int64(len(data)), 0)
+				}
+			}
+			continue
+		}
+
+		var resp response
+		err := checkPath(root, req.Path, followsLink[req.Op])
+		if err == nil && req.Op == opRename {
+			err = checkPath(root, req.Target, false)
+		}
+		if err == nil {
+			switch req.Op {
+			case opLstat:
+				var fi fileInfo
+				if fi, err = fs.Lstat(req.Path); err == nil {
+					resp.Info = newStatInfo(fi.info)
+					resp.LinkPath = fi.linkPath
+				}
+			case opList:
+				var infos []fileInfo
+				if infos, err = fs.List(req.Path); err == nil {
+					for _, fi := range infos {
+						resp.Entries = append(resp.Entries, listEntry{Info: newStatInfo(fi.info),
+							LinkPath: fi.linkPath})
+					}
+				}
+			case opRead:
+				resp.Data, err = readChunk(fs, req.Path, req.Offset, req.Size)
+			case opMkdir:
+				err = fs.Mkdir(req.Path, req.Mode)
+			case opCreate, opAppend:
+				var fw io.WriteCloser
+				if req.Op == opCreate {
+					fw, err = fs.Create(req.Path)
+				} else {
+					fw, err = fs.Append(req.Path)
+				}
+				if err == nil {
+					nextHandle++
+					files[nextHandle] = &openFile{w: fw}
+					resp.Handle = nextHandle
+				}
+			case opClose:
+				f, ok := files[req.Handle]
+				if !ok {
+					err = fmt.Errorf("invalid file handle %d", req.Handle)
+					break
+				}
+				delete(files, req.Handle)
+				err = f.err
+				if cerr := f.w.Close(); err == nil {
+					err = cerr
+				}
+				if err == nil {
+					procMetrics.addTransfer(0, 1)
+				}
+			case opSum:
+				if req.Hash == "" {
+					req.Hash = hashSHA256
+				}
+				if _, err = parseHashAlgo(string(req.Hash)); err == nil {
+					resp.Sum, err = fs.PrefixSum(req.Path, req.Size, req.Hash)
+					resp.Hash = req.Hash
+				}
+			case opRename:
+				err = fs.Rename(req.Path, req.Target)
+			case opSymlink:
+				err = fs.Symlink(req.Target, req.Path)
+			case opRemove:
+				err = fs.Remove(req.Path)
+			case opChtimes:
+				err = fs.Chtimes(req.Path, req.Time)
+			case opChmod:
+				err = fs.Chmod(req.Path, req.Mode)
+			case opPack:
+				if err = checkCompression(req.Target); err == nil {
+					packing = req.Target
+				}
+			case opChown:
+				if req.Owner == nil {
+					err = fmt.Errorf("missing owner in chown request")
+				} else {
+					err = fs.Lchown(req.Path, req.Owner)
+				}
+			default:
+				err = fmt.Errorf("unknown protocol operation %s", req.Op)
+			}
+		}
+
+		if err := c.reply(&resp, err); err != nil {
+			return err
+		}
+	}
+}
+
+// serverCmd implements the hidden --server mode used as the remote helper.
+// It serves the tree provided as argument on stdin and stdout.
+func serverCmd(args []string) {
+	if len(args) != 1 {
+		log.Fatal("usage: syngo --server <tree>")
+	}
+	if err := serve(args[0], os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,751 @@
+// repo contains a backend storing target trees in a deduplicating
+// repository. File contents are split into content-defined chunks (see
+// chunker.go) stored once under their checksum, so unchanged data is
+// shared between files and snapshots. Every sync run records a snapshot listing all entries of the
+// synced trees together with the chunks of their content. Pruning snapshots
+// removes the chunks which no remaining snapshot references.
+//
+// Repository layout:
+//
+//	chunks/<2 hex digits>/<checksum>  content chunks
+//	snapshots/<time>                  one manifest (see manifest.go) per run
+//	hash                              checksum algorithm of the chunks, sha256 if missing
+//	.syngo/lock                       held by runs writing to the repository and by prune
+package syngo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// repoPrefix marks repository targets of the form repo:<dir>
+const repoPrefix = "repo:"
+
+// repoFS is a backend writing into a repository. It starts out with the
+// entries of the latest snapshot and records a new snapshot on Close.
+// Entries which were not looked up or written during the run are no longer
+// part of the synced trees and are left out of the new snapshot.
+type repoFS struct {
+	dir  string
+	algo hashAlgo // checksum algorithm of the chunks
+
+	mu      sync.Mutex
+	entries map[string]*manifestEntry // by target path
+	seen    map[string]bool
+
+	newChunks, newBytes int64 // chunks stored by this run
+	oldChunks           int64 // chunks already present in the repository
+
+	log  *runLog     // receives the summary of the run
+	lock *targetLock // keeps prune from removing the chunks of the run
+}
+
+// newRepoBackend opens the repository described by a target of the form
+// repo:<dir>, creating it with chunks identified by opts.checksumChoice
+// checksums if necessary
+func newRepoBackend(spec string, opts *options) (backend, error) {
+	dir := strings.TrimPrefix(spec, repoPrefix)
+	if dir == "" {
+		return nil, fmt.Errorf("missing repository directory in %s", spec)
+	}
+	_, err := os.Lstat(filepath.Join(dir, "chunks"))
+	created := os.IsNotExist(err)
+	for _, d := range []string{"chunks", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	r := &repoFS{dir: dir, entries: make(map[string]*manifestEntry), seen: make(map[string]bool),
+		log: opts.log}
+	if r.algo, err = repoHash(dir, opts.checksumChoice, created); err != nil {
+		return nil, err
+	}
+	if r.lock, err = lockTarget(dir, opts.waitForLock, opts.done(), opts.log); err != nil {
+		return nil, err
+	}
+	snaps, err := repoSnapshots(dir)
+	if err != nil {
+		r.lock.unlock()
+		return nil, err
+	}
+	if len(snaps) > 0 {
+		entries, err := readManifestEntries(filepath.Join(dir, "snapshots", snaps[len(snaps)-1]))
+		if err != nil {
+			r.lock.unlock()
+			return nil, err
+		}
+		for i := range entries {
+			r.entries[filepath.FromSlash(entries[i].Path)] = &entries[i]
+		}
+	}
+	return r, nil
+}
+
+// repoHash returns the checksum algorithm of the chunks of the repository
+// dir. Repositories not recording it predate the choice and use SHA-256. New
+// repositories record algo, or SHA-256 if algo is not cryptographic since
+// chunks with colliding checksums would silently replace each other.
+func repoHash(dir string, algo hashAlgo, created bool) (hashAlgo, error) {
+	p := filepath.Join(dir, "hash")
+	data, err := ioutil.ReadFile(p)
+	if err == nil {
+		return parseHashAlgo(strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) || !created {
+		return hashSHA256, nil
+	}
+	if !algo.cryptographic() {
+		algo = hashSHA256
+	}
+	return algo, ioutil.WriteFile(p, []byte(algo+"\n"), 0600)
+}
+
+// repoSnapshots returns the names of the snapshots in the repository dir from
+// oldest to newest
+func repoSnapshots(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(dir, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".tmp") && !strings.HasSuffix(info.Name(), ".json") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// chunkPath returns the path of the chunk with the hex encoded checksum sum
+func chunkPath(dir, sum string) string {
+	return filepath.Join(dir, "chunks", sum[:2], sum)
+}
+
+// validChunkSum determines if sum is a hex encoded checksum, which rules out
+// snapshots referring to files outside the chunks directory
+func validChunkSum(sum string) bool {
+	b, err := hex.DecodeString(sum)
+	return err == nil && len(b) > 0
+}
+
+// readRepoChunk returns the content of the chunk of the repository dir
+// with the hex encoded checksum sum
+func readRepoChunk(dir, sum string) ([]byte, error) {
+	if !validChunkSum(sum) {
+		return nil, fmt.Errorf("invalid chunk checksum %q", sum)
+	}
+	return ioutil.ReadFile(chunkPath(dir, sum))
+}
+
+// storeChunk stores data unless the repository already contains it and
+// returns its checksum
+func (r *repoFS) storeChunk(data []byte) (string, error) {
+	sum := hex.EncodeToString(r.algo.sum(data))
+	p := chunkPath(r.dir, sum)
+	if _, err := os.Lstat(p); err == nil {
+		atomic.AddInt64(&r.oldChunks, 1)
+		return sum, nil
+	}
+
+	// chunks are written under a temporary name and moved into place once
+	// complete so interrupted runs never leave corrupt chunks behind
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), sum+".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	atomic.AddInt64(&r.newChunks, 1)
+	atomic.AddInt64(&r.newBytes, int64(len(data)))
+	return sum, nil
+}
+
+// put records entry e, replacing any previous entry of the same path
+func (r *repoFS) put(p string, e *manifestEntry) {
+	e.Path = filepath.ToSlash(p)
+	r.mu.Lock()
+	r.entries[p] = e
+	r.seen[p] = true
+	r.mu.Unlock()
+}
+
+func (r *repoFS) Lstat(p string) (fileInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p == "." || p == "" {
+		return fileInfo{info: &statInfo{FName: ".", FMode: os.ModeDir | 0755}, path: p}, nil
+	}
+	e, ok := r.entries[p]
+	if !ok {
+		return fileInfo{}, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+	}
+	r.seen[p] = true
+	return fileInfo{info: &statInfo{FName: filepath.Base(p), FSize: e.Size, FMode: e.Mode,
+		FModTime: e.Mtime}, path: p, linkPath: e.Link}, nil
+}
+
+// List returns the entries of directory p. Unlike Lstat, listing entries
+// does not keep them in the next snapshot.
+func (r *repoFS) List(p string) ([]fileInfo, error) {
+	p = filepath.Clean(p)
+	r.mu.Lock()
+	if e, ok := r.entries[p]; p != "." && (!ok || !e.Mode.IsDir()) {
+		r.mu.Unlock()
+		return nil, &os.PathError{Op: "list", Path: p, Err: os.ErrNotExist}
+	}
+	var infos []fileInfo
+	for q, e := range r.entries {
+		if filepath.Dir(q) == p {
+			infos = append(infos, fileInfo{info: &statInfo{FName: filepath.Base(q), FSize: e.Size,
+				FMode: e.Mode, FModTime: e.Mtime}, path: q, linkPath: e.Link})
+		}
+	}
+	r.mu.Unlock()
+	sortInfos(infos)
+	return infos, nil
+}
+
+// Open returns a reader concatenating the chunks of file p
+func (r *repoFS) Open(p string) (io.ReadCloser, error) {
+	r.mu.Lock()
+	e, ok := r.entries[p]
+	r.mu.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	return &repoReader{dir: r.dir, chunks: e.Chunks}, nil
+}
+
+// repoReader reads the content of a file from its chunks
+type repoReader struct {
+	dir    string
+	chunks []string
+	data   []byte // rest of the current chunk
+}
+
+func (rr *repoReader) Read(p []byte) (int, error) {
+	for len(rr.data) == 0 {
+		if len(rr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := readRepoChunk(rr.dir, rr.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		rr.data, rr.chunks = data, rr.chunks[1:]
+	}
+	n := copy(p, rr.data)
+	rr.data = rr.data[n:]
+	return n, nil
+}
+
+func (rr *repoReader) Close() error {
+	return nil
+}
+
+// Mkdir records directory p and any missing parents
+func (r *repoFS) Mkdir(p string, mode os.FileMode) error {
+	for d := p; d != "." && d != "" && d != string(filepath.Separator); d = filepath.Dir(d) {
+		if _, err := r.Lstat(d); err == nil {
+			break
+		}
+		r.put(d, &manifestEntry{Mode: mode | os.ModeDir, Mtime: time.Now()})
+	}
+	return nil
+}
+
+func (r *repoFS) Create(p string) (io.WriteCloser, error) {
+	return r.CreateWithAttrs(p, 0644, time.Now())
+}
+
+// CreateWithAttrs returns a writer storing the data written to it as chunks.
+// The file is only recorded once the writer is closed.
+func (r *repoFS) CreateWithAttrs(p string, mode os.FileMode, mtime time.Time) (io.WriteCloser, error) {
+	return &repoFile{r: r, path: p, entry: manifestEntry{Mode: mode, Mtime: mtime}}, nil
+}
+
+func (r *repoFS) Symlink(oldname, newname string) error {
+	r.put(newname, &manifestEntry{Mode: os.ModeSymlink | 0777, Mtime: time.Now(), Link: oldname})
+	return nil
+}
+
+// Remove drops p and, for directories, all entries below it
+func (r *repoFS) Remove(p string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[p]; !ok {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	for q := range r.entries {
+		if withinDir(q, p) {
+			delete(r.entries, q)
+		}
+	}
+	return nil
+}
+
+// update applies fn to the entry of p. The metadata of the root of the
+// synced trees is not recorded.
+func (r *repoFS) update(p string, fn func(e *manifestEntry)) error {
+	if p == "." || p == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[p]
+	if !ok {
+		return &os.PathError{Op: "update", Path: p, Err: os.ErrNotExist}
+	}
+	fn(e)
+	return nil
+}
+
+func (r *repoFS) Chtimes(p string, mtime time.Time) error {
+	return r.update(p, func(e *manifestEntry) { e.Mtime = mtime })
+}
+
+func (r *repoFS) Chmod(p string, mode os.FileMode) error {
+	return r.update(p, func(e *manifestEntry) { e.Mode = mode })
+}
+
+// Close records the entries of the synced trees as a new snapshot
+func (r *repoFS) Close() error {
+	defer r.lock.unlock()
+	r.mu.Lock()
+	var entries []manifestEntry
+	for p, e := range r.entries {
+		if r.seen[p] {
+			entries = append(entries, *e)
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	// runs within the same second get numbered snapshots, which sort after
+	// the first one
+	now := time.Now()
+	name := now.Format(snapshotTimeFormat)
+	p := filepath.Join(r.dir, "snapshots", name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			break
+		} else if i == 1000 {
+			return fmt.Errorf("snapshot %s already exists", name)
+		}
+		name = fmt.Sprintf("%s-%03d", now.Format(snapshotTimeFormat), i)
+		p = filepath.Join(r.dir, "snapshots", name)
+	}
+
+	// the metadata not derived from the manifest is kept next to it
+	meta, err := json.Marshal(snapshotInfo{Name: name, Time: now, NewBytes: r.newBytes})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p+".json", meta, 0600); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeManifest(f, entries); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p+".tmp", p); err != nil {
+		return err
+	}
+	r.log.infof(levelSummary, "recorded repository snapshot %s, %d new chunks (%.5g MB), %d chunks reused\n",
+		name, r.newChunks, float64(r.newBytes)/1024/1024, r.oldChunks)
+	return nil
+}
+
+// repoFile splits the data written to it into chunks
+type repoFile struct {
+	r     *repoFS
+	path  string
+	entry manifestEntry
+	buf   []byte
+}
+
+func (f *repoFile) Write(p []byte) (int, error) {
+	n := len(p)
+	f.buf = append(f.buf, p...)
+	// boundaries are only searched once a maximum sized chunk is buffered
+	// so they do not depend on the size of writes
+	for len(f.buf) >= maxChunkSize {
+		if err := f.flush(chunkBoundary(f.buf)); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// flush stores the first n buffered bytes as a chunk
+func (f *repoFile) flush(n int) error {
+	sum, err := f.r.storeChunk(f.buf[:n])
+	if err != nil {
+		return err
+	}
+	f.entry.Chunks = append(f.entry.Chunks, sum)
+	f.entry.Size += int64(n)
+	f.buf = append(f.buf[:0], f.buf[n:]...)
+	return nil
+}
+
+func (f *repoFile) Close() error {
+	for len(f.buf) > 0 {
+		if err := f.flush(chunkBoundary(f.buf)); err != nil {
+			return err
+		}
+	}
+	f.r.put(f.path, &f.entry)
+	return nil
+}
+
+// readRepoSnapshots returns the metadata of the snapshots in the repository
+// dir from oldest to newest
+func readRepoSnapshots(dir string) ([]snapshotInfo, error) {
+	names, err := repoSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []snapshotInfo
+	for _, name := range names {
+		entries, err := readManifestEntries(filepath.Join(dir, "snapshots", name))
+		if err != nil {
+			return nil, err
+		}
+		info := snapshotInfo{Name: name}
+		// snapshots of older versions have no metadata
+		if data, err := ioutil.ReadFile(filepath.Join(dir, "snapshots", name+".json")); err == nil {
+			if err := json.Unmarshal(data, &info); err != nil {
+				return nil, fmt.Errorf("invalid metadata of snapshot %s: %s", name, err)
+			}
+		} else if len(name) >= len(snapshotTimeFormat) {
+			info.Time, _ = time.ParseInLocation(snapshotTimeFormat, name[:len(snapshotTimeFormat)], time.Local)
+		}
+		for _, e := range entries {
+			if e.Mode.IsRegular() {
+				info.NumFiles++
+				info.NumBytes += e.Size
+			}
+		}
+		snaps = append(snaps, info)
+	}
+	return snaps, nil
+}
+
+// restoreRepo restores the entries of the named snapshot (or the latest one)
+// of the repository dir below dest. Non-empty paths restrict the restore to
+// the given files or directories. It returns the number of errors.
+func restoreRepo(dir, snapshot, dest string, paths []string) int {
+	if snapshot == "" {
+		names, err := repoSnapshots(dir)
+		if err != nil || len(names) == 0 {
+			log.Printf("no snapshots in repository %s\n", dir)
+			return 1
+		}
+		snapshot = names[len(names)-1]
+	}
+	algo, err := repoHash(dir, "", false)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	entries, err := readManifestEntries(filepath.Join(dir, "snapshots", snapshot))
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	// directory metadata is set once their content is restored, deepest
+	// directories first
+	var dirs []manifestEntry
+	numErrors := 0
+	for _, e := range entries {
+		if !restorePath(e.Path, paths) {
+			continue
+		}
+		rel := filepath.FromSlash(e.Path)
+		if !filepath.IsLocal(rel) {
+			log.Printf("refusing to restore %s: path is not below the destination\n", e.Path)
+			numErrors++
+			continue
+		}
+		if linkedParent(dest, rel) {
+			log.Printf("refusing to restore %s: path crosses a symbolic link\n", e.Path)
+			numErrors++
+			continue
+		}
+		p := filepath.Join(dest, rel)
+		if e.Mode.IsDir() {
+			dirs = append(dirs, e)
+		}
+		if err := restoreRepoEntry(dir, p, e, algo); err != nil {
+			log.Printf("failed to restore %s: %s\n", e.Path, err)
+			numErrors++
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p := filepath.Join(dest, filepath.FromSlash(dirs[i].Path))
+		if err := os.Chmod(p, dirs[i].Mode); err != nil {
+			log.Println(err)
+			numErrors++
+		}
+		if err := os.Chtimes(p, dirs[i].Mtime, dirs[i].Mtime); err != nil {
+			log.Println(err)
+			numErrors++
+		}
+	}
+	return numErrors
+}
+
+// linkedParent determines if one of the parents of the entry at the relative
+// path rel below dest is a symbolic link, e.g. restored from a manipulated
+// snapshot, which entries must not be restored through
+func linkedParent(dest, rel string) bool {
+	for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+		info, err := os.Lstat(filepath.Join(dest, dir))
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// restorePath determines if the entry at slash separated path p is selected
+// by paths
+func restorePath(p string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, sel := range paths {
+		if withinDir(p, sel) || withinDir(sel, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreRepoEntry restores the entry e of the repository dir, whose chunks
+// are identified by algo checksums, at p. The metadata of directories is
+// left to the caller.
+func restoreRepoEntry(dir, p string, e manifestEntry, algo hashAlgo) error {
+	switch {
+	case e.Mode.IsDir():
+		return os.MkdirAll(p, 0700)
+	case e.Mode&os.ModeSymlink != 0:
+		os.Remove(p)
+		return os.Symlink(e.Link, p)
+	case !e.Mode.IsRegular():
+		return nil
+	}
+	for _, sum := range e.Chunks {
+		if !validChunkSum(sum) {
+			return fmt.Errorf("invalid chunk checksum %q", sum)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	os.Remove(p)
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, newFileMode)
+	if err != nil {
+		return err
+	}
+	for _, sum := range e.Chunks {
+		data, err := readRepoChunk(dir, sum)
+		if err == nil {
+			if hex.EncodeToString(algo.sum(data)) != sum {
+				err = fmt.Errorf("chunk %s is corrupt", sum)
+			}
+		}
+		if err == nil {
+			_, err = f.Write(data)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(p, e.Mode); err != nil {
+		return err
+	}
+	return os.Chtimes(p, e.Mtime, e.Mtime)
+}
+
+// pruneRepo removes the snapshots of the repository dir selected like by
+// pruneSnapshots followed by the chunks which are no longer referenced
+func pruneRepo(dir string, names []string, olderThan time.Duration, keep int, dryRun bool) error {
+	lock, err := lockTarget(dir, 0, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	snaps, err := readRepoSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	selected, err := selectSnapshots(snaps, names, olderThan, keep)
+	if err != nil {
+		return err
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+
+	for _, s := range snaps {
+		if !selected[s.Name] {
+			continue
+		}
+		fmt.Printf("pruning snapshot %s (%.5g MB)\n", s.Name, float64(s.NumBytes)/1024/1024)
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, "snapshots", s.Name)); err != nil {
+			log.Printf("failed to remove snapshot %s: %s\n", s.Name, err)
+			// the chunks of the snapshot are still in use
+			delete(selected, s.Name)
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, "snapshots", s.Name+".json")); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove metadata of snapshot %s: %s\n", s.Name, err)
+		}
+	}
+	numChunks, numBytes, err := collectChunks(dir, selected, dryRun)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d chunks, reclaimed %.5g MB\n", numChunks, float64(numBytes)/1024/1024)
+	return nil
+}
+
+// gc implements the gc command which removes the chunks of a repository no
+// snapshot references, e.g. stored by runs which were interrupted before
+// recording their snapshot
+func gc(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report how many chunks would be removed")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo gc [options] repo:<dir>")
+		fmt.Println("\noptions:")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("incorrect number of command line arguments\n\n")
+		flags.Usage()
+	}
+	spec := flags.Arg(0)
+	if !strings.HasPrefix(spec, repoPrefix) {
+		log.Fatalf("%s is not a repository\n", spec)
+	}
+	dir := strings.TrimPrefix(spec, repoPrefix)
+
+	lock, err := lockTarget(dir, 0, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	numChunks, numBytes, err := collectChunks(dir, nil, *dryRun)
+	lock.unlock()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("removed %d chunks, reclaimed %.5g MB\n", numChunks, float64(numBytes)/1024/1024)
+}
+
+// collectChunks removes the chunks of the repository dir which are not
+// referenced by any snapshot except the pruned ones, including chunks left
+// behind by runs which did not record a snapshot. It returns the number and
+// size of the removed chunks. Dry runs only determine them.
+// NOTE: The caller holds the lock of the repository so no run stores chunks
+// which are not referenced by a snapshot yet.
+func collectChunks(dir string, pruned map[string]bool, dryRun bool) (int, int64, error) {
+	names, err := repoSnapshots(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	used := make(map[string]bool)
+	for _, name := range names {
+		if pruned[name] {
+			continue
+		}
+		entries, err := readManifestEntries(filepath.Join(dir, "snapshots", name))
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, e := range entries {
+			for _, sum := range e.Chunks {
+				used[sum] = true
+			}
+		}
+	}
+
+	var numChunks int
+	var numBytes int64
+	chunks := filepath.Join(dir, "chunks")
+	prefixes, err := ioutil.ReadDir(chunks)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() {
+			continue
+		}
+		infos, err := ioutil.ReadDir(filepath.Join(chunks, prefix.Name()))
+		if err != nil {
+			return numChunks, numBytes, err
+		}
+		for _, info := range infos {
+			// temporary files of interrupted runs are removed as well
+			if used[info.Name()] || !info.Mode().IsRegular() {
+				continue
+			}
+			if !dryRun {
+				if err := os.Remove(filepath.Join(chunks, prefix.Name(), info.Name())); err != nil {
+					log.Println(err)
+					continue
+				}
+			}
+			numChunks++
+			numBytes += info.Size()
+		}
+	}
+	return numChunks, numBytes, nil
+}
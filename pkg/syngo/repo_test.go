@@ -0,0 +1,130 @@
+package syngo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreRepoStaysInDestination(t *testing.T) {
+	dir, dest, outside := t.TempDir(), t.TempDir(), t.TempDir()
+	for _, d := range []string{"chunks", "snapshots"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	entries := []manifestEntry{
+		{Path: "../escaped", Mode: 0644, Mtime: now},
+		{Path: filepath.ToSlash(filepath.Join(outside, "absolute")), Mode: 0644, Mtime: now},
+		{Path: "link", Mode: os.ModeSymlink | 0777, Mtime: now, Link: outside},
+		{Path: "link/through", Mode: 0644, Mtime: now},
+		{Path: "chunk", Mode: 0644, Mtime: now, Chunks: []string{"../../hash"}},
+	}
+	var buf bytes.Buffer
+	if err := writeManifest(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "snapshots", "manipulated"), buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if numErrors := restoreRepo(dir, "manipulated", dest, nil); numErrors != 4 {
+		t.Errorf("%d errors, want 4", numErrors)
+	}
+	for _, p := range []string{filepath.Join(filepath.Dir(dest), "escaped"), filepath.Join(outside, "absolute"),
+		filepath.Join(outside, "through"), filepath.Join(dest, "chunk")} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was restored", p)
+		}
+	}
+}
+
+func TestPruneRepoRemovesUnreferencedChunks(t *testing.T) {
+	dir := t.TempDir()
+	var chunks [][]string
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			waitForNextSecond()
+		}
+		r, err := newRepoBackend(repoPrefix+dir, &options{checksumChoice: hashSHA256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := r.Create("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, r.(*repoFS).entries["file"].Chunks)
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneRepo(dir, nil, 0, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	names, err := repoSnapshots(dir)
+	if err != nil || len(names) != 1 {
+		t.Fatalf("snapshots after pruning: %v, %v", names, err)
+	}
+	for i, want := range []bool{false, true} {
+		for _, sum := range chunks[i] {
+			if _, err := os.Stat(chunkPath(dir, sum)); (err == nil) != want {
+				t.Errorf("chunk %s of snapshot %d exists: %v", sum, i, err == nil)
+			}
+		}
+	}
+}
+
+func TestRepoSnapshotsRecordNewBytes(t *testing.T) {
+	dir := t.TempDir()
+	// both runs usually finish within the same second
+	for _, files := range []map[string][]byte{
+		{"a": randomData(7, 1000)},
+		{"a": randomData(7, 1000), "b": randomData(8, 500)},
+	} {
+		r, err := newRepoBackend(repoPrefix+dir, &options{checksumChoice: hashSHA256})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range files {
+			w, err := r.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snaps, err := readRepoSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 || snaps[0].Name == snaps[1].Name {
+		t.Fatalf("snapshots %v", snaps)
+	}
+	for i, want := range []struct{ numBytes, newBytes int64 }{{1000, 1000}, {1500, 500}} {
+		if snaps[i].NumBytes != want.numBytes || snaps[i].NewBytes != want.newBytes || snaps[i].Time.IsZero() {
+			t.Errorf("snapshot %s has %d bytes, %d new, and time %s", snaps[i].Name, snaps[i].NumBytes,
+				snaps[i].NewBytes, snaps[i].Time)
+		}
+	}
+}
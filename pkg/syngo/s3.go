@@ -0,0 +1,380 @@
+// s3 contains the object store implementation for Amazon S3 and S3
+// compatible services
+package syngo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the part size used for multipart uploads. Files smaller than
+// this are uploaded with a single request.
+const s3PartSize = 16 * 1024 * 1024
+
+// s3Store provides access to the objects of an S3 bucket
+type s3Store struct {
+	client    *http.Client
+	endpoint  *url.URL
+	pathStyle bool
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+}
+
+// newS3Backend returns a backend for a target of the form s3://bucket/prefix.
+// Credentials and region are taken from the standard AWS environment
+// variables; opts.s3Endpoint selects an S3 compatible service.
+func newS3Backend(spec string, opts *options) (backend, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket name in %s", spec)
+	}
+
+	s := &s3Store{
+		client:    &http.Client{},
+		bucket:    u.Host,
+		region:    os.Getenv("AWS_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY need to be set for s3 targets")
+	}
+
+	endpoint := opts.s3Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		// S3 compatible services usually only support path style requests
+		if s.endpoint, err = url.Parse(endpoint); err != nil {
+			return nil, err
+		}
+		s.pathStyle = true
+	} else {
+		s.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", s.region)}
+		s.pathStyle = strings.Contains(s.bucket, ".")
+	}
+	return &objectFS{store: s, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// objectURL returns the request URL for the object with the given key
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3Escape(u.Path)
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	return &u
+}
+
+// s3Escape percent encodes p as required for canonical S3 request URIs, i.e.
+// everything but unreserved characters and slashes is escaped
+func s3Escape(p string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// do performs a signed request against the object with the given key.
+// Responses with error status are turned into errors, 404s into errors
+// satisfying os.IsNotExist.
+func (s *s3Store) do(method, key string, query url.Values, header http.Header,
+	body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: strings.ToLower(method), Path: key, Err: os.ErrNotExist}
+		}
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		xml.Unmarshal(data, &s3Err)
+		return nil, fmt.Errorf("s3 %s %s failed: %s %s %s", method, key, resp.Status,
+			s3Err.Code, s3Err.Message)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS signature version 4 authorization header to req
+func (s *s3Store) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders string
+	for _, k := range names {
+		canonHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// metaHeader returns the request headers storing the provided metadata
+func metaHeader(meta map[string]string) http.Header {
+	h := make(http.Header)
+	for k, v := range meta {
+		h.Set("X-Amz-Meta-"+k, v)
+	}
+	return h
+}
+
+func (s *s3Store) head(key string) (objectAttrs, error) {
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return objectAttrs{}, err
+	}
+	resp.Body.Close()
+
+	attrs := objectAttrs{size: resp.ContentLength, meta: make(map[string]string)}
+	attrs.modified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for k := range resp.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			attrs.meta[strings.ToLower(strings.TrimPrefix(k, "X-Amz-Meta-"))] = resp.Header.Get(k)
+		}
+	}
+	return attrs, nil
+}
+
+func (s *s3Store) download(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) upload(key string, meta map[string]string) (io.WriteCloser, error) {
+	return &s3Writer{store: s, key: key, header: metaHeader(meta)}, nil
+}
+
+// setMeta replaces the metadata of an object by copying it onto itself.
+// NOTE: Server side copies are limited to objects of up to 5 GB.
+func (s *s3Store) setMeta(key string, meta map[string]string) error {
+	h := metaHeader(meta)
+	h.Set("X-Amz-Copy-Source", s3Escape("/"+s.bucket+"/"+key))
+	h.Set("X-Amz-Metadata-Directive", "REPLACE")
+	resp, err := s.do("PUT", key, nil, h, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) remove(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Part describes an uploaded part of a multipart upload
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Writer uploads data written to it as an object. Data is buffered until a
+// full part is available; small objects are uploaded with a single request
+// on Close.
+type s3Writer struct {
+	store    *s3Store
+	key      string
+	header   http.Header
+	buf      []byte
+	uploadID string
+	parts    []s3Part
+	err      error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= s3PartSize && w.err == nil {
+		w.err = w.uploadPart(w.buf[:s3PartSize])
+		w.buf = append([]byte(nil), w.buf[s3PartSize:]...)
+	}
+	return len(p), w.err
+}
+
+// uploadPart uploads data as the next part of a multipart upload which is
+// started if necessary
+func (w *s3Writer) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.store.do("POST", w.key, url.Values{"uploads": {""}}, w.header, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var result struct {
+			UploadId string
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("failed to start multipart upload of %s: %s", w.key, err)
+		}
+		w.uploadID = result.UploadId
+	}
+
+	num := len(w.parts) + 1
+	q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {w.uploadID}}
+	resp, err := w.store.do("PUT", w.key, q, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, s3Part{PartNumber: num, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.err == nil {
+		w.err = w.finish()
+	}
+	if w.err != nil && w.uploadID != "" {
+		if resp, err := w.store.do("DELETE", w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+	return w.err
+}
+
+// finish uploads all remaining data and completes the upload
+func (w *s3Writer) finish() error {
+	if w.uploadID == "" {
+		resp, err := w.store.do("PUT", w.key, nil, w.header, w.buf)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.uploadPart(w.buf); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := w.store.do("POST", w.key, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// errors during completion may be reported with a 200 status code
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if xml.Unmarshal(data, &result) == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("failed to complete upload of %s: %s %s", w.key, result.Code, result.Message)
+	}
+	return nil
+}
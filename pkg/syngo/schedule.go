@@ -0,0 +1,176 @@
+// schedule contains the scheduling of periodic sync runs for -every
+package syngo
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule determines when periodic runs are due, either at a fixed interval
+// or according to a cron expression
+type schedule struct {
+	every time.Duration // interval between the starts of runs, 0 for cron schedules
+
+	// bit sets of the minutes, hours, days of the month, months, and
+	// weekdays (0 is Sunday) matching a cron schedule
+	fields [5]uint64
+	anyDay [2]bool // whether days of the month and weekdays were unrestricted
+}
+
+// cron field ranges in the order of a cron expression
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseSchedule parses an interval such as 30m or 1d, or a cron expression
+// consisting of the five fields minute, hour, day of month, month, and day of
+// week. Cron fields may be *, numbers, ranges (1-5), lists (1,15), and steps
+// (*/15 or 0-30/10).
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 1 {
+		every, err := parseAge(spec)
+		if err != nil || every <= 0 {
+			return nil, fmt.Errorf("invalid interval %s", spec)
+		}
+		return &schedule{every: every}, nil
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", spec)
+	}
+
+	s := &schedule{}
+	for i, f := range fields {
+		bits, err := parseCronField(f, cronRanges[i][0], cronRanges[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %s", spec, err)
+		}
+		s.fields[i] = bits
+	}
+	// 7 is an alias for Sunday
+	if s.fields[4]&(1<<7) != 0 {
+		s.fields[4] |= 1
+	}
+	s.anyDay = [2]bool{fields[2] == "*", fields[4] == "*"}
+	return s, nil
+}
+
+// parseCronField returns the bit set of the values in [min, max] matched by
+// the cron field f
+func parseCronField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %s", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid range %s", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matches determines if field i of the cron schedule matches v
+func (s *schedule) matches(i, v int) bool {
+	return s.fields[i]&(1<<uint(v)) != 0
+}
+
+// matchesDay determines if the cron schedule runs on the day of t. Like cron,
+// restricting both the day of the month and the weekday matches either.
+func (s *schedule) matchesDay(t time.Time) bool {
+	dom, dow := s.matches(2, t.Day()), s.matches(4, int(t.Weekday()))
+	switch {
+	case s.anyDay[0] && s.anyDay[1]:
+		return true
+	case s.anyDay[0]:
+		return dow
+	case s.anyDay[1]:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the start of the first run due after a run started at t, or
+// the zero time if the schedule never matches
+func (s *schedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// every matching time is at most a few years away
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case !s.matches(3, int(t.Month())):
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.matches(1, t.Hour()):
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.matches(0, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// runScheduled performs runs as scheduled by s until done is closed.
+// Interval schedules start with a run right away; runs taking longer than
+// the interval are followed by the next run immediately.
+func runScheduled(s *schedule, done <-chan struct{}, run func() int) {
+	next := time.Now()
+	if s.every == 0 {
+		next = s.next(next)
+	}
+	for {
+		if next.IsZero() {
+			log.Fatal("schedule does not match any time")
+		}
+		if d := time.Until(next); d > 0 {
+			infof(levelSummary, "next sync at %s\n", next.Format(time.RFC3339))
+			select {
+			case <-time.After(d):
+			case <-done:
+				return
+			}
+		}
+		start := time.Now()
+		code := run()
+		infof(levelSummary, "sync started at %s finished with exit code %d\n",
+			start.Format(time.RFC3339), code)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		next = s.next(start)
+	}
+}
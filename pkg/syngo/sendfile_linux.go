@@ -0,0 +1,32 @@
+//go:build linux
+
+// sendfile_linux contains zero-copy transfers between local files on Linux
+package syngo
+
+import (
+	"os"
+	"syscall"
+)
+
+// sendFile copies the remaining content of src to dst inside the kernel in
+// chunks of at most chunk bytes and calls report after each chunk. The copy
+// is aborted if report fails.
+func sendFile(dst, src *os.File, chunk int, report func(n int) error) (int64, error) {
+	var total int64
+	for {
+		n, err := syscall.Sendfile(int(dst.Fd()), int(src.Fd()), nil, chunk)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil
+		}
+		total += int64(n)
+		if err := report(n); err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+// sendfile_other contains the fallback for platforms without sendfile
+// support for regular files
+package syngo
+
+import (
+	"errors"
+	"os"
+)
+
+// sendFile always fails so callers fall back to copying via user space
+func sendFile(dst, src *os.File, chunk int, report func(n int) error) (int64, error) {
+	return 0, errors.New("sendfile is not supported on this platform")
+}
@@ -0,0 +1,799 @@
+// sftp contains a backend for syncing to any SSH server via version 3 of the
+// SFTP protocol. The ssh binary is used as transport so syngo does not need
+// to be installed on the remote host.
+package syngo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SFTP packet types
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpRead     = 5
+	sshFxpWrite    = 6
+	sshFxpLstat    = 7
+	sshFxpSetstat  = 9
+	sshFxpOpendir  = 11
+	sshFxpReaddir  = 12
+	sshFxpRemove   = 13
+	sshFxpMkdir    = 14
+	sshFxpRmdir    = 15
+	sshFxpReadlink = 19
+	sshFxpSymlink  = 20
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpData     = 103
+	sshFxpName     = 104
+	sshFxpAttrs    = 105
+)
+
+// SFTP attribute flags
+const (
+	sshFileXferAttrSize        = 0x1
+	sshFileXferAttrUIDGID      = 0x2
+	sshFileXferAttrPermissions = 0x4
+	sshFileXferAttrACModTime   = 0x8
+	sshFileXferAttrExtended    = 0x80000000
+)
+
+// SFTP open flags
+const (
+	sshFxfRead  = 0x1
+	sshFxfWrite = 0x2
+	sshFxfCreat = 0x8
+	sshFxfTrunc = 0x10
+)
+
+// SFTP status codes
+const (
+	sshFxOK               = 0
+	sshFxEOF              = 1
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+)
+
+// sftpChunkSize is the amount of data sent per write request. Servers are
+// only required to accept 32 kB.
+const sftpChunkSize = 32 * 1024
+
+// sftpMaxPending is the maximum number of unacknowledged write requests per file
+const sftpMaxPending = 64
+
+// sftpPacket is a response packet received from the server with the type
+// and request id already stripped
+type sftpPacket struct {
+	typ  byte
+	data []byte
+}
+
+// sftpFS is a backend storing the target tree on an SFTP server. Requests are
+// pipelined so concurrent checkers and syncers can share a single session.
+type sftpFS struct {
+	root   string
+	w      io.Writer
+	wmu    sync.Mutex
+	mu     sync.Mutex
+	nextID uint32
+	reqs   map[uint32]chan sftpPacket
+	err    error // set once the connection is lost
+	closer func() error
+}
+
+// newSFTPBackend starts an SFTP session for a target of the form
+// sftp://[user@]host[:port]/path using the remote shell configured in opts
+func newSFTPBackend(spec string, opts *options) (backend, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	root := u.Path
+	if root == "" {
+		root = "."
+	}
+
+	rsh := strings.Fields(opts.rsh)
+	if len(rsh) == 0 {
+		return nil, fmt.Errorf("no remote shell command provided")
+	}
+	args := rsh[1:]
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	args = append(args, "-s", host, "sftp")
+	cmd := exec.Command(rsh[0], args...)
+	cmd.Stderr = os.Stderr
+
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start remote shell %s: %s", rsh[0], err)
+	}
+
+	closer := func() error {
+		w.Close()
+		return cmd.Wait()
+	}
+	fs, err := newSFTPFS(root, r, w, closer)
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// newSFTPFS performs the SFTP version handshake on the provided stream and
+// starts dispatching responses
+func newSFTPFS(root string, r io.Reader, w io.Writer, closer func() error) (*sftpFS, error) {
+	init := new(sftpBuf)
+	init.u8(sshFxpInit)
+	init.u32(3)
+	if _, err := w.Write(init.packet()); err != nil {
+		return nil, err
+	}
+	typ, _, err := readSFTPPacket(r)
+	if err != nil {
+		return nil, fmt.Errorf("sftp handshake failed: %s", err)
+	}
+	if typ != sshFxpVersion {
+		return nil, fmt.Errorf("sftp handshake failed: unexpected packet type %d", typ)
+	}
+
+	fs := &sftpFS{
+		root:   root,
+		w:      w,
+		reqs:   make(map[uint32]chan sftpPacket),
+		closer: closer,
+	}
+	go fs.dispatch(r)
+	return fs, nil
+}
+
+// readSFTPPacket reads a single length prefixed packet and returns its type
+// and payload
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var l uint32
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return 0, nil, err
+	}
+	if l == 0 || l > 1<<24 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", l)
+	}
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return data[0], data[1:], nil
+}
+
+// dispatch delivers responses read from r to the goroutines waiting for them
+func (s *sftpFS) dispatch(r io.Reader) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err == nil && len(data) < 4 {
+			err = fmt.Errorf("short sftp packet")
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.err = fmt.Errorf("lost sftp connection: %s", err)
+			for id, c := range s.reqs {
+				close(c)
+				delete(s.reqs, id)
+			}
+			s.mu.Unlock()
+			return
+		}
+
+		id := binary.BigEndian.Uint32(data)
+		s.mu.Lock()
+		c, ok := s.reqs[id]
+		delete(s.reqs, id)
+		s.mu.Unlock()
+		if ok {
+			c <- sftpPacket{typ: typ, data: data[4:]}
+		}
+	}
+}
+
+// send sends a request of type typ with the provided payload and returns a
+// channel on which the response will be delivered
+func (s *sftpFS) send(typ byte, payload *sftpBuf) (chan sftpPacket, error) {
+	c := make(chan sftpPacket, 1)
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	s.nextID++
+	id := s.nextID
+	s.reqs[id] = c
+	s.mu.Unlock()
+
+	b := new(sftpBuf)
+	b.u8(typ)
+	b.u32(id)
+	b.b = append(b.b, payload.b...)
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := s.w.Write(b.packet()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// wait waits for the response on c
+func (s *sftpFS) wait(c chan sftpPacket) (sftpPacket, error) {
+	p, ok := <-c
+	if !ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return p, s.err
+	}
+	return p, nil
+}
+
+// call sends a request and waits for its response
+func (s *sftpFS) call(typ byte, payload *sftpBuf) (sftpPacket, error) {
+	c, err := s.send(typ, payload)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	return s.wait(c)
+}
+
+// status checks that p is a status packet reporting success
+func (s *sftpFS) status(p sftpPacket, op, name string) error {
+	if p.typ != sshFxpStatus {
+		return fmt.Errorf("sftp %s %s: unexpected packet type %d", op, name, p.typ)
+	}
+	return statusError(p, op, name)
+}
+
+// statusError converts a status packet into an error value
+func statusError(p sftpPacket, op, name string) error {
+	r := sftpReader{b: p.data}
+	code := r.u32()
+	msg := r.str()
+	switch code {
+	case sshFxOK:
+		return nil
+	case sshFxNoSuchFile:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	case sshFxPermissionDenied:
+		return &os.PathError{Op: op, Path: name, Err: os.ErrPermission}
+	}
+	return &os.PathError{Op: op, Path: name, Err: errors.New(msg)}
+}
+
+// simple sends a request expecting a plain status response
+func (s *sftpFS) simple(typ byte, payload *sftpBuf, op, name string) error {
+	p, err := s.call(typ, payload)
+	if err != nil {
+		return err
+	}
+	return s.status(p, op, name)
+}
+
+func (s *sftpFS) path(p string) string {
+	return path.Join(s.root, p)
+}
+
+// lstat returns the attributes of the file at full path p
+func (s *sftpFS) lstat(p string) (*statInfo, error) {
+	b := new(sftpBuf)
+	b.str(p)
+	resp, err := s.call(sshFxpLstat, b)
+	if err != nil {
+		return nil, err
+	}
+	if resp.typ != sshFxpAttrs {
+		if err := s.status(resp, "lstat", p); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("sftp lstat %s: unexpected response", p)
+	}
+	r := sftpReader{b: resp.data}
+	info := r.attrs()
+	info.FName = path.Base(p)
+	return info, nil
+}
+
+func (s *sftpFS) Lstat(name string) (fileInfo, error) {
+	p := s.path(name)
+	info, err := s.lstat(p)
+	if err != nil {
+		return fileInfo{}, err
+	}
+
+	var linkPath string
+	if info.FMode&os.ModeSymlink != 0 {
+		b := new(sftpBuf)
+		b.str(p)
+		resp, err := s.call(sshFxpReadlink, b)
+		if err != nil {
+			return fileInfo{}, err
+		}
+		if resp.typ != sshFxpName {
+			return fileInfo{}, s.status(resp, "readlink", p)
+		}
+		r := sftpReader{b: resp.data}
+		if r.u32() > 0 {
+			linkPath = r.str()
+		}
+	}
+	return fileInfo{info: info, path: name, linkPath: linkPath}, nil
+}
+
+// openHandle sends an open or opendir request for the full path p and
+// returns the handle of the opened file or directory
+func (s *sftpFS) openHandle(typ byte, b *sftpBuf, op, p string) (string, error) {
+	resp, err := s.call(typ, b)
+	if err != nil {
+		return "", err
+	}
+	if resp.typ != sshFxpHandle {
+		return "", s.status(resp, op, p)
+	}
+	r := sftpReader{b: resp.data}
+	return r.str(), nil
+}
+
+// closeHandle closes a file or directory handle
+func (s *sftpFS) closeHandle(handle, p string) error {
+	b := new(sftpBuf)
+	b.str(handle)
+	return s.simple(sshFxpClose, b, "close", p)
+}
+
+// isEOF determines if p is a status packet reporting the end of a file or
+// directory
+func isEOF(p sftpPacket) bool {
+	r := sftpReader{b: p.data}
+	return p.typ == sshFxpStatus && r.u32() == sshFxEOF
+}
+
+func (s *sftpFS) List(name string) ([]fileInfo, error) {
+	p := s.path(name)
+	b := new(sftpBuf)
+	b.str(p)
+	handle, err := s.openHandle(sshFxpOpendir, b, "opendir", p)
+	if err != nil {
+		return nil, err
+	}
+	defer s.closeHandle(handle, p)
+
+	var infos []fileInfo
+	for {
+		b := new(sftpBuf)
+		b.str(handle)
+		resp, err := s.call(sshFxpReaddir, b)
+		if err != nil {
+			return nil, err
+		}
+		if isEOF(resp) {
+			break
+		} else if resp.typ != sshFxpName {
+			return nil, s.status(resp, "readdir", p)
+		}
+		r := sftpReader{b: resp.data}
+		for n := r.u32(); n > 0; n-- {
+			entry := r.str()
+			r.str() // long name
+			info := r.attrs()
+			if entry == "." || entry == ".." {
+				continue
+			}
+			info.FName = entry
+			fi := fileInfo{info: info, path: path.Join(name, entry)}
+			// link targets are only available via readlink
+			if info.FMode&os.ModeSymlink != 0 {
+				if fi, err = s.Lstat(fi.path); err != nil {
+					return nil, err
+				}
+			}
+			infos = append(infos, fi)
+		}
+	}
+	sortInfos(infos)
+	return infos, nil
+}
+
+func (s *sftpFS) Open(name string) (io.ReadCloser, error) {
+	p := s.path(name)
+	b := new(sftpBuf)
+	b.str(p)
+	b.u32(sshFxfRead)
+	b.u32(0)
+	handle, err := s.openHandle(sshFxpOpen, b, "open", p)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpReadFile{fs: s, name: p, handle: handle}, nil
+}
+
+func (s *sftpFS) Mkdir(name string, mode os.FileMode) error {
+	return s.mkdirAll(s.path(name), mode)
+}
+
+// mkdirAll creates directory p including all missing parents
+func (s *sftpFS) mkdirAll(p string, mode os.FileMode) error {
+	if _, err := s.lstat(p); err == nil {
+		return nil
+	}
+	if parent := path.Dir(p); parent != p {
+		if err := s.mkdirAll(parent, mode); err != nil {
+			return err
+		}
+	}
+
+	b := new(sftpBuf)
+	b.str(p)
+	b.u32(sshFileXferAttrPermissions)
+	b.u32(unixModeFromFile(mode))
+	if err := s.simple(sshFxpMkdir, b, "mkdir", p); err != nil {
+		// another worker may have created the directory in the meantime
+		if info, serr := s.lstat(p); serr == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sftpFS) Create(name string) (io.WriteCloser, error) {
+	p := s.path(name)
+	s.Remove(name)
+
+	b := new(sftpBuf)
+	b.str(p)
+	b.u32(sshFxfWrite | sshFxfCreat | sshFxfTrunc)
+	b.u32(sshFileXferAttrPermissions)
+	b.u32(unixModeFromFile(newFileMode))
+	resp, err := s.call(sshFxpOpen, b)
+	if err != nil {
+		return nil, err
+	}
+	if resp.typ != sshFxpHandle {
+		return nil, s.status(resp, "open", p)
+	}
+	r := sftpReader{b: resp.data}
+	return &sftpFile{fs: s, name: p, handle: r.str()}, nil
+}
+
+func (s *sftpFS) Symlink(oldname, newname string) error {
+	p := s.path(newname)
+	// NOTE: OpenSSH swaps the arguments of SSH_FXP_SYMLINK relative to the
+	// specification. Since it is by far the most common server we follow its
+	// ordering (link target first).
+	b := new(sftpBuf)
+	b.str(oldname)
+	b.str(p)
+	return s.simple(sshFxpSymlink, b, "symlink", p)
+}
+
+func (s *sftpFS) Remove(name string) error {
+	p := s.path(name)
+	b := new(sftpBuf)
+	b.str(p)
+	err := s.simple(sshFxpRemove, b, "remove", p)
+	if err != nil && !os.IsNotExist(err) {
+		if s.simple(sshFxpRmdir, b, "rmdir", p) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *sftpFS) Chtimes(name string, mtime time.Time) error {
+	p := s.path(name)
+	b := new(sftpBuf)
+	b.str(p)
+	b.u32(sshFileXferAttrACModTime)
+	b.u32(uint32(mtime.Unix()))
+	b.u32(uint32(mtime.Unix()))
+	return s.simple(sshFxpSetstat, b, "setstat", p)
+}
+
+func (s *sftpFS) Chmod(name string, mode os.FileMode) error {
+	p := s.path(name)
+	b := new(sftpBuf)
+	b.str(p)
+	b.u32(sshFileXferAttrPermissions)
+	b.u32(unixModeFromFile(mode))
+	return s.simple(sshFxpSetstat, b, "setstat", p)
+}
+
+// MtimePrecision reports that SFTP version 3 only stores whole seconds
+func (s *sftpFS) MtimePrecision() time.Duration {
+	return time.Second
+}
+
+func (s *sftpFS) Close() error {
+	return s.closer()
+}
+
+// sftpFile is a remote file opened for writing. Write requests are pipelined
+// and their results collected when the file is closed.
+type sftpFile struct {
+	fs      *sftpFS
+	name    string
+	handle  string
+	offset  uint64
+	pending []chan sftpPacket
+	err     error
+}
+
+// collect waits for the oldest outstanding write request
+func (f *sftpFile) collect() {
+	c := f.pending[0]
+	f.pending = f.pending[1:]
+	p, err := f.fs.wait(c)
+	if err == nil {
+		err = f.fs.status(p, "write", f.name)
+	}
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *sftpFile) Write(data []byte) (int, error) {
+	for n := 0; n < len(data); n += sftpChunkSize {
+		if f.err != nil {
+			return n, f.err
+		}
+		end := n + sftpChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		b := new(sftpBuf)
+		b.str(f.handle)
+		b.u64(f.offset)
+		b.str(string(data[n:end]))
+		c, err := f.fs.send(sshFxpWrite, b)
+		if err != nil {
+			return n, err
+		}
+		f.offset += uint64(end - n)
+		f.pending = append(f.pending, c)
+		if len(f.pending) >= sftpMaxPending {
+			f.collect()
+		}
+	}
+	return len(data), f.err
+}
+
+func (f *sftpFile) Close() error {
+	for len(f.pending) > 0 {
+		f.collect()
+	}
+	b := new(sftpBuf)
+	b.str(f.handle)
+	err := f.fs.simple(sshFxpClose, b, "close", f.name)
+	if f.err != nil {
+		return f.err
+	}
+	return err
+}
+
+// sftpReadFile is a remote file opened for reading
+type sftpReadFile struct {
+	fs     *sftpFS
+	name   string
+	handle string
+	offset uint64
+	data   []byte // data received but not read yet
+}
+
+func (f *sftpReadFile) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		b := new(sftpBuf)
+		b.str(f.handle)
+		b.u64(f.offset)
+		b.u32(sftpChunkSize)
+		resp, err := f.fs.call(sshFxpRead, b)
+		if err != nil {
+			return 0, err
+		}
+		if isEOF(resp) {
+			return 0, io.EOF
+		} else if resp.typ != sshFxpData {
+			return 0, f.fs.status(resp, "read", f.name)
+		}
+		r := sftpReader{b: resp.data}
+		f.data = []byte(r.str())
+		f.offset += uint64(len(f.data))
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func (f *sftpReadFile) Close() error {
+	return f.fs.closeHandle(f.handle, f.name)
+}
+
+// sftpBuf assembles SFTP packets
+type sftpBuf struct {
+	b []byte
+}
+
+func (b *sftpBuf) u8(v byte) {
+	b.b = append(b.b, v)
+}
+
+func (b *sftpBuf) u32(v uint32) {
+	b.b = append(b.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (b *sftpBuf) u64(v uint64) {
+	b.u32(uint32(v >> 32))
+	b.u32(uint32(v))
+}
+
+func (b *sftpBuf) str(s string) {
+	b.u32(uint32(len(s)))
+	b.b = append(b.b, s...)
+}
+
+// packet returns the buffer contents prefixed by their length
+func (b *sftpBuf) packet() []byte {
+	p := make([]byte, 4, 4+len(b.b))
+	binary.BigEndian.PutUint32(p, uint32(len(b.b)))
+	return append(p, b.b...)
+}
+
+// sftpReader parses SFTP packets. Reads past the end of the data return
+// zero values.
+type sftpReader struct {
+	b []byte
+}
+
+func (r *sftpReader) u32() uint32 {
+	if len(r.b) < 4 {
+		r.b = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpReader) u64() uint64 {
+	return uint64(r.u32())<<32 | uint64(r.u32())
+}
+
+func (r *sftpReader) str() string {
+	l := int(r.u32())
+	if l > len(r.b) {
+		l = len(r.b)
+	}
+	s := string(r.b[:l])
+	r.b = r.b[l:]
+	return s
+}
+
+// attrs parses an SFTP attribute block
+func (r *sftpReader) attrs() *statInfo {
+	info := &statInfo{}
+	flags := r.u32()
+	if flags&sshFileXferAttrSize != 0 {
+		info.FSize = int64(r.u64())
+	}
+	if flags&sshFileXferAttrUIDGID != 0 {
+		r.u32()
+		r.u32()
+	}
+	if flags&sshFileXferAttrPermissions != 0 {
+		info.FMode = fileModeFromUnix(r.u32())
+	}
+	if flags&sshFileXferAttrACModTime != 0 {
+		r.u32()
+		info.FModTime = time.Unix(int64(r.u32()), 0)
+	}
+	if flags&sshFileXferAttrExtended != 0 {
+		for n := r.u32(); n > 0; n-- {
+			r.str()
+			r.str()
+		}
+	}
+	return info
+}
+
+// unix file type and mode bits
+const (
+	unixTypeMask = 0170000
+	unixSocket   = 0140000
+	unixSymlink  = 0120000
+	unixRegular  = 0100000
+	unixBlock    = 0060000
+	unixDir      = 0040000
+	unixChar     = 0020000
+	unixFifo     = 0010000
+	unixSetuid   = 04000
+	unixSetgid   = 02000
+	unixSticky   = 01000
+)
+
+// fileModeFromUnix converts a unix st_mode value into an os.FileMode
+func fileModeFromUnix(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	switch m & unixTypeMask {
+	case unixSocket:
+		mode |= os.ModeSocket
+	case unixSymlink:
+		mode |= os.ModeSymlink
+	case unixBlock:
+		mode |= os.ModeDevice
+	case unixDir:
+		mode |= os.ModeDir
+	case unixChar:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case unixFifo:
+		mode |= os.ModeNamedPipe
+	}
+	if m&unixSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&unixSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&unixSticky != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// unixModeFromFile converts an os.FileMode into a unix st_mode value
+func unixModeFromFile(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeSocket != 0:
+		m |= unixSocket
+	case mode&os.ModeSymlink != 0:
+		m |= unixSymlink
+	case mode&os.ModeCharDevice != 0:
+		m |= unixChar
+	case mode&os.ModeDevice != 0:
+		m |= unixBlock
+	case mode&os.ModeDir != 0:
+		m |= unixDir
+	case mode&os.ModeNamedPipe != 0:
+		m |= unixFifo
+	default:
+		m |= unixRegular
+	}
+	if mode&os.ModeSetuid != 0 {
+		m |= unixSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= unixSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= unixSticky
+	}
+	return m
+}
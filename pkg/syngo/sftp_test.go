@@ -0,0 +1,277 @@
+package syngo
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeSFTP is an SFTP version 3 server for the tree rooted at root, which
+// implements the requests used by sftpFS and follows the argument order of
+// OpenSSH for symlink requests
+type fakeSFTP struct {
+	root    string
+	w       io.Writer
+	files   map[string]*os.File
+	dirs    map[string][]os.FileInfo
+	handles int
+}
+
+// sftpAttrs encodes the attributes of info
+func sftpAttrs(b *sftpBuf, info os.FileInfo) {
+	b.u32(sshFileXferAttrSize | sshFileXferAttrPermissions | sshFileXferAttrACModTime)
+	b.u64(uint64(info.Size()))
+	b.u32(unixModeFromFile(info.Mode()))
+	b.u32(uint32(info.ModTime().Unix()))
+	b.u32(uint32(info.ModTime().Unix()))
+}
+
+// reply sends a response of type typ to request id
+func (s *fakeSFTP) reply(typ byte, id uint32, payload *sftpBuf) {
+	b := new(sftpBuf)
+	b.u8(typ)
+	b.u32(id)
+	b.b = append(b.b, payload.b...)
+	s.w.Write(b.packet())
+}
+
+// status sends the status response to request id corresponding to err
+func (s *fakeSFTP) status(id uint32, err error) {
+	b := new(sftpBuf)
+	switch {
+	case err == nil:
+		b.u32(sshFxOK)
+	case err == io.EOF:
+		b.u32(sshFxEOF)
+	case os.IsNotExist(err):
+		b.u32(sshFxNoSuchFile)
+	default:
+		b.u32(4) // SSH_FX_FAILURE
+	}
+	if err != nil {
+		b.str(err.Error())
+	} else {
+		b.str("")
+	}
+	b.str("")
+	s.reply(sshFxpStatus, id, b)
+}
+
+// handle registers a new handle
+func (s *fakeSFTP) handle(id uint32) string {
+	s.handles++
+	h := strconv.Itoa(s.handles)
+	b := new(sftpBuf)
+	b.str(h)
+	s.reply(sshFxpHandle, id, b)
+	return h
+}
+
+func (s *fakeSFTP) serve(r io.Reader) {
+	for {
+		typ, data, err := readSFTPPacket(r)
+		if err != nil {
+			return
+		}
+		req := sftpReader{b: data}
+		if typ == sshFxpInit {
+			b := new(sftpBuf)
+			b.u8(sshFxpVersion)
+			b.u32(3)
+			s.w.Write(b.packet())
+			continue
+		}
+		id := req.u32()
+		p := filepath.Join(s.root, req.str())
+
+		switch typ {
+		case sshFxpLstat:
+			info, err := os.Lstat(p)
+			if err != nil {
+				s.status(id, err)
+				continue
+			}
+			b := new(sftpBuf)
+			sftpAttrs(b, info)
+			s.reply(sshFxpAttrs, id, b)
+		case sshFxpReadlink:
+			target, err := os.Readlink(p)
+			if err != nil {
+				s.status(id, err)
+				continue
+			}
+			b := new(sftpBuf)
+			b.u32(1)
+			b.str(target)
+			b.str(target)
+			b.u32(0)
+			s.reply(sshFxpName, id, b)
+		case sshFxpOpendir:
+			infos, err := ioutil.ReadDir(p)
+			if err != nil {
+				s.status(id, err)
+				continue
+			}
+			s.dirs[s.handle(id)] = infos
+		case sshFxpReaddir:
+			infos, ok := s.dirs[filepath.Base(p)]
+			if !ok || len(infos) == 0 {
+				s.status(id, io.EOF)
+				continue
+			}
+			b := new(sftpBuf)
+			b.u32(uint32(len(infos) + 1))
+			b.str(".")
+			b.str(".")
+			b.u32(0)
+			for _, info := range infos {
+				b.str(info.Name())
+				b.str(info.Name())
+				sftpAttrs(b, info)
+			}
+			s.dirs[filepath.Base(p)] = nil
+			s.reply(sshFxpName, id, b)
+		case sshFxpOpen:
+			flag := os.O_RDONLY
+			if req.u32()&sshFxfWrite != 0 {
+				flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			}
+			f, err := os.OpenFile(p, flag, 0644)
+			if err != nil {
+				s.status(id, err)
+				continue
+			}
+			s.files[s.handle(id)] = f
+		case sshFxpWrite:
+			offset := req.u64()
+			_, err := s.files[filepath.Base(p)].WriteAt([]byte(req.str()), int64(offset))
+			s.status(id, err)
+		case sshFxpRead:
+			offset, size := req.u64(), req.u32()
+			data := make([]byte, size)
+			n, err := s.files[filepath.Base(p)].ReadAt(data, int64(offset))
+			if n == 0 {
+				s.status(id, err)
+				continue
+			}
+			b := new(sftpBuf)
+			b.str(string(data[:n]))
+			s.reply(sshFxpData, id, b)
+		case sshFxpClose:
+			h := filepath.Base(p)
+			if f, ok := s.files[h]; ok {
+				s.status(id, f.Close())
+				delete(s.files, h)
+			} else {
+				delete(s.dirs, h)
+				s.status(id, nil)
+			}
+		case sshFxpMkdir:
+			req.u32()
+			s.status(id, os.Mkdir(p, os.FileMode(req.u32())&os.ModePerm))
+		case sshFxpSetstat:
+			var err error
+			switch req.u32() {
+			case sshFileXferAttrPermissions:
+				err = os.Chmod(p, fileModeFromUnix(req.u32()))
+			case sshFileXferAttrACModTime:
+				atime, mtime := req.u32(), req.u32()
+				err = os.Chtimes(p, time.Unix(int64(atime), 0), time.Unix(int64(mtime), 0))
+			}
+			s.status(id, err)
+		case sshFxpRemove:
+			if info, err := os.Lstat(p); err == nil && info.IsDir() {
+				s.status(id, os.ErrPermission)
+				continue
+			}
+			s.status(id, os.Remove(p))
+		case sshFxpRmdir:
+			s.status(id, os.Remove(p))
+		case sshFxpSymlink:
+			// the path read first is the link target
+			s.status(id, os.Symlink(p[len(s.root)+1:], filepath.Join(s.root, req.str())))
+		default:
+			s.status(id, os.ErrInvalid)
+		}
+	}
+}
+
+func TestSFTPRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	srv := &fakeSFTP{root: root, w: sw, files: make(map[string]*os.File), dirs: make(map[string][]os.FileInfo)}
+	go srv.serve(sr)
+	s, err := newSFTPFS(".", cr, cw, func() error { return cw.Close() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Mkdir("dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// several pipelined write requests
+	data := randomData(11, 5*sftpChunkSize+7)
+	w, err := s.Create("dir/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := s.Chtimes("dir/sub/file", mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Chmod("dir/sub/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Symlink("file", "dir/sub/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := s.Lstat("dir/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.info.Size() != int64(len(data)) || fi.info.Mode() != 0600 || !fi.info.ModTime().Equal(mtime) {
+		t.Errorf("file has size %d, mode %s, and mtime %s", fi.info.Size(), fi.info.Mode(), fi.info.ModTime())
+	}
+	if link, err := os.Readlink(filepath.Join(root, "dir", "sub", "link")); err != nil || link != "file" {
+		t.Errorf("link to %q: %v", link, err)
+	}
+	infos, err := s.List("dir/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].path != "dir/sub/file" || infos[1].linkPath != "file" {
+		t.Errorf("listing %v", infos)
+	}
+	r, err := s.Open("dir/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read %d of %d bytes: %v", len(got), len(data), err)
+	}
+
+	for _, p := range []string{"dir/sub/link", "dir/sub/file", "dir/sub"} {
+		if err := s.Remove(p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("removed %s: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+// snapshot contains functions for recording point in time copies (snapshots)
+// of a target tree and for restoring content from them
+package syngo
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// metaDir is the directory at the top of a target tree in which syngo keeps
+// its back history and other bookkeeping data
+const metaDir = ".syngo"
+
+// snapshotTimeFormat is the time layout used for naming snapshots
+const snapshotTimeFormat = "20060102-150405"
+
+// snapshotInfo is the metadata recorded alongside each snapshot at sync time
+type snapshotInfo struct {
+	Name     string    `json:"name"`
+	Time     time.Time `json:"time"`
+	NumFiles int64     `json:"num_files"`        // number of files in the snapshot
+	NumBytes int64     `json:"num_bytes"`        // total size of the snapshot
+	NewBytes int64     `json:"new_bytes"`        // data transferred by the sync run
+	Bases    []string  `json:"bases,omitempty"`  // snapshots used as compare-dest bases
+	Linked   string    `json:"linked,omitempty"` // snapshot unchanged files are hard-linked from
+
+	LinkedBytes int64 `json:"linked_bytes,omitempty"` // part of NumBytes shared with Linked
+}
+
+// snapshotDir returns the directory containing all snapshots of target tree tgt
+func snapshotDir(tgt string) string {
+	return filepath.Join(tgt, metaDir, "snapshots")
+}
+
+// snapshotMetaPath returns the path of the metadata file of the named snapshot
+func snapshotMetaPath(tgt, name string) string {
+	return filepath.Join(snapshotDir(tgt), name+".json")
+}
+
+// createSnapshot records the current state of target tree tgt as a new
+// snapshot and returns its name. The provided stats of the preceding sync run
+// are stored as part of the snapshot metadata. If some entries could not be
+// copied, the incomplete snapshot is still recorded and returned together
+// with an error. Files unchanged since the previous snapshot are hard-linked
+// from it, and those of the first snapshot from the target itself, so every
+// snapshot is a browsable full tree while only changed files take up space.
+// Syncs replace changed target files rather than writing to them, which
+// leaves the snapshots' links alone. The snapshots among the compare-dest
+// directories of the sync run, basis, are recorded as its bases since files
+// unchanged there are missing from the new snapshot.
+func createSnapshot(tgt string, runStats syncStats, basis *basisDirs) (string, error) {
+	now := time.Now()
+	name := now.Format(snapshotTimeFormat)
+	path := filepath.Join(snapshotDir(tgt), name)
+	if _, err := os.Lstat(path); err == nil {
+		return "", fmt.Errorf("snapshot %s already exists", name)
+	}
+
+	snaps, err := readSnapshots(tgt)
+	if err != nil {
+		return "", fmt.Errorf("failed to read snapshots of %s: %s", tgt, err)
+	}
+	base := tgt
+	if len(snaps) > 0 {
+		base = filepath.Join(snapshotDir(tgt), snaps[len(snaps)-1].Name)
+	}
+	opts := &options{skipMeta: true, basis: &basisDirs{mode: basisLink, dirs: []string{base}}}
+	stats := runSync(treeSource(tgt), &localFS{root: path}, opts)
+
+	info := snapshotInfo{
+		Name:     name,
+		Time:     now,
+		NumFiles: stats.numFiles,
+		NumBytes: stats.numBytes,
+		NewBytes: runStats.numBytes,
+		Bases:    snapshotBases(tgt, basis),
+	}
+	info.NumFiles += opts.basis.files
+	info.NumBytes += opts.basis.bytes
+	if base != tgt && opts.basis.files > 0 {
+		info.Linked = filepath.Base(base)
+		info.LinkedBytes = opts.basis.bytes
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(snapshotMetaPath(tgt, name), data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write metadata for snapshot %s: %s", name, err)
+	}
+	if stats.numErrors > 0 {
+		return name, fmt.Errorf("snapshot %s is incomplete, %d errors occurred while copying",
+			name, stats.numErrors)
+	}
+	return name, nil
+}
+
+// snapshotBases returns the names of the snapshots of target tree tgt which
+// are or contain compare-dest directories. Other basis directories are never
+// needed later: linked files stay until all their links are gone and copied
+// files are independent anyway.
+func snapshotBases(tgt string, basis *basisDirs) []string {
+	if basis == nil || basis.mode != basisCompare {
+		return nil
+	}
+	s := &snapshotInfo{}
+	for _, d := range basis.dirs {
+		rel, err := filepath.Rel(snapshotDir(tgt), d)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		s.addBase(strings.SplitN(filepath.ToSlash(rel), "/", 2)[0])
+	}
+	return s.Bases
+}
+
+// addBase records the snapshot name as a base of s
+func (s *snapshotInfo) addBase(name string) {
+	for _, b := range s.Bases {
+		if b == name {
+			return
+		}
+	}
+	s.Bases = append(s.Bases, name)
+}
+
+// readSnapshots returns the metadata of all snapshots of target tree tgt
+// sorted from oldest to newest. Snapshots without a metadata file are
+// reported based on their name only.
+func readSnapshots(tgt string) ([]snapshotInfo, error) {
+	entries, err := ioutil.ReadDir(snapshotDir(tgt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var snaps []snapshotInfo
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info := snapshotInfo{Name: e.Name()}
+		data, err := ioutil.ReadFile(snapshotMetaPath(tgt, e.Name()))
+		if err == nil {
+			err = json.Unmarshal(data, &info)
+		}
+		if err != nil {
+			log.Printf("failed to read metadata for snapshot %s: %s\n", e.Name(), err)
+			info.Time, _ = time.ParseInLocation(snapshotTimeFormat, e.Name(), time.Local)
+		}
+		snaps = append(snaps, info)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+	return snaps, nil
+}
+
+// listSnapshots implements the snapshots command which lists the available
+// snapshots of a target tree
+func listSnapshots(args []string) {
+	flags := flag.NewFlagSet("snapshots", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println("usage: syngo snapshots <target tree>")
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("incorrect number of command line arguments\n\n")
+		flags.Usage()
+	}
+
+	var snaps []snapshotInfo
+	var err error
+	if spec := flags.Arg(0); strings.HasPrefix(spec, repoPrefix) {
+		snaps, err = readRepoSnapshots(strings.TrimPrefix(spec, repoPrefix))
+	} else {
+		var tgtTree string
+		if tgtTree, err = absPath(spec); err != nil {
+			log.Fatal(err)
+		}
+		snaps, err = readSnapshots(tgtTree)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTIME\tFILES\tSIZE (MB)\tNEW (MB)")
+	for _, s := range snaps {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.5g\t%.5g\n", s.Name,
+			s.Time.Format("2006-01-02 15:04:05"), s.NumFiles,
+			float64(s.NumBytes)/1024/1024, float64(s.NewBytes)/1024/1024)
+	}
+	w.Flush()
+}
+
+// prune implements the prune command which deletes snapshots selected by
+// name, age, or count. Snapshots which remaining snapshots reference as their
+// compare-dest base are never removed. Pruning the snapshots of a repository
+// removes the chunks no longer referenced by the remaining ones as well.
+func prune(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	olderThan := flags.String("older-than", "", "prune snapshots older than the given age (e.g. 36h, 30d, 2w)")
+	keep := flags.Int("keep", 0, "prune all but the given number of most recent snapshots")
+	dryRun := flags.Bool("dry-run", false, "only report which snapshots would be pruned")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo prune [options] <target tree> [snapshot ...]")
+		fmt.Println("\noptions:")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Printf("incorrect number of command line arguments\n\n")
+		flags.Usage()
+	}
+	if flags.NArg() == 1 && *olderThan == "" && *keep <= 0 {
+		fmt.Printf("no snapshots selected for pruning\n\n")
+		flags.Usage()
+	}
+
+	var age time.Duration
+	var err error
+	if *olderThan != "" {
+		if age, err = parseAge(*olderThan); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if spec := flags.Arg(0); strings.HasPrefix(spec, repoPrefix) {
+		err = pruneRepo(strings.TrimPrefix(spec, repoPrefix), flags.Args()[1:], age, *keep, *dryRun)
+	} else {
+		var tgtTree string
+		if tgtTree, err = absPath(spec); err != nil {
+			log.Fatal(err)
+		}
+		err = pruneSnapshots(tgtTree, flags.Args()[1:], age, *keep, *dryRun)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// snapshotPolicy describes the snapshot to create after a sync run and the
+// snapshots to prune afterwards
+type snapshotPolicy struct {
+	keep      int           // number of most recent snapshots to keep, 0 for all
+	olderThan time.Duration // age of snapshots to prune, 0 for none
+}
+
+// pruneSnapshots removes the named snapshots of target tree tgtTree as well
+// as all snapshots older than olderThan (if non-zero) and all but the keep
+// most recent ones (if non-zero). Snapshots serving as compare-dest base of
+// a kept snapshot, directly or via other bases, are never removed.
+func pruneSnapshots(tgtTree string, names []string, olderThan time.Duration, keep int,
+	dryRun bool) error {
+	snaps, err := readSnapshots(tgtTree)
+	if err != nil {
+		return err
+	}
+	selected, err := selectSnapshots(snaps, names, olderThan, keep)
+	if err != nil {
+		return err
+	}
+
+	if len(selected) == 0 {
+		return nil
+	}
+	var numBytes int64
+	for _, s := range snaps {
+		if !selected[s.Name] {
+			continue
+		}
+		fmt.Printf("pruning snapshot %s (%.5g MB)\n", s.Name, float64(s.NumBytes)/1024/1024)
+		// data hard-linked from the previous snapshot is not freed
+		freed := s.NumBytes - s.LinkedBytes
+		if dryRun {
+			numBytes += freed
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(snapshotDir(tgtTree), s.Name)); err != nil {
+			log.Printf("failed to remove snapshot %s: %s\n", s.Name, err)
+			continue
+		}
+		if err := os.Remove(snapshotMetaPath(tgtTree, s.Name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove metadata of snapshot %s: %s\n", s.Name, err)
+		}
+		numBytes += freed
+	}
+	fmt.Printf("reclaimed up to %.5g MB\n", float64(numBytes)/1024/1024)
+	return nil
+}
+
+// selectSnapshots returns the names of the snapshots among snaps, sorted from
+// oldest to newest, which are pruned by pruneSnapshots
+func selectSnapshots(snaps []snapshotInfo, names []string, olderThan time.Duration,
+	keep int) (map[string]bool, error) {
+	selected := make(map[string]bool)
+	for _, name := range names {
+		found := false
+		for _, s := range snaps {
+			if s.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("snapshot %s does not exist", name)
+		}
+		selected[name] = true
+	}
+
+	if olderThan > 0 {
+		cutoff := time.Now().Add(-olderThan)
+		for _, s := range snaps {
+			if s.Time.Before(cutoff) {
+				selected[s.Name] = true
+			}
+		}
+	}
+
+	if keep > 0 && len(snaps) > keep {
+		for _, s := range snaps[:len(snaps)-keep] {
+			selected[s.Name] = true
+		}
+	}
+
+	// never remove the compare-dest base of a snapshot which is kept, kept
+	// bases keep their own bases in turn
+	for kept := true; kept; {
+		kept = false
+		for _, s := range snaps {
+			if selected[s.Name] {
+				continue
+			}
+			for _, b := range s.Bases {
+				if selected[b] {
+					log.Printf("refusing to prune snapshot %s: it is the compare-dest base of %s\n", b, s.Name)
+					delete(selected, b)
+					kept = true
+				}
+			}
+		}
+	}
+	return selected, nil
+}
+
+// restore implements the restore command which copies files from a snapshot
+// (or the latest state) of a target tree back to a destination. Optional path
+// arguments restrict the restore to individual files or directories.
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	snapshot := flags.String("snapshot", "", "restore from the named snapshot instead of the latest target state")
+	flags.Usage = func() {
+		fmt.Println("usage: syngo restore [options] <target tree> <destination> [path ...]")
+		fmt.Println("\noptions:")
+		flags.PrintDefaults()
+		os.Exit(exitFatal)
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		fmt.Printf("incorrect number of command line arguments\n\n")
+		flags.Usage()
+	}
+
+	startTime := time.Now()
+
+	destTree, err := absPath(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var paths []string
+	for _, p := range flags.Args()[2:] {
+		p = filepath.Clean(strings.TrimSpace(p))
+		if !filepath.IsLocal(p) {
+			log.Fatalf("restore path %s must be relative to the target tree", p)
+		}
+		paths = append(paths, p)
+	}
+	// snapshots are named entries of the snapshot directory
+	if *snapshot != "" && (!filepath.IsLocal(*snapshot) || filepath.Base(*snapshot) != *snapshot) {
+		log.Fatalf("invalid snapshot name %s", *snapshot)
+	}
+
+	if spec := flags.Arg(0); strings.HasPrefix(spec, repoPrefix) {
+		fmt.Printf("restoring %s to %s\n", spec, destTree)
+		if restoreRepo(strings.TrimPrefix(spec, repoPrefix), *snapshot, destTree, paths) > 0 {
+			os.Exit(exitPartial)
+		}
+		fmt.Println("done restoring")
+		return
+	}
+
+	tgtTree, err := absPath(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srcTree := tgtTree
+	if *snapshot != "" {
+		srcTree = filepath.Join(snapshotDir(tgtTree), *snapshot)
+	}
+
+	if err := checkInput(srcTree, destTree); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("restoring %s to %s\n", srcTree, destTree)
+
+	stats := runSync(treeSource(srcTree), &localFS{root: destTree}, &options{paths: paths, skipMeta: true})
+	printStats(stats, startTime, false)
+	defaultLog.printErrors()
+	fmt.Println("done restoring")
+	if stats.numErrors > 0 {
+		os.Exit(exitPartial)
+	}
+}
@@ -0,0 +1,241 @@
+package syngo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForNextSecond blocks until the next full second so that snapshots
+// created afterwards get a new name
+func waitForNextSecond() {
+	now := time.Now()
+	time.Sleep(now.Truncate(time.Second).Add(time.Second).Sub(now))
+}
+
+// snapshotNames returns the names of the snapshots of tgt from oldest to
+// newest
+func snapshotNames(t *testing.T, tgt string) []string {
+	t.Helper()
+	snaps, err := readSnapshots(tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range snaps {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestPruneKeep(t *testing.T) {
+	tgt := t.TempDir()
+	// every snapshot links the unchanged file from its predecessor
+	if err := ioutil.WriteFile(filepath.Join(tgt, "unchanged"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var created []string
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			waitForNextSecond()
+		}
+		if err := ioutil.WriteFile(filepath.Join(tgt, "changed"), []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		name, err := createSnapshot(tgt, syncStats{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, name)
+	}
+
+	if err := pruneSnapshots(tgt, nil, 0, 2, false); err != nil {
+		t.Fatal(err)
+	}
+	names := snapshotNames(t, tgt)
+	if len(names) != 2 || names[0] != created[1] || names[1] != created[2] {
+		t.Fatalf("kept snapshots %v, want %v", names, created[1:])
+	}
+	data, err := ioutil.ReadFile(filepath.Join(snapshotDir(tgt), created[1], "unchanged"))
+	if err != nil || string(data) != "data" {
+		t.Fatalf("linked file of kept snapshot: %q, %v", data, err)
+	}
+}
+
+func TestPruneKeepsCompareDestBases(t *testing.T) {
+	tgt := t.TempDir()
+	// c depends on b which depends on a, d depends on nothing
+	bases := map[string][]string{"a": nil, "b": {"a"}, "c": {"b"}, "d": nil}
+	start := time.Now().Add(-time.Hour)
+	for i, name := range []string{"a", "b", "c", "d"} {
+		if err := os.MkdirAll(filepath.Join(snapshotDir(tgt), name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		info := snapshotInfo{Name: name, Time: start.Add(time.Duration(i) * time.Minute),
+			Bases: bases[name]}
+		data, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(snapshotMetaPath(tgt, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneSnapshots(tgt, []string{"a", "b", "d"}, 0, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	names := snapshotNames(t, tgt)
+	if len(names) != 3 || names[0] != "a" || names[1] != "b" || names[2] != "c" {
+		t.Fatalf("kept snapshots %v, want [a b c]", names)
+	}
+}
+
+func TestSelectSnapshots(t *testing.T) {
+	now := time.Now()
+	snaps := []snapshotInfo{
+		{Name: "a", Time: now.Add(-72 * time.Hour)},
+		{Name: "b", Time: now.Add(-48 * time.Hour)},
+		{Name: "c", Time: now.Add(-24 * time.Hour), Bases: []string{"b"}},
+		{Name: "d", Time: now.Add(-time.Hour)},
+	}
+	for _, tt := range []struct {
+		name      string
+		names     []string
+		olderThan time.Duration
+		keep      int
+		want      []string
+		ok        bool
+	}{
+		{"nothing", nil, 0, 0, nil, true},
+		{"by name", []string{"a", "d"}, 0, 0, []string{"a", "d"}, true},
+		{"missing name", []string{"x"}, 0, 0, nil, false},
+		{"older than", nil, 36 * time.Hour, 0, []string{"a"}, true},
+		{"keep newest", nil, 0, 1, []string{"a", "b", "c"}, true},
+		{"keep all", nil, 0, 4, nil, true},
+		{"base of kept", []string{"b"}, 0, 0, nil, true},
+		{"base with its snapshot", []string{"b", "c"}, 0, 0, []string{"b", "c"}, true},
+		{"older than and keep", nil, 36 * time.Hour, 3, []string{"a"}, true},
+	} {
+		selected, err := selectSnapshots(snaps, tt.names, tt.olderThan, tt.keep)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for name := range selected {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: selected %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotLinksUnchangedFiles(t *testing.T) {
+	tgt := t.TempDir()
+	for _, p := range []string{"changed", "unchanged"} {
+		if err := ioutil.WriteFile(filepath.Join(tgt, p), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := createSnapshot(tgt, syncStats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// syncs replace changed files rather than writing to them
+	if err := os.Remove(filepath.Join(tgt, "changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tgt, "changed"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForNextSecond()
+	second, err := createSnapshot(tgt, syncStats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snaps, err := readSnapshots(tgt)
+	if err != nil || len(snaps) != 2 || snaps[1].Linked != first {
+		t.Fatalf("snapshots %+v: %v", snaps, err)
+	}
+	for _, tt := range []struct {
+		path   string
+		linked bool
+	}{
+		{"changed", false},
+		{"unchanged", true},
+	} {
+		old, err := os.Stat(filepath.Join(snapshotDir(tgt), first, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur, err := os.Stat(filepath.Join(snapshotDir(tgt), second, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(old, cur) != tt.linked {
+			t.Errorf("%s linked from the previous snapshot: %v", tt.path, !tt.linked)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(snapshotDir(tgt), first, "changed")); err != nil || string(data) != "old" {
+		t.Errorf("first snapshot holds %q: %v", data, err)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	tgt, dst := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(tgt, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"dir/file", "other"} {
+		if err := ioutil.WriteFile(filepath.Join(tgt, p), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name, err := createSnapshot(tgt, syncStats{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(tgt, "dir", "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tgt, "dir", "file"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		snapshot string
+		paths    []string
+		files    map[string]string // restored contents, empty if missing
+	}{
+		{"latest state", "", nil, map[string]string{"dir/file": "new", "other": "old"}},
+		{"snapshot", name, nil, map[string]string{"dir/file": "old", "other": "old"}},
+		{"path of snapshot", name, []string{"dir"}, map[string]string{"dir/file": "old", "other": ""}},
+	} {
+		dst := filepath.Join(dst, strings.Replace(tt.name, " ", "-", -1))
+		var args []string
+		if tt.snapshot != "" {
+			args = []string{"-snapshot", tt.snapshot}
+		}
+		restore(append(append(args, tgt, dst), tt.paths...))
+		for p, want := range tt.files {
+			data, err := ioutil.ReadFile(filepath.Join(dst, p))
+			if want == "" && !os.IsNotExist(err) || want != "" && (err != nil || string(data) != want) {
+				t.Errorf("%s: restored %s: %q, %v", tt.name, p, data, err)
+			}
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(tgt, "dir", "file")); err != nil || string(data) != "new" {
+		t.Errorf("restore changed the target: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,167 @@
+// sumcache contains the persistent cache of file checksums which lets
+// checksum comparisons and manifests skip re-reading files which did not
+// change since they were last hashed
+package syngo
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// sumCacheEntry holds the cached checksums of a file by algorithm together
+// with the state of the file they were computed for
+type sumCacheEntry struct {
+	Size   int64               `json:"size"`
+	Mtime  int64               `json:"mtime"` // nanoseconds since the epoch
+	Inode  uint64              `json:"inode,omitempty"`
+	SHA256 string              `json:"sha256,omitempty"` // written by earlier versions
+	Sums   map[hashAlgo]string `json:"sums,omitempty"`
+}
+
+// sumCache maps absolute file paths to their cached checksums.
+// NOTE: Entries of files which were removed are kept; remove the cache file
+// to start over.
+type sumCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]sumCacheEntry
+	dirty   bool
+}
+
+// loadSumCache loads the checksum cache kept at path, starting out empty if
+// it does not exist yet
+func loadSumCache(path string) (*sumCache, error) {
+	c := &sumCache{path: path, entries: make(map[string]sumCacheEntry)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// openSumCache loads the checksum cache named by the -checksum-cache option
+// of cmd, returning nil if none was requested
+func openSumCache(cmd, path string) *sumCache {
+	if path == "" {
+		return nil
+	}
+	c, err := loadSumCache(path)
+	if err != nil {
+		log.Fatalf("%s: failed to load checksum cache %s: %v\n", cmd, path, err)
+	}
+	return c
+}
+
+// cacheEntry describes the file with info without any checksums
+func cacheEntry(info os.FileInfo) sumCacheEntry {
+	e := sumCacheEntry{Size: info.Size(), Mtime: info.ModTime().UnixNano()}
+	e.Inode, _ = inodeNumber(info)
+	return e
+}
+
+// lookup returns the cached algo checksum of the file at p if the file did
+// not change since it was computed
+func (c *sumCache) lookup(p string, info os.FileInfo, algo hashAlgo) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[p]
+	sum := e.Sums[algo]
+	c.mu.Unlock()
+	if !ok || !sameFile(e, cacheEntry(info)) {
+		return nil, false
+	}
+	if sum == "" && algo == hashSHA256 {
+		sum = e.SHA256
+	}
+	if sum == "" {
+		return nil, false
+	}
+	s, err := hex.DecodeString(sum)
+	return s, err == nil
+}
+
+// fileSum returns the algo checksum of the first size bytes of the open file
+// f. Checksums of complete files are looked up in and added to the cache if
+// it is not nil.
+func (c *sumCache) fileSum(f *os.File, size int64, algo hashAlgo) ([]byte, error) {
+	r := io.NewSectionReader(f, 0, size)
+	if c == nil {
+		return prefixSum(r, size, algo)
+	}
+	info, err := f.Stat()
+	if err != nil || info.Size() != size {
+		return prefixSum(r, size, algo)
+	}
+	key, err := filepath.Abs(f.Name())
+	if err != nil {
+		return prefixSum(r, size, algo)
+	}
+	if sum, ok := c.lookup(key, info, algo); ok {
+		return sum, nil
+	}
+	sum, err := prefixSum(r, size, algo)
+	if err == nil {
+		c.store(key, info, algo, sum)
+	}
+	return sum, err
+}
+
+// sameFile determines if the cache entries describe the same state of a file
+func sameFile(a, b sumCacheEntry) bool {
+	return a.Size == b.Size && a.Mtime == b.Mtime && a.Inode == b.Inode
+}
+
+// store records the algo checksum sum of the file at p described by info.
+// Checksums of other algorithms are kept while the file is unchanged.
+func (c *sumCache) store(p string, info os.FileInfo, algo hashAlgo, sum []byte) {
+	c.mu.Lock()
+	e, ok := c.entries[p]
+	if !ok || !sameFile(e, cacheEntry(info)) {
+		e = cacheEntry(info)
+	}
+	sums := map[hashAlgo]string{algo: hex.EncodeToString(sum)}
+	for a, s := range e.Sums {
+		if a != algo {
+			sums[a] = s
+		}
+	}
+	e.Sums = sums
+	c.entries[p] = e
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+// save writes the cache back to its file if it changed. A nil cache is
+// allowed.
+func (c *sumCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
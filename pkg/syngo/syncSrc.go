@@ -0,0 +1,456 @@
+// syncSrc contains functions related to syncing content in the source location
+package syngo
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// numWalkers is the number of directories read concurrently while scanning
+// the source tree
+const numWalkers = 8
+
+// parseSrcDirs determines the directory layout of the src trees.
+func parseSrcDirs(srcs []*source, dirList chan<- []fileInfo, opts *options) {
+	b := &batcher{out: dirList}
+	for _, src := range srcs {
+		dev, checkDev := rootDevice(src, opts)
+		// unreadable directories and symbolic link loops are reported by
+		// the walk of parseSrcFiles
+		src.scan(opts, false, func(relPath string, d os.DirEntry) bool {
+			if opts.interrupted() || !isDir(d) || skipPath(relPath, true, opts) {
+				return false
+			}
+			i, err := d.Info()
+			if err != nil {
+				opts.log.logError("scan", src.tgtPath(relPath), "stat", err)
+				return false
+			}
+			if opts.chmod != nil {
+				i = modeInfo{i, applyChmod(i.Mode(), opts.chmod)}
+			}
+			// mount points are created but not descended into
+			b.add(fileInfo{info: i, path: src.tgtPath(relPath), src: src})
+			if checkDev && otherDevice(i, dev) {
+				opts.log.infoEvent(levelDecisions, event{Phase: "scan", Path: src.tgtPath(relPath),
+					Action: "skip", Msg: "other file system"}, "%s: on another file system, skipped\n",
+					src.tgtPath(relPath))
+				return false
+			}
+			return true
+		})
+	}
+	b.flush()
+	close(dirList)
+}
+
+// parseSrcFiles determined the files that need to be checked for syncing based on
+// the provided src locations. For now, this simply performs a file system
+// walk of each src tree.
+func parseSrcFiles(srcs []*source, fileList chan<- []fileInfo, stats *syncStats, opts *options) {
+	b := &batcher{out: fileList}
+	for _, src := range srcs {
+		parseSrcTree(src, b, stats, opts)
+	}
+	b.flush()
+	close(fileList)
+}
+
+// parseSrcTree adds the files of the src tree to b
+func parseSrcTree(src *source, b *batcher, stats *syncStats, opts *options) {
+	dev, checkDev := rootDevice(src, opts)
+	numErrors := src.scan(opts, true, func(relPath string, d os.DirEntry) bool {
+		// interrupted scans neither descend further nor add entries
+		if opts.interrupted() {
+			return false
+		}
+		if isDir(d) {
+			if skipPath(relPath, true, opts) {
+				atomic.AddInt64(&stats.numFiltered, 1)
+				return false
+			}
+			if checkDev {
+				i, err := d.Info()
+				return err == nil && !otherDevice(i, dev)
+			}
+			return true
+		}
+
+		// only entries passing the filters are stat'ed
+		if skipPath(relPath, false, opts) {
+			atomic.AddInt64(&stats.numFiltered, 1)
+			return false
+		}
+		i, err := d.Info()
+		if err != nil {
+			opts.log.logError("scan", src.tgtPath(relPath), "stat", err)
+			atomic.AddInt64(&stats.numErrors, 1)
+			return false
+		}
+		i = linkInfo(filepath.Join(src.root, relPath), i)
+		if i.Mode().IsRegular() && opts.chmod != nil {
+			i = modeInfo{i, applyChmod(i.Mode(), opts.chmod)}
+		}
+		if i.Mode().IsRegular() {
+			if reason := skipFile(i, opts); reason != "" {
+				opts.log.infoEvent(levelDecisions, event{Phase: "scan", Path: src.tgtPath(relPath),
+					Action: "skip", Msg: reason}, "%s: %s, skipped\n", src.tgtPath(relPath), reason)
+				atomic.AddInt64(&stats.numFiltered, 1)
+				return false
+			}
+		}
+
+		// symbolic links are recreated verbatim, i.e. relative and absolute
+		// link targets are kept as they are and dangling links are synced as
+		// well. Only -L resolves them, see walkTreeFollow.
+		var symPath string
+		if i.Mode()&os.ModeSymlink != 0 {
+			symPath, err = src.readlink(relPath)
+			if err != nil {
+				opts.log.logError("scan", src.tgtPath(relPath), "read symbolic link", err)
+				atomic.AddInt64(&stats.numErrors, 1)
+				return false
+			}
+			if (opts.safeLinks || opts.munge) && unsafeLink(relPath, symPath) {
+				if opts.safeLinks {
+					opts.log.infoEvent(levelDecisions, event{Phase: "scan", Path: src.tgtPath(relPath),
+						Action: "skip", Msg: "unsafe symbolic link"}, "%s: unsafe symbolic link, skipped\n",
+						src.tgtPath(relPath))
+					atomic.AddInt64(&stats.numFiltered, 1)
+					return false
+				}
+				symPath = mungePrefix + symPath
+			}
+			if opts.dangling && src.archive == nil {
+				if _, err := os.Stat(filepath.Join(src.root, relPath)); os.IsNotExist(err) {
+					opts.log.infoEvent(levelSummary, event{Phase: "scan", Path: src.tgtPath(relPath),
+						Action: "warn", Msg: "dangling symbolic link"}, "%s: dangling symbolic link to %s\n",
+						src.tgtPath(relPath), symPath)
+				}
+			}
+		}
+
+		file := fileInfo{info: i, path: src.tgtPath(relPath), linkPath: symPath, src: src}
+		if i.Mode().IsRegular() && opts.transforms != nil {
+			ok, err := applyTransforms(&file, opts.transforms)
+			if err != nil {
+				opts.log.logError("scan", file.path, "transform", err)
+				atomic.AddInt64(&stats.numErrors, 1)
+				return false
+			} else if !ok {
+				opts.log.infoEvent(levelDecisions, event{Phase: "scan", Path: file.path, Action: "skip",
+					Msg: "vetoed by transform"}, "%s: vetoed by transform, skipped\n", file.path)
+				atomic.AddInt64(&stats.numFiltered, 1)
+				return false
+			}
+			if file.origPath != "" {
+				opts.renamed.add(file.path)
+			}
+		}
+		b.add(file)
+		return false
+	})
+	atomic.AddInt64(&stats.numErrors, numErrors)
+}
+
+// batchSize is the number of entries handed between pipeline stages at once
+const batchSize = 64
+
+// batcher collects entries produced by concurrent walkers into batches which
+// are sent to out once full
+type batcher struct {
+	mu    sync.Mutex
+	batch []fileInfo
+	out   chan<- []fileInfo
+}
+
+func (b *batcher) add(fi fileInfo) {
+	b.mu.Lock()
+	b.batch = append(b.batch, fi)
+	var full []fileInfo
+	if len(b.batch) >= batchSize {
+		full, b.batch = b.batch, nil
+	}
+	b.mu.Unlock()
+
+	if full != nil {
+		b.out <- full
+	}
+}
+
+// flush sends the remaining entries
+func (b *batcher) flush() {
+	if len(b.batch) > 0 {
+		b.out <- b.batch
+		b.batch = nil
+	}
+}
+
+// errSymlinkLoop is reported for symbolic links to directories containing them
+var errSymlinkLoop = errors.New("symbolic link loop")
+
+// resolve returns the directory entry of the referent of the symbolic link d
+// at relPath, or d itself if the link is dangling. It fails for links to a
+// directory containing the link since following them would never end.
+func (w *treeWalker) resolve(relPath string, d os.DirEntry) (os.DirEntry, bool) {
+	info, err := os.Stat(filepath.Join(w.root, relPath))
+	if err != nil {
+		return d, true
+	}
+	if info.IsDir() {
+		target, err := filepath.EvalSymlinks(filepath.Join(w.root, relPath))
+		if err != nil {
+			return d, true
+		}
+		// the link loops if its target is the real location of one of the
+		// directories on its path, which may have been reached via links
+		// themselves
+		for dir := filepath.Dir(relPath); ; dir = filepath.Dir(dir) {
+			if real, err := filepath.EvalSymlinks(filepath.Join(w.root, dir)); err == nil && real == target {
+				w.fail(relPath, "follow", errSymlinkLoop)
+				return nil, false
+			}
+			if dir == "." {
+				break
+			}
+		}
+	}
+	return fs.FileInfoToDirEntry(info), true
+}
+
+// walkTree walks the tree rooted at root reading up to workers directories
+// concurrently. visit is called (concurrently) for every entry including the
+// root with its path relative to root and its directory entry; for
+// directories it returns whether the walk should descend into them. Unlike
+// filepath.Walk, entries are not visited in lexical order and are not stat'ed
+// unless visit asks for their Info, which saves an lstat per entry on file
+// systems reporting entry types in their directory listings. walkTree logs
+// the directories which could not be read to logs and returns their number.
+func walkTree(root string, workers int, logs *runLog, visit func(relPath string, d os.DirEntry) bool) int64 {
+	return walk(root, workers, false, true, logs, visit)
+}
+
+// walkTreeFollow is like walkTree but visits the referents of symbolic links
+// instead of the links themselves, descending into linked directories. Links
+// to directories containing them are reported as loops and counted as
+// unreadable directories. Dangling links are visited as links.
+func walkTreeFollow(root string, workers int, logs *runLog,
+	visit func(relPath string, d os.DirEntry) bool) int64 {
+	return walk(root, workers, true, true, logs, visit)
+}
+
+// walk implements walkTree and walkTreeFollow. Unless report is set, the
+// directories which could not be read are counted but not logged, e.g. if
+// another walk of the same tree reports them.
+func walk(root string, workers int, follow, report bool, logs *runLog,
+	visit func(relPath string, d os.DirEntry) bool) int64 {
+	info, err := os.Lstat(root)
+	if err != nil {
+		if report {
+			logs.logError("scan", root, "stat", err)
+		}
+		return 1
+	}
+	if !visit(".", fs.FileInfoToDirEntry(info)) || !info.IsDir() {
+		return 0
+	}
+
+	w := &treeWalker{root: root, visit: visit, follow: follow, report: report, log: logs,
+		queue: []string{"."}, pending: 1}
+	w.cond = sync.NewCond(&w.mu)
+	var done sync.WaitGroup
+	done.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			w.work()
+			done.Done()
+		}()
+	}
+	done.Wait()
+	return w.numErrors
+}
+
+// treeWalker keeps track of the directories still to be read during a
+// walkTree. The queue is used as a stack so the walk proceeds mostly depth
+// first which keeps the queue short for wide trees.
+type treeWalker struct {
+	root   string
+	visit  func(relPath string, d os.DirEntry) bool
+	follow bool    // visit the referents of symbolic links
+	report bool    // log the directories which could not be read
+	log    *runLog // receives the errors of report
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	queue     []string
+	pending   int   // directories queued or being read
+	numErrors int64 // directories which could not be read
+}
+
+// work reads queued directories until all directories have been read
+func (w *treeWalker) work() {
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && w.pending > 0 {
+			w.cond.Wait()
+		}
+		if w.pending == 0 {
+			w.mu.Unlock()
+			return
+		}
+		dir := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		w.mu.Unlock()
+
+		w.readDir(dir)
+
+		w.mu.Lock()
+		w.pending--
+		if w.pending == 0 {
+			w.cond.Broadcast()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// fail records that action failed on the directory at relPath
+func (w *treeWalker) fail(relPath, action string, err error) {
+	if w.report {
+		w.log.logError("scan", relPath, action, err)
+	}
+	atomic.AddInt64(&w.numErrors, 1)
+}
+
+// readDir visits all entries of directory dir and queues the subdirectories
+// to descend into
+func (w *treeWalker) readDir(dir string) {
+	f, err := os.Open(filepath.Join(w.root, dir))
+	if err != nil {
+		w.fail(dir, "open directory", err)
+		return
+	}
+	entries, err := f.ReadDir(-1)
+	f.Close()
+	if err != nil {
+		w.fail(dir, "read directory", err)
+	}
+
+	for _, d := range entries {
+		relPath := filepath.Join(dir, d.Name())
+		if w.follow && d.Type()&os.ModeSymlink != 0 {
+			var ok bool
+			if d, ok = w.resolve(relPath, d); !ok {
+				continue
+			}
+		}
+		if w.visit(relPath, d) && d.IsDir() {
+			w.mu.Lock()
+			w.queue = append(w.queue, relPath)
+			w.pending++
+			w.cond.Signal()
+			w.mu.Unlock()
+		}
+	}
+}
+
+// isDir determines if the source entry d is a directory to descend into.
+// Irregular directories such as junctions on Windows are synced as links.
+func isDir(d os.DirEntry) bool {
+	return d.IsDir() && d.Type()&os.ModeIrregular == 0
+}
+
+// scanTree walks the source tree at root with numWalkers concurrent walkers,
+// following symbolic links if requested. The directories which could not be
+// read are only logged if report is set.
+func scanTree(root string, opts *options, report bool, visit func(relPath string, d os.DirEntry) bool) int64 {
+	return walk(root, numWalkers, opts.follow, report, opts.log, visit)
+}
+
+// mungePrefix is prepended to the targets of unsafe symbolic links with
+// -munge-links so they no longer resolve
+const mungePrefix = "/syngo-munged/"
+
+// unsafeLink determines if the symbolic link at relPath (relative to the
+// source root) pointing to link refers to a location outside the source
+// tree, i.e. is absolute, refers to a drive, or leaves the tree via ..
+func unsafeLink(relPath, link string) bool {
+	if filepath.IsAbs(link) || filepath.VolumeName(link) != "" {
+		return true
+	}
+	return withinDir(filepath.Join(filepath.Dir(relPath), link), "..")
+}
+
+// rootDevice returns the device of the root of src if file system boundaries
+// are not to be crossed, and whether it has to be checked
+func rootDevice(src *source, opts *options) (uint64, bool) {
+	if !opts.oneFS {
+		return 0, false
+	}
+	info, err := os.Lstat(src.root)
+	if err != nil {
+		return 0, false
+	}
+	return deviceID(info)
+}
+
+// otherDevice determines if the entry described by info lies on another
+// device than dev
+func otherDevice(info os.FileInfo, dev uint64) bool {
+	d, ok := deviceID(info)
+	return ok && d != dev
+}
+
+// skipFile determines if the regular file described by info is left out of
+// the sync by the size or age filters and returns the reason, or "" if it is
+// kept. Ages are relative to the time of the check so repeated runs of
+// -watch or -every move along.
+func skipFile(info os.FileInfo, opts *options) string {
+	age := time.Since(info.ModTime())
+	switch {
+	case opts.minSize > 0 && info.Size() < opts.minSize:
+		return "too small"
+	case opts.maxSize > 0 && info.Size() > opts.maxSize:
+		return "too large"
+	case opts.newerThan > 0 && age > opts.newerThan:
+		return "too old"
+	case opts.olderThan > 0 && age < opts.olderThan:
+		return "too recent"
+	}
+	return ""
+}
+
+// skipPath determines if the entry at relPath (relative to the source root)
+// should be left out of the sync based on the provided options. Directories
+// leading up to a selected path are kept so the layout can be recreated.
+func skipPath(relPath string, isDir bool, opts *options) bool {
+	if opts.skipMeta && relPath == metaDir {
+		return true
+	}
+	if relPath != "." && excluded(filepath.ToSlash(relPath), opts.filters) {
+		return true
+	}
+
+	if len(opts.paths) == 0 || relPath == "." {
+		return false
+	}
+	for _, p := range opts.paths {
+		if withinDir(relPath, p) || (isDir && withinDir(p, relPath)) {
+			return false
+		}
+	}
+	return true
+}
+
+// withinDir determines if path equals dir or lies below it. Both are compared
+// with forward slashes so paths of all platforms, manifests, and the remote
+// protocol agree.
+func withinDir(path, dir string) bool {
+	path, dir = filepath.ToSlash(path), filepath.ToSlash(dir)
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
@@ -0,0 +1,875 @@
+// syncTgt contains functions related to syncing content to the target location
+package syngo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncFiles processes a list of files which need to be synced and processes
+// them one by one
+// NOTE: Currently we only deal with regular files and symlinks, all others are
+// skipped
+func syncFiles(tgt backend, fileList <-chan []fileInfo, syncDone chan<- syncStats,
+	opts *options) {
+	var numBytes int64
+	var fileCount int64
+	var numErrors, numSkipped, numSymlinks int64
+	var failed []fileInfo
+	// each syncer reuses a single copy buffer for all its files
+	buf := make([]byte, opts.bufferSize)
+	for batch := range fileList {
+		for _, file := range batch {
+			opts.pause.wait(opts.done())
+			if opts.interrupted() {
+				continue
+			}
+			srcPath := file.src.srcPath(file.path)
+			if file.origPath != "" {
+				srcPath = file.src.srcPath(file.origPath)
+			}
+
+			fileMode := file.info.Mode()
+			// dry runs report the entries they would sync without touching
+			// the target
+			if opts.dryRun {
+				if !fileMode.IsRegular() && fileMode&os.ModeSymlink == 0 {
+					numSkipped++
+					continue
+				}
+				if fileMode.IsRegular() {
+					numBytes += file.info.Size()
+				}
+				fileCount++
+				reportSynced(file, opts)
+				continue
+			}
+			if fileMode.IsRegular() {
+				span := opts.trace.startSampled("transfer file")
+				dataPath := srcPath
+				if file.basis != "" {
+					dataPath = file.basis
+				}
+				n, err := syncFile(dataPath, tgt, file, buf, opts)
+				span.set("path", file.path)
+				span.set("size", file.info.Size())
+				span.set("bytes", n)
+				span.fail(err)
+				span.finish()
+				if err != nil && opts.interrupted() {
+					continue
+				} else if err != nil {
+					numErrors++
+					failed = append(failed, file)
+					continue
+				}
+				numBytes += n
+				if opts.macMeta {
+					if err := copyMacMetadata(srcPath, tgt.(*localFS).path(file.path)); err != nil {
+						opts.log.logError("sync", file.path, "copy macOS metadata of", err)
+						numErrors++
+					}
+				}
+
+			} else if fileMode&os.ModeSymlink != 0 {
+				if err := backupTarget(tgt, file.path, opts); err != nil {
+					opts.log.logError("sync", file.path, "back up", err)
+					numErrors++
+					failed = append(failed, file)
+					continue
+				}
+				if _, err := tgt.Lstat(file.path); err == nil {
+					if err := tgt.Remove(file.path); err != nil {
+						opts.log.logError("sync", file.path, "remove stale symbolic link", err)
+						numErrors++
+						failed = append(failed, file)
+						continue
+					}
+				}
+				linkPath := file.linkPath
+				if err := tgt.Symlink(linkPath, file.path); err != nil {
+					opts.log.logError("sync", file.path, "create symbolic link", err)
+					numErrors++
+					failed = append(failed, file)
+					continue
+				}
+				numSymlinks++
+				if err := setOwner(tgt, file, opts); err != nil {
+					opts.log.logError("sync", file.path, "change owner of", err)
+					numErrors++
+				}
+
+			} else if opts.fakeSuper && fileMode&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+				if err := backupTarget(tgt, file.path, opts); err != nil {
+					opts.log.logError("sync", file.path, "back up", err)
+					numErrors++
+					failed = append(failed, file)
+					continue
+				}
+				major, minor := deviceNumbers(file.info)
+				if err := tgt.(*localFS).createFakeSpecial(file.path, fileMode, major, minor); err != nil {
+					opts.log.logError("sync", file.path, "create", err)
+					numErrors++
+					failed = append(failed, file)
+					continue
+				}
+				if err := setOwner(tgt, file, opts); err != nil {
+					opts.log.logError("sync", file.path, "change owner of", err)
+					numErrors++
+				}
+				if err := tgt.Chtimes(file.path, file.info.ModTime()); err != nil {
+					opts.log.logError("sync", file.path, "change modification time of", err)
+					numErrors++
+				}
+
+			} else {
+				numSkipped++
+				continue
+			}
+			if opts.crtimes {
+				if err := copyBirthTime(tgt, file); err != nil {
+					opts.log.logError("sync", file.path, "set creation time of", err)
+					numErrors++
+				}
+			}
+			if opts.removeSrc {
+				if err := removeSource(tgt, srcPath, file, opts); err != nil {
+					opts.log.logError("sync", file.path, "remove source of", err)
+					numErrors++
+				}
+			}
+			opts.dirs.touch(file.path)
+			opts.index.record(file)
+			fileCount++
+			reportSynced(file, opts)
+		}
+	}
+	syncDone <- syncStats{numFiles: fileCount, numBytes: numBytes, numErrors: numErrors,
+		numSkipped: numSkipped, numSymlinks: numSymlinks, failed: failed}
+}
+
+// reportSynced reports the entry file as synced
+func reportSynced(file fileInfo, opts *options) {
+	if opts.itemize {
+		opts.log.printf("%s %s\n", itemize(file), file.path)
+	} else {
+		opts.log.infoEvent(levelFiles, event{Phase: "sync", Path: file.path, Action: "sync",
+			Bytes: file.info.Size()}, "%s\n", file.path)
+	}
+	if opts.progress != nil {
+		opts.progress.fileDone(file.path)
+	}
+}
+
+// errSourceChanged is reported for source files which changed while they were
+// synced
+var errSourceChanged = errors.New("source changed while syncing")
+
+// removeSource removes the source file at srcPath once file was synced to tgt.
+// Unless copies are verified by checksum, the size of the copy is checked
+// first. Sources which changed while being synced are kept.
+// NOTE: Only entries synced by the run are removed; sources which were
+// already up to date on the target are left alone.
+func removeSource(tgt backend, srcPath string, file fileInfo, opts *options) error {
+	info, err := os.Lstat(srcPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != file.info.Size() || !info.ModTime().Equal(file.info.ModTime()) {
+		return errSourceChanged
+	}
+	if !opts.verify && file.info.Mode().IsRegular() {
+		tgtFile, err := tgt.Lstat(file.path)
+		if err != nil {
+			return err
+		}
+		if tgtFile.info.Size() != file.info.Size() {
+			return fmt.Errorf("size of copy differs from source")
+		}
+	}
+	return os.Remove(srcPath)
+}
+
+// retryFailed syncs the entries which failed to sync again up to opts.retries
+// times, doubling the delay between attempts. Entries synced successfully on
+// retry are no longer counted and reported as errors.
+func retryFailed(tgt backend, stats *syncStats, opts *options) {
+	delay := retryDelay
+	for i := 0; i < opts.retries && len(stats.failed) > 0; i++ {
+		opts.log.infof(levelSummary, "retrying %d failed entries in %s\n", len(stats.failed), delay)
+		opts.progress.phase("retry")
+		select {
+		case <-time.After(delay):
+		case <-opts.done():
+			return
+		}
+		delay *= 2
+
+		// errors of the retried entries are recorded again if they persist
+		for _, f := range stats.failed {
+			opts.log.forgetErrors(f.path)
+		}
+		retryList := make(chan []fileInfo, 1)
+		retryList <- stats.failed
+		close(retryList)
+		syncDone := make(chan syncStats, 1)
+		syncFiles(tgt, retryList, syncDone, opts)
+
+		d := <-syncDone
+		stats.numFiles += d.numFiles
+		stats.numBytes += d.numBytes
+		stats.numSymlinks += d.numSymlinks
+		// the failures of the retried entries are replaced by those of the
+		// retry, which include metadata failures of entries synced by it
+		stats.numErrors += d.numErrors - int64(len(stats.failed))
+		stats.failed = d.failed
+	}
+}
+
+// syncDirLayout syncs the target directory layout with the provided source layout.
+// XXX: This function assumes that os.MkdirAll is threadsafe which it most
+// likely isn't. Thus, this steps needs much more thought going forward.
+func syncDirLayout(tgt backend, dirList <-chan []fileInfo, done *sync.WaitGroup,
+	stats *syncStats, opts *options) {
+	for batch := range dirList {
+		if opts.interrupted() {
+			continue
+		}
+		for _, dir := range batch {
+			if opts.index.unchanged(dir) {
+				opts.dirs.add(dir, false)
+				opts.index.record(dir)
+				continue
+			}
+			tgtDir, err := lstatTarget(tgt, dir.path, opts)
+			if err != nil && os.IsNotExist(err) && opts.existing {
+				opts.log.infoEvent(levelDecisions, event{Phase: "dirs", Path: dir.path, Action: "skip",
+					Msg: "missing"}, "%s/: missing, ignored\n", dir.path)
+			} else if err != nil && os.IsNotExist(err) {
+				// dry runs only report the directories they would create
+				if !opts.dryRun {
+					// the final mode is set once the content is synced
+					err := tgt.Mkdir(dir.path, dir.info.Mode()|0700)
+					if err != nil {
+						opts.log.logError("dirs", dir.path, "create directory", err)
+						atomic.AddInt64(&stats.numErrors, 1)
+						continue
+					}
+					opts.dirs.add(dir, true)
+					opts.index.record(dir)
+					atomic.AddInt64(&stats.numDirs, 1)
+					if err := setOwner(tgt, dir, opts); err != nil {
+						opts.log.logError("dirs", dir.path, "change owner of", err)
+						atomic.AddInt64(&stats.numErrors, 1)
+					}
+					if opts.macMeta {
+						if err := copyMacMetadata(dir.src.srcPath(dir.path), tgt.(*localFS).path(dir.path)); err != nil {
+							opts.log.logError("dirs", dir.path, "copy macOS metadata of", err)
+							atomic.AddInt64(&stats.numErrors, 1)
+						}
+					}
+					if opts.crtimes {
+						if err := copyBirthTime(tgt, dir); err != nil {
+							opts.log.logError("dirs", dir.path, "set creation time of", err)
+							atomic.AddInt64(&stats.numErrors, 1)
+						}
+					}
+				}
+				if opts.itemize {
+					dir.change = changeNew
+					opts.log.printf("%s %s/\n", itemize(dir), dir.path)
+				} else {
+					opts.log.infoEvent(levelFiles, event{Phase: "dirs", Path: dir.path, Action: "mkdir"},
+						"%s/\n", dir.path)
+				}
+			} else if err == nil {
+				opts.dirs.add(dir, tgtDir.info.Mode() != dir.info.Mode() ||
+					!sameModTime(tgt, dir.info.ModTime(), tgtDir.info.ModTime(), opts.modifyWindow))
+				opts.index.record(dir)
+				// directories recorded in the manifest may be missing on the
+				// actual target, e.g. when staging changes for an offline target
+				if opts.tgtManifest != nil && !opts.dryRun {
+					if err := tgt.Mkdir(dir.path, dir.info.Mode()|0700); err != nil {
+						opts.log.logError("dirs", dir.path, "create directory", err)
+						atomic.AddInt64(&stats.numErrors, 1)
+					}
+				}
+			} else {
+				opts.log.logError("dirs", dir.path, "check", err)
+				atomic.AddInt64(&stats.numErrors, 1)
+			}
+		}
+	}
+	done.Done()
+}
+
+// reasons for syncing an entry determined by checkTgt
+const (
+	changeNew     = 1 << iota // missing on the target or of different type
+	changeSize                // size differs
+	changeTime                // modification time differs
+	changeMode                // permissions differ
+	changeLink                // symbolic link points elsewhere
+	changeContent             // content differs, only determined by checksum comparisons
+	changeCtime               // inode of the source changed after the target was written
+)
+
+// itemize returns an rsync -i like change code for the provided entry. The
+// first character is > for transferred files and c for locally created
+// entries, the second the entry type (f, L, d) followed by either +++ for new
+// entries or the s(ize), t(ime), p(ermission), and l(ink target) changes.
+func itemize(file fileInfo) string {
+	code := []byte(">f....")
+	if file.info.Mode()&os.ModeSymlink != 0 {
+		code[0], code[1] = 'c', 'L'
+	} else if file.info.IsDir() {
+		code[0], code[1] = 'c', 'd'
+	}
+	if file.change&changeNew != 0 {
+		copy(code[2:], "++++")
+		return string(code)
+	}
+	for i, c := range []int{changeSize, changeTime, changeMode, changeLink} {
+		if file.change&c != 0 {
+			code[2+i] = "stpl"[i]
+		}
+	}
+	return string(code)
+}
+
+// resolveUpdateConflict resolves the conflict between srcFile and the newer
+// tgtFile with the configured strategy and reports if srcFile still needs
+// to be synced
+func resolveUpdateConflict(tgt backend, srcFile *fileInfo, tgtFile fileInfo,
+	stats *syncStats, opts *options) bool {
+	path := srcFile.path
+	switch resolveConflict(opts.conflict, manifestEntryOf(*srcFile), manifestEntryOf(tgtFile)) {
+	case resolveFirst:
+		opts.log.infoEvent(levelSummary, event{Phase: "check", Path: path, Action: "conflict",
+			Msg: "source wins"}, "%s: conflict, replacing newer target\n", path)
+		return true
+	case resolveBoth:
+		if !opts.dryRun {
+			if err := tgt.(renamer).Rename(path, conflictPath(path)); err != nil {
+				opts.log.logError("check", path, "keep conflicting", err)
+				atomic.AddInt64(&stats.numErrors, 1)
+				return false
+			}
+		}
+		opts.log.infoEvent(levelSummary, event{Phase: "check", Path: path, Action: "conflict",
+			Msg: "kept both"}, "%s: conflict, target kept as %s\n", path, conflictPath(path))
+		srcFile.change = changeNew
+		return true
+	case resolveNone:
+		if opts.conflict == conflictFail {
+			opts.log.logError("check", path, "update", errTargetNewer)
+			atomic.AddInt64(&stats.numErrors, 1)
+			return false
+		}
+	}
+	opts.log.infoEvent(levelSummary, event{Phase: "check", Path: path, Action: "skip",
+		Msg: "target is newer"}, "%s: skipped, target is newer\n", path)
+	return false
+}
+
+// checkTgt processes a channel of target fileInfo types and determines if
+// entry needs to be synced or not.
+func checkTgt(tgt backend, fileList <-chan []fileInfo, updateList chan<- []fileInfo,
+	done *sync.WaitGroup, stats *syncStats, opts *options) {
+	for batch := range fileList {
+		if opts.interrupted() {
+			continue
+		}
+		// entries needing an update are handed on once the batch is checked
+		var updates []fileInfo
+		for _, srcFile := range batch {
+			atomic.AddInt64(&stats.numExamined, 1)
+			if opts.index.unchanged(srcFile) {
+				opts.log.infoEvent(levelDecisions, event{Phase: "check", Path: srcFile.path, Action: "skip",
+					Msg: "unchanged"}, "%s: unchanged since last run\n", srcFile.path)
+				opts.index.record(srcFile)
+				atomic.AddInt64(&stats.numUnchanged, 1)
+				continue
+			}
+			tgtFile, err := lstatTarget(tgt, srcFile.path, opts)
+			if err != nil {
+				if os.IsNotExist(err) && opts.existing {
+					opts.log.infoEvent(levelDecisions, event{Phase: "check", Path: srcFile.path, Action: "skip",
+						Msg: "missing"}, "%s: missing, ignored\n", srcFile.path)
+				} else if os.IsNotExist(err) && useBasis(tgt, &srcFile, opts) {
+					atomic.AddInt64(&stats.numUnchanged, 1)
+				} else if os.IsNotExist(err) {
+					srcFile.change = changeNew
+					opts.log.infoEvent(levelDecisions, event{Phase: "check", Path: srcFile.path, Action: "new"},
+						"%s: new\n", srcFile.path)
+					updates = append(updates, srcFile)
+				} else {
+					opts.log.logError("check", srcFile.path, "check", err)
+					atomic.AddInt64(&stats.numErrors, 1)
+				}
+				continue
+			}
+			if opts.ignoreExisting {
+				opts.log.infoEvent(levelDecisions, event{Phase: "check", Path: srcFile.path, Action: "skip",
+					Msg: "exists"}, "%s: exists, ignored\n", srcFile.path)
+				continue
+			}
+			srcFile.change = entryChange(tgt, srcFile, tgtFile, opts.modifyWindow)
+			if opts.sizeOnly && srcFile.info.Mode().IsRegular() && srcFile.change&changeSize == 0 {
+				srcFile.change &^= changeTime | changeMode
+			}
+			// files of equal size are compared by content instead of
+			// modification time
+			if opts.checksum && srcFile.info.Mode().IsRegular() && tgtFile.info.Mode().IsRegular() &&
+				srcFile.change&(changeNew|changeSize) == 0 && !srcFile.streamed() {
+				srcFile.change &^= changeTime
+				same, err := sameCopy(tgt, srcFile, opts)
+				if err != nil {
+					opts.log.logError("check", srcFile.path, "checksum", err)
+					atomic.AddInt64(&stats.numErrors, 1)
+					continue
+				}
+				if !same {
+					srcFile.change |= changeContent
+				}
+			}
+			// the size of transformed content is only known once it is
+			// copied
+			if srcFile.content != nil {
+				srcFile.change &^= changeSize
+			}
+			if opts.ctime && srcFile.change == 0 && newerCtime(srcFile.info, tgtFile.info) {
+				srcFile.change = changeCtime
+			}
+			// entries of the same type changed on the target more recently
+			// conflict with the source and are resolved on request
+			if opts.update && srcFile.change != 0 && srcFile.change&changeNew == 0 &&
+				tgtFile.info.ModTime().After(srcFile.info.ModTime().Add(opts.modifyWindow)) {
+				atomic.AddInt64(&stats.numConflicts, 1)
+				if !resolveUpdateConflict(tgt, &srcFile, tgtFile, stats, opts) {
+					continue
+				}
+			}
+			// resuming would extend the previous version instead of
+			// backing it up
+			if srcFile.info.Mode().IsRegular() && !opts.backup && !srcFile.streamed() {
+				srcFile.partial = resumableSize(srcFile.info, tgtFile.info)
+			}
+			if srcFile.change != 0 {
+				opts.log.infoEvent(levelDecisions, event{Phase: "check", Path: srcFile.path, Action: "update",
+					Msg: describeChange(srcFile.change)}, "%s: %s\n", srcFile.path,
+					describeChange(srcFile.change))
+				updates = append(updates, srcFile)
+			} else {
+				opts.log.infoEvent(levelDecisions, event{Phase: "check", Path: srcFile.path, Action: "skip"},
+					"%s: up to date\n", srcFile.path)
+				opts.index.record(srcFile)
+				atomic.AddInt64(&stats.numUnchanged, 1)
+			}
+		}
+		if len(updates) > 0 {
+			if opts.progress != nil {
+				for _, u := range updates {
+					opts.progress.queue(u.info.Size())
+				}
+			}
+			updateList <- updates
+		}
+	}
+	done.Done()
+}
+
+// minResumeSize is the minimum size of partial target files which are
+// resumed. Smaller files are cheaper to copy again than to checksum.
+const minResumeSize = 1024 * 1024
+
+// resumableSize returns the size of the target file described by tgtInfo if
+// it may be a partial copy of the source file left behind by an interrupted
+// run, and 0 otherwise
+func resumableSize(srcInfo, tgtInfo os.FileInfo) int64 {
+	if tgtInfo.Mode().IsRegular() && tgtInfo.Size() >= minResumeSize &&
+		tgtInfo.Size() < srcInfo.Size() {
+		return tgtInfo.Size()
+	}
+	return 0
+}
+
+// resumeFile checks if the partial copy of size bytes at path on tgt matches
+// the start of the source file s by comparing their algo checksums. If so, it returns the target opened for
+// appending and the size of the partial copy with s positioned right after
+// it. Otherwise a nil writer is returned and the file has to be copied from
+// the start. Resumed copies are logged to logs.
+func resumeFile(s *os.File, tgt backend, path string, size int64, algo hashAlgo,
+	logs *runLog) (io.WriteCloser, int64) {
+	r, ok := tgt.(resumer)
+	if !ok {
+		return nil, 0
+	}
+	srcSum, err := prefixSum(io.NewSectionReader(s, 0, size), size, algo)
+	if err != nil {
+		return nil, 0
+	}
+	tgtSum, err := r.PrefixSum(path, size, algo)
+	if err != nil || !bytes.Equal(srcSum, tgtSum) {
+		return nil, 0
+	}
+	t, err := r.Append(path)
+	if err != nil {
+		return nil, 0
+	}
+	if _, err := s.Seek(size, io.SeekStart); err != nil {
+		t.Close()
+		return nil, 0
+	}
+	logs.infoEvent(levelDecisions, event{Phase: "sync", Path: path, Action: "resume",
+		Bytes: size}, "%s: resuming after %d bytes\n", path, size)
+	return t, size
+}
+
+// errChecksumMismatch is reported for copies failing verification
+var errChecksumMismatch = errors.New("checksum of copy differs from source")
+
+// verifyFile compares the algo checksums of the first size bytes of the
+// source file s and its copy at path on tgt, looking up the checksum of the
+// source in sums unless it is nil
+func verifyFile(s *os.File, tgt backend, path string, size int64, algo hashAlgo, sums *sumCache) error {
+	srcSum, err := sums.fileSum(s, size, algo)
+	if err != nil {
+		return err
+	}
+	tgtSum, err := targetSum(tgt, path, size, algo)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(srcSum, tgtSum) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// sameCopy compares the checksums of the regular source file and its
+// copy on tgt, both of the same size
+func sameCopy(tgt backend, file fileInfo, opts *options) (bool, error) {
+	srcPath := file.src.srcPath(file.path)
+	if file.origPath != "" {
+		srcPath = file.src.srcPath(file.origPath)
+	}
+	s, err := os.Open(srcPath)
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+	size := file.info.Size()
+	srcSum, err := opts.sums.fileSum(s, size, opts.checksumChoice)
+	if err != nil {
+		return false, err
+	}
+	tgtSum, err := targetSum(tgt, file.path, size, opts.checksumChoice)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(srcSum, tgtSum), nil
+}
+
+// targetSum returns the algo checksum of the first size bytes of the file at
+// path on tgt. Files on targets which can not checksum them are read.
+func targetSum(tgt backend, path string, size int64, algo hashAlgo) ([]byte, error) {
+	if r, ok := tgt.(resumer); ok {
+		return r.PrefixSum(path, size, algo)
+	}
+	return readSum(tgt, path, size, algo)
+}
+
+// readSum returns the algo checksum of the first size bytes of the file at
+// path on tgt by reading them
+func readSum(tgt backend, path string, size int64, algo hashAlgo) ([]byte, error) {
+	f, err := tgt.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return prefixSum(f, size, algo)
+}
+
+// copyBirthTime sets the creation time of the copy of file on the local
+// target tgt to the one of its source if it is known
+func copyBirthTime(tgt backend, file fileInfo) error {
+	t, ok := birthTime(file.info)
+	if !ok {
+		return nil
+	}
+	return setBirthTime(tgt.(*localFS).path(file.path), t)
+}
+
+// discardPartial removes the incomplete copy at path left behind by a failed
+// transfer unless partial copies are kept for resuming them later
+func discardPartial(tgt backend, path string, opts *options) {
+	if opts.partial || opts.partialDir != "" {
+		return
+	}
+	// NOTE: Removal fails for backends which never created the file, e.g.
+	// object stores aborting the upload, which is fine
+	tgt.Remove(path)
+}
+
+// lstatTarget looks up path on tgt, or in the target manifest if one is used
+func lstatTarget(tgt backend, path string, opts *options) (fileInfo, error) {
+	if opts.tgtManifest == nil {
+		return tgt.Lstat(path)
+	}
+	fi, ok := opts.tgtManifest[path]
+	if !ok {
+		return fileInfo{}, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return fi, nil
+}
+
+// entryChange determines the reasons for syncing srcFile to tgt given its
+// existing counterpart tgtFile there, or 0 if it is up to date. Modification
+// times within window of each other are considered equal.
+func entryChange(tgt backend, srcFile, tgtFile fileInfo, window time.Duration) int {
+	info := tgtFile.info
+	srcIsSymlink := srcFile.info.Mode()&os.ModeSymlink != 0
+	tgtIsSymlink := info.Mode()&os.ModeSymlink != 0
+
+	change := 0
+	if !srcIsSymlink && !tgtIsSymlink {
+		// regular files
+		if srcFile.info.Size() != info.Size() {
+			change |= changeSize
+		}
+		if !sameModTime(tgt, srcFile.info.ModTime(), info.ModTime(), window) {
+			change |= changeTime
+		}
+		if srcFile.info.Mode() != info.Mode() && keepsMode(tgt) {
+			change |= changeMode
+		}
+	} else if srcIsSymlink && tgtIsSymlink {
+		// check that link points to the correct file
+		if tgtFile.linkPath != srcFile.linkPath {
+			change = changeLink
+		}
+	} else {
+		// the entry changed its type and is replaced
+		change = changeNew
+	}
+	return change
+}
+
+// newerCtime determines if the inode of the source entry described by
+// srcInfo changed after the one of its target counterpart described by
+// tgtInfo, e.g. because of metadata-only changes which keep the modification
+// time. Targets without inode change times never are older.
+func newerCtime(srcInfo, tgtInfo os.FileInfo) bool {
+	srcTime, ok := inodeChangeTime(srcInfo)
+	if !ok {
+		return false
+	}
+	tgtTime, ok := inodeChangeTime(tgtInfo)
+	return ok && srcTime.After(tgtTime)
+}
+
+// chanCloser closes the provided fileInfo channel once the provided done channel
+// has delivered the specified number of elements
+func chanCloser(fileList chan<- []fileInfo, done *sync.WaitGroup) {
+	done.Wait()
+	close(fileList)
+}
+
+// syncFile synchronizes target and source and makes sure they have identical
+// permissions and timestamps. buf is used for copying unless the copy can be
+// offloaded to the kernel. Failures are logged before they are returned.
+func syncFile(srcPath string, tgt backend, file fileInfo, buf []byte, opts *options) (int64, error) {
+	// s is only set for files of source trees
+	var s *os.File
+	var src io.ReadCloser
+	var err error
+	if file.basis == "" && file.src != nil && file.src.archive != nil {
+		relPath := file.path
+		if file.origPath != "" {
+			relPath = file.origPath
+		}
+		src, err = file.src.archive.open(relPath)
+	} else if s, err = os.Open(srcPath); err == nil {
+		src = s
+	}
+	if err != nil {
+		opts.log.logError("sync", file.path, "open source file", err)
+		return 0, err
+	}
+	defer src.Close()
+
+	// with a partial dir, files are copied there and moved into place once
+	// they are complete
+	dst := file.path
+	if opts.partialDir != "" {
+		dst = filepath.Join(opts.partialDir, file.path)
+		file.partial = 0
+		if fi, err := tgt.Lstat(dst); err == nil && !file.streamed() {
+			file.partial = resumableSize(file.info, fi.info)
+		} else if err := tgt.Mkdir(filepath.Dir(dst), 0700); err != nil {
+			opts.log.logError("sync", file.path, "create partial dir for", err)
+			return 0, err
+		}
+	}
+
+	// renamed files may end up in directories missing from the source
+	if file.origPath != "" && filepath.Dir(file.path) != filepath.Dir(file.origPath) {
+		if err := tgt.Mkdir(filepath.Dir(file.path), 0755); err != nil {
+			opts.log.logError("sync", file.path, "create parent dir for", err)
+			return 0, err
+		}
+	}
+
+	var t io.WriteCloser
+	var offset int64
+	ac, hasAttrs := tgt.(attrCreator)
+	sc, sized := tgt.(sizedCreator)
+	if sized && file.content != nil {
+		err := errors.New("transformed content can not be synced to this target")
+		opts.log.logError("sync", file.path, "create", err)
+		return 0, err
+	}
+	if file.partial > 0 {
+		t, offset = resumeFile(s, tgt, dst, file.partial, opts.checksumChoice, opts.log)
+	}
+	if t == nil {
+		// without a partial dir, the previous version is replaced right away
+		if dst == file.path {
+			if err := backupTarget(tgt, dst, opts); err != nil {
+				opts.log.logError("sync", file.path, "back up", err)
+				return 0, err
+			}
+		}
+		if sized {
+			t, err = sc.CreateSized(dst, file.info.Mode(), file.info.ModTime(), file.info.Size())
+		} else if hasAttrs {
+			t, err = ac.CreateWithAttrs(dst, file.info.Mode(), file.info.ModTime())
+		} else {
+			t, err = tgt.Create(dst)
+		}
+		if err != nil {
+			opts.log.logError("sync", file.path, "create", err)
+			return 0, err
+		}
+	}
+
+	// report is called for every chunk of data copied, blocks while the run
+	// is paused, and aborts the copy once the run is interrupted
+	var fp *fileProgress
+	if opts.progress != nil {
+		fp = opts.progress.startFile(file.path, file.info.Size())
+		defer opts.progress.endFile(fp)
+		fp.add(offset)
+	}
+	report := func(n int) error {
+		opts.pause.wait(opts.done())
+		if opts.limiter != nil {
+			opts.limiter.wait(n)
+		}
+		if fp != nil {
+			fp.add(int64(n))
+		}
+		if opts.interrupted() {
+			return opts.ctx.Err()
+		}
+		return nil
+	}
+
+	// for local targets, try to share the data via a reflink first and fall
+	// back to copying large files in parallel streams if enabled, or inside
+	// the kernel via sendfile. Only if neither works we copy through user
+	// space.
+	var n int64
+	copied := false
+	if f, ok := t.(*os.File); ok && s != nil && file.content == nil {
+		if offset == 0 && cloneFile(f, s) == nil {
+			n, copied = file.info.Size(), true
+			if fp != nil {
+				fp.add(n)
+			}
+		} else if offset == 0 && useCopyStreams(file.info.Size(), opts) {
+			n, err = parallelCopy(f, s, file.info.Size(), opts.copyStreams, len(buf), report)
+			copied = true
+		} else if n, err = sendFile(f, s, len(buf), report); err == nil || n > 0 {
+			copied = true
+		}
+	}
+	if !copied {
+		var r io.Reader = src
+		if file.content != nil {
+			r = file.content(src)
+		}
+		n, err = io.CopyBuffer(t, &reportReader{r: r, report: report}, buf)
+	}
+	// NOTE: On failure the partial copy is removed unless it is kept for
+	// resuming; its attributes are left alone so it does not look up to date
+	// on the next run
+	if err != nil {
+		t.Close()
+		if !opts.interrupted() {
+			opts.log.logError("sync", file.path, "copy", err)
+		}
+		discardPartial(tgt, dst, opts)
+		return n, err
+	}
+	if err := t.Close(); err != nil {
+		opts.log.logError("sync", file.path, "close", err)
+		discardPartial(tgt, dst, opts)
+		return n, err
+	}
+	if opts.verify && !file.streamed() {
+		if err := verifyFile(s, tgt, dst, offset+n, opts.checksumChoice, opts.sums); err != nil {
+			opts.log.logError("sync", file.path, "verify", err)
+			return n, err
+		}
+	}
+	if dst != file.path {
+		if err := backupTarget(tgt, file.path, opts); err != nil {
+			opts.log.logError("sync", file.path, "back up", err)
+			return n, err
+		}
+		if err := tgt.(renamer).Rename(dst, file.path); err != nil {
+			opts.log.logError("sync", file.path, "move complete copy into place", err)
+			return n, err
+		}
+	}
+	// the mode and modification time of files created with their attributes
+	// are final, only their ownership is left to set
+	if hasAttrs || sized {
+		if err := setOwner(tgt, file, opts); err != nil {
+			opts.log.logError("sync", file.path, "change owner of", err)
+			return n, err
+		}
+		return n, nil
+	}
+
+	// sync file properties between source and target, ownership first since
+	// changing it may clear the setuid and setgid bits. All of them are
+	// attempted; the first failure fails the file.
+	var metaErr error
+	if err := setOwner(tgt, file, opts); err != nil {
+		opts.log.logError("sync", file.path, "change owner of", err)
+		metaErr = err
+	}
+	if err := tgt.Chtimes(file.path, file.info.ModTime()); err != nil {
+		opts.log.logError("sync", file.path, "change modification time of", err)
+		if metaErr == nil {
+			metaErr = err
+		}
+	}
+	if err := tgt.Chmod(file.path, file.info.Mode()); err != nil {
+		opts.log.logError("sync", file.path, "change mode of", err)
+		if metaErr == nil {
+			metaErr = err
+		}
+	}
+	return n, metaErr
+}
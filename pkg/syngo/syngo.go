@@ -0,0 +1,1300 @@
+// Package syngo implements syngo, a rsync like filesystem synchronization
+// tool with the ability to keep a customizeable amount of back history. Other
+// programs can embed it via Sync, the syngo command is a thin wrapper around
+// Main.
+package syngo
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// default number of concurrent checkers and syncers for local targets. Remote
+// targets are bound by latency rather than disk throughput and default to
+// more workers.
+const (
+	defaultSyncers       = 2
+	defaultRemoteWorkers = 8
+	defaultQueueDepth    = 16 // batches buffered between pipeline stages
+	defaultBufferSize    = 256 * 1024
+	retryDelay           = time.Second // delay before the first retry of failed entries
+)
+
+// exit codes of syngo. Usage errors and failures preventing a run from
+// starting exit with exitFatal (as done by log.Fatal). Like rsync, runs in
+// which some entries could not be synced exit with 23 and interrupted runs
+// with 20. syngo compare exits with exitDiffer if the compared trees differ.
+const (
+	exitOK          = 0
+	exitFatal       = 1
+	exitDiffer      = 2
+	exitInterrupted = 20
+	exitPartial     = 23
+)
+
+// syncStats keeps a record of useful sync statistics (number of files,
+// amount of data, ...)
+type syncStats struct {
+	numFiles     int64
+	numBytes     int64
+	numErrors    int64      // failures while scanning, checking, or syncing
+	numSkipped   int64      // entries of unsupported types (devices, sockets, ...)
+	numConflicts int64      // entries modified on the target more recently with -update
+	numDeleted   int64      // extraneous target entries deleted
+	numExamined  int64      // source files and symbolic links checked against the target
+	numUnchanged int64      // examined entries which were up to date
+	numFiltered  int64      // source entries skipped by filters and limits
+	numSymlinks  int64      // symbolic links created on the target
+	numDirs      int64      // directories created on the target
+	failed       []fileInfo // entries which failed to sync
+}
+
+// fileInfo keeps track of the information needed to determine if a file needs
+// to be resynced or not
+type fileInfo struct {
+	info     os.FileInfo
+	path     string
+	linkPath string  // target path for symbolic links
+	src      *source // source tree containing the entry
+	change   int     // reasons for syncing the entry as determined by checkTgt
+	partial  int64   // size of a possibly partial copy on the target to resume
+
+	// target path of the entry before a transform renamed it, empty if it
+	// was not renamed
+	origPath string
+	// unchanged copy of the file in a -copy-dest directory which is copied
+	// instead of the source, empty if unused
+	basis string
+	// wraps the source data while it is copied, nil to copy it verbatim
+	content func(io.Reader) io.Reader
+}
+
+// streamed reports if the content of file is not copied verbatim from a file
+// of a source tree, i.e. is transformed or read from an archive, which rules
+// out resuming, cloning, and verifying its copies
+func (f *fileInfo) streamed() bool {
+	return f.content != nil || (f.basis == "" && f.src != nil && f.src.archive != nil)
+}
+
+// options collects the settings controlling a single sync run
+type options struct {
+	paths       []string     // if non-empty, only sync these paths relative to src
+	skipMeta    bool         // skip syngo's metadata directory at the top of src
+	rsh         string       // remote shell command used to reach remote targets
+	remoteSyngo string       // path of the syngo binary on remote hosts
+	s3Endpoint  string       // endpoint URL of an S3 compatible object store
+	compress    int          // compression level of data sent to syngo servers, 0 if disabled
+	packing     string       // compression algorithm of data sent to syngo servers
+	limiter     *rateLimiter // shared bandwidth limit of all syncers, nil if unlimited
+	checkers    int          // number of concurrent checkers, 0 for the default
+	syncers     int          // number of concurrent syncers, 0 for the default
+	queueDepth  int          // batches buffered between pipeline stages, 0 for the default
+	bufferSize  int          // size of the syncers' copy buffers, 0 for the default
+	progress    *progress    // progress display, nil if disabled
+	dirs        *dirTracker  // directories whose metadata is set at the end of a run
+	itemize     bool         // print a change code for every synced entry
+	dryRun      bool         // only report the changes a run would make
+	retries     int          // number of times failed entries are retried at the end of a run
+	partial     bool         // keep partial copies of files which failed to sync
+	partialDir  string       // copy files here relative to the target and move them once complete
+	verify      bool         // compare checksums of source and target after copying
+	removeSrc   bool         // remove source files once they are synced
+	macMeta     bool         // copy macOS metadata (Finder info, resource forks)
+	crtimes     bool         // preserve creation times
+	nfs         bool         // tune local targets for NFS mounts
+	chmod       []chmodRule  // permission changes applied to synced files and directories
+	chown       *owner       // ownership of synced entries, nil to leave it alone
+	owner       bool         // preserve the owner of source entries
+	group       bool         // preserve the group of source entries
+	numericIDs  bool         // preserve owner and group by numeric ID instead of by name
+	usermap     []idMapping  // translation of source owners, implies owner
+	groupmap    []idMapping  // translation of source groups, implies group
+	fakeSuper   bool         // record ownership, devices, and special bits in xattrs
+	crypt       *cryptKeys   // encrypts data written to the target, nil if disabled
+
+	// filtering of source entries, limits are ignored if 0
+	filters   []filterRule  // regular expression rules matched against entry paths
+	oneFS     bool          // do not descend into directories on other file systems
+	follow    bool          // sync the referents of symbolic links instead of the links
+	dangling  bool          // warn about symbolic links whose target does not exist
+	safeLinks bool          // skip symbolic links pointing outside the source tree
+	munge     bool          // make symbolic links pointing outside the source tree unusable
+	minSize   int64         // files smaller than this are skipped
+	maxSize   int64         // files larger than this are skipped
+	newerThan time.Duration // files modified longer ago than this are skipped
+	olderThan time.Duration // files modified more recently than this are skipped
+
+	// comparison of source and target entries
+	sizeOnly     bool          // files of equal size are up to date
+	checksum     bool          // compare files of equal size by checksum instead of modification time
+	ctime        bool          // resync entries whose source inode changed after their copy
+	modifyWindow time.Duration // modification times differing at most this much are equal
+
+	// handling of entries existing on the target
+	update         bool   // skip entries which are newer on the target
+	ignoreExisting bool   // only sync entries missing on the target
+	existing       bool   // only sync entries already present on the target
+	conflict       string // resolution of -update conflicts
+	backup         bool   // move replaced target entries into a backup
+	backupDir      string // backups are kept here relative to the target, next to the entries if empty
+	backupSuffix   string // suffix appended to backups
+
+	// basis directories used for files missing on the target, nil if unused
+	basis *basisDirs
+
+	// removal of target entries missing in the sources
+	delete bool // remove extraneous target entries
+	trash  bool // move extraneous target entries into the trash instead
+
+	// entries of the target as recorded in a manifest which are checked
+	// instead of the target itself, nil if unused
+	tgtManifest map[string]fileInfo
+
+	// source entries found in sync by the previous run which are not looked
+	// up on the target again while unchanged, nil if unused
+	index *fileIndex
+
+	// canceled once the run is interrupted, e.g. by SIGINT, nil if it can not
+	// be interrupted
+	ctx context.Context
+	// blocks syncers while the run is paused, nil if it can not be paused
+	pause *pauser
+	// records the spans of runs, nil if they are not traced
+	trace *tracer
+	// receives the messages and errors of the run, nil for the log of the
+	// syngo command
+	log *runLog
+	// how long to wait for other runs syncing to the same local target
+	waitForLock time.Duration
+
+	// shell commands run before and after every run, empty if unused
+	preCmd  string
+	postCmd string
+
+	// file recording the changes of the run for read-batch, empty if unused,
+	// and whether the target itself is left alone
+	writeBatch string
+	onlyBatch  bool
+	// records the changes of the current run, nil unless writeBatch is set
+	batch *batchFS
+
+	// state of the last full backup differential backups are based on,
+	// empty if unused, and whether they are written as archives
+	differential    string
+	differentialTar bool
+
+	// compression of archive targets, chosen by their name if empty
+	archiveCompress string
+
+	// algorithm of the checksums verifying and resuming copies and
+	// identifying the chunks of new repositories
+	checksumChoice hashAlgo
+	// cache of the checksums of local source and target files, nil if unused
+	sums *sumCache
+
+	// large files copied between local files are split into ranges copied
+	// by this many goroutines, disabled if at most 1, once they reach
+	// copyStreamsMin bytes (0 for the default)
+	copyStreams    int
+	copyStreamsMin int64
+
+	// per-file transforms registered through the library API and the target
+	// paths of the files they renamed during the run, nil without transforms
+	transforms []Transform
+	renamed    *renamedPaths
+}
+
+// interrupted reports if the run was canceled
+func (o *options) interrupted() bool {
+	return o.ctx != nil && o.ctx.Err() != nil
+}
+
+// done returns a channel which is closed once the run is canceled, nil if it
+// can not be
+func (o *options) done() <-chan struct{} {
+	if o.ctx == nil {
+		return nil
+	}
+	return o.ctx.Done()
+}
+
+// Main runs the syngo command with the provided command line arguments,
+// excluding the program name, and exits the program unless the command ran
+// successfully
+func Main(args []string) {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "restore":
+			restore(args[1:])
+			return
+		case "snapshots":
+			listSnapshots(args[1:])
+			return
+		case "manifest":
+			manifestCmd(args[1:])
+			return
+		case "compare":
+			compareCmd(args[1:])
+			return
+		case "prune":
+			prune(args[1:])
+			return
+		case "gc":
+			gc(args[1:])
+			return
+		case "empty-trash":
+			emptyTrash(args[1:])
+			return
+		case "bisync":
+			bisyncCmd(args[1:])
+			return
+		case "decrypt":
+			decryptCmd(args[1:])
+			return
+		case "run":
+			runCmd(args[1:])
+			return
+		case "read-batch":
+			readBatchCmd(args[1:])
+			return
+		case "--serve":
+			daemonCmd(args[1:])
+			return
+		case "--server":
+			serverCmd(args[1:])
+			return
+		}
+	}
+	syncCmd(args)
+}
+
+// syncCmd implements the main sync command with the provided command line
+// arguments
+func syncCmd(args []string) {
+	opts := &options{}
+	snapshot := flag.Bool("snapshot", false, "record a snapshot of the target tree after syncing")
+	flag.StringVar(&opts.rsh, "rsh", "ssh", "remote shell command used to reach [user@]host:path and sftp:// targets")
+	flag.StringVar(&opts.remoteSyngo, "remote-syngo", "syngo", "path of the syngo binary on remote hosts")
+	compress := flag.Bool("compress", false, "compress file data sent to [user@]host:path and syngo:// targets (for sftp:// targets, enable compression in ssh instead; s3://, gs://, and az:// targets store data as sent)")
+	compressLevel := flag.Int("compress-level", 0, fmt.Sprintf("compression level from 1 (fastest) to 9 (smallest) used by -compress (default %d); implies -compress", defaultCompressLevel))
+	compressChoice := flag.String("compress-choice", compressLZ4, "compression used by -compress: lz4 (fast) or deflate (smaller); servers without lz4 get deflate")
+	flag.StringVar(&opts.s3Endpoint, "s3-endpoint", "", "endpoint URL of an S3 compatible service for s3:// targets")
+	flag.IntVar(&opts.checkers, "checkers", 0, "number of concurrent target checkers (default depends on CPUs and target)")
+	flag.IntVar(&opts.syncers, "syncers", 0, "number of concurrent file syncers (default depends on target)")
+	flag.IntVar(&opts.queueDepth, "queue-depth", defaultQueueDepth, "number of batches of entries buffered between scanning, checking, and syncing")
+	quiet := flag.Bool("q", false, "quiet, only report errors")
+	verbose := flag.Bool("v", false, "verbose, list every synced entry")
+	veryVerbose := flag.Bool("vv", false, "very verbose, also show why entries are synced or skipped")
+	logFormat := flag.String("log-format", "text", "format of log messages, text or json (structured events)")
+	logFile := flag.String("log-file", "", "append all errors and messages (at least -v level) with timestamps to this file")
+	flag.BoolVar(&opts.dryRun, "dry-run", false, "only report what would be synced, and with -delete list the entries which would be deleted, without changing the target")
+	flag.BoolVar(&opts.itemize, "itemize", false, "print a change code for every synced entry, like rsync -i")
+	statsFormat := flag.String("stats-format", "text", "format of the final statistics, text or json")
+	showProgress := flag.Bool("progress", false, "show the progress of the sync including an ETA")
+	progressJSON := flag.Int("progress-json", -1, "write progress events as newline delimited JSON to this file descriptor (e.g. 3), for driving other progress displays")
+	bufferSize := flag.String("buffer-size", "256K", "size of the buffer used by each syncer for copying files (e.g. 4M)")
+	flag.IntVar(&opts.copyStreams, "copy-streams", 0, "copy large files between local trees with this many goroutines writing disjoint ranges of the preallocated copy, e.g. for network file systems or RAID arrays (0 copies every file as a single stream)")
+	copyStreamsMin := flag.String("copy-streams-min", "256M", "with -copy-streams, only split files of at least this size")
+	flag.IntVar(&opts.retries, "retries", 0, "retry entries which failed to sync up to this many times at the end of the run, with exponential backoff")
+	flag.BoolVar(&opts.partial, "partial", false, "keep partially copied files on failure so later runs can resume them")
+	flag.StringVar(&opts.partialDir, "partial-dir", "", "copy files into this directory relative to the target tree (e.g. .syngo/partial) and move them into place once complete; implies -partial")
+	flag.Var(filterFlag{rules: &opts.filters}, "exclude-regexp", "skip entries whose path relative to the source tree matches this regular expression (repeatable, the first matching include or exclude rule applies)")
+	flag.Var(filterFlag{rules: &opts.filters, include: true}, "include-regexp", "sync entries whose path relative to the source tree matches this regular expression even if a later exclude rule matches (repeatable)")
+	flag.Var(basisFlag{basis: &opts.basis, mode: basisLink}, "link-dest", "hard-link files missing on the target from this directory instead of copying them if they are unchanged there (repeatable, local targets only)")
+	flag.Var(basisFlag{basis: &opts.basis, mode: basisCompare}, "compare-dest", "skip files missing on the target if they are unchanged in this directory (repeatable)")
+	flag.Var(basisFlag{basis: &opts.basis, mode: basisCopy}, "copy-dest", "copy files missing on the target from this directory instead of the source if they are unchanged there (repeatable)")
+	flag.BoolVar(&opts.oneFS, "x", false, "don't cross file system boundaries, creating mount points below the source trees but skipping their content")
+	flag.BoolVar(&opts.oneFS, "one-file-system", false, "same as -x")
+	flag.BoolVar(&opts.follow, "L", false, "follow symbolic links, syncing the files and directories they point to instead of the links")
+	flag.BoolVar(&opts.dangling, "warn-dangling", false, "warn about symbolic links whose target does not exist (they are synced nonetheless)")
+	flag.BoolVar(&opts.safeLinks, "safe-links", false, "skip symbolic links which are absolute or point outside the source tree")
+	flag.BoolVar(&opts.munge, "munge-links", false, "prefix the targets of symbolic links which are absolute or point outside the source tree with "+mungePrefix+" so they no longer resolve")
+	minSize := flag.String("min-size", "", "skip files smaller than this size (e.g. 1K)")
+	maxSize := flag.String("max-size", "", "skip files larger than this size (e.g. 4G)")
+	newerThan := flag.String("newer-than", "", "only sync files modified within the given age (e.g. 24h, 7d)")
+	olderThan := flag.String("older-than", "", "only sync files modified longer ago than the given age (e.g. 30d, 2w)")
+	flag.BoolVar(&opts.ctime, "ctime", false, "also sync entries whose inode change time (ctime) is newer than that of their copy, catching metadata-only changes like chmod, chown, or extended attributes which keep the modification time (local sources and targets only)")
+	flag.BoolVar(&opts.sizeOnly, "size-only", false, "only sync files whose size differs, ignoring modification times and permissions (e.g. for targets with unreliable mtimes)")
+	flag.DurationVar(&opts.modifyWindow, "modify-window", 0, "consider modification times differing by at most this much equal (e.g. 2s for FAT, 1s for some NFS servers)")
+	flag.BoolVar(&opts.update, "update", false, "skip entries whose target copy was modified more recently than the source")
+	flag.BoolVar(&opts.ignoreExisting, "ignore-existing", false, "only sync entries missing on the target, never touching existing ones")
+	flag.BoolVar(&opts.existing, "existing", false, "only update entries already present on the target, never creating new ones")
+	flag.StringVar(&opts.conflict, "conflict", conflictNewer, "resolution of -update conflicts: newer (target is kept), larger, keep-both, or fail")
+	flag.BoolVar(&opts.delete, "delete", false, "delete target entries which do not exist in the source (local targets only)")
+	flag.BoolVar(&opts.trash, "trash", false, "with -delete, move deleted entries into .syngo/trash/<time> instead of removing them (see syngo empty-trash)")
+	flag.BoolVar(&opts.backup, "backup", false, "move target files and links which are replaced aside instead of overwriting them")
+	flag.StringVar(&opts.backupDir, "backup-dir", "", "keep backups in this directory relative to the target tree (e.g. .syngo/backup) instead of next to the replaced entries; implies -backup")
+	flag.StringVar(&opts.backupSuffix, "suffix", "", "suffix appended to backups (default \""+defaultBackupSuffix+"\" without -backup-dir)")
+	flag.BoolVar(&opts.removeSrc, "remove-source-files", false, "remove source files (not directories) once they are synced and verified, moving them to the target")
+	flag.BoolVar(&opts.macMeta, "mac-metadata", false, "preserve macOS Finder info, resource forks, and other com.apple.* extended attributes of synced files and new directories (local targets on macOS only)")
+	flag.BoolVar(&opts.nfs, "nfs", false, "tune for local targets on NFS mounts: look up entries from directory listings, compare modification times at one second precision, and create new files in a single request")
+	flag.BoolVar(&opts.crtimes, "crtimes", false, "preserve the creation (birth) time of synced entries (local targets on macOS and Windows only)")
+	chmod := flag.String("chmod", "", "change the permissions of synced files and directories with comma separated rules like chmod(1), prefixed by D or F to only affect directories or files (e.g. D755,F644 or go-w)")
+	chown := flag.String("chown", "", "change the owner and group of synced entries, given as user:group, user, or :group (names are resolved on the target)")
+	flag.BoolVar(&opts.owner, "owner", false, "preserve the owner of synced entries, mapped by user name unless -numeric-ids is given (usually requires root on the target)")
+	flag.BoolVar(&opts.group, "group", false, "preserve the group of synced entries, mapped by group name unless -numeric-ids is given")
+	flag.BoolVar(&opts.numericIDs, "numeric-ids", false, "with -owner and -group, copy numeric user and group IDs instead of mapping them by name")
+	usermap := flag.String("usermap", "", "with -owner, translate source owners given as comma separated from:to pairs of user names or IDs, from may be * to match all (e.g. 1000:alice,*:nobody); implies -owner")
+	groupmap := flag.String("groupmap", "", "like -usermap for groups; implies -group")
+	flag.BoolVar(&opts.fakeSuper, "fake-super", false, "record ownership, device files, and setuid, setgid, and sticky bits of synced entries in the user.rsync.%stat extended attribute instead of applying them, for restoring unprivileged backups later (like rsync --fake-super); implies -owner and -group (local targets on Linux only)")
+	encryptKey := flag.String("encrypt-key", "", "encrypt file contents with a key derived from this file of at least 32 random bytes before writing them to the target (see syngo decrypt)")
+	encryptNames := flag.Bool("encrypt-names", false, "with -encrypt-key, encrypt entry names and symbolic link targets as well; names longer than 143 bytes can not be synced then")
+	flag.BoolVar(&opts.verify, "verify", false, "re-read every copied file and compare its checksum against the source")
+	flag.BoolVar(&opts.checksum, "checksum", false, "compare the content of files of equal size by checksum instead of their modification times")
+	opts.checksumChoice = defaultHash
+	flag.Var(hashAlgoFlag{&opts.checksumChoice}, "checksum-choice", checksumChoiceUsage+"; used by -checksum, -verify, resumed copies, and new repo: targets, which fall back to sha256 for xxh64")
+	cacheFile := flag.String("checksum-cache", "", "with -checksum or -verify, cache the checksums of local files in this file so unchanged files are not reread by later runs")
+	tgtManifest := flag.String("target-manifest", "", "check the source against this manifest of the target (see syngo manifest) instead of the target itself")
+	flag.DurationVar(&opts.waitForLock, "wait-for-lock", 0, "wait up to this long for other syngo runs syncing to the same local target to finish instead of failing right away (e.g. 30m)")
+	flag.StringVar(&opts.preCmd, "pre-cmd", "", "run this shell command before every run, e.g. to mount the target; the run is aborted if it fails")
+	flag.StringVar(&opts.postCmd, "post-cmd", "", "run this shell command after every run with its results in SYNGO_* environment variables (see usage)")
+	index := flag.String("index", "", "record the synced entries in this file and skip checking the target for source entries unchanged since the previous run (only valid while nothing but syngo changes the target)")
+	watchMode := flag.Bool("watch", false, "keep running after the initial sync and sync changes to the source tree as they happen")
+	pruneKeep := flag.Int("prune-keep", 0, "after creating a snapshot, prune all but the given number of most recent snapshots")
+	pruneOlderThan := flag.String("prune-older-than", "", "after creating a snapshot, prune snapshots older than the given age (e.g. 30d)")
+	traceEndpoint := flag.String("trace-endpoint", "", "export spans of the phases of every run to this OTLP/HTTP traces endpoint of an OpenTelemetry collector (e.g. http://localhost:4318/v1/traces)")
+	traceFiles := flag.Float64("trace-files", 0, "with -trace-endpoint, also trace this fraction of file transfers individually (0 to 1)")
+	metricsListen := flag.String("metrics-listen", "", "with -watch or -every, export Prometheus metrics at /metrics on this address (e.g. :9730)")
+	every := flag.String("every", "", "keep running and sync periodically, either at an interval (e.g. 1h) or on a cron schedule (e.g. \"0 3 * * *\")")
+	flag.StringVar(&opts.writeBatch, "write-batch", "", "record the changes made to the target in this batch file for applying them to another copy of the target with syngo read-batch")
+	onlyWriteBatch := flag.String("only-write-batch", "", "like -write-batch but leave the target unchanged")
+	flag.StringVar(&opts.archiveCompress, "tar-compress", "", "compression of tar:<file> targets: gzip, zstd, or none (default from the file name, none for stdout)")
+	flag.StringVar(&opts.differential, "differential", "", "write only the files changed since the full backup whose manifest is in this file into a new dated directory of the target, together with a manifest of the source; without the file, make a full backup and record its manifest there")
+	flag.BoolVar(&opts.differentialTar, "differential-tar", false, "with -differential, write the backup as a dated .tar.gz archive instead of a directory (see -tar-compress)")
+	bwlimit := flag.String("bwlimit", "", "limit the aggregate transfer rate to this many bytes/s (e.g. 500K, 10M)")
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	if flag.NArg() < 2 {
+		fmt.Printf("incorrect number of command line arguments\n\n")
+		usage()
+	}
+	switch {
+	case *veryVerbose:
+		defaultLog.verbosity = levelDecisions
+	case *verbose:
+		defaultLog.verbosity = levelFiles
+	case *quiet:
+		defaultLog.verbosity = levelQuiet
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		log.Fatalf("invalid log format %s\n", *logFormat)
+	}
+	defaultLog.json = *logFormat == "json"
+	if *logFile != "" {
+		if err := openLogFile(*logFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *statsFormat != "text" && *statsFormat != "json" {
+		log.Fatalf("invalid stats format %s\n", *statsFormat)
+	}
+	jsonStats := *statsFormat == "json"
+	if size, err := parseSize(*bufferSize); err != nil || size <= 0 || size > 1<<30 {
+		log.Fatalf("invalid buffer size %s\n", *bufferSize)
+	} else {
+		opts.bufferSize = int(size)
+	}
+	if size, err := parseSize(*copyStreamsMin); err != nil || size <= 0 {
+		log.Fatalf("invalid minimum size %s of files copied in streams\n", *copyStreamsMin)
+	} else {
+		opts.copyStreamsMin = size
+	}
+	if opts.copyStreams < 0 {
+		log.Fatalf("invalid number of copy streams %d\n", opts.copyStreams)
+	}
+	if *showProgress || *progressJSON >= 0 {
+		var events *progressStream
+		if *progressJSON >= 0 {
+			events = newProgressStream(os.NewFile(uintptr(*progressJSON), "progress-json"))
+		}
+		opts.progress = newProgress(*showProgress, events)
+	}
+	if *bwlimit != "" {
+		rate, err := parseSize(*bwlimit)
+		if err != nil || rate <= 0 {
+			log.Fatalf("invalid bandwidth limit %s\n", *bwlimit)
+		}
+		opts.limiter = newRateLimiter(rate)
+	}
+	if *compressLevel != 0 {
+		if *compressLevel < 1 || *compressLevel > 9 {
+			log.Fatalf("invalid compression level %d\n", *compressLevel)
+		}
+		opts.compress = *compressLevel
+	} else if *compress {
+		opts.compress = defaultCompressLevel
+	}
+	var err error
+	if opts.packing, err = parseCompressChoice(*compressChoice); err != nil {
+		log.Fatal(err)
+	}
+	if *chmod != "" {
+		if opts.chmod, err = parseChmod(*chmod); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *chown != "" {
+		if opts.chown, err = parseChown(*chown); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *usermap != "" {
+		if opts.usermap, err = parseIDMap(*usermap); err != nil {
+			log.Fatal(err)
+		}
+		opts.owner = true
+	}
+	if *groupmap != "" {
+		if opts.groupmap, err = parseIDMap(*groupmap); err != nil {
+			log.Fatal(err)
+		}
+		opts.group = true
+	}
+	if *encryptKey != "" {
+		if opts.crypt, err = loadCryptKeys(*encryptKey, *encryptNames); err != nil {
+			log.Fatal(err)
+		}
+		if opts.delete || opts.verify || opts.checksum || opts.macMeta || opts.crtimes || opts.fakeSuper {
+			log.Fatal("-delete, -verify, -checksum, -mac-metadata, -crtimes, and -fake-super can not be combined with -encrypt-key")
+		}
+	} else if *encryptNames {
+		log.Fatal("-encrypt-names requires -encrypt-key")
+	}
+	if *minSize != "" {
+		if opts.minSize, err = parseSize(*minSize); err != nil || opts.minSize <= 0 {
+			log.Fatalf("invalid minimum file size %s\n", *minSize)
+		}
+	}
+	if *maxSize != "" {
+		if opts.maxSize, err = parseSize(*maxSize); err != nil || opts.maxSize <= 0 {
+			log.Fatalf("invalid maximum file size %s\n", *maxSize)
+		}
+	}
+	if *newerThan != "" {
+		if opts.newerThan, err = parseAge(*newerThan); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *olderThan != "" {
+		if opts.olderThan, err = parseAge(*olderThan); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *tgtManifest != "" {
+		entries, err := readManifest(*tgtManifest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.tgtManifest = entries
+	}
+	if *index != "" {
+		if opts.index, err = loadFileIndex(*index, opts.ctime); err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts.sums = openSumCache("sync", *cacheFile)
+
+	srcs, err := sources(flag.Args()[:flag.NArg()-1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tgtTree := flag.Arg(flag.NArg() - 1)
+	if tgtTree == archivePrefix+"-" {
+		defaultLog.stdout = os.Stderr
+	}
+	if !isRemote(tgtTree) {
+		if tgtTree, err = absPath(tgtTree); err != nil {
+			log.Fatal(err)
+		}
+	} else if *snapshot {
+		log.Fatal("snapshots are only supported for local target trees")
+	} else if opts.delete {
+		log.Fatal("-delete is only supported for local target trees")
+	}
+	if opts.macMeta && !macMetadataSupported {
+		log.Fatal("-mac-metadata is only supported on macOS")
+	}
+	if opts.crtimes && !birthTimeSupported {
+		log.Fatal("-crtimes is not supported on this platform")
+	}
+	if opts.ctime && !ctimeSupported {
+		log.Fatal("-ctime is not supported on this platform")
+	}
+	if opts.fakeSuper {
+		if !fakeSuperSupported {
+			log.Fatal("-fake-super is not supported on this platform")
+		}
+		opts.owner, opts.group = true, true
+	}
+	if opts.trash && !opts.delete {
+		log.Fatal("-trash requires -delete")
+	}
+	if *watchMode && opts.delete {
+		log.Fatal("-watch cannot be combined with -delete")
+	}
+	if *watchMode && *snapshot {
+		log.Fatal("-watch cannot be combined with -snapshot")
+	}
+	if opts.dryRun && (*watchMode || *snapshot) {
+		log.Fatal("-dry-run cannot be combined with -watch or -snapshot")
+	}
+	if opts.dryRun && (strings.HasPrefix(tgtTree, archivePrefix) || strings.HasPrefix(tgtTree, repoPrefix)) {
+		log.Fatal("-dry-run is not supported for archive and repository targets")
+	}
+	var policy *snapshotPolicy
+	if *snapshot {
+		policy = &snapshotPolicy{keep: *pruneKeep}
+		if *pruneOlderThan != "" {
+			if policy.olderThan, err = parseAge(*pruneOlderThan); err != nil {
+				log.Fatal(err)
+			}
+		}
+	} else if *pruneKeep > 0 || *pruneOlderThan != "" {
+		log.Fatal("-prune-keep and -prune-older-than require -snapshot")
+	}
+	if err := checkConflictStrategy(opts.conflict); err != nil {
+		log.Fatal(err)
+	}
+	if opts.backupDir != "" {
+		opts.backup = true
+	} else if opts.backupSuffix == "" {
+		opts.backupSuffix = defaultBackupSuffix
+	}
+	if opts.existing && opts.ignoreExisting {
+		log.Fatal("-existing cannot be combined with -ignore-existing")
+	}
+	if *watchMode && *every != "" {
+		log.Fatal("-watch cannot be combined with -every")
+	}
+	if *traceEndpoint != "" {
+		opts.trace = newTracer(*traceEndpoint, *traceFiles)
+	} else if *traceFiles > 0 {
+		log.Fatal("-trace-files requires -trace-endpoint")
+	}
+	if *metricsListen != "" {
+		if !*watchMode && *every == "" {
+			log.Fatal("-metrics-listen requires -watch or -every")
+		}
+		serveMetrics(*metricsListen)
+	}
+	if *onlyWriteBatch != "" {
+		if opts.writeBatch != "" {
+			log.Fatal("-write-batch cannot be combined with -only-write-batch")
+		}
+		opts.writeBatch, opts.onlyBatch = *onlyWriteBatch, true
+		if *snapshot || opts.index != nil || opts.removeSrc {
+			log.Fatal("-only-write-batch cannot be combined with -snapshot, -index, or -remove-source-files")
+		}
+	}
+	if opts.writeBatch != "" {
+		if *watchMode || *every != "" || opts.dryRun {
+			log.Fatal("batches cannot be written with -watch, -every, or -dry-run")
+		}
+		if strings.HasPrefix(tgtTree, archivePrefix) || strings.HasPrefix(tgtTree, repoPrefix) {
+			log.Fatal("batches cannot be written for archive and repository targets")
+		}
+	}
+	if opts.differential != "" {
+		if isRemote(tgtTree) {
+			log.Fatal("-differential is only supported for local target trees")
+		}
+		if *tgtManifest != "" || *snapshot || *watchMode || opts.delete || opts.index != nil || opts.writeBatch != "" {
+			log.Fatal("-differential cannot be combined with -target-manifest, -snapshot, -watch, -delete, -index, or batches")
+		}
+	} else if opts.differentialTar {
+		log.Fatal("-differential-tar requires -differential")
+	}
+	if *watchMode && len(srcs) > 1 {
+		log.Fatal("-watch only supports a single source tree")
+	}
+
+	if err := checkHTTPSource(srcs, opts); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkArchiveSource(srcs, opts); err != nil {
+		log.Fatal(err)
+	}
+	for _, src := range srcs {
+		if isHTTPSource(src.root) || src.archive != nil {
+			if *watchMode {
+				log.Fatal("-watch is not supported for HTTP and archive sources")
+			}
+			continue
+		}
+		if err := checkInput(src.root, filepath.Join(tgtTree, src.prefix)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// the first interrupt stops the run after aborting in-flight copies, the
+	// default handling of later ones kills syngo right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	opts.ctx = ctx
+	go func() {
+		<-ctx.Done()
+		stop()
+		infof(levelSummary, "interrupted, stopping (interrupt again to quit immediately)\n")
+	}()
+	opts.pause = &pauser{}
+	handlePauseSignals(opts.pause)
+
+	if *every != "" {
+		sched, err := parseSchedule(*every)
+		if err != nil {
+			log.Fatal(err)
+		}
+		runScheduled(sched, opts.done(), func() int {
+			runOpts := *opts
+			if opts.progress != nil {
+				runOpts.progress = newProgress(opts.progress.display, opts.progress.events)
+			}
+			runOpts.log.resetErrors()
+			return syncTree(srcs, tgtTree, &runOpts, policy, jsonStats, false)
+		})
+		os.Exit(exitInterrupted)
+	}
+	os.Exit(syncTree(srcs, tgtTree, opts, policy, jsonStats, *watchMode))
+}
+
+// syncTree performs a single sync run of srcs to tgtTree surrounded by the
+// -pre-cmd and -post-cmd hooks and returns the exit code of the run
+func syncTree(srcs []*source, tgtTree string, opts *options, policy *snapshotPolicy, jsonStats,
+	watchMode bool) int {
+	startTime := time.Now()
+	if opts.preCmd != "" {
+		if err := runHook(opts.preCmd, hookEnv(srcs, tgtTree)); err != nil {
+			log.Printf("pre-cmd failed: %s\n", err)
+			return exitFatal
+		}
+	}
+	var out runOutcome
+	exitCode := syncTreeRun(srcs, tgtTree, opts, policy, jsonStats, watchMode, &out)
+	if opts.postCmd != "" {
+		env := append(hookEnv(srcs, tgtTree), out.env(exitCode, time.Since(startTime))...)
+		if err := runHook(opts.postCmd, env); err != nil {
+			log.Printf("post-cmd failed: %s\n", err)
+			if exitCode == exitOK {
+				exitCode = exitPartial
+			}
+		}
+	}
+	return exitCode
+}
+
+// syncTreeRun performs a single sync run of srcs to tgtTree including the
+// reporting of its results and a snapshot unless policy is nil, records them
+// in out, and returns the exit code of the run. In watch mode, it keeps
+// syncing changes to the single source after the initial sync.
+func syncTreeRun(srcs []*source, tgtTree string, opts *options, policy *snapshotPolicy, jsonStats,
+	watchMode bool, out *runOutcome) int {
+	startTime := time.Now()
+	if opts.differential != "" {
+		var err error
+		if tgtTree, err = differentialTarget(tgtTree, opts); err != nil {
+			log.Print(err)
+			return exitFatal
+		}
+	}
+	tgt, err := openTarget(tgtTree, opts)
+	if err != nil {
+		log.Print(err)
+		return exitFatal
+	}
+	// dry runs do not touch the target and need no lock
+	if _, ok := tgt.(*localFS); ok && !opts.dryRun && !opts.onlyBatch {
+		lock, err := lockTarget(tgtTree, opts.waitForLock, opts.done(), opts.log)
+		if err != nil {
+			log.Print(err)
+			return exitFatal
+		}
+		defer lock.unlock()
+	}
+	// batches record the changes as made to the target, i.e. encrypted
+	if opts.writeBatch != "" {
+		b, err := createBatch(opts.writeBatch, tgt, opts.onlyBatch)
+		if err != nil {
+			log.Print(err)
+			tgt.Close()
+			return exitFatal
+		}
+		tgt, opts.batch = b, b
+	}
+	if opts.crypt != nil {
+		tgt = &cryptFS{backend: tgt, keys: opts.crypt}
+	}
+	if err := checkTarget(tgt, tgtTree, opts, watchMode); err != nil {
+		log.Print(err)
+		return exitFatal
+	}
+	if !jsonStats {
+		var roots []string
+		for _, src := range srcs {
+			roots = append(roots, src.root)
+		}
+		infof(levelSummary, "syncing %s to %s\n", strings.Join(roots, ", "), tgtTree)
+	}
+
+	runSpan := opts.trace.begin("sync")
+	runSpan.set("target", tgtTree)
+	stats := syncSources(srcs, tgt, tgtTree, opts)
+	// extraneous entries are only determined by complete runs
+	if opts.delete && !opts.interrupted() {
+		opts.progress.phase("delete")
+		deleteSpan := opts.trace.start("delete")
+		numDeleted, numErrors := deleteExtra(srcs, tgtTree, opts)
+		stats.numDeleted += numDeleted
+		stats.numErrors += numErrors
+		deleteSpan.set("deleted", numDeleted)
+		deleteSpan.finish()
+	}
+	runSpan.set("errors", stats.numErrors)
+	opts.trace.end()
+	// the index only records entries which are actually in sync
+	if !opts.dryRun {
+		if err := opts.index.save(); err != nil {
+			log.Printf("failed to save index: %s\n", err)
+			stats.numErrors++
+		}
+	}
+	if err := opts.sums.save(); err != nil {
+		log.Printf("failed to save checksum cache: %s\n", err)
+	}
+	out.stats = stats
+	if watchMode {
+		reportRun(stats, startTime, jsonStats, opts.dryRun)
+		watch(srcs[0], tgt, opts, jsonStats)
+		if opts.interrupted() {
+			tgt.Close()
+			return exitInterrupted
+		}
+		// watch only returns once changes can no longer be observed
+		return exitFatal
+	}
+	if err := tgt.Close(); err != nil {
+		log.Printf("failed to close target %s: %s\n", tgtTree, err)
+		stats.numErrors++
+	}
+	// interrupted backups do not record the state of the sources
+	if opts.differential != "" && !opts.interrupted() && !opts.dryRun {
+		// files missing from incomplete full backups would never be
+		// backed up by the differential ones
+		full := opts.tgtManifest == nil
+		if full && stats.numErrors > 0 {
+			log.Printf("full backup %s is incomplete, not recording it in %s\n", tgtTree, opts.differential)
+			full = false
+		}
+		if err := writeDifferentialManifest(srcs, tgtTree, full, opts); err != nil {
+			log.Print(err)
+			stats.numErrors++
+		}
+	}
+	opts.progress.phase("done")
+	procMetrics.recordRun(startTime, stats.numBytes, stats.numFiles, stats.numErrors)
+	out.stats = stats
+	if !jsonStats {
+		printStats(stats, startTime, opts.dryRun)
+		if opts.dryRun {
+			infof(levelSummary, "dry run, the target was not changed\n")
+		}
+	}
+
+	exitCode := exitOK
+	if stats.numErrors > 0 {
+		exitCode = exitPartial
+	}
+	if !defaultLog.json {
+		defaultLog.printErrors()
+	}
+	// interrupted runs are not recorded as snapshots
+	if opts.interrupted() {
+		infof(levelSummary, "sync interrupted\n")
+		exitCode, policy = exitInterrupted, nil
+	}
+
+	var snapshotName string
+	if policy != nil {
+		if snapshotName, err = createSnapshot(tgtTree, stats, opts.basis); err != nil {
+			log.Print(err)
+			if snapshotName == "" {
+				return exitFatal
+			}
+			exitCode = exitPartial
+		}
+		out.snapshot = snapshotName
+		if !jsonStats {
+			infof(levelSummary, "created snapshot %s\n", snapshotName)
+		}
+		if policy.keep > 0 || policy.olderThan > 0 {
+			if err := pruneSnapshots(tgtTree, nil, policy.olderThan, policy.keep, false); err != nil {
+				log.Print(err)
+				exitCode = exitPartial
+			}
+		}
+	}
+
+	if jsonStats {
+		if err := printJSONStats(stats, startTime, snapshotName); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		infof(levelSummary, "done syncing\n")
+	}
+	return exitCode
+}
+
+// source is a tree synced to the target. Its entries are synced below prefix
+// in the target tree, directly into the target if prefix is ".".
+type source struct {
+	root    string
+	prefix  string
+	archive *srcArchive // set if root is an archive file
+}
+
+// tgtPath returns the target path of the entry at relPath in the source
+func (s *source) tgtPath(relPath string) string {
+	return filepath.Join(s.prefix, relPath)
+}
+
+// srcPath returns the absolute path in the source of the entry at target
+// path tgtPath
+func (s *source) srcPath(tgtPath string) string {
+	if s.prefix == "." {
+		return filepath.Join(s.root, tgtPath)
+	}
+	return filepath.Join(s.root, strings.TrimPrefix(tgtPath, s.prefix))
+}
+
+// scan visits the entries of the source like scanTree
+func (s *source) scan(opts *options, report bool, visit func(relPath string, d os.DirEntry) bool) int64 {
+	if s.archive != nil {
+		s.archive.walk(visit)
+		return 0
+	}
+	return scanTree(s.root, opts, report, visit)
+}
+
+// lstat returns information about the entry at relPath in the source
+func (s *source) lstat(relPath string) (os.FileInfo, error) {
+	if s.archive != nil {
+		e, err := s.archive.lstat(relPath)
+		if err != nil {
+			return nil, err
+		}
+		return e.info, nil
+	}
+	return os.Lstat(filepath.Join(s.root, relPath))
+}
+
+// readlink returns the target of the symbolic link at relPath in the source
+func (s *source) readlink(relPath string) (string, error) {
+	if s.archive != nil {
+		e, err := s.archive.lstat(relPath)
+		if err != nil {
+			return "", err
+		}
+		return e.link, nil
+	}
+	return os.Readlink(filepath.Join(s.root, relPath))
+}
+
+// closeSources releases the archives among srcs
+func closeSources(srcs []*source) {
+	for _, src := range srcs {
+		if src.archive != nil {
+			src.archive.close()
+		}
+	}
+}
+
+// treeSource returns the single source syncing the content of root
+func treeSource(root string) []*source {
+	return []*source{{root: root, prefix: "."}}
+}
+
+// sources returns the sources for the provided command line paths. Like with
+// rsync, the content of source trees ending in a slash is synced directly into
+// the target while other source trees are synced into a directory of the same
+// name inside the target.
+func sources(paths []string) ([]*source, error) {
+	var srcs []*source
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		// HTTP sources are always mirrored into the target itself
+		if isHTTPSource(p) {
+			srcs = append(srcs, &source{root: strings.TrimSpace(p), prefix: "."})
+			continue
+		}
+		root, err := absPath(p)
+		if err != nil {
+			return nil, err
+		}
+		// archives are always synced into the target itself
+		if isArchiveSource(root) {
+			a, err := openSrcArchive(root)
+			if err != nil {
+				return nil, err
+			}
+			srcs = append(srcs, &source{root: root, prefix: ".", archive: a})
+			continue
+		}
+		src := &source{root: root, prefix: "."}
+		p = strings.TrimSpace(p)
+		if !strings.HasSuffix(p, "/") && p != "." && !strings.HasSuffix(p, "/.") {
+			src.prefix = filepath.Base(root)
+			if seen[src.prefix] {
+				return nil, fmt.Errorf("multiple source trees named %s", src.prefix)
+			}
+			seen[src.prefix] = true
+		}
+		srcs = append(srcs, src)
+	}
+	return srcs, nil
+}
+
+// runSync synchronizes the directory layout and files of srcs to tgt and
+// returns the accumulated statistics of the run
+func runSync(srcs []*source, tgt backend, opts *options) syncStats {
+	numCheckers, numSyncers := workerCounts(tgt, opts)
+
+	queueDepth := opts.queueDepth
+	if queueDepth <= 0 {
+		queueDepth = defaultQueueDepth
+	}
+	if opts.bufferSize <= 0 {
+		opts.bufferSize = defaultBufferSize
+	}
+
+	// synchronize directory layout between source and target, their
+	// metadata is set once their content is synced
+	opts.dirs = newDirTracker()
+	if opts.transforms != nil {
+		opts.renamed = newRenamedPaths()
+	}
+	dirList := make(chan []fileInfo, queueDepth)
+	opts.progress.phase("dirs")
+	dirSpan := opts.trace.start("dirs")
+	go parseSrcDirs(srcs, dirList, opts)
+
+	var stats syncStats
+	var dirSync sync.WaitGroup
+	dirSync.Add(numCheckers)
+	for i := 0; i < numCheckers; i++ {
+		go syncDirLayout(tgt, dirList, &dirSync, &stats, opts)
+	}
+	dirSync.Wait()
+	dirSpan.finish()
+
+	// synchronize files between source and target
+	fileList := make(chan []fileInfo, queueDepth)
+	opts.progress.phase("files")
+	// scanning, checking, and transferring overlap, their spans end once
+	// the respective stage is done
+	scanSpan, checkSpan, transferSpan := opts.trace.start("scan"), opts.trace.start("check"),
+		opts.trace.start("transfer")
+	go func() {
+		parseSrcFiles(srcs, fileList, &stats, opts)
+		scanSpan.finish()
+	}()
+
+	updateList := make(chan []fileInfo, queueDepth)
+	var done sync.WaitGroup
+	done.Add(numCheckers)
+	for i := 0; i < numCheckers; i++ {
+		go checkTgt(tgt, fileList, updateList, &done, &stats, opts)
+	}
+	go chanCloser(updateList, &done)
+	go func() {
+		done.Wait()
+		checkSpan.finish()
+	}()
+
+	if opts.progress != nil {
+		opts.progress.run()
+		defer opts.progress.finish()
+		go func() {
+			done.Wait()
+			opts.progress.checkDone()
+		}()
+	}
+
+	syncDone := make(chan syncStats)
+	for i := 0; i < numSyncers; i++ {
+		go syncFiles(tgt, updateList, syncDone, opts)
+	}
+
+	for i := 0; i < numSyncers; i++ {
+		d := <-syncDone
+		stats.numFiles += d.numFiles
+		stats.numBytes += d.numBytes
+		stats.numErrors += d.numErrors
+		stats.numSkipped += d.numSkipped
+		stats.numSymlinks += d.numSymlinks
+		stats.failed = append(stats.failed, d.failed...)
+	}
+	transferSpan.set("files", stats.numFiles)
+	transferSpan.set("bytes", stats.numBytes)
+	transferSpan.finish()
+	if len(stats.failed) > 0 && opts.retries > 0 {
+		retrySpan := opts.trace.start("retry")
+		retryFailed(tgt, &stats, opts)
+		retrySpan.finish()
+	}
+	if opts.dryRun {
+		return stats
+	}
+	// object stores have no directories and archive entries can not be
+	// changed once written
+	inner := tgt
+	if c, ok := tgt.(*cryptFS); ok {
+		inner = c.backend
+	}
+	switch inner.(type) {
+	case *objectFS, *archiveFS:
+	default:
+		finalizeSpan := opts.trace.start("finalize")
+		stats.numErrors += opts.dirs.finalize(tgt, opts.log)
+		finalizeSpan.finish()
+	}
+	return stats
+}
+
+// checkTarget verifies that the target tgt opened for tgtTree supports the
+// requested options. Some options are adjusted to the target.
+func checkTarget(tgt backend, tgtTree string, opts *options, watchMode bool) error {
+	// repositories record the entries looked up by a run as its snapshot
+	if _, ok := tgt.(*repoFS); ok && (watchMode || opts.tgtManifest != nil || opts.index != nil) {
+		return fmt.Errorf("-watch, -target-manifest, and -index are not supported for repository %s", tgtTree)
+	}
+	if _, ok := tgt.(renamer); opts.partialDir != "" && !ok {
+		return fmt.Errorf("-partial-dir is not supported for target %s", tgtTree)
+	}
+	if _, ok := tgt.(*localFS); opts.macMeta && !ok {
+		return fmt.Errorf("-mac-metadata is not supported for target %s", tgtTree)
+	}
+	if _, ok := tgt.(*localFS); opts.fakeSuper && !ok {
+		return fmt.Errorf("-fake-super is not supported for target %s", tgtTree)
+	}
+	if _, ok := tgt.(*localFS); opts.nfs && !ok {
+		return fmt.Errorf("-nfs is not supported for target %s", tgtTree)
+	}
+	if _, ok := tgt.(*localFS); opts.basis != nil && opts.basis.mode == basisLink && !ok {
+		return fmt.Errorf("-link-dest is not supported for target %s", tgtTree)
+	}
+	if _, ok := tgt.(*localFS); opts.crtimes && !ok {
+		return fmt.Errorf("-crtimes is not supported for target %s", tgtTree)
+	}
+	// encrypted targets change ownership through the backend they wrap
+	owned := tgt
+	if c, ok := tgt.(*cryptFS); ok {
+		owned = c.backend
+	}
+	if _, ok := owned.(chowner); (opts.chown != nil || opts.owner || opts.group) && !ok {
+		return fmt.Errorf("-chown, -owner, and -group are not supported for target %s", tgtTree)
+	}
+	if _, ok := tgt.(renamer); opts.backup && !ok {
+		return fmt.Errorf("-backup is not supported for target %s", tgtTree)
+	}
+	if _, ok := tgt.(renamer); opts.update && opts.conflict == conflictKeepBoth && !ok {
+		return fmt.Errorf("-conflict keep-both is not supported for target %s", tgtTree)
+	}
+	// sources are only removed after verifying their copies if possible
+	if _, ok := tgt.(resumer); opts.removeSrc && ok {
+		opts.verify = true
+	}
+	if _, ok := tgt.(*archiveFS); opts.verify && ok {
+		return fmt.Errorf("-verify is not supported for target %s", tgtTree)
+	}
+	return nil
+}
+
+// workerCounts returns the number of checkers and syncers to use for tgt.
+// Unless configured otherwise, local targets get one checker per CPU (at
+// least three) while remote targets get more workers to hide latency.
+func workerCounts(tgt backend, opts *options) (int, int) {
+	checkers, syncers := runtime.NumCPU(), defaultSyncers
+	if checkers < 3 {
+		checkers = 3
+	}
+	if _, ok := tgt.(*localFS); !ok {
+		checkers, syncers = defaultRemoteWorkers, defaultRemoteWorkers
+	}
+
+	if opts.checkers > 0 {
+		checkers = opts.checkers
+	}
+	if opts.syncers > 0 {
+		syncers = opts.syncers
+	}
+	return checkers, syncers
+}
+
+// printStats prints a short summary of the provided sync statistics of a run,
+// which only reported its changes if dryRun is set
+func printStats(stats syncStats, startTime time.Time, dryRun bool) {
+	numMBytes := float64(stats.numBytes) / 1024 / 1024
+	dur := time.Since(startTime).Seconds()
+	infof(levelSummary, "Synced %d files with %.5g MB in %.5g s (%.5g MB/s)\n", stats.numFiles,
+		numMBytes, dur, numMBytes/dur)
+	infof(levelSummary, "%d entries examined, %d unchanged, %d filtered; created %d directories and %d symbolic links\n",
+		stats.numExamined, stats.numUnchanged, stats.numFiltered, stats.numDirs, stats.numSymlinks)
+	if stats.numErrors > 0 || stats.numSkipped > 0 {
+		infof(levelSummary, "%d errors, %d entries of unsupported type skipped\n", stats.numErrors,
+			stats.numSkipped)
+	}
+	if stats.numDeleted > 0 && dryRun {
+		infof(levelSummary, "%d extraneous entries would be deleted\n", stats.numDeleted)
+	} else if stats.numDeleted > 0 {
+		infof(levelSummary, "%d extraneous entries deleted\n", stats.numDeleted)
+	}
+	if stats.numConflicts > 0 {
+		infof(levelSummary, "%d conflicts with newer target entries\n", stats.numConflicts)
+	}
+}
+
+// printJSONStats writes the provided sync statistics as a JSON object to
+// stdout for consumption by monitoring systems
+func printJSONStats(stats syncStats, startTime time.Time, snapshot string) error {
+	return json.NewEncoder(defaultLog.stdout).Encode(struct {
+		Files     int64   `json:"files"`
+		Bytes     int64   `json:"bytes"`
+		Errors    int64   `json:"errors"`
+		Skipped   int64   `json:"skipped"`
+		Conflicts int64   `json:"conflicts"`
+		Deleted   int64   `json:"deleted"`
+		Examined  int64   `json:"examined"`
+		Unchanged int64   `json:"unchanged"`
+		Filtered  int64   `json:"filtered"`
+		Dirs      int64   `json:"dirs_created"`
+		Symlinks  int64   `json:"symlinks_created"`
+		Duration  float64 `json:"duration_seconds"`
+		Snapshot  string  `json:"snapshot,omitempty"`
+	}{stats.numFiles, stats.numBytes, stats.numErrors, stats.numSkipped,
+		stats.numConflicts, stats.numDeleted, stats.numExamined, stats.numUnchanged,
+		stats.numFiltered, stats.numDirs, stats.numSymlinks, time.Since(startTime).Seconds(),
+		snapshot})
+}
+
+// usage provides a simple usage string
+func usage() {
+	fmt.Println("usage: syngo [options] <source tree> [source tree ...] <target tree>")
+	fmt.Println("       syngo restore [options] <target tree> <destination> [path ...]")
+	fmt.Println("       syngo snapshots <target tree>")
+	fmt.Println("       syngo prune [options] <target tree> [snapshot ...]")
+	fmt.Println("       syngo gc [options] repo:<dir>")
+	fmt.Println("       syngo empty-trash [options] <target tree>")
+	fmt.Println("       syngo compare [options] <source tree> <target tree>")
+	fmt.Println("       syngo manifest [options] <tree>")
+	fmt.Println("       syngo run [options] <job>")
+	fmt.Println("       syngo bisync [options] <tree A> <tree B>")
+	fmt.Println("       syngo decrypt [options] <encrypted tree> <destination>")
+	fmt.Println("       syngo read-batch [options] <batch file> <target tree>")
+	fmt.Println("       syngo --serve [options] <root>")
+	fmt.Println("\nSource trees ending in / are synced into the target tree itself, others into")
+	fmt.Println("a directory of the same name inside the target tree.")
+	fmt.Println("\nSource archives (.tar, .tar.gz, .tgz, or .zip files) are synced into the target")
+	fmt.Println("tree itself like source trees ending in /.")
+	fmt.Println("\nSources of the form http(s)://<url>/ mirror the directory listing at url, other")
+	fmt.Println("http(s) URLs the tree described by a syngo manifest. Files are only fetched if")
+	fmt.Println("the server reports them as modified since they were last fetched.")
+	fmt.Println("\nTargets of the form tar:<file> write a tar archive of the source trees instead,")
+	fmt.Println("gzip compressed if file ends in .gz or .tgz, zstd compressed if it ends in .zst")
+	fmt.Println("or .tzst (see -tar-compress), or to stdout if file is -.")
+	fmt.Println("Targets of the form repo:<dir> store a snapshot of the source trees in a")
+	fmt.Println("deduplicating repository per run (see syngo snapshots and syngo restore).")
+	fmt.Println("Pruning their snapshots removes the chunks no other snapshot refers to, syngo gc")
+	fmt.Println("the chunks left behind by interrupted runs.")
+	fmt.Println("\nSIGUSR1 pauses copying files until SIGUSR2 resumes it, SIGINT and SIGTERM stop")
+	fmt.Println("the run after aborting the copies in flight.")
+	fmt.Println("\n-pre-cmd and -post-cmd see SYNGO_SOURCES and SYNGO_TARGET, -post-cmd also")
+	fmt.Println("SYNGO_EXIT_CODE, SYNGO_FILES, SYNGO_BYTES, SYNGO_ERRORS, SYNGO_DELETED,")
+	fmt.Println("SYNGO_DURATION (in seconds), and SYNGO_SNAPSHOT.")
+	fmt.Println("\noptions:")
+	flag.PrintDefaults()
+	os.Exit(exitFatal)
+}
+
+// absPath turns the provided command line path into a clean absolute path.
+// NOTE: On Windows, the os package adds the \\?\ prefix to long absolute
+// paths itself, so trees beyond MAX_PATH work as long as paths are absolute.
+func absPath(p string) (string, error) {
+	return filepath.Abs(filepath.Clean(strings.TrimSpace(p)))
+}
+
+// parseAge parses an age or interval such as 90m, 36h, 30d, or 2w. In addition
+// to the units understood by time.ParseDuration, d (days) and w (weeks) are
+// supported.
+func parseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid age %s", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// parseSize parses a size such as 4096, 500K, 10M, or 2G. Units are powers of
+// 1024 and may optionally be followed by B.
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(size), "B"))
+	unit := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		case 'T':
+			unit = 1 << 40
+		}
+		if unit != 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// checkInput does some basic sanity check on the provided input
+// NOTE: This check only makes sense if src and dst are local file trees. In
+// the future this will need to be changed and made more robust.
+func checkInput(src, dst string) error {
+	if src == dst {
+		return fmt.Errorf("source and target tree cannot be identical")
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a valid source directory tree", src)
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+// tracing contains the tracing of sync runs. Spans of the phases of a run,
+// and optionally of sampled file transfers, are exported to an OpenTelemetry
+// collector via OTLP/HTTP with JSON encoding once the run is done.
+package syngo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// traceExportTimeout limits how long exporting the spans of a run may take
+const traceExportTimeout = 10 * time.Second
+
+// tracer collects the spans of the current run
+type tracer struct {
+	endpoint string  // OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces
+	sample   float64 // fraction of file transfers traced individually
+
+	mu      sync.Mutex
+	traceID string
+	root    *span
+	spans   []*span
+}
+
+// span is a timed operation of a run. A nil span ignores all calls.
+type span struct {
+	t      *tracer
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  map[string]interface{}
+	err    error
+}
+
+func newTracer(endpoint string, sample float64) *tracer {
+	return &tracer{endpoint: endpoint, sample: sample}
+}
+
+// randomID returns n random bytes in hex
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// begin starts the trace of a new run and returns its root span of the
+// given name. A nil tracer is allowed.
+func (t *tracer) begin(name string) *span {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	t.traceID, t.spans = randomID(16), nil
+	t.mu.Unlock()
+	t.root = t.start(name)
+	return t.root
+}
+
+// start starts a span of the current run below its root span
+func (t *tracer) start(name string) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{t: t, id: randomID(8), name: name, start: time.Now(),
+		attrs: make(map[string]interface{})}
+	if t.root != nil {
+		s.parent = t.root.id
+	}
+	return s
+}
+
+// startSampled starts a span like start for the configured fraction of calls
+// and returns nil otherwise
+func (t *tracer) startSampled(name string) *span {
+	if t == nil || t.sample <= 0 || mrand.Float64() >= t.sample {
+		return nil
+	}
+	return t.start(name)
+}
+
+// set records the attribute key of s
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+// fail marks s as failed with err unless it is nil
+func (s *span) fail(err error) {
+	if s != nil {
+		s.err = err
+	}
+}
+
+// finish ends s and adds it to the spans of the run
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.t.mu.Lock()
+	s.t.spans = append(s.t.spans, s)
+	s.t.mu.Unlock()
+}
+
+// end finishes the root span of the current run and exports all spans of the
+// run. Export failures are only logged. A nil tracer is allowed.
+func (t *tracer) end() {
+	if t == nil || t.root == nil {
+		return
+	}
+	t.root.finish()
+	t.root = nil
+	t.mu.Lock()
+	body, err := json.Marshal(t.otlp())
+	t.spans = nil
+	t.mu.Unlock()
+	if err == nil {
+		err = t.export(body)
+	}
+	if err != nil {
+		log.Printf("failed to export trace to %s: %s\n", t.endpoint, err)
+	}
+}
+
+// export sends the encoded spans to the collector
+func (t *tracer) export(body []byte) error {
+	client := &http.Client{Timeout: traceExportTimeout}
+	resp, err := client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of spans, see opentelemetry-proto's trace.proto
+type (
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []otlpAttr `json:"attributes,omitempty"`
+		Status            otlpStatus `json:"status"`
+	}
+)
+
+// otlpSpanKindInternal and otlpStatusError are the span kind and status
+// code values used by syngo
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+// otlpAttribute encodes the attribute key with value
+func otlpAttribute(key string, value interface{}) otlpAttr {
+	var v otlpValue
+	switch value := value.(type) {
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case bool:
+		v.BoolValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpAttr{Key: key, Value: v}
+}
+
+// otlp returns the request exporting the spans of the current run
+func (t *tracer) otlp() interface{} {
+	var spans []otlpSpan
+	for _, s := range t.spans {
+		o := otlpSpan{TraceID: t.traceID, SpanID: s.id, ParentSpanID: s.parent, Name: s.name,
+			Kind: otlpSpanKindInternal, StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano: strconv.FormatInt(s.end.UnixNano(), 10)}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttribute(k, v))
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.err.Error()}
+		}
+		spans = append(spans, o)
+	}
+	type m = map[string]interface{}
+	return m{"resourceSpans": []m{{
+		"resource":   m{"attributes": []otlpAttr{otlpAttribute("service.name", "syngo")}},
+		"scopeSpans": []m{{"scope": m{"name": "syngo"}, "spans": spans}},
+	}}}
+}
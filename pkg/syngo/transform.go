@@ -0,0 +1,95 @@
+// transform contains the per-file transforms registered through the library
+// API
+package syngo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrSkipFile is returned by a Transform to veto syncing a file
+var ErrSkipFile = errors.New("skip file")
+
+// Transform customizes how a regular source file is synced. It is called
+// concurrently by the scanners with the target path of every file passing
+// the filters, relative to the target root, and returns the path the file is
+// synced to instead, usually path itself. content wraps the source data
+// while it is copied, nil to copy it verbatim; readers needing to flush at
+// the end of the data have to do so before returning io.EOF. Returning
+// ErrSkipFile vetoes syncing the file, other errors fail it.
+// NOTE: Files with transformed content are only compared by modification
+// time and mode, are never resumed or verified, and can not be synced to
+// tar archives.
+type Transform func(path string, info os.FileInfo) (tgtPath string, content func(io.Reader) io.Reader, err error)
+
+// applyTransforms runs transforms on file in order, each seeing the path
+// returned by the previous one, and records the final target path and the
+// chained content wrappers in file. It returns false if file was vetoed.
+func applyTransforms(file *fileInfo, transforms []Transform) (bool, error) {
+	path := file.path
+	for _, t := range transforms {
+		p, wrap, err := t(path, file.info)
+		if err == ErrSkipFile {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		p = filepath.Clean(p)
+		if filepath.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+			return false, fmt.Errorf("invalid target path %s", p)
+		}
+		path = p
+		if wrap == nil {
+			continue
+		}
+		if prev := file.content; prev != nil {
+			file.content = func(r io.Reader) io.Reader { return wrap(prev(r)) }
+		} else {
+			file.content = wrap
+		}
+	}
+	if path != file.path {
+		file.origPath, file.path = file.path, path
+	}
+	return true, nil
+}
+
+// renamedPaths records the target paths of the files renamed by transforms
+// during a run, which Delete keeps although the sources lack them
+type renamedPaths struct {
+	mu    sync.Mutex
+	paths map[string]bool // renamed files (true) and the directories leading to them
+}
+
+func newRenamedPaths() *renamedPaths {
+	return &renamedPaths{paths: make(map[string]bool)}
+}
+
+// add records the renamed file at path
+func (r *renamedPaths) add(path string) {
+	r.mu.Lock()
+	r.paths[path] = true
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if _, ok := r.paths[dir]; ok {
+			break
+		}
+		r.paths[dir] = false
+	}
+	r.mu.Unlock()
+}
+
+// lookup reports if path is a renamed file or a directory leading to one
+func (r *renamedPaths) lookup(path string) (file, dir bool) {
+	if r == nil {
+		return false, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, ok := r.paths[path]
+	return file, ok && !file
+}
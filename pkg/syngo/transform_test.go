@@ -0,0 +1,32 @@
+package syngo
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteKeepsRenamedFiles(t *testing.T) {
+	src, tgt := t.TempDir(), t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rename := func(path string, info os.FileInfo) (string, func(io.Reader) io.Reader, error) {
+		return filepath.Join("renamed", path+".bak"), nil, nil
+	}
+	opts := Options{Delete: true, Transforms: []Transform{rename}}
+	for run := 0; run < 2; run++ {
+		res, err := Sync([]string{src + "/"}, tgt, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Deleted != 0 {
+			t.Fatalf("run %d deleted %d entries", run, res.Deleted)
+		}
+		if _, err := os.Stat(filepath.Join(tgt, "renamed", "a.txt.bak")); err != nil {
+			t.Fatalf("run %d: %s", run, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// watch contains syngo's watch mode which keeps syncing changes to the source
+// tree after the initial sync
+package syngo
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// watchDelay is the time changes are collected for before they are synced,
+// so bursts of changes are synced together
+const watchDelay = time.Second
+
+// watch syncs the paths below src reported as changed to tgt until the run
+// is interrupted. Changes are synced by regular runs restricted to the
+// changed paths; a change of "." requests a full sync.
+// NOTE: Removals from the source are not propagated since syngo does not
+// delete anything on the target.
+func watch(src *source, tgt backend, opts *options, jsonStats bool) {
+	changes, err := watchTree(src.root)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts.log.infof(levelSummary, "watching %s for changes\n", src.root)
+
+	for {
+		var p string
+		var ok bool
+		select {
+		case p, ok = <-changes:
+			if !ok {
+				return
+			}
+		case <-opts.done():
+			return
+		}
+		changed := map[string]bool{p: true}
+		timer := time.After(watchDelay)
+	collect:
+		for {
+			select {
+			case p, ok := <-changes:
+				if !ok {
+					return
+				}
+				changed[p] = true
+			case <-timer:
+				break collect
+			case <-opts.done():
+				return
+			}
+		}
+
+		runOpts := *opts
+		runOpts.progress = nil
+		if !changed["."] {
+			runOpts.paths = nil
+			for p := range changed {
+				runOpts.paths = append(runOpts.paths, p)
+			}
+			sort.Strings(runOpts.paths)
+		}
+
+		startTime := time.Now()
+		runOpts.log.resetErrors()
+		runOpts.trace.begin("sync")
+		stats := runSync([]*source{src}, tgt, &runOpts)
+		runOpts.trace.end()
+		reportRun(stats, startTime, jsonStats, runOpts.dryRun)
+	}
+}
+
+// reportRun prints the statistics and error summary of a single sync run in
+// watch mode
+func reportRun(stats syncStats, startTime time.Time, jsonStats, dryRun bool) {
+	procMetrics.recordRun(startTime, stats.numBytes, stats.numFiles, stats.numErrors)
+	if jsonStats {
+		if err := printJSONStats(stats, startTime, ""); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		printStats(stats, startTime, dryRun)
+	}
+	if !defaultLog.json {
+		defaultLog.printErrors()
+	}
+}
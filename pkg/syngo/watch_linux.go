@@ -0,0 +1,122 @@
+//go:build linux
+
+// watch_linux contains the inotify based change notification for watch mode
+package syngo
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask selects the inotify events signaling content to be synced
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB
+
+// inotifyWatcher keeps track of the inotify watches of all directories of a
+// tree
+type inotifyWatcher struct {
+	fd   int
+	root string
+
+	mu   sync.Mutex
+	dirs map[int32]string // watched directory per watch descriptor
+}
+
+// watchTree returns a channel delivering the paths relative to root of all
+// entries changed below root. Newly created directories are watched
+// automatically. If events were lost, "." is delivered instead.
+func watchTree(root string) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotifyWatcher{fd: fd, root: root, dirs: make(map[int32]string)}
+	if err := w.addTree("."); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	changes := make(chan string, defaultQueueDepth*batchSize)
+	go w.read(changes)
+	return changes, nil
+}
+
+// addTree watches dir and all directories below it
+func (w *inotifyWatcher) addTree(dir string) error {
+	var err error
+	walkTree(filepath.Join(w.root, dir), numWalkers, nil, func(relPath string, d os.DirEntry) bool {
+		if !d.IsDir() {
+			return false
+		}
+		p := filepath.Join(dir, relPath)
+		wd, werr := syscall.InotifyAddWatch(w.fd, filepath.Join(w.root, p), watchMask)
+		if werr != nil {
+			// directories removed in the meantime are fine to miss
+			if werr != syscall.ENOENT {
+				logError("watch", p, "watch", os.NewSyscallError("inotify_add_watch", werr))
+				w.mu.Lock()
+				err = werr
+				w.mu.Unlock()
+			}
+			return false
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = p
+		w.mu.Unlock()
+		return true
+	})
+	return err
+}
+
+// read delivers the paths of all inotify events to changes
+func (w *inotifyWatcher) read(changes chan<- string) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logError("watch", w.root, "read events of", os.NewSyscallError("read", err))
+			close(changes)
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				changes <- "."
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.dirs[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, ev.Wd)
+			}
+			w.mu.Unlock()
+			if !ok || ev.Len == 0 {
+				continue
+			}
+
+			// names are padded with NUL bytes
+			name := string(nameBytes)
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			p := filepath.Join(dir, name)
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				w.addTree(p)
+			}
+			changes <- p
+		}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+// watch_other contains the fallback change notification for watch mode on
+// platforms without inotify support
+package syngo
+
+import "time"
+
+// watchPollInterval is the interval of full syncs in watch mode on platforms
+// without change notifications
+const watchPollInterval = time.Minute
+
+// watchTree returns a channel requesting a full sync of root periodically
+// since changes cannot be observed directly on this platform
+func watchTree(root string) (<-chan string, error) {
+	changes := make(chan string)
+	go func() {
+		for range time.Tick(watchPollInterval) {
+			changes <- "."
+		}
+	}()
+	return changes, nil
+}
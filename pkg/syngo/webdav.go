@@ -0,0 +1,385 @@
+// webdav contains a backend for syncing to WebDAV servers such as Nextcloud,
+// ownCloud, or Apache mod_dav. File modes, modification times, and symbolic
+// link targets are stored as dead properties in the syngo namespace.
+package syngo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// davNamespace is the XML namespace of syngo's dead properties
+const davNamespace = "https://github.com/haskelladdict/syngo"
+
+// davPropfind is the PROPFIND request body asking for all properties we need
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:" xmlns:S="` + davNamespace + `"><D:prop>
+<D:resourcetype/><D:getcontentlength/><D:getlastmodified/>
+<S:mtime/><S:mode/><S:symlink/>
+</D:prop></D:propfind>`
+
+// davMultistatus is the response of a PROPFIND request
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				Mtime         string `xml:"https://github.com/haskelladdict/syngo mtime"`
+				Mode          string `xml:"https://github.com/haskelladdict/syngo mode"`
+				Symlink       string `xml:"https://github.com/haskelladdict/syngo symlink"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// webdavFS is a backend storing the target tree on a WebDAV server. Lookups
+// are answered from per directory PROPFIND listings.
+type webdavFS struct {
+	client   *http.Client
+	base     *url.URL
+	user     string
+	password string
+
+	mu      sync.Mutex
+	dirs    map[string]map[string]fileInfo // listings of directories
+	changed map[string]bool                // paths modified since listing
+}
+
+// newWebDAVBackend returns a backend for a target of the form
+// dav[s]://[user[:password]@]host[:port]/path. If no password is part of the
+// URL it is taken from SYNGO_WEBDAV_PASSWORD.
+func newWebDAVBackend(spec string, opts *options) (backend, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	w := &webdavFS{
+		client:  &http.Client{},
+		dirs:    make(map[string]map[string]fileInfo),
+		changed: make(map[string]bool),
+	}
+	if u.User != nil {
+		w.user = u.User.Username()
+		w.password, _ = u.User.Password()
+		if w.password == "" {
+			w.password = os.Getenv("SYNGO_WEBDAV_PASSWORD")
+		}
+		u.User = nil
+	}
+	if u.Scheme == "davs" {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	w.base = u
+	return w, nil
+}
+
+// url returns the URL of path p, with a trailing slash for collections
+func (w *webdavFS) url(p string, collection bool) string {
+	u := *w.base
+	u.Path = path.Join(u.Path, p)
+	if collection {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	return u.String()
+}
+
+// do performs a request. Responses with error status are turned into
+// errors, 404s into errors satisfying os.IsNotExist.
+func (w *webdavFS) do(method, u string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if w.user != "" {
+		req.SetBasicAuth(w.user, w.password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: strings.ToLower(method), Path: u, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("webdav %s %s failed: %s", method, u, resp.Status)
+	}
+	return resp, nil
+}
+
+// propfind returns file information for p (depth 0) or for all entries of
+// directory p (depth 1) keyed by their paths relative to the tree root
+func (w *webdavFS) propfind(p string, depth string) (map[string]fileInfo, error) {
+	h := http.Header{
+		"Depth":        {depth},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+	resp, err := w.do("PROPFIND", w.url(p, depth == "1"), h, strings.NewReader(davPropfind))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("invalid PROPFIND response for %s: %s", p, err)
+	}
+
+	infos := make(map[string]fileInfo)
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimSuffix(href.Path, "/"), w.base.Path)
+		rel = path.Clean("./" + rel)
+
+		info := &statInfo{FName: path.Base(rel), FMode: 0644}
+		var linkPath string
+		for _, ps := range r.Propstat {
+			prop := ps.Prop
+			if prop.ResourceType.Collection != nil {
+				info.FMode = os.ModeDir | 0755
+			}
+			if v, err := strconv.ParseInt(prop.ContentLength, 10, 64); err == nil {
+				info.FSize = v
+			}
+			if t, err := http.ParseTime(prop.LastModified); err == nil && info.FModTime.IsZero() {
+				info.FModTime = t
+			}
+			if v, err := strconv.ParseInt(prop.Mtime, 10, 64); err == nil {
+				info.FModTime = time.Unix(0, v)
+			}
+			if v, err := strconv.ParseUint(prop.Mode, 8, 32); err == nil {
+				info.FMode = os.FileMode(v)
+			}
+			if prop.Symlink != "" {
+				linkPath = prop.Symlink
+				info.FMode |= os.ModeSymlink
+			}
+		}
+		infos[rel] = fileInfo{info: info, path: rel, linkPath: linkPath}
+	}
+	return infos, nil
+}
+
+func (w *webdavFS) Lstat(p string) (fileInfo, error) {
+	p = path.Clean(p)
+	dir := path.Dir(p)
+
+	w.mu.Lock()
+	listing, listed := w.dirs[dir]
+	changed := w.changed[p]
+	w.mu.Unlock()
+
+	if changed || p == "." {
+		infos, err := w.propfind(p, "0")
+		if err != nil {
+			return fileInfo{}, err
+		}
+		if fi, ok := infos[p]; ok {
+			return fi, nil
+		}
+		return fileInfo{}, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+	}
+
+	if !listed {
+		infos, err := w.propfind(dir, "1")
+		if err != nil && !os.IsNotExist(err) {
+			return fileInfo{}, err
+		}
+		listing = infos
+		w.mu.Lock()
+		w.dirs[dir] = listing
+		w.mu.Unlock()
+	}
+
+	if fi, ok := listing[p]; ok {
+		return fi, nil
+	}
+	return fileInfo{}, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+}
+
+func (w *webdavFS) List(p string) ([]fileInfo, error) {
+	p = path.Clean(p)
+	listing, err := w.propfind(p, "1")
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fileInfo, 0, len(listing))
+	for rel, fi := range listing {
+		if rel != p {
+			infos = append(infos, fi)
+		}
+	}
+	sortInfos(infos)
+	return infos, nil
+}
+
+func (w *webdavFS) Open(p string) (io.ReadCloser, error) {
+	resp, err := w.do("GET", w.url(p, false), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// forget marks p as modified so it is no longer looked up in the listing
+func (w *webdavFS) forget(p string) {
+	w.mu.Lock()
+	w.changed[path.Clean(p)] = true
+	w.mu.Unlock()
+}
+
+func (w *webdavFS) Mkdir(p string, mode os.FileMode) error {
+	p = path.Clean(p)
+	if fi, err := w.Lstat(p); err == nil && fi.info.IsDir() {
+		return nil
+	}
+	if parent := path.Dir(p); parent != p {
+		if err := w.Mkdir(parent, mode); err != nil {
+			return err
+		}
+	}
+
+	w.forget(p)
+	resp, err := w.do("MKCOL", w.url(p, true), nil, nil)
+	if err != nil {
+		// another worker may have created the collection in the meantime
+		if fi, serr := w.Lstat(p); serr == nil && fi.info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *webdavFS) Create(p string) (io.WriteCloser, error) {
+	return w.CreateWithAttrs(p, 0644, time.Now())
+}
+
+// CreateWithAttrs streams the file content to the server with a PUT request
+// and stores its attributes once the upload is complete
+func (w *webdavFS) CreateWithAttrs(p string, mode os.FileMode, mtime time.Time) (io.WriteCloser, error) {
+	w.forget(p)
+	pr, pw := io.Pipe()
+	f := &webdavFile{pw: pw, done: make(chan error, 1)}
+	go func() {
+		// Nextcloud and ownCloud take the modification time from this header
+		h := http.Header{"X-Oc-Mtime": {strconv.FormatInt(mtime.Unix(), 10)}}
+		resp, err := w.do("PUT", w.url(p, false), h, pr)
+		if err == nil {
+			resp.Body.Close()
+			err = w.proppatch(p, map[string]string{
+				"mtime": strconv.FormatInt(mtime.UnixNano(), 10),
+				"mode":  strconv.FormatUint(uint64(mode), 8),
+			})
+		}
+		pr.CloseWithError(err)
+		f.done <- err
+	}()
+	return f, nil
+}
+
+// proppatch sets the provided syngo properties on p
+func (w *webdavFS) proppatch(p string, props map[string]string) error {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<D:propertyupdate xmlns:D="DAV:" xmlns:S="` + davNamespace + `"><D:set><D:prop>`)
+	for k, v := range props {
+		fmt.Fprintf(&buf, "<S:%s>", k)
+		xml.EscapeText(&buf, []byte(v))
+		fmt.Fprintf(&buf, "</S:%s>", k)
+	}
+	buf.WriteString(`</D:prop></D:set></D:propertyupdate>`)
+
+	h := http.Header{"Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := w.do("PROPPATCH", w.url(p, false), h, &buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Symlink stores symbolic links as empty files with the link target kept in
+// a property since WebDAV has no notion of links
+func (w *webdavFS) Symlink(oldname, newname string) error {
+	f, err := w.CreateWithAttrs(newname, os.ModeSymlink|0777, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return w.proppatch(newname, map[string]string{"symlink": oldname})
+}
+
+func (w *webdavFS) Remove(p string) error {
+	w.forget(p)
+	resp, err := w.do("DELETE", w.url(p, false), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *webdavFS) Chtimes(p string, mtime time.Time) error {
+	w.forget(p)
+	return w.proppatch(p, map[string]string{"mtime": strconv.FormatInt(mtime.UnixNano(), 10)})
+}
+
+func (w *webdavFS) Chmod(p string, mode os.FileMode) error {
+	w.forget(p)
+	return w.proppatch(p, map[string]string{"mode": strconv.FormatUint(uint64(mode), 8)})
+}
+
+// MtimePrecision reports second precision since servers not storing dead
+// properties only provide getlastmodified
+func (w *webdavFS) MtimePrecision() time.Duration {
+	return time.Second
+}
+
+func (w *webdavFS) Close() error {
+	return nil
+}
+
+// webdavFile streams data written to it as the body of a PUT request
+type webdavFile struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	return f.pw.Write(p)
+}
+
+func (f *webdavFile) Close() error {
+	f.pw.Close()
+	return <-f.done
+}
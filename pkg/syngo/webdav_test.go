@@ -0,0 +1,195 @@
+package syngo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// davNode is a resource of fakeDAV
+type davNode struct {
+	dir   bool
+	data  []byte
+	props map[string]string
+}
+
+// fakeDAV is a WebDAV server keeping its resources in memory. It implements
+// just enough of RFC 4918 for webdavFS and requires basic authentication.
+type fakeDAV struct {
+	mu    sync.Mutex
+	nodes map[string]*davNode
+}
+
+func (d *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := path.Clean(r.URL.Path)
+	n, exists := d.nodes[p]
+	if !exists && r.Method != "PUT" && r.Method != "MKCOL" {
+		http.NotFound(w, r)
+		return
+	}
+	if parent := d.nodes[path.Dir(p)]; parent == nil || !parent.dir {
+		http.Error(w, "missing parent", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Write(n.data)
+	case "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		d.nodes[p] = &davNode{data: data, props: make(map[string]string)}
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		if exists {
+			http.Error(w, "exists", http.StatusMethodNotAllowed)
+			return
+		}
+		d.nodes[p] = &davNode{dir: true, props: make(map[string]string)}
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		for q := range d.nodes {
+			if q == p || strings.HasPrefix(q, p+"/") {
+				delete(d.nodes, q)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPPATCH":
+		body, _ := ioutil.ReadAll(r.Body)
+		for k, v := range davProps(body) {
+			n.props[k] = v
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+	case "PROPFIND":
+		var buf bytes.Buffer
+		buf.WriteString(`<?xml version="1.0"?><D:multistatus xmlns:D="DAV:" xmlns:S="` + davNamespace + `">`)
+		d.writeProps(&buf, p, n)
+		if n.dir && r.Header.Get("Depth") == "1" {
+			for q, c := range d.nodes {
+				if q != p && path.Dir(q) == p {
+					d.writeProps(&buf, q, c)
+				}
+			}
+		}
+		buf.WriteString(`</D:multistatus>`)
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write(buf.Bytes())
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeProps writes the PROPFIND response element of the resource n at p
+func (d *fakeDAV) writeProps(buf *bytes.Buffer, p string, n *davNode) {
+	fmt.Fprintf(buf, "<D:response><D:href>%s</D:href><D:propstat><D:prop>", p)
+	if n.dir {
+		buf.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+	} else {
+		fmt.Fprintf(buf, "<D:resourcetype/><D:getcontentlength>%d</D:getcontentlength>", len(n.data))
+	}
+	for k, v := range n.props {
+		fmt.Fprintf(buf, "<S:%s>", k)
+		xml.EscapeText(buf, []byte(v))
+		fmt.Fprintf(buf, "</S:%s>", k)
+	}
+	buf.WriteString("</D:prop></D:propstat></D:response>")
+}
+
+// davProps returns the syngo properties set by a PROPPATCH request body
+func davProps(body []byte) map[string]string {
+	props := make(map[string]string)
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return props
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Space == davNamespace {
+			var v string
+			dec.DecodeElement(&v, &se)
+			props[se.Name.Local] = v
+		}
+	}
+}
+
+func TestWebDAVRoundTrip(t *testing.T) {
+	dav := &fakeDAV{nodes: map[string]*davNode{"/": {dir: true}, "/dav": {dir: true, props: map[string]string{}}}}
+	srv := httptest.NewServer(dav)
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	b, err := newWebDAVBackend("dav://user:secret@"+host+"/dav/", &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := b.(*webdavFS)
+	if err := w.Mkdir("dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	f, err := w.CreateWithAttrs("dir/sub/file", 0600, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Symlink("file", "dir/sub/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := w.Lstat("dir/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.info.Size() != 4 || fi.info.Mode() != 0600 || !fi.info.ModTime().Equal(mtime) {
+		t.Errorf("file has size %d, mode %s, and mtime %s", fi.info.Size(), fi.info.Mode(), fi.info.ModTime())
+	}
+	infos, err := w.List("dir/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].path != "dir/sub/file" || infos[1].linkPath != "file" {
+		t.Errorf("listing %v", infos)
+	}
+	r, err := w.Open("dir/sub/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "data" {
+		t.Errorf("read %q: %v", data, err)
+	}
+	if err := w.Remove("dir/sub/link"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Lstat("dir/sub/link"); !os.IsNotExist(err) {
+		t.Errorf("removed link: %v", err)
+	}
+
+	b, err = newWebDAVBackend("dav://user:guess@"+host+"/dav/", &options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.List("dir"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("listing with wrong password: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+// zstd contains a compressor writing the Zstandard format (RFC 8878) used for
+// .tar.zst archive targets. Blocks are compressed by a greedy match search
+// and stored with raw literals and the predefined entropy tables of the
+// format. This compresses less than the reference implementation, which also
+// entropy codes literals, but needs no table descriptions and stays short.
+package syngo
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// Zstandard frame parameters
+const (
+	zstdMagic     = 0xfd2fb528
+	zstdWindowLog = 20 // matches reach back 1 MiB
+	zstdWindow    = 1 << zstdWindowLog
+	zstdBlockSize = 128 * 1024 // largest block allowed by the format
+	zstdMinMatch  = 4
+	zstdHashLog   = 17
+)
+
+// zstd block types
+const (
+	zstdBlockRaw        = 0
+	zstdBlockCompressed = 2
+)
+
+var errZstdClosed = errors.New("write to closed zstd stream")
+
+// zstdWriter compresses the data written to it into a single Zstandard
+// frame with a content checksum
+type zstdWriter struct {
+	w     io.Writer
+	hist  []byte  // window preceding the pending data followed by it
+	start int     // start of the pending data in hist
+	table []int32 // positions + 1 in hist of recently seen 4 byte sequences
+	sum   *xxh64
+	err   error
+	began bool // frame header was written
+}
+
+func newZstdWriter(w io.Writer) *zstdWriter {
+	return &zstdWriter{w: w, table: make([]int32, 1<<zstdHashLog), sum: newXXH64()}
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	z.sum.Write(p)
+	for n := 0; n < len(p); {
+		m := zstdBlockSize - (len(z.hist) - z.start)
+		if m > len(p)-n {
+			m = len(p) - n
+		}
+		z.hist = append(z.hist, p[n:n+m]...)
+		n += m
+		if len(z.hist)-z.start == zstdBlockSize {
+			if z.err = z.writeBlock(false); z.err != nil {
+				return n, z.err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes the last block and the checksum. It does not close the
+// underlying writer.
+func (z *zstdWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	if z.err = z.writeBlock(true); z.err != nil {
+		return z.err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.sum.Sum64()))
+	if _, z.err = z.w.Write(sum[:]); z.err != nil {
+		return z.err
+	}
+	z.err = errZstdClosed
+	return nil
+}
+
+// writeBlock writes the pending data as a block, compressed unless that does
+// not make it smaller, and slides the window once the history has grown to
+// twice its size
+func (z *zstdWriter) writeBlock(last bool) error {
+	var out []byte
+	if !z.began {
+		// no content size and a window descriptor without mantissa
+		out = make([]byte, 6)
+		binary.LittleEndian.PutUint32(out, zstdMagic)
+		out[4], out[5] = 1<<2, (zstdWindowLog-10)<<3
+		z.began = true
+	}
+
+	data := z.hist[z.start:]
+	typ, body := zstdBlockRaw, data
+	if packed := z.compressBlock(); len(packed) < len(data) {
+		typ, body = zstdBlockCompressed, packed
+	}
+	hdr := uint32(len(body))<<3 | uint32(typ)<<1
+	if last {
+		hdr |= 1
+	}
+	out = append(out, byte(hdr), byte(hdr>>8), byte(hdr>>16))
+	if _, err := z.w.Write(out); err != nil {
+		return err
+	}
+	if _, err := z.w.Write(body); err != nil {
+		return err
+	}
+
+	z.start = len(z.hist)
+	if z.start >= 2*zstdWindow {
+		drop := z.start - zstdWindow
+		z.hist = z.hist[:copy(z.hist, z.hist[drop:])]
+		z.start -= drop
+		for i, pos := range z.table {
+			if pos -= int32(drop); pos < 0 {
+				pos = 0
+			}
+			z.table[i] = pos
+		}
+	}
+	return nil
+}
+
+// zstdSeq is a sequence of literals followed by a match
+type zstdSeq struct {
+	litLen, offset, matchLen int
+}
+
+// compressBlock returns the compressed block of the pending data
+func (z *zstdWriter) compressBlock() []byte {
+	hist, end := z.hist, len(z.hist)
+	var lits []byte
+	var seqs []zstdSeq
+	anchor := z.start // start of the pending literals
+	for i := z.start; i+zstdMinMatch <= end; {
+		v := binary.LittleEndian.Uint32(hist[i:])
+		h := (v * 2654435761) >> (32 - zstdHashLog)
+		cand := int(z.table[h]) - 1
+		z.table[h] = int32(i + 1)
+		if cand < 0 || i-cand >= zstdWindow || binary.LittleEndian.Uint32(hist[cand:]) != v {
+			i += 1 + (i-anchor)>>6
+			continue
+		}
+
+		for i > anchor && cand > 0 && hist[i-1] == hist[cand-1] {
+			i--
+			cand--
+		}
+		m := i + zstdMinMatch
+		for m < end && hist[m] == hist[m-i+cand] {
+			m++
+		}
+		seqs = append(seqs, zstdSeq{litLen: i - anchor, offset: i - cand, matchLen: m - i})
+		lits = append(lits, hist[anchor:i]...)
+		anchor, i = m, m
+	}
+	lits = append(lits, hist[anchor:end]...)
+
+	// raw literals section
+	var out []byte
+	switch n := len(lits); {
+	case n < 1<<5:
+		out = append(out, byte(n<<3))
+	case n < 1<<12:
+		out = append(out, byte(n<<4)|1<<2, byte(n>>4))
+	default:
+		out = append(out, byte(n<<4)|3<<2, byte(n>>4), byte(n>>12))
+	}
+	out = append(out, lits...)
+
+	// sequences section with predefined tables for all symbols
+	switch n := len(seqs); {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7f00:
+		out = append(out, byte(n>>8)+128, byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+	if len(seqs) == 0 {
+		return out
+	}
+	out = append(out, 0)
+	return zstdEncodeSeqs(out, seqs)
+}
+
+// zstdEncodeSeqs appends the bitstream of seqs to out. The stream is read
+// backwards, so sequences are encoded from the last to the first.
+func zstdEncodeSeqs(out []byte, seqs []zstdSeq) []byte {
+	bw := zstdBitWriter{out: out}
+	var ll, ml, of uint16 // states
+	for k := len(seqs) - 1; k >= 0; k-- {
+		s := seqs[k]
+		llCode, llBits, llExtra := zstdLengthCode(s.litLen, zstdLLBase[:], zstdLLBits[:])
+		mlCode, mlBits, mlExtra := zstdLengthCode(s.matchLen, zstdMLBase[:], zstdMLBits[:])
+		// offset values above 3 are plain offsets, lower ones repeat offsets
+		ofValue := uint32(s.offset + 3)
+		ofCode := bits.Len32(ofValue) - 1
+		ofExtra := ofValue - 1<<uint(ofCode)
+
+		if k == len(seqs)-1 {
+			ll, ml, of = zstdLLTable.first[llCode], zstdMLTable.first[mlCode], zstdOFTable.first[ofCode]
+		} else {
+			of = zstdOFTable.encode(&bw, of, ofCode)
+			ml = zstdMLTable.encode(&bw, ml, mlCode)
+			ll = zstdLLTable.encode(&bw, ll, llCode)
+		}
+		bw.add(llExtra, llBits)
+		bw.add(mlExtra, mlBits)
+		bw.add(ofExtra, uint(ofCode))
+	}
+	bw.add(uint32(ml), zstdMLTable.log)
+	bw.add(uint32(of), zstdOFTable.log)
+	bw.add(uint32(ll), zstdLLTable.log)
+	return bw.close()
+}
+
+// zstdLengthCode returns the code of the literal or match length n given
+// the baselines and numbers of extra bits of the codes, together with the
+// extra bits
+func zstdLengthCode(n int, base []uint32, nbits []uint8) (int, uint, uint32) {
+	code := len(base) - 1
+	for base[code] > uint32(n) {
+		code--
+	}
+	return code, uint(nbits[code]), uint32(n) - base[code]
+}
+
+// zstdBitWriter writes the bits added to it starting at the least
+// significant bit of each byte
+type zstdBitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (w *zstdBitWriter) add(v uint32, n uint) {
+	w.acc |= uint64(v) & (1<<n - 1) << w.n
+	for w.n += n; w.n >= 8; w.n -= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+	}
+}
+
+// close ends the stream with a set bit marking its end for the reader
+func (w *zstdBitWriter) close() []byte {
+	w.add(1, 1)
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+// zstdFSE is a finite state entropy table. Decoding a symbol in a state
+// reads bits which added to the state's baseline give the next state, so
+// the encoder, going backwards, writes those bits and moves to a state of
+// the symbol whose range of next states contains its current state.
+type zstdFSE struct {
+	log   uint
+	first []uint16   // a state of each symbol
+	bits  []uint8    // bits read after each state
+	base  []uint16   // baseline of the next state of each state
+	enc   [][]uint16 // state encoding each symbol followed by each state
+}
+
+// newZstdFSE builds the table of the normalized symbol counts norm, where
+// -1 stands for a probability below 1 in 2^log, like decoders do
+func newZstdFSE(norm []int, log uint) *zstdFSE {
+	size := 1 << log
+	t := &zstdFSE{log: log, first: make([]uint16, len(norm)), bits: make([]uint8, size),
+		base: make([]uint16, size), enc: make([][]uint16, len(norm))}
+	sym := make([]int, size)
+	next := make([]int, len(norm))
+	high := size - 1
+	for s, c := range norm {
+		next[s] = c
+		if c == -1 {
+			sym[high] = s
+			high--
+			next[s] = 1
+		}
+	}
+	step, mask, pos := size>>1+size>>3+3, size-1, 0
+	for s, c := range norm {
+		for i := 0; i < c; i++ {
+			sym[pos] = s
+			for pos = (pos + step) & mask; pos > high; pos = (pos + step) & mask {
+			}
+		}
+	}
+
+	for s := range norm {
+		t.enc[s] = make([]uint16, size)
+	}
+	for u := size - 1; u >= 0; u-- {
+		t.first[sym[u]] = uint16(u)
+	}
+	for u, s := range sym {
+		n := next[s]
+		next[s]++
+		nb := log - uint(bits.Len(uint(n))-1)
+		t.bits[u] = uint8(nb)
+		t.base[u] = uint16(n<<nb - size)
+		for x := int(t.base[u]); x < int(t.base[u])+1<<nb; x++ {
+			t.enc[s][x] = uint16(u)
+		}
+	}
+	return t
+}
+
+// encode writes the bits leading from a state of symbol s to state and
+// returns that state of s
+func (t *zstdFSE) encode(bw *zstdBitWriter, state uint16, s int) uint16 {
+	u := t.enc[s][state]
+	bw.add(uint32(state-t.base[u]), uint(t.bits[u]))
+	return u
+}
+
+// predefined distributions and length codes of RFC 8878
+var (
+	zstdLLTable = newZstdFSE([]int{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1}, 6)
+	zstdMLTable = newZstdFSE([]int{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1}, 6)
+	zstdOFTable = newZstdFSE([]int{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}, 5)
+
+	zstdLLBase = [36]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536}
+	zstdLLBits = [36]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16}
+	zstdMLBase = [53]uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539}
+	zstdMLBits = [53]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16}
+)
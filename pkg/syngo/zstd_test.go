@@ -0,0 +1,63 @@
+package syngo
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+)
+
+func TestZstdTables(t *testing.T) {
+	for name, table := range map[string]*zstdFSE{"literal lengths": zstdLLTable,
+		"match lengths": zstdMLTable, "offsets": zstdOFTable} {
+		// every state is reached from a state of every symbol
+		for s, enc := range table.enc {
+			for x, u := range enc {
+				if base := int(table.base[u]); x < base || x >= base+1<<table.bits[u] {
+					t.Fatalf("%s: state %d of symbol %d does not lead to %d", name, u, s, x)
+				}
+			}
+			if u := table.first[s]; enc[table.base[u]] != u {
+				t.Errorf("%s: first state %d is not one of symbol %d", name, u, s)
+			}
+		}
+	}
+}
+
+func TestZstdDecompressesWithZstd(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd not installed")
+	}
+	text := bytes.Repeat([]byte("syngo writes archives in a single pass. "), 100000)
+	for name, data := range map[string][]byte{
+		"empty":  nil,
+		"short":  []byte("abc"),
+		"zeros":  make([]byte, 3*zstdBlockSize+5),
+		"random": randomData(9, zstdBlockSize+100),
+		// repeated beyond the window, so the history slides
+		"text": append(text, randomData(10, zstdWindow)...),
+	} {
+		var buf bytes.Buffer
+		z := newZstdWriter(&buf)
+		for p := data; len(p) > 0; {
+			n := 50000
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := z.Write(p[:n]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[n:]
+		}
+		if err := z.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		cmd := exec.Command(zstd, "-d", "-c")
+		cmd.Stdin = &buf
+		out, err := cmd.Output()
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%s: decompressed %d of %d bytes: %v", name, len(out), len(data), err)
+		}
+	}
+}